@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/router"
+)
+
+// dryRun builds the routers of the configuration at path and prints
+// every route in the order requests are matched, without binding any
+// listeners, returning the exit code
+func dryRun(path string) int {
+	source, err := config.OpenSource(path, sourceOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	cfg, err := source.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	routes, err := router.Build(cfg.Services)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	sniRoutes, err := router.BuildSNI(cfg.Services)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	listen := make(map[string]string, len(cfg.Services))
+	for _, svc := range cfg.Services {
+		listen[svc.Name] = svc.Addr
+	}
+
+	fmt.Printf("%s: %d route(s)\n\n", source, len(routes.GetRoutes())+len(sniRoutes.GetRoutes()))
+	printRoutes(os.Stdout, routes.GetRoutes(), listen)
+	if sni := sniRoutes.GetRoutes(); len(sni) > 0 {
+		fmt.Println("\nSNI routes, matched by the server name of TLS connections:")
+		printRoutes(os.Stdout, sni, listen)
+	}
+	return 0
+}
+
+// printRoutes writes routes as a table
+func printRoutes(w io.Writer, routes []router.Route, listen map[string]string) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "#\tSERVICE\tLISTEN\tROUTE\tRULE\tADDR\tPROXY")
+	for i, route := range routes {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			strconv.Itoa(i+1),
+			route.Service,
+			listen[route.Service],
+			route.Name,
+			router.RuleText(route.Node),
+			nodeAddr(route.Node),
+			nodeProxy(route.Node),
+		)
+	}
+	tw.Flush()
+}
+
+// nodeAddr describes where a node's requests go
+func nodeAddr(node *config.Node) string {
+	switch {
+	case len(node.Backends) > 0:
+		return strings.Join(node.Backends, ",")
+	case node.HostMap != "":
+		return "by host map"
+	default:
+		return node.Addr
+	}
+}
+
+// nodeProxy describes how a node's backends are reached, without proxy
+// passwords
+func nodeProxy(node *config.Node) string {
+	switch {
+	case node.Dialer != "":
+		return "dialer " + node.Dialer
+	case len(node.Proxies) > 0:
+		proxies := make([]string, len(node.Proxies))
+		for i, proxy := range node.Proxies {
+			proxies[i] = redactURL(proxy)
+		}
+		return strings.Join(proxies, ",")
+	case node.ProxyURL() != "":
+		return redactURL(node.ProxyURL())
+	default:
+		return "direct"
+	}
+}
+
+// redactURL hides the password of a URL
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	return u.Redacted()
+}
@@ -11,13 +11,17 @@ import (
 
 	"github.com/rs/zerolog/log"
 	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/lint"
 	"github.com/simman/go-forwarder/internal/server"
 	"github.com/simman/go-forwarder/pkg/logger"
 )
 
 var (
-	configPath = flag.String("config", "configs/config.yaml", "Path to configuration file")
-	version    = flag.Bool("version", false, "Print version information")
+	configPath   = flag.String("config", "configs/config.yaml", "Path to configuration file or directory, an etcd:// or consul:// key, or an http(s) URL")
+	configFormat = flag.String("config-format", "", "Configuration format: yaml, json or toml (default by file extension)")
+	configPoll   = flag.Duration("config-interval", config.DefaultPollInterval, "How often a configuration URL is fetched")
+	dryRunOnly   = flag.Bool("dry-run", false, "Print the routing table of the configuration and exit, without binding listeners")
+	version      = flag.Bool("version", false, "Print version information")
 )
 
 const (
@@ -26,15 +30,42 @@ const (
 )
 
 func main() {
-	flag.Parse()
+	// "replay" sends recorded traffic to a forwarder, with flags of its own
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "replay" {
+		os.Exit(replayCommand(args[1:]))
+	}
+
+	// "validate" checks the configuration and exits, flags may come before
+	// or after it
+	validateOnly := len(args) > 0 && args[0] == "validate"
+	if validateOnly {
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	if flag.Arg(0) == "validate" {
+		validateOnly = true
+	}
 
 	if *version {
 		fmt.Printf("%s version %s\n", appName, appVersion)
 		os.Exit(0)
 	}
 
+	if validateOnly {
+		os.Exit(validate(*configPath))
+	}
+	if *dryRunOnly {
+		os.Exit(dryRun(*configPath))
+	}
+
 	// Load configuration
-	cfg, err := config.LoadConfig(*configPath)
+	source, err := config.OpenSource(*configPath, sourceOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
+		os.Exit(1)
+	}
+	cfg, err := source.Load()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Failed to load config: %v\n", err)
 		os.Exit(1)
@@ -48,8 +79,9 @@ func main() {
 
 	log.Info().
 		Str("version", appVersion).
-		Str("config", *configPath).
+		Str("config", source.String()).
 		Msg("starting go-forwarder")
+	logWarnings(cfg)
 
 	// Create server
 	srv, err := server.NewServer(cfg)
@@ -62,45 +94,48 @@ func main() {
 		log.Fatal().Err(err).Msg("failed to start server")
 	}
 
-	// Setup config watcher for hot-reload
-	watcher, err := config.NewWatcher(*configPath, func(newCfg *config.Config) error {
-		log.Info().Msg("config changed, reloading")
-		
-		// Reinitialize logger if logging config changed
-		if cfg.Logging != newCfg.Logging {
-			if err := logger.InitLogger(newCfg.Logging.Level, newCfg.Logging.Format, newCfg.Logging.Output); err != nil {
+	// Reinitialize the logger when a reload changes its config. The server
+	// holds the config in effect, so rollbacks and route imports through
+	// the admin API are covered as well.
+	srv.OnReload(func(current, next *config.Config) error {
+		if current.Logging != next.Logging {
+			if err := logger.InitLogger(next.Logging.Level, next.Logging.Format, next.Logging.Output); err != nil {
 				return fmt.Errorf("failed to reinitialize logger: %w", err)
 			}
 		}
-		
-		// Reload server configuration
+		return nil
+	})
+
+	// Watch the config source for hot-reload. SIGHUP reloads through the
+	// same path, the server applies one reload at a time.
+	onChange := func(newCfg *config.Config) error {
+		log.Info().Msg("config changed, reloading")
 		if err := srv.Reload(newCfg); err != nil {
 			return fmt.Errorf("failed to reload server: %w", err)
 		}
-		
-		cfg = newCfg
+		logWarnings(newCfg)
 		return nil
-	})
-	if err != nil {
-		log.Fatal().Err(err).Msg("failed to create config watcher")
 	}
-
-	if err := watcher.Start(); err != nil {
+	if err := source.Watch(onChange); err != nil {
 		log.Fatal().Err(err).Msg("failed to start config watcher")
 	}
-	defer watcher.Stop()
+	defer source.Stop()
 
 	log.Info().Msg("go-forwarder is ready")
 
-	// Wait for interrupt signal
+	// Reload on SIGHUP until an interrupt signal
 	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
 
 	sig := <-sigCh
+	for sig == syscall.SIGHUP {
+		reloadConfig(source, onChange)
+		sig = <-sigCh
+	}
 	log.Info().Str("signal", sig.String()).Msg("received shutdown signal")
 
-	// Graceful shutdown
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Graceful shutdown, after the drain period
+	ctx, cancel := context.WithTimeout(context.Background(), srv.Config().Server.ShutdownDrain+30*time.Second)
 	defer cancel()
 
 	if err := srv.Stop(ctx); err != nil {
@@ -110,3 +145,54 @@ func main() {
 
 	log.Info().Msg("go-forwarder stopped gracefully")
 }
+
+// reloadConfig reads the configuration from source and applies it with
+// onChange, whether or not it changed. A configuration that fails to load
+// or apply keeps the old one.
+func reloadConfig(source config.Source, onChange func(*config.Config) error) {
+	log.Info().Str("source", source.String()).Msg("received SIGHUP, reloading config")
+	newCfg, err := source.Load()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to reload config, keeping old config")
+		return
+	}
+	if err := onChange(newCfg); err != nil {
+		log.Error().Err(err).Msg("failed to apply new config, keeping old config")
+		return
+	}
+	log.Info().Msg("config reloaded successfully")
+}
+
+// validate loads the configuration at path and prints its problems,
+// returning the exit code
+func validate(path string) int {
+	source, err := config.OpenSource(path, sourceOptions())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+	cfg, err := source.Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	warnings := lint.Check(cfg)
+	for _, w := range warnings {
+		fmt.Printf("warning: %s\n", w)
+	}
+	fmt.Printf("%s: configuration is valid, %d warning(s)\n", source, len(warnings))
+	return 0
+}
+
+// sourceOptions returns how the configuration is read, from the flags
+func sourceOptions() config.SourceOptions {
+	return config.SourceOptions{Format: *configFormat, PollInterval: *configPoll}
+}
+
+// logWarnings logs likely mistakes in a valid configuration
+func logWarnings(cfg *config.Config) {
+	for _, w := range lint.Check(cfg) {
+		log.Warn().Str("node", w.Node).Msg(w.Message)
+	}
+}
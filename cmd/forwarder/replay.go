@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/replay"
+	"github.com/simman/go-forwarder/internal/router"
+	"github.com/simman/go-forwarder/internal/server"
+	"github.com/simman/go-forwarder/pkg/logger"
+)
+
+// replayCommand replays a capture file against a forwarder and prints a
+// report, returning the exit code
+func replayCommand(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	target := fs.String("target", "", "Running forwarder to replay against, e.g. http://127.0.0.1:22222")
+	cfgPath := fs.String("config", "", "Replay against an in-process forwarder with this configuration instead")
+	rate := fs.Float64("rate", 0, "Requests per second, 0 keeps the recorded timing")
+	speed := fs.Float64("speed", 1, "Multiplier for the recorded pace")
+	concurrency := fs.Int("concurrency", 32, "Most requests in flight")
+	timeout := fs.Duration("timeout", 30*time.Second, "Timeout per request")
+	insecure := fs.Bool("insecure", false, "Skip certificate verification of an https target")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	strict := fs.Bool("strict", false, "Exit with status 2 if any request is routed or answered differently than recorded")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s replay [flags] <capture.har|access.log>\n", appName)
+		fs.PrintDefaults()
+	}
+
+	// Flags may come before or after the capture file
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	capture := fs.Arg(0)
+	if fs.NArg() > 0 {
+		if err := fs.Parse(fs.Args()[1:]); err != nil {
+			return 1
+		}
+	}
+	if capture == "" || fs.NArg() > 0 || (*target == "") == (*cfgPath == "") {
+		fs.Usage()
+		return 1
+	}
+
+	reqs, err := replay.Load(capture)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	opts := replay.Options{
+		Rate:        *rate,
+		Speed:       *speed,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+		Insecure:    *insecure,
+	}
+	if *cfgPath != "" {
+		stop, err := startReplayForwarder(*cfgPath, &opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		defer stop()
+	} else if opts.Target, err = url.Parse(*target); err != nil || opts.Target.Host == "" {
+		fmt.Fprintf(os.Stderr, "error: invalid target %q\n", *target)
+		return 1
+	}
+
+	// Stop sending on Ctrl-C and report what was replayed so far
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer cancel()
+	report := replay.Run(ctx, reqs, opts)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		printReplayReport(report)
+	}
+
+	if *strict && (len(report.Changes) > 0 || report.StatusChanged > 0 || report.Errors > 0) {
+		return 2
+	}
+	return 0
+}
+
+// startReplayForwarder serves the configuration on a loopback port for the
+// replay and routes requests with it to tell where they went. Forwarding
+// logs are kept to warnings.
+func startReplayForwarder(path string, opts *replay.Options) (func(), error) {
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := logger.InitLogger("warn", cfg.Logging.Format, "stderr"); err != nil {
+		return nil, fmt.Errorf("failed to initialize logger: %w", err)
+	}
+
+	routes, err := router.Build(cfg.Services)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build routes: %w", err)
+	}
+	opts.Route = func(r *http.Request) string {
+		if node, ok := routes.Match(r); ok {
+			return node.Name
+		}
+		return ""
+	}
+
+	srv, err := server.NewServer(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create forwarder: %w", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	hs := &http.Server{Handler: srv}
+	go hs.Serve(ln)
+	opts.Target = &url.URL{Scheme: "http", Host: ln.Addr().String()}
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		hs.Shutdown(ctx)
+		srv.Stop(ctx)
+	}, nil
+}
+
+// printReplayReport prints a replay report for people
+func printReplayReport(report *replay.Report) {
+	rate := float64(report.Requests) / max(report.Duration.Seconds(), 1e-9)
+	fmt.Printf("requests: %d in %s (%.1f/s), %d error(s)\n",
+		report.Requests, report.Duration.Round(time.Millisecond), rate, report.Errors)
+
+	statuses := make([]int, 0, len(report.Statuses))
+	for status := range report.Statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	for _, status := range statuses {
+		fmt.Printf("  %d: %d\n", status, report.Statuses[status])
+	}
+
+	l := report.Latency
+	fmt.Printf("latency: p50 %s, p90 %s, p99 %s, max %s\n",
+		l.P50.Round(time.Microsecond), l.P90.Round(time.Microsecond), l.P99.Round(time.Microsecond), l.Max.Round(time.Microsecond))
+	fmt.Printf("status changed: %d\n", report.StatusChanged)
+
+	fmt.Printf("routing changes: %d\n", len(report.Changes))
+	for _, c := range report.Changes {
+		to := c.To
+		if to == "" {
+			to = "(unmatched)"
+		}
+		fmt.Printf("  %s -> %s: %d\n", c.From, to, c.Count)
+		for _, e := range c.Examples {
+			fmt.Printf("    %s\n", e)
+		}
+	}
+}
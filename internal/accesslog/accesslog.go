@@ -0,0 +1,48 @@
+package accesslog
+
+import (
+	"time"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	entriesDropped = metrics.NewCounterVec(
+		"forwarder_access_log_dropped_total",
+		"Access log entries dropped before reaching a sink",
+		"sink", "reason",
+	)
+	batchesShipped = metrics.NewCounterVec(
+		"forwarder_access_log_batches_total",
+		"Access log batches shipped, by result",
+		"sink", "result",
+	)
+)
+
+// Entry is a single access log record
+type Entry struct {
+	Time       time.Time     `json:"time"`
+	RemoteAddr string        `json:"remote_addr"`
+	Method     string        `json:"method"`
+	Host       string        `json:"host"`
+	Path       string        `json:"path"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Bytes      int64         `json:"bytes"`
+	Duration   time.Duration `json:"duration_ns"`
+	Node       string        `json:"node,omitempty"`
+	Upstream   string        `json:"upstream,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	JA3        string        `json:"ja3,omitempty"` // TLS client fingerprints
+	JA4        string        `json:"ja4,omitempty"`
+
+	Headers map[string]string `json:"headers,omitempty"` // selected request headers by canonical name
+}
+
+// Sink receives access log entries
+type Sink interface {
+	// Log queues an entry without blocking
+	Log(e *Entry)
+	// Close flushes pending entries and releases resources
+	Close() error
+}
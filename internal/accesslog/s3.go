@@ -0,0 +1,220 @@
+package accesslog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/sigv4"
+)
+
+const (
+	s3SinkName      = "s3"
+	s3QueueSize     = 10000
+	s3UploadRetries = 3
+)
+
+// S3Sink batches entries into gzip-compressed JSON lines objects and
+// uploads them to S3-compatible storage under time-partitioned keys
+type S3Sink struct {
+	cfg     config.S3AccessLog
+	signer  *sigv4.Signer
+	client  *http.Client
+	host    string
+	entries chan *Entry
+	done    chan struct{}
+	wg      sync.WaitGroup
+	seq     atomic.Uint64
+	closed  sync.Once
+}
+
+// NewS3Sink creates an S3 sink and starts its background uploader
+func NewS3Sink(cfg *config.S3AccessLog) (*S3Sink, error) {
+	if _, err := url.Parse(cfg.Endpoint); err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "forwarder"
+	}
+
+	s := &S3Sink{
+		cfg: *cfg,
+		signer: &sigv4.Signer{
+			Credentials: sigv4.CredentialsFromEnv(sigv4.Credentials{
+				AccessKeyID:     cfg.AccessKeyID,
+				SecretAccessKey: cfg.SecretAccessKey,
+				SessionToken:    cfg.SessionToken,
+			}),
+			Region:  cfg.Region,
+			Service: "s3",
+		},
+		client:  &http.Client{Timeout: 60 * time.Second},
+		host:    host,
+		entries: make(chan *Entry, s3QueueSize),
+		done:    make(chan struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+// Log queues an entry, dropping it if the queue is full
+func (s *S3Sink) Log(e *Entry) {
+	select {
+	case s.entries <- e:
+	default:
+		entriesDropped.With(s3SinkName, "queue_full").Inc()
+	}
+}
+
+// Close flushes pending entries and stops the uploader
+func (s *S3Sink) Close() error {
+	s.closed.Do(func() {
+		close(s.done)
+		s.wg.Wait()
+	})
+	return nil
+}
+
+// run collects entries and uploads a batch when it is full or the flush
+// interval elapses
+func (s *S3Sink) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Entry, 0, s.cfg.BatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		s.upload(batch)
+		batch = make([]*Entry, 0, s.cfg.BatchSize)
+	}
+
+	for {
+		select {
+		case e := <-s.entries:
+			batch = append(batch, e)
+			if len(batch) >= s.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-s.done:
+			// Drain whatever is still queued
+			for {
+				select {
+				case e := <-s.entries:
+					batch = append(batch, e)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// upload compresses a batch and PUTs it, retrying transient failures
+func (s *S3Sink) upload(batch []*Entry) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(gz)
+	for _, e := range batch {
+		if err := enc.Encode(e); err != nil {
+			log.Error().Err(err).Msg("failed to encode access log entry")
+		}
+	}
+	if err := gz.Close(); err != nil {
+		log.Error().Err(err).Msg("failed to compress access log batch")
+		return
+	}
+
+	key := s.objectKey(batch[0].Time)
+	body := buf.Bytes()
+
+	var err error
+	for attempt := 0; attempt < s3UploadRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		if err = s.put(key, body); err == nil {
+			batchesShipped.With(s3SinkName, "success").Inc()
+			log.Debug().Str("key", key).Int("entries", len(batch)).Msg("access log batch uploaded")
+			return
+		}
+	}
+
+	batchesShipped.With(s3SinkName, "failure").Inc()
+	entriesDropped.With(s3SinkName, "upload_failed").Add(float64(len(batch)))
+	log.Error().Err(err).Str("key", key).Int("entries", len(batch)).Msg("failed to upload access log batch")
+}
+
+// objectKey builds a Hive-style time-partitioned key for a batch
+func (s *S3Sink) objectKey(t time.Time) string {
+	t = t.UTC()
+	return fmt.Sprintf("%syear=%04d/month=%02d/day=%02d/hour=%02d/%s-%d-%d.jsonl.gz",
+		s.cfg.Prefix, t.Year(), t.Month(), t.Day(), t.Hour(),
+		s.host, t.UnixNano(), s.seq.Add(1))
+}
+
+// put uploads one object
+func (s *S3Sink) put(key string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, s.objectURL(key), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create upload request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+
+	if err := s.signer.Sign(req, sigv4.HashPayload(body), time.Now()); err != nil {
+		return fmt.Errorf("failed to sign upload request: %w", err)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to upload: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("upload returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// objectURL returns the URL of key in path-style or virtual-hosted style
+func (s *S3Sink) objectURL(key string) string {
+	u, _ := url.Parse(s.cfg.Endpoint)
+
+	path := "/" + key
+	if s.cfg.PathStyle {
+		path = "/" + s.cfg.Bucket + path
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = sigv4.EscapePath(u.Path)
+	return u.String()
+}
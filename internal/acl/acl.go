@@ -0,0 +1,66 @@
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ACL is a list of IP addresses and CIDR blocks
+type ACL struct {
+	nets []*net.IPNet
+}
+
+// New parses a list of IPs and CIDRs into an ACL
+func New(entries []string) (*ACL, error) {
+	a := &ACL{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", entry)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			entry = fmt.Sprintf("%s/%d", ip.String(), bits)
+		}
+
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR: %s", entry)
+		}
+		a.nets = append(a.nets, ipNet)
+	}
+	return a, nil
+}
+
+// Contains reports whether ip is covered by the ACL
+func (a *ACL) Contains(ip net.IP) bool {
+	if a == nil || ip == nil {
+		return false
+	}
+	for _, n := range a.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Empty reports whether the ACL has no entries
+func (a *ACL) Empty() bool {
+	return a == nil || len(a.nets) == 0
+}
+
+// ClientIP returns the IP address of the peer that sent the request
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
@@ -0,0 +1,362 @@
+// Package cluster gossips backend state between forwarder instances over
+// UDP. Each instance sends what it knows to a few random peers every
+// round, and at once to all peers when it learns something itself, so a
+// fleet converges within a few rounds.
+package cluster
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// maxMessage bounds the size of a gossip datagram
+const maxMessage = 60 * 1024
+
+// mergeSlack is how much later a pause must end to count as news. Pauses
+// gossiped back and forth gain the network delay on every hop.
+const mergeSlack = 250 * time.Millisecond
+
+// maxSkew is how far the send time of an authenticated message may be
+// from the receiver's clock before it is taken for a replay
+const maxSkew = 30 * time.Second
+
+var (
+	messagesTotal = metrics.NewCounterVec(
+		"forwarder_cluster_messages_total",
+		"Gossip messages sent to and received from peers",
+		"direction", "result",
+	)
+	pausesLearned = metrics.NewCounterVec(
+		"forwarder_cluster_pauses_learned_total",
+		"Backend pauses learned from peers",
+		"node",
+	)
+	peersAlive = metrics.NewGaugeVec(
+		"forwarder_cluster_peers_alive",
+		"Peers heard from within the last three gossip rounds",
+	)
+)
+
+// Pause is a backend an instance saw ask for a pause, until Until
+type Pause struct {
+	Node    string
+	Backend string
+	Until   time.Time
+}
+
+// wirePause carries a pause as the time left, so instances don't need
+// synchronized clocks to agree on when it ends
+type wirePause struct {
+	Node    string `json:"node"`
+	Backend string `json:"backend"`
+	LeftMS  int64  `json:"left_ms"`
+}
+
+// message is the body of a gossip datagram
+type message struct {
+	From   string      `json:"from"`
+	SentMS int64       `json:"sent_ms"`
+	Pauses []wirePause `json:"pauses,omitempty"`
+}
+
+// Options configures a Cluster
+type Options struct {
+	Name     string   // this instance, messages from it are ignored
+	Bind     string   // UDP address to receive gossip on
+	Peers    []string // bind addresses of the other instances
+	Secret   string   // authenticates messages when set
+	Interval time.Duration
+	Fanout   int
+
+	// OnPause is called for pauses learned from peers that extend what
+	// this instance knew
+	OnPause func(Pause)
+}
+
+// PeerStatus describes a peer for the admin API
+type PeerStatus struct {
+	Addr      string     `json:"addr"`
+	Name      string     `json:"name,omitempty"`
+	LastHeard *time.Time `json:"last_heard,omitempty"`
+	Alive     bool       `json:"alive"`
+}
+
+// Cluster exchanges state with the peers
+type Cluster struct {
+	opts Options
+	conn *net.UDPConn
+
+	mu     sync.Mutex
+	pauses map[string]Pause        // node|backend -> pause
+	heard  map[string]time.Time    // peer UDP address -> last valid message
+	names  map[string]string       // peer UDP address -> instance name
+	addrs  map[string]*net.UDPAddr // configured peer -> resolved address
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New opens the gossip socket
+func New(opts Options) (*Cluster, error) {
+	addr, err := net.ResolveUDPAddr("udp", opts.Bind)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve cluster bind address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for cluster gossip: %w", err)
+	}
+	return &Cluster{
+		opts:   opts,
+		conn:   conn,
+		pauses: make(map[string]Pause),
+		heard:  make(map[string]time.Time),
+		names:  make(map[string]string),
+		addrs:  make(map[string]*net.UDPAddr),
+		done:   make(chan struct{}),
+	}, nil
+}
+
+// Start begins receiving and gossiping
+func (c *Cluster) Start() {
+	c.wg.Add(2)
+	go c.receive()
+	go c.gossip()
+	log.Info().
+		Str("bind", c.conn.LocalAddr().String()).
+		Strs("peers", c.opts.Peers).
+		Bool("authenticated", c.opts.Secret != "").
+		Msg("cluster gossip started")
+}
+
+// Stop closes the socket and waits for the goroutines
+func (c *Cluster) Stop() {
+	close(c.done)
+	c.conn.Close()
+	c.wg.Wait()
+}
+
+// Pause shares a pause this instance saw, sending it to every peer at once
+func (c *Cluster) Pause(p Pause) {
+	c.mu.Lock()
+	c.merge(p)
+	c.mu.Unlock()
+
+	c.send(c.opts.Peers, c.message([]Pause{p}))
+}
+
+// merge records p, reporting whether it extends a known pause. The caller
+// must hold c.mu.
+func (c *Cluster) merge(p Pause) bool {
+	key := p.Node + "|" + p.Backend
+	if known, ok := c.pauses[key]; ok && !p.Until.After(known.Until.Add(mergeSlack)) {
+		return false
+	}
+	c.pauses[key] = p
+	return true
+}
+
+// Peers reports the configured peers and when they were last heard from
+func (c *Cluster) Peers() []PeerStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	peers := make([]PeerStatus, 0, len(c.opts.Peers))
+	for _, peer := range c.opts.Peers {
+		status := PeerStatus{Addr: peer}
+		if addr := c.addrs[peer]; addr != nil {
+			if at, ok := c.heard[addr.String()]; ok {
+				status.LastHeard = &at
+				status.Name = c.names[addr.String()]
+				status.Alive = now.Sub(at) < 3*c.opts.Interval
+			}
+		}
+		peers = append(peers, status)
+	}
+	return peers
+}
+
+// gossip sends the known state to a few random peers every round
+func (c *Cluster) gossip() {
+	defer c.wg.Done()
+
+	ticker := time.NewTicker(c.opts.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		now := time.Now()
+		pauses := make([]Pause, 0, len(c.pauses))
+		for key, p := range c.pauses {
+			if !now.Before(p.Until) {
+				delete(c.pauses, key)
+				continue
+			}
+			pauses = append(pauses, p)
+		}
+		alive := 0
+		for _, at := range c.heard {
+			if now.Sub(at) < 3*c.opts.Interval {
+				alive++
+			}
+		}
+		c.mu.Unlock()
+		peersAlive.With().Set(float64(alive))
+
+		peers := append([]string(nil), c.opts.Peers...)
+		rand.Shuffle(len(peers), func(i, j int) { peers[i], peers[j] = peers[j], peers[i] })
+		if len(peers) > c.opts.Fanout {
+			peers = peers[:c.opts.Fanout]
+		}
+		c.send(peers, c.message(pauses))
+	}
+}
+
+// message encodes pauses for the peers, soonest to end last so the
+// longest pauses survive when the datagram has to be cut short
+func (c *Cluster) message(pauses []Pause) []byte {
+	sort.Slice(pauses, func(i, j int) bool { return pauses[i].Until.After(pauses[j].Until) })
+
+	now := time.Now()
+	msg := message{From: c.opts.Name, SentMS: now.UnixMilli()}
+	for _, p := range pauses {
+		msg.Pauses = append(msg.Pauses, wirePause{Node: p.Node, Backend: p.Backend, LeftMS: p.Until.Sub(now).Milliseconds()})
+	}
+
+	for {
+		body, _ := json.Marshal(msg)
+		if len(body)+sha256.Size <= maxMessage || len(msg.Pauses) == 0 {
+			return c.seal(body)
+		}
+		msg.Pauses = msg.Pauses[:len(msg.Pauses)/2]
+	}
+}
+
+// seal prefixes body with its MAC, zeros without a secret
+func (c *Cluster) seal(body []byte) []byte {
+	mac := make([]byte, sha256.Size)
+	if c.opts.Secret != "" {
+		h := hmac.New(sha256.New, []byte(c.opts.Secret))
+		h.Write(body)
+		mac = h.Sum(nil)
+	}
+	return append(mac, body...)
+}
+
+// open checks the MAC of a datagram and returns its body
+func (c *Cluster) open(data []byte) ([]byte, error) {
+	if len(data) < sha256.Size {
+		return nil, errors.New("short message")
+	}
+	mac, body := data[:sha256.Size], data[sha256.Size:]
+	if c.opts.Secret != "" {
+		h := hmac.New(sha256.New, []byte(c.opts.Secret))
+		h.Write(body)
+		if !hmac.Equal(mac, h.Sum(nil)) {
+			return nil, errors.New("bad MAC")
+		}
+	}
+	return body, nil
+}
+
+// send delivers data to peers, resolving their addresses anew so peers
+// behind DNS names can move
+func (c *Cluster) send(peers []string, data []byte) {
+	for _, peer := range peers {
+		addr, err := net.ResolveUDPAddr("udp", peer)
+		if err != nil {
+			messagesTotal.With("sent", "error").Inc()
+			log.Debug().Err(err).Str("peer", peer).Msg("failed to resolve cluster peer")
+			continue
+		}
+		c.mu.Lock()
+		c.addrs[peer] = addr
+		c.mu.Unlock()
+
+		if _, err := c.conn.WriteToUDP(data, addr); err != nil {
+			messagesTotal.With("sent", "error").Inc()
+			log.Debug().Err(err).Str("peer", peer).Msg("failed to send cluster gossip")
+			continue
+		}
+		messagesTotal.With("sent", "ok").Inc()
+	}
+}
+
+// receive merges the state peers send
+func (c *Cluster) receive() {
+	defer c.wg.Done()
+
+	buf := make([]byte, maxMessage)
+	for {
+		n, from, err := c.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-c.done:
+				return
+			default:
+			}
+			log.Warn().Err(err).Msg("failed to read cluster gossip")
+			continue
+		}
+
+		var msg message
+		body, err := c.open(buf[:n])
+		if err == nil {
+			err = json.Unmarshal(body, &msg)
+		}
+		now := time.Now()
+		if err == nil && c.opts.Secret != "" {
+			if skew := now.Sub(time.UnixMilli(msg.SentMS)).Abs(); skew > maxSkew {
+				err = fmt.Errorf("sent %s off the local clock", skew.Round(time.Second))
+			}
+		}
+		if err != nil {
+			messagesTotal.With("received", "invalid").Inc()
+			log.Debug().Err(err).Str("from", from.String()).Msg("ignored invalid cluster gossip")
+			continue
+		}
+		if msg.From == c.opts.Name {
+			continue
+		}
+		messagesTotal.With("received", "ok").Inc()
+
+		var learned []Pause
+		c.mu.Lock()
+		c.heard[from.String()] = now
+		c.names[from.String()] = msg.From
+		for _, wp := range msg.Pauses {
+			if wp.LeftMS <= 0 {
+				continue
+			}
+			p := Pause{Node: wp.Node, Backend: wp.Backend, Until: now.Add(time.Duration(wp.LeftMS) * time.Millisecond)}
+			if c.merge(p) {
+				learned = append(learned, p)
+			}
+		}
+		c.mu.Unlock()
+
+		for _, p := range learned {
+			pausesLearned.With(p.Node).Inc()
+			if c.opts.OnPause != nil {
+				c.opts.OnPause(p)
+			}
+		}
+	}
+}
@@ -2,23 +2,80 @@ package config
 
 import (
 	"fmt"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
-// LoadConfig loads and parses the configuration file
+// LoadConfig loads and parses the configuration file, in the format its
+// extension names
 func LoadConfig(path string) (*Config, error) {
+	return LoadConfigFormat(path, "")
+}
+
+// LoadConfigFormat loads and parses the configuration file in the given
+// format, detected from the extension when empty. A directory is read as
+// the fragments it holds, see loadDir.
+func LoadConfigFormat(path, format string) (*Config, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if info.IsDir() {
+		doc, err := loadDir(path, format)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config directory: %w", err)
+		}
+		return parseDocument(doc)
+	}
+
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config file: %w", err)
 	}
+	if format == "" {
+		format = DetectFormat(path)
+	}
+	return ParseFormat(data, format)
+}
 
-	var cfg Config
-	if err := yaml.Unmarshal(data, &cfg); err != nil {
+// Parse parses a YAML configuration document, applying environment
+// overrides and defaults and validating it
+func Parse(data []byte) (*Config, error) {
+	return ParseFormat(data, FormatYAML)
+}
+
+// ParseFormat parses a configuration document in the given format, like
+// Parse
+func ParseFormat(data []byte, format string) (*Config, error) {
+	doc, err := decodeDocument(data, format)
+	if err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %w", err)
 	}
+	return parseDocument(doc)
+}
+
+// parseDocument turns a parsed document into the configuration, applying
+// environment overrides and defaults and validating it
+func parseDocument(doc yaml.Node) (*Config, error) {
+	// Containers change single keys without templating the file
+	if err := applyEnv(&doc, os.Environ()); err != nil {
+		return nil, fmt.Errorf("failed to apply environment overrides: %w", err)
+	}
+	// Credentials are referenced instead of written into the file
+	if err := expandSecrets(&doc); err != nil {
+		return nil, fmt.Errorf("failed to expand config secrets: %w", err)
+	}
+
+	var cfg Config
+	if doc.Kind != 0 {
+		if err := doc.Decode(&cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config file: %w", err)
+		}
+	}
 
 	// Set defaults
 	if err := setDefaults(&cfg); err != nil {
@@ -35,6 +92,16 @@ func LoadConfig(path string) (*Config, error) {
 
 // setDefaults sets default values for optional fields
 func setDefaults(cfg *Config) error {
+	// An admin listener without access control is only reachable locally
+	if strings.HasPrefix(cfg.Admin.Addr, ":") && cfg.Admin.Token == "" && len(cfg.Admin.AllowIPs) == 0 {
+		cfg.Admin.Addr = "127.0.0.1" + cfg.Admin.Addr
+	}
+
+	// Keep enough recent requests for a meaningful what-if check
+	if cfg.Admin.ShadowSamples == 0 {
+		cfg.Admin.ShadowSamples = 1000
+	}
+
 	// Server defaults
 	if cfg.Server.Addr == "" {
 		cfg.Server.Addr = ":22222"
@@ -48,6 +115,145 @@ func setDefaults(cfg *Config) error {
 	if cfg.Server.IdleTimeout == 0 {
 		cfg.Server.IdleTimeout = 120 * time.Second
 	}
+	if cfg.Server.DrainTimeout == 0 {
+		cfg.Server.DrainTimeout = 30 * time.Second
+	}
+	if cfg.Server.ExpectContinueTimeout == 0 {
+		cfg.Server.ExpectContinueTimeout = time.Second
+	}
+	if cfg.Server.UpstreamIdleTimeout == 0 {
+		cfg.Server.UpstreamIdleTimeout = 90 * time.Second
+	}
+	if cfg.Server.Timeouts.Route == 0 {
+		// Upstream work past the write timeout can't be answered
+		cfg.Server.Timeouts.Route = 60 * time.Second
+		if cfg.Server.WriteTimeout > 0 {
+			cfg.Server.Timeouts.Route = min(cfg.Server.Timeouts.Route, cfg.Server.WriteTimeout)
+		}
+	}
+	if cfg.Server.Listen.OnFailure == "" {
+		cfg.Server.Listen.OnFailure = ListenContinue
+	}
+	if cfg.Rollback.Window == 0 {
+		cfg.Rollback.Window = 2 * time.Minute
+	}
+	if cfg.Rollback.MinRequests == 0 {
+		cfg.Rollback.MinRequests = 100
+	}
+	if cfg.Rollback.MaxNoMatch == 0 {
+		cfg.Rollback.MaxNoMatch = 0.1
+	}
+	if cfg.DNS.NXDomainTTL == nil {
+		ttl := 5 * time.Second
+		cfg.DNS.NXDomainTTL = &ttl
+	}
+	// Transport limits left out get defaults, an explicit 0 lifts them
+	if cfg.Transport.MaxIdleConns == nil {
+		n := 100
+		cfg.Transport.MaxIdleConns = &n
+	}
+	if cfg.Transport.MaxIdleConnsPerHost == nil {
+		n := http.DefaultMaxIdleConnsPerHost
+		if limit := cfg.Transport.MaxConnsPerHost; limit > 0 {
+			n = min(n, limit)
+		}
+		cfg.Transport.MaxIdleConnsPerHost = &n
+	}
+	if cfg.Transport.TLSHandshakeTimeout == nil {
+		d := 10 * time.Second
+		cfg.Transport.TLSHandshakeTimeout = &d
+	}
+
+	// Header names are looked up in their canonical form
+	if limits := cfg.Server.Headers.Limits; limits != nil {
+		cfg.Server.Headers.Limits = make(map[string]int, len(limits))
+		for name, limit := range limits {
+			cfg.Server.Headers.Limits[http.CanonicalHeaderKey(name)] = limit
+		}
+	}
+	for i, name := range cfg.AccessLog.Headers {
+		cfg.AccessLog.Headers[i] = http.CanonicalHeaderKey(name)
+	}
+
+	// A peer that stops reading for a minute is considered stalled
+	if cfg.Server.Tunnel.ClientWriteTimeout == 0 {
+		cfg.Server.Tunnel.ClientWriteTimeout = 60 * time.Second
+	}
+	if cfg.Server.Tunnel.UpstreamWriteTimeout == 0 {
+		cfg.Server.Tunnel.UpstreamWriteTimeout = 60 * time.Second
+	}
+
+	// Proxies commonly drop idle connections after a minute
+	if cfg.Server.Tunnel.ProxyPool.IdleTimeout == 0 {
+		cfg.Server.Tunnel.ProxyPool.IdleTimeout = 30 * time.Second
+	}
+
+	// Unmatched requests get the JSON 502 unless a policy is set
+	if cfg.Unmatched.Action == "" {
+		cfg.Unmatched.Action = "json"
+	}
+
+	// Allow chains of forwarders, but not endless ones
+	if cfg.Loops.MaxHops == 0 {
+		cfg.Loops.MaxHops = 10
+	}
+
+	// Low priority routes are shed first, at three quarters of the threshold
+	if cfg.LoadShedding.LowThreshold == 0 && cfg.LoadShedding.Threshold > 0 {
+		cfg.LoadShedding.LowThreshold = max(cfg.LoadShedding.Threshold*3/4, 1)
+	}
+
+	// Feature flags are refreshed twice a minute
+	if ff := cfg.FeatureFlags; ff != nil {
+		if ff.Refresh == 0 {
+			ff.Refresh = 30 * time.Second
+		}
+		if ff.Timeout == 0 {
+			ff.Timeout = 5 * time.Second
+		}
+	}
+
+	// Cluster members gossip every second, to three peers a round
+	if c := cfg.Cluster; c != nil {
+		if c.Interval == 0 {
+			c.Interval = time.Second
+		}
+		if c.Fanout == 0 {
+			c.Fanout = 3
+		}
+	}
+
+	// Proxy credentials are checked for rotation twice a minute
+	for i := range cfg.ProxyCredentials {
+		pc := &cfg.ProxyCredentials[i]
+		if pc.Refresh == 0 {
+			pc.Refresh = 30 * time.Second
+		}
+		if v := pc.Vault; v != nil {
+			if v.UsernameField == "" {
+				v.UsernameField = "username"
+			}
+			if v.PasswordField == "" {
+				v.PasswordField = "password"
+			}
+		}
+	}
+
+	// Retry budget defaults
+	if cfg.RetryBudget.Ratio == 0 {
+		cfg.RetryBudget.Ratio = 0.2
+	}
+	if cfg.RetryBudget.MinPerSecond == 0 {
+		cfg.RetryBudget.MinPerSecond = 10
+	}
+
+	// Debug header defaults
+	if cfg.Debug.Header == "" {
+		cfg.Debug.Header = "X-Forwarder-Debug"
+	}
+	if cfg.Debug.TraceHeader == "" {
+		cfg.Debug.TraceHeader = "X-Forwarder-Trace"
+	}
 
 	// Logging defaults
 	if cfg.Logging.Level == "" {
@@ -60,33 +266,337 @@ func setDefaults(cfg *Config) error {
 		cfg.Logging.Output = "stdout"
 	}
 
+	// Access log defaults
+	if s3 := cfg.AccessLog.S3; s3 != nil {
+		if s3.Region == "" {
+			s3.Region = "us-east-1"
+		}
+		if s3.Endpoint == "" {
+			s3.Endpoint = "https://s3." + s3.Region + ".amazonaws.com"
+		}
+		if s3.BatchSize == 0 {
+			s3.BatchSize = 1000
+		}
+		if s3.FlushInterval == 0 {
+			s3.FlushInterval = time.Minute
+		}
+	}
+
+	// Named dialers take the dial defaults nodes do
+	for name, d := range cfg.Dialers {
+		d.Dial = dialDefaults(d.Dial, cfg.Dial)
+		cfg.Dialers[name] = d
+	}
+
 	// Service defaults
 	for i := range cfg.Services {
 		svc := &cfg.Services[i]
-		
-		// Use global server addr if not specified for service
+
+		// Use global server addr if not specified for service, redirect
+		// services listen on the plain HTTP port
+		if svc.Addr == "" && svc.Handler.Type == "redirect" {
+			svc.Addr = ":80"
+		}
 		if svc.Addr == "" {
 			svc.Addr = cfg.Server.Addr
 		}
-		
+
 		// Set default handler type
 		if svc.Handler.Type == "" {
 			svc.Handler.Type = "http"
 		}
-		
+
 		// Set default listener type
 		if svc.Listener.Type == "" {
 			svc.Listener.Type = "tcp"
 		}
-		
+
+		// Redirects go permanently to the standard HTTPS port
+		if svc.Handler.Type == "redirect" {
+			if svc.Redirect == nil {
+				svc.Redirect = &Redirect{}
+			}
+			if svc.Redirect.Port == 0 {
+				svc.Redirect.Port = 443
+			}
+			if svc.Redirect.Status == 0 {
+				svc.Redirect.Status = http.StatusMovedPermanently
+			}
+		}
+
+		// *.domain matches subdomains at any depth unless configured otherwise
+		if svc.HostWildcard == "" {
+			svc.HostWildcard = "any"
+		}
+
+		// Synthetic routes answer 200, and redirects 302, unless configured
+		// otherwise
+		for j := range svc.Synthetic {
+			route := &svc.Synthetic[j]
+			if route.Status == 0 && route.Type == "redirect" {
+				route.Status = http.StatusFound
+			}
+			if route.Status == 0 {
+				route.Status = http.StatusOK
+			}
+			if route.Type == "ping" && route.Body == "" {
+				route.Body = "pong"
+			}
+		}
+
 		// Set node proxy defaults
 		for j := range svc.Forwarder.Nodes {
-			node := &svc.Forwarder.Nodes[j]
-			if node.Proxy == "" && cfg.DefaultProxy != "" {
-				node.Proxy = cfg.DefaultProxy
-			}
+			setNodeDefaults(cfg, &svc.Forwarder.Nodes[j])
 		}
 	}
 
 	return nil
 }
+
+// setNodeDefaults fills in the unset settings of node, from its route group
+// and the global defaults of cfg
+func setNodeDefaults(cfg *Config, node *Node) {
+	// Inherit shared settings from the node's route group first
+	if group, ok := cfg.RouteGroups[node.Group]; ok && node.Group != "" {
+		applyRouteGroup(node, &group)
+	}
+
+	if node.Proxy == "" && len(node.Proxies) == 0 && node.Dialer == "" && cfg.DefaultProxy != "" {
+		node.Proxy = cfg.DefaultProxy
+	}
+
+	// Proxy selection defaults
+	if len(node.Proxies) > 0 {
+		if node.ProxySelect == nil {
+			node.ProxySelect = &ProxySelect{}
+		}
+		if node.ProxySelect.ProbeInterval == 0 {
+			node.ProxySelect.ProbeInterval = 10 * time.Second
+		}
+		if node.ProxySelect.ProbeTimeout == 0 {
+			node.ProxySelect.ProbeTimeout = 2 * time.Second
+		}
+		if node.ProxySelect.Hysteresis == 0 {
+			node.ProxySelect.Hysteresis = 20 * time.Millisecond
+		}
+	}
+
+	// Standby probing defaults
+	if sb := node.Standby; sb != nil {
+		if sb.ProbeInterval == 0 {
+			sb.ProbeInterval = 5 * time.Second
+		}
+		if sb.ProbeTimeout == 0 {
+			sb.ProbeTimeout = 2 * time.Second
+		}
+		if sb.FailAfter == 0 {
+			sb.FailAfter = 3
+		}
+		if sb.FailBack == 0 {
+			sb.FailBack = 30 * time.Second
+		}
+	}
+
+	// Retry defaults
+	if node.Retry != nil {
+		if node.Retry.Backoff == 0 {
+			node.Retry.Backoff = 50 * time.Millisecond
+		}
+		if node.Retry.MaxBackoff == 0 {
+			node.Retry.MaxBackoff = time.Second
+		}
+		if node.Retry.Jitter == 0 {
+			node.Retry.Jitter = 0.5
+		}
+	}
+
+	// Signatures are computed over the body, with 5 minutes of
+	// clock skew allowed for timestamps
+	if sig := node.Signature; sig != nil {
+		if sig.Algorithm == "" {
+			sig.Algorithm = "sha256"
+		}
+		if sig.Encoding == "" {
+			sig.Encoding = "hex"
+		}
+		if sig.Payload == "" {
+			sig.Payload = "{body}"
+		}
+		if sig.MaxSkew == 0 {
+			sig.MaxSkew = 5 * time.Minute
+		}
+		if sig.MaxBodySize == 0 {
+			sig.MaxBodySize = 10 << 20
+		}
+	}
+
+	// All requests are recorded, the last 100 kept with 4kb of body
+	if rec := node.Recording; rec != nil {
+		if rec.SampleRate == 0 {
+			rec.SampleRate = 1
+		}
+		if rec.Size == 0 {
+			rec.Size = 100
+		}
+		if rec.MaxBodySize == 0 {
+			rec.MaxBodySize = 4 << 10
+		}
+	}
+
+	// Faults hit every request unless a share is given, aborts
+	// answer 503
+	if f := node.Faults; f != nil {
+		if f.Delay != nil && f.Delay.Percent == 0 {
+			f.Delay.Percent = 100
+		}
+		if f.Abort != nil {
+			if f.Abort.Status == 0 {
+				f.Abort.Status = http.StatusServiceUnavailable
+			}
+			if f.Abort.Percent == 0 {
+				f.Abort.Percent = 100
+			}
+		}
+		if f.Reset != nil && f.Reset.Percent == 0 {
+			f.Reset.Percent = 100
+		}
+	}
+
+	// Request bodies are decompressed up to 10mb and compressed from 1kb
+	if enc := node.RequestEncoding; enc != nil {
+		if enc.MaxSize == 0 {
+			enc.MaxSize = 10 << 20
+		}
+		if enc.MinSize == 0 {
+			enc.MinSize = 1 << 10
+		}
+		if enc.Level == 0 {
+			enc.Level = 6
+		}
+	}
+
+	// Timeout shorthands fill the settings they stand for, a conflicting
+	// value set there too is rejected by validation
+	if node.ConnectTimeout > 0 && node.Dialer == "" {
+		if node.Dial == nil {
+			node.Dial = &Dial{}
+		}
+		if node.Dial.Timeout == 0 {
+			node.Dial.Timeout = node.ConnectTimeout
+		}
+	}
+	if node.TotalTimeout > 0 && node.Timeout == 0 {
+		node.Timeout = node.TotalTimeout
+	}
+
+	// Dial defaults, inheriting unset fields from the global policy.
+	// A named dialer brings its own.
+	if node.Dialer == "" {
+		node.Dial = dialDefaults(node.Dial, cfg.Dial)
+	}
+
+	// Addr falls back to the first backend for logging and host headers
+	if node.Addr == "" && len(node.Backends) > 0 {
+		node.Addr = node.Backends[0]
+	}
+
+	// Canary overrides default to the node's proxy and standard names
+	if node.Canary != nil {
+		if node.Canary.Proxy == "" {
+			node.Canary.Proxy = node.Proxy
+		}
+		if node.Canary.Header == "" {
+			node.Canary.Header = "X-Canary"
+		}
+		if node.Canary.Cookie == "" {
+			node.Canary.Cookie = "canary"
+		}
+	}
+
+	// Maintenance defaults
+	if node.Maintenance != nil {
+		if node.Maintenance.ContentType == "" {
+			node.Maintenance.ContentType = "text/html; charset=utf-8"
+		}
+		if node.Maintenance.RetryAfter == 0 {
+			node.Maintenance.RetryAfter = 5 * time.Minute
+		}
+	}
+
+	// Backpressure defaults
+	if node.Backpressure != nil {
+		if node.Backpressure.MaxPause == 0 {
+			node.Backpressure.MaxPause = time.Minute
+		}
+		if node.Backpressure.MaxQueued == 0 {
+			node.Backpressure.MaxQueued = 100
+		}
+	}
+
+	// SLO defaults
+	if node.SLO != nil {
+		if node.SLO.Latency > 0 && node.SLO.LatencyTarget == 0 {
+			node.SLO.LatencyTarget = 0.99
+		}
+		if node.SLO.Window == 0 {
+			node.SLO.Window = 24 * time.Hour
+		}
+	}
+
+	// Queued requests wait 5s by default before being rejected
+	if node.Limits != nil && node.Limits.QueueSize > 0 && node.Limits.QueueTimeout == 0 {
+		node.Limits.QueueTimeout = 5 * time.Second
+	}
+}
+
+// dialDefaults returns dial policy d with the unset fields inherited from
+// the global policy and defaults for the rest, nil when neither is set
+func dialDefaults(d, global *Dial) *Dial {
+	if global != nil {
+		if d == nil {
+			d = &Dial{}
+		}
+		inheritDial(d, global)
+	}
+	if d != nil {
+		if d.IPFamily == "" {
+			d.IPFamily = "auto"
+		}
+		if d.FallbackDelay == 0 {
+			d.FallbackDelay = 300 * time.Millisecond
+		}
+		if d.Timeout == 0 {
+			d.Timeout = 30 * time.Second
+		}
+	}
+	return d
+}
+
+// inheritDial fills the unset fields of d from the global dial policy
+func inheritDial(d, global *Dial) {
+	if d.IPFamily == "" {
+		d.IPFamily = global.IPFamily
+	}
+	if d.FallbackDelay == 0 {
+		d.FallbackDelay = global.FallbackDelay
+	}
+	if d.Timeout == 0 {
+		d.Timeout = global.Timeout
+	}
+	if d.SourceIP == "" && d.Interface == "" {
+		d.SourceIP = global.SourceIP
+		d.Interface = global.Interface
+	}
+	if d.DSCP == 0 {
+		d.DSCP = global.DSCP
+	}
+	if d.NoDelay == nil {
+		d.NoDelay = global.NoDelay
+	}
+	if d.KeepAlive == 0 {
+		d.KeepAlive = global.KeepAlive
+	}
+	if d.UserTimeout == 0 {
+		d.UserTimeout = global.UserTimeout
+	}
+}
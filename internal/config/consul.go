@@ -0,0 +1,102 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// consulWait is how long a blocking query waits for the key to change
+const consulWait = 5 * time.Minute
+
+// consulStore reads a key of Consul's KV store, watching it with blocking
+// queries
+type consulStore struct {
+	client *http.Client
+	url    string // of the key, with the query parameters to pass on
+	token  string
+}
+
+// newConsulStore creates a store for a consul:// location. The token comes
+// from the token query parameter or CONSUL_HTTP_TOKEN, other parameters
+// such as dc are passed on to Consul.
+func newConsulStore(u *url.URL) (*consulStore, error) {
+	key := strings.Trim(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("consul config location must be consul://host:port/key")
+	}
+
+	query := u.Query()
+	token := query.Get("token")
+	if token == "" {
+		token = os.Getenv("CONSUL_HTTP_TOKEN")
+	}
+	query.Del("token")
+	query.Set("raw", "")
+
+	scheme := "http"
+	if u.Scheme == "consul+https" {
+		scheme = "https"
+	}
+	keyURL := url.URL{Scheme: scheme, Host: u.Host, Path: "/v1/kv/" + key, RawQuery: query.Encode()}
+
+	return &consulStore{
+		client: &http.Client{},
+		url:    keyURL.String(),
+		token:  token,
+	}, nil
+}
+
+func (c *consulStore) get(ctx context.Context, version uint64) ([]byte, uint64, error) {
+	target := c.url
+	if version > 0 {
+		// Consul returns early, when the key changes, or after the wait
+		// plus some jitter
+		target += "&index=" + strconv.FormatUint(version, 10) + "&wait=" + consulWait.String()
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, consulWait+time.Minute)
+		defer cancel()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create consul request: %w", err)
+	}
+	if c.token != "" {
+		req.Header.Set("X-Consul-Token", c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to query consul: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigDocument+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read consul response: %w", err)
+	}
+	if len(data) > maxConfigDocument {
+		return nil, 0, fmt.Errorf("consul value larger than %d bytes", maxConfigDocument)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, 0, fmt.Errorf("consul key not found")
+	default:
+		return nil, 0, fmt.Errorf("consul returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	index, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil || index == 0 {
+		// An index of zero would make the next query return at once
+		index = 1
+	}
+	return data, index, nil
+}
@@ -0,0 +1,196 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// What happened to a part of the configuration
+const (
+	ChangeAdded    = "added"
+	ChangeRemoved  = "removed"
+	ChangeModified = "modified"
+)
+
+// Change is one difference between two configurations
+type Change struct {
+	Kind   string   `json:"kind"`             // section, service, node or rule
+	Name   string   `json:"name"`             // of the section, service or node
+	Op     string   `json:"op"`               // added, removed or modified
+	Fields []string `json:"fields,omitempty"` // settings that differ, of a modification
+}
+
+// ruleFields are the node settings making up its routing rule
+var ruleFields = []string{"filter", "matcher"}
+
+// Diff lists what changed from old to new: top-level sections, services,
+// nodes and the routing rules of nodes. Nodes are told apart by name, so a
+// node moved to another service is modified. Only the names of changed
+// settings are given, never their values, so the changes can be logged
+// without leaking secrets.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+
+	// Top-level sections, services are compared one by one below
+	ov, nv := reflect.ValueOf(*old), reflect.ValueOf(*new)
+	for _, name := range diffFields(ov, nv, "services") {
+		changes = append(changes, Change{
+			Kind:   "section",
+			Name:   name,
+			Op:     ChangeModified,
+			Fields: sectionFields(fieldByTag(ov, name), fieldByTag(nv, name)),
+		})
+	}
+
+	oldSvcs := make(map[string]*Service, len(old.Services))
+	for i := range old.Services {
+		oldSvcs[old.Services[i].Name] = &old.Services[i]
+	}
+	newSvcs := make(map[string]bool, len(new.Services))
+	for i := range new.Services {
+		svc := &new.Services[i]
+		newSvcs[svc.Name] = true
+		prev, ok := oldSvcs[svc.Name]
+		if !ok {
+			changes = append(changes, Change{Kind: "service", Name: svc.Name, Op: ChangeAdded})
+			continue
+		}
+		if fields := diffFields(reflect.ValueOf(*prev), reflect.ValueOf(*svc), "forwarder"); len(fields) > 0 {
+			changes = append(changes, Change{Kind: "service", Name: svc.Name, Op: ChangeModified, Fields: fields})
+		}
+	}
+	for _, svc := range old.Services {
+		if !newSvcs[svc.Name] {
+			changes = append(changes, Change{Kind: "service", Name: svc.Name, Op: ChangeRemoved})
+		}
+	}
+
+	oldNodes := indexNodes(old)
+	newNodes := indexNodes(new)
+	for _, svc := range new.Services {
+		for i := range svc.Forwarder.Nodes {
+			node := &svc.Forwarder.Nodes[i]
+			prev, ok := oldNodes[node.Name]
+			if !ok {
+				changes = append(changes, Change{Kind: "node", Name: node.Name, Op: ChangeAdded})
+				continue
+			}
+			ov, nv := reflect.ValueOf(*prev.node), reflect.ValueOf(*node)
+			fields := diffFields(ov, nv, ruleFields...)
+			if prev.service != svc.Name {
+				fields = append(fields, "service")
+			}
+			if len(fields) > 0 {
+				changes = append(changes, Change{Kind: "node", Name: node.Name, Op: ChangeModified, Fields: fields})
+			}
+			var rule []string
+			for _, name := range ruleFields {
+				if !reflect.DeepEqual(fieldByTag(ov, name).Interface(), fieldByTag(nv, name).Interface()) {
+					rule = append(rule, name)
+				}
+			}
+			if len(rule) > 0 {
+				changes = append(changes, Change{Kind: "rule", Name: node.Name, Op: ChangeModified, Fields: rule})
+			}
+		}
+	}
+	for _, svc := range old.Services {
+		for _, node := range svc.Forwarder.Nodes {
+			if _, ok := newNodes[node.Name]; !ok {
+				changes = append(changes, Change{Kind: "node", Name: node.Name, Op: ChangeRemoved})
+			}
+		}
+	}
+
+	return changes
+}
+
+// serviceNode is a node and the service it belongs to
+type serviceNode struct {
+	service string
+	node    *Node
+}
+
+// indexNodes returns the nodes of cfg by name
+func indexNodes(cfg *Config) map[string]serviceNode {
+	nodes := make(map[string]serviceNode)
+	for _, svc := range cfg.Services {
+		for i := range svc.Forwarder.Nodes {
+			nodes[svc.Forwarder.Nodes[i].Name] = serviceNode{svc.Name, &svc.Forwarder.Nodes[i]}
+		}
+	}
+	return nodes
+}
+
+// diffFields returns the yaml names of the fields of two structs of the
+// same type that differ, leaving out those named in skip
+func diffFields(a, b reflect.Value, skip ...string) []string {
+	var fields []string
+	for i := 0; i < a.NumField(); i++ {
+		name := yamlName(a.Type().Field(i))
+		if name == "" || slices.Contains(skip, name) {
+			continue
+		}
+		if !reflect.DeepEqual(a.Field(i).Interface(), b.Field(i).Interface()) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// sectionFields returns what differs within a section: the fields of a
+// struct, or the keys of a map. A section added or removed as a whole has
+// none.
+func sectionFields(a, b reflect.Value) []string {
+	if a.Kind() == reflect.Pointer {
+		if a.IsNil() || b.IsNil() {
+			return nil
+		}
+		a, b = a.Elem(), b.Elem()
+	}
+	switch a.Kind() {
+	case reflect.Struct:
+		return diffFields(a, b)
+	case reflect.Map:
+		var keys []string
+		for _, k := range a.MapKeys() {
+			if bv := b.MapIndex(k); !bv.IsValid() || !reflect.DeepEqual(a.MapIndex(k).Interface(), bv.Interface()) {
+				keys = append(keys, fmt.Sprint(k.Interface()))
+			}
+		}
+		for _, k := range b.MapKeys() {
+			if !a.MapIndex(k).IsValid() {
+				keys = append(keys, fmt.Sprint(k.Interface()))
+			}
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	return nil
+}
+
+// fieldByTag returns the field of struct v with the given yaml name
+func fieldByTag(v reflect.Value, name string) reflect.Value {
+	for i := 0; i < v.NumField(); i++ {
+		if yamlName(v.Type().Field(i)) == name {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+// yamlName returns the name a struct field has in the config file, empty
+// for fields that aren't read from it
+func yamlName(f reflect.StructField) string {
+	name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+	if name == "-" || !f.IsExported() {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(f.Name)
+	}
+	return name
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// isFragment reports whether a file of a config directory is part of the
+// configuration: YAML, JSON and TOML files, except hidden ones such as
+// editor swap files
+func isFragment(name string) bool {
+	name = filepath.Base(name)
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml", ".json", ".toml":
+		return true
+	}
+	return false
+}
+
+// loadDir reads the fragments of a config directory in lexical order and
+// merges them into one document: blocks are merged key by key, lists are
+// appended to, so every fragment can add services, and other values are
+// replaced by the last fragment setting them. Each fragment is read in the
+// format its extension names, or in format when set. Subdirectories are
+// skipped.
+func loadDir(dir, format string) (yaml.Node, error) {
+	var doc yaml.Node
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return doc, err
+	}
+
+	found := false
+	for _, entry := range entries {
+		if entry.IsDir() || !isFragment(entry.Name()) {
+			continue
+		}
+		found = true
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return doc, err
+		}
+		fragmentFormat := format
+		if fragmentFormat == "" {
+			fragmentFormat = DetectFormat(entry.Name())
+		}
+		fragment, err := decodeDocument(data, fragmentFormat)
+		if err != nil {
+			return doc, fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+
+		// Empty fragments, such as ones commented out, add nothing
+		if fragment.Kind == 0 {
+			continue
+		}
+		if fragment.Content[0].Kind != yaml.MappingNode {
+			return doc, fmt.Errorf("%s: fragment is not a mapping", entry.Name())
+		}
+		if doc.Kind == 0 {
+			doc = fragment
+			continue
+		}
+		mergeNode(doc.Content[0], fragment.Content[0])
+	}
+
+	if !found {
+		return doc, fmt.Errorf("no .yaml, .json or .toml files in %s", dir)
+	}
+	return doc, nil
+}
+
+// mergeNode merges src into dst: mappings by key, sequences by appending
+// the items of src, anything else by replacing dst
+func mergeNode(dst, src *yaml.Node) {
+	switch {
+	case dst.Kind == yaml.MappingNode && src.Kind == yaml.MappingNode:
+		for i := 0; i+1 < len(src.Content); i += 2 {
+			key, value := src.Content[i], src.Content[i+1]
+			if existing := mappingValue(dst, key.Value); existing != nil {
+				mergeNode(existing, value)
+			} else {
+				dst.Content = append(dst.Content, key, value)
+			}
+		}
+	case dst.Kind == yaml.SequenceNode && src.Kind == yaml.SequenceNode:
+		dst.Content = append(dst.Content, src.Content...)
+	default:
+		*dst = *src
+	}
+}
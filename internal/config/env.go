@@ -0,0 +1,233 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// envPrefix starts the names of environment variables that override config
+// keys, e.g. FORWARDER_SERVER_ADDR for server.addr
+const envPrefix = "FORWARDER_"
+
+// envStep is one key of the path an environment variable names
+type envStep struct {
+	key   string // mapping key
+	index int    // sequence index, when key is empty
+}
+
+// applyEnv overrides keys of doc with the FORWARDER_ variables in environ,
+// given as KEY=value. The name after the prefix is the key path with
+// underscores between keys, matched against the config fields, so
+// FORWARDER_SERVER_READ_TIMEOUT sets server.read_timeout. List items are
+// named by their index, FORWARDER_SERVICES_0_ADDR, and map keys by their
+// name with dashes as underscores. Values are read as YAML, so lists and
+// blocks can be set as flow documents. Variables that name no config key
+// are logged and skipped, as orchestrators set FORWARDER_ variables of their
+// own, such as Kubernetes' FORWARDER_PORT for a service named forwarder.
+func applyEnv(doc *yaml.Node, environ []string) error {
+	overrides := make(map[string]string)
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if strings.HasPrefix(name, envPrefix) && len(name) > len(envPrefix) {
+			overrides[name] = value
+		}
+	}
+	if len(overrides) == 0 {
+		return nil
+	}
+
+	if doc.Kind == 0 {
+		*doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}
+	}
+	if doc.Kind != yaml.DocumentNode || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("config document is not a mapping")
+	}
+	root := doc.Content[0]
+
+	// Apply in name order, so a list override comes before overrides of
+	// its items
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		tokens := strings.Split(strings.ToLower(strings.TrimPrefix(name, envPrefix)), "_")
+		path, ok := envPath(root, reflect.TypeOf(Config{}), tokens)
+		if !ok {
+			log.Warn().Str("variable", name).Msg("environment variable names no config key, ignoring it")
+			continue
+		}
+		if err := setEnvValue(root, path, envValue(overrides[name])); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+// envPath resolves tokens to the key path of a field of type t. node is
+// the document at that point, nil where it has no such key yet, and is
+// only consulted for map keys.
+func envPath(node *yaml.Node, t reflect.Type, tokens []string) ([]envStep, bool) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if len(tokens) == 0 {
+		return nil, true
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		// Keys contain underscores too, try the longest first
+		for n := len(tokens); n > 0; n-- {
+			key := strings.Join(tokens[:n], "_")
+			field, ok := yamlField(t, key)
+			if !ok {
+				continue
+			}
+			if rest, ok := envPath(mappingValue(node, key), field.Type, tokens[n:]); ok {
+				return append([]envStep{{key: key}}, rest...), true
+			}
+		}
+	case reflect.Slice:
+		index, err := strconv.Atoi(tokens[0])
+		if err != nil || index < 0 {
+			return nil, false
+		}
+		var item *yaml.Node
+		if node != nil && node.Kind == yaml.SequenceNode && index < len(node.Content) {
+			item = node.Content[index]
+		}
+		if rest, ok := envPath(item, t.Elem(), tokens[1:]); ok {
+			return append([]envStep{{index: index}}, rest...), true
+		}
+	case reflect.Map:
+		// Existing keys win, compared with dashes as underscores
+		if node != nil && node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				key := node.Content[i].Value
+				want := strings.ToLower(strings.ReplaceAll(key, "-", "_"))
+				for n := len(tokens); n > 0; n-- {
+					if strings.Join(tokens[:n], "_") != want {
+						continue
+					}
+					if rest, ok := envPath(node.Content[i+1], t.Elem(), tokens[n:]); ok {
+						return append([]envStep{{key: key}}, rest...), true
+					}
+				}
+			}
+		}
+		// A new key takes the rest of the name when it holds a value
+		elem := t.Elem()
+		for elem.Kind() == reflect.Pointer {
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			return []envStep{{key: strings.Join(tokens, "_")}}, true
+		}
+		if rest, ok := envPath(nil, elem, tokens[1:]); ok {
+			return append([]envStep{{key: tokens[0]}}, rest...), true
+		}
+	case reflect.Interface:
+		// Free-form values such as handler metadata
+		steps := make([]envStep, len(tokens))
+		for i, token := range tokens {
+			steps[i] = envStep{key: token}
+		}
+		return steps, true
+	}
+	return nil, false
+}
+
+// yamlField returns the field of struct t with the given yaml key
+func yamlField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == key && field.IsExported() {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// mappingValue returns the value of key in a mapping node, or nil
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// envValue parses an environment value as YAML, falling back to a plain
+// string for text YAML can't read
+func envValue(value string) *yaml.Node {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(value), &doc); err == nil && doc.Kind == yaml.DocumentNode && len(doc.Content) == 1 {
+		return doc.Content[0]
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// setEnvValue stores value at path below node, creating the mappings on
+// the way. Lists aren't extended: an index must name an existing item or
+// the one after the last.
+func setEnvValue(node *yaml.Node, path []envStep, value *yaml.Node) error {
+	for i, step := range path {
+		last := i == len(path)-1
+		next := &yaml.Node{Kind: yaml.MappingNode}
+		if !last && path[i+1].key == "" {
+			next.Kind = yaml.SequenceNode
+		}
+		if last {
+			next = value
+		}
+
+		if step.key == "" {
+			if node.Kind != yaml.SequenceNode || step.index > len(node.Content) {
+				return fmt.Errorf("list has no item %d", step.index)
+			}
+			if step.index == len(node.Content) {
+				node.Content = append(node.Content, next)
+			} else if last || !isCollection(node.Content[step.index]) {
+				node.Content[step.index] = next
+			}
+			node = node.Content[step.index]
+			continue
+		}
+
+		if node.Kind == yaml.ScalarNode && node.Tag == "!!null" {
+			node.Kind, node.Tag, node.Value = yaml.MappingNode, "", ""
+		}
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s is not a block", step.key)
+		}
+		existing := mappingValue(node, step.key)
+		switch {
+		case existing == nil:
+			node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: step.key}, next)
+			existing = next
+		case last || !isCollection(existing):
+			*existing = *next
+		}
+		node = existing
+	}
+	return nil
+}
+
+// isCollection reports whether node is a mapping or a sequence
+func isCollection(node *yaml.Node) bool {
+	return node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode
+}
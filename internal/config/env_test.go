@@ -0,0 +1,32 @@
+package config
+
+import (
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestApplyEnvSkipsUnknownNames(t *testing.T) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte("server: {addr: \":8080\"}\n"), &doc); err != nil {
+		t.Fatalf("invalid document: %v", err)
+	}
+
+	// Kubernetes sets these for a service named forwarder
+	environ := []string{
+		"FORWARDER_PORT=tcp://10.0.0.1:80",
+		"FORWARDER_SERVICE_HOST=10.0.0.1",
+		"FORWARDER_SERVER_ADDR=:9090",
+	}
+	if err := applyEnv(&doc, environ); err != nil {
+		t.Fatalf("applyEnv: %v", err)
+	}
+
+	var cfg Config
+	if err := doc.Decode(&cfg); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if cfg.Server.Addr != ":9090" {
+		t.Fatalf("server.addr = %q, want %q", cfg.Server.Addr, ":9090")
+	}
+}
@@ -0,0 +1,239 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// etcdWait is how long a watch waits for the key to change before the key
+// is read again
+const etcdWait = 5 * time.Minute
+
+// etcdStore reads a key of etcd through its v3 JSON gateway, watching it
+// with the watch API
+type etcdStore struct {
+	client   *http.Client
+	endpoint string // scheme://host:port
+	key      string // base64, as the gateway takes keys
+
+	username string
+	password string
+	mu       sync.Mutex
+	token    string
+}
+
+// errEtcdUnauthenticated reports an expired or missing auth token
+var errEtcdUnauthenticated = errors.New("unauthenticated")
+
+// newEtcdStore creates a store for an etcd:// location. The key is the
+// path, including its leading slash. User and password of the location
+// authenticate with etcd.
+func newEtcdStore(u *url.URL) (*etcdStore, error) {
+	if u.Host == "" || u.Path == "" || u.Path == "/" {
+		return nil, fmt.Errorf("etcd config location must be etcd://host:port/key")
+	}
+
+	scheme := "http"
+	if u.Scheme == "etcd+https" {
+		scheme = "https"
+	}
+	e := &etcdStore{
+		client:   &http.Client{},
+		endpoint: scheme + "://" + u.Host,
+		key:      base64.StdEncoding.EncodeToString([]byte(u.Path)),
+	}
+	if u.User != nil {
+		e.username = u.User.Username()
+		e.password, _ = u.User.Password()
+	}
+	return e, nil
+}
+
+func (e *etcdStore) get(ctx context.Context, version uint64) ([]byte, uint64, error) {
+	if version > 0 {
+		if err := e.watch(ctx, version+1); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	var resp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	body, err := e.call(ctx, "/v3/kv/range", map[string]any{"key": e.key})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer body.Close()
+	if err := json.NewDecoder(body).Decode(&resp); err != nil {
+		return nil, 0, fmt.Errorf("failed to decode etcd response: %w", err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, 0, fmt.Errorf("etcd key not found")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(resp.KVs[0].Value)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to decode etcd value: %w", err)
+	}
+	// The store's revision rather than the key's: watching from the key's
+	// revision fails for good once etcd compacts past it
+	revision, err := strconv.ParseUint(resp.Header.Revision, 10, 64)
+	if err != nil || revision == 0 {
+		return nil, 0, fmt.Errorf("etcd response has no revision")
+	}
+	return data, revision, nil
+}
+
+// watch waits until the key changes at or after revision, or the wait
+// ends. A revision already compacted away returns at once, so the key is
+// read again at the revision etcd is at now.
+func (e *etcdStore) watch(ctx context.Context, revision uint64) error {
+	ctx, cancel := context.WithTimeout(ctx, etcdWait)
+	defer cancel()
+
+	body, err := e.call(ctx, "/v3/watch", map[string]any{
+		"create_request": map[string]any{
+			"key":            e.key,
+			"start_revision": strconv.FormatUint(revision, 10),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	// The gateway streams one JSON object per watch response
+	dec := json.NewDecoder(body)
+	for {
+		var msg struct {
+			Result struct {
+				Events          []json.RawMessage `json:"events"`
+				Canceled        bool              `json:"canceled"`
+				CancelReason    string            `json:"cancel_reason"`
+				CompactRevision string            `json:"compact_revision"`
+			} `json:"result"`
+			Error *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil && !errors.Is(ctx.Err(), context.Canceled) {
+				// The wait ended without a change
+				return nil
+			}
+			return fmt.Errorf("failed to watch etcd key: %w", err)
+		}
+		if msg.Error != nil {
+			return fmt.Errorf("failed to watch etcd key: %s", msg.Error.Message)
+		}
+		if len(msg.Result.Events) > 0 || msg.Result.CompactRevision != "" {
+			return nil
+		}
+		if msg.Result.Canceled {
+			// Returned as an error, so the watch is retried after a pause
+			return fmt.Errorf("etcd canceled the watch: %s", msg.Result.CancelReason)
+		}
+	}
+}
+
+// call posts a request to the gateway and returns the response body,
+// authenticating first when the location has credentials
+func (e *etcdStore) call(ctx context.Context, path string, request any) (io.ReadCloser, error) {
+	body, err := e.post(ctx, path, request)
+	if errors.Is(err, errEtcdUnauthenticated) && e.username != "" {
+		// Tokens expire, authenticate again once
+		e.mu.Lock()
+		e.token = ""
+		e.mu.Unlock()
+		body, err = e.post(ctx, path, request)
+	}
+	return body, err
+}
+
+func (e *etcdStore) post(ctx context.Context, path string, request any) (io.ReadCloser, error) {
+	token, err := e.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create etcd request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query etcd: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if resp.StatusCode == http.StatusUnauthorized {
+			return nil, fmt.Errorf("etcd returned %s: %w", resp.Status, errEtcdUnauthenticated)
+		}
+		return nil, fmt.Errorf("etcd returned %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return resp.Body, nil
+}
+
+// authenticate returns the auth token, fetching one when the location has
+// credentials and there is none yet
+func (e *etcdStore) authenticate(ctx context.Context) (string, error) {
+	if e.username == "" {
+		return "", nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.token != "" {
+		return e.token, nil
+	}
+
+	payload, _ := json.Marshal(map[string]string{"name": e.username, "password": e.password})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint+"/v3/auth/authenticate", bytes.NewReader(payload))
+	if err != nil {
+		return "", fmt.Errorf("failed to create etcd request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate with etcd: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to authenticate with etcd: %s", resp.Status)
+	}
+
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", fmt.Errorf("failed to decode etcd auth response: %w", err)
+	}
+	e.token = auth.Token
+	return e.token, nil
+}
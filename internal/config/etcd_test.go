@@ -0,0 +1,89 @@
+package config
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeEtcd serves the range and watch calls of the v3 JSON gateway for one
+// key last written at revision 3, with history compacted up to revision 8
+// and the store at revision 10
+type fakeEtcd struct {
+	mu      sync.Mutex
+	watches []uint64 // start revisions
+}
+
+func (f *fakeEtcd) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/v3/kv/range":
+		fmt.Fprintf(w, `{"header": {"revision": "10"}, "kvs": [{"value": %q, "mod_revision": "3"}]}`,
+			base64.StdEncoding.EncodeToString([]byte("port: 8080")))
+	case "/v3/watch":
+		var req struct {
+			Create struct {
+				StartRevision string `json:"start_revision"`
+			} `json:"create_request"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		start, _ := strconv.ParseUint(req.Create.StartRevision, 10, 64)
+		f.mu.Lock()
+		f.watches = append(f.watches, start)
+		f.mu.Unlock()
+
+		fmt.Fprint(w, `{"result": {"created": true}}`)
+		switch {
+		case start <= 8:
+			fmt.Fprint(w, `{"result": {"canceled": true, "compact_revision": "8"}}`)
+		case start == 11:
+			fmt.Fprint(w, `{"result": {"events": [{"type": "PUT"}]}}`)
+		default:
+			fmt.Fprint(w, `{"result": {"canceled": true, "cancel_reason": "permission denied"}}`)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEtcdStoreVersionIsStoreRevision(t *testing.T) {
+	fake := &fakeEtcd{}
+	ts := httptest.NewServer(fake)
+	defer ts.Close()
+
+	u, _ := url.Parse("etcd://" + ts.Listener.Addr().String() + "/forwarder")
+	store, err := newEtcdStore(u)
+	if err != nil {
+		t.Fatalf("newEtcdStore: %v", err)
+	}
+
+	data, version, err := store.get(context.Background(), 0)
+	if err != nil || string(data) != "port: 8080" || version != 10 {
+		t.Fatalf("get = %q, %d, %v, want the value at revision 10", data, version, err)
+	}
+
+	// The next watch starts after the store revision, not the compacted
+	// revision the key was written at
+	if _, version, err = store.get(context.Background(), version); err != nil || version != 10 {
+		t.Fatalf("get after a change = %d, %v", version, err)
+	}
+	if len(fake.watches) != 1 || fake.watches[0] != 11 {
+		t.Fatalf("watches started at %v, want [11]", fake.watches)
+	}
+
+	// A compacted start revision reads the key again
+	if _, version, err = store.get(context.Background(), 3); err != nil || version != 10 {
+		t.Fatalf("get after compaction = %d, %v", version, err)
+	}
+
+	// Any other cancellation is an error, so the caller backs off
+	if _, _, err = store.get(context.Background(), 20); err == nil {
+		t.Fatalf("get after a canceled watch succeeded")
+	}
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats
+const (
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+	FormatTOML = "toml"
+)
+
+// DetectFormat returns the format of a config file by its extension:
+// .json and .toml files are read as such, anything else as YAML
+func DetectFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// decodeDocument parses a config document into a YAML node, whatever its
+// format, so environment overrides and decoding into Config work the same
+// for all of them. Keys are the yaml keys in every format.
+func decodeDocument(data []byte, format string) (yaml.Node, error) {
+	var doc yaml.Node
+	switch format {
+	case FormatYAML:
+		err := yaml.Unmarshal(data, &doc)
+		return doc, err
+	case FormatJSON:
+		// JSON is YAML too, but checked strictly so its errors read as
+		// JSON errors
+		var v any
+		if err := json.Unmarshal(data, &v); err != nil {
+			return doc, err
+		}
+		err := yaml.Unmarshal(data, &doc)
+		return doc, err
+	case FormatTOML:
+		var v map[string]any
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return doc, err
+		}
+		if len(v) == 0 {
+			return doc, nil
+		}
+		var root yaml.Node
+		if err := root.Encode(v); err != nil {
+			return doc, err
+		}
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{&root}}
+		return doc, nil
+	default:
+		return doc, fmt.Errorf("unknown config format %q (must be yaml, json or toml)", format)
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import "reflect"
+
+// applyRouteGroup fills every setting the node leaves unset from its route
+// group. Nested blocks such as dial or limits are merged field by field, so
+// a node can override a single field of a shared block.
+func applyRouteGroup(node *Node, group *Node) {
+	mergeDefaults(reflect.ValueOf(node).Elem(), reflect.ValueOf(group).Elem())
+}
+
+// mergeDefaults copies fields of src into the zero-valued fields of dst
+func mergeDefaults(dst, src reflect.Value) {
+	for i := 0; i < dst.NumField(); i++ {
+		d, s := dst.Field(i), src.Field(i)
+		if s.IsZero() {
+			continue
+		}
+
+		switch {
+		case d.IsZero():
+			d.Set(copyValue(s))
+		case d.Kind() == reflect.Struct:
+			mergeDefaults(d, s)
+		case d.Kind() == reflect.Pointer && d.Elem().Kind() == reflect.Struct:
+			mergeDefaults(d.Elem(), s.Elem())
+		}
+	}
+}
+
+// copyValue returns v, with pointed-to structs copied so nodes sharing a
+// group don't share blocks that later defaults modify in place
+func copyValue(v reflect.Value) reflect.Value {
+	if v.Kind() == reflect.Pointer && v.Elem().Kind() == reflect.Struct {
+		c := reflect.New(v.Elem().Type())
+		c.Elem().Set(v.Elem())
+		return c
+	}
+	return v
+}
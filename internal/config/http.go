@@ -0,0 +1,109 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPollInterval is how often a config URL is fetched
+	DefaultPollInterval = 30 * time.Second
+	// maxConfigDocument bounds the size of a fetched config
+	maxConfigDocument = 16 << 20
+)
+
+// httpStore polls a config document from an http(s) URL. Fetches are
+// conditional on the ETag and Last-Modified of the last document, so an
+// unchanged document costs a 304.
+type httpStore struct {
+	client   *http.Client
+	url      string
+	interval time.Duration
+
+	mu           sync.Mutex
+	data         []byte
+	version      uint64 // counts changed documents
+	etag         string
+	lastModified string
+}
+
+// newHTTPStore creates a store fetching url every interval. User and
+// password of the URL are sent with basic auth.
+func newHTTPStore(url string, interval time.Duration) *httpStore {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	return &httpStore{
+		client:   &http.Client{},
+		url:      url,
+		interval: interval,
+	}
+}
+
+func (h *httpStore) get(ctx context.Context, version uint64) ([]byte, uint64, error) {
+	if version > 0 {
+		// Spread fetches of many forwarders polling the same URL
+		wait := h.interval + time.Duration(rand.Int63n(int64(h.interval)/10+1))
+		select {
+		case <-ctx.Done():
+			return nil, 0, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to create config request: %w", err)
+	}
+	h.mu.Lock()
+	if h.data != nil {
+		if h.etag != "" {
+			req.Header.Set("If-None-Match", h.etag)
+		}
+		if h.lastModified != "" {
+			req.Header.Set("If-Modified-Since", h.lastModified)
+		}
+	}
+	h.mu.Unlock()
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	defer resp.Body.Close()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && h.data != nil:
+		return h.data, h.version, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, 0, fmt.Errorf("failed to fetch config: unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxConfigDocument+1))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to fetch config: %w", err)
+	}
+	if len(data) > maxConfigDocument {
+		return nil, 0, fmt.Errorf("failed to fetch config: document larger than %d bytes", maxConfigDocument)
+	}
+
+	// Servers without validators send the document every time, it
+	// counts as changed only when it is different
+	if h.data == nil || !bytes.Equal(data, h.data) {
+		h.version++
+	}
+	h.data = data
+	h.etag = resp.Header.Get("ETag")
+	h.lastModified = resp.Header.Get("Last-Modified")
+	return data, h.version, nil
+}
@@ -0,0 +1,117 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// RouteDelta adds nodes to and removes nodes from a running configuration,
+// without replacing the rest of it
+type RouteDelta struct {
+	Add    []NodeAddition `yaml:"add"`
+	Remove []string       `yaml:"remove"` // names of the nodes to remove
+}
+
+// NodeAddition is a node added to a service. Requests are matched against
+// the nodes of a service in order, so the position matters.
+type NodeAddition struct {
+	Service string `yaml:"service"`
+	Before  string `yaml:"before,omitempty"` // node the new one is matched ahead of, default after the last
+	Node    Node   `yaml:"node"`
+}
+
+// ParseRouteDelta parses a route delta in YAML or JSON. Deltas come from
+// the admin API, so unlike the config file they may not name secrets:
+// ${env:...} and ${file:...} placeholders are rejected.
+func ParseRouteDelta(data []byte) (*RouteDelta, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse route delta: %w", err)
+	}
+	if err := rejectSecrets(&doc); err != nil {
+		return nil, fmt.Errorf("invalid route delta: %w", err)
+	}
+
+	var delta RouteDelta
+	if doc.Kind != 0 {
+		if err := doc.Decode(&delta); err != nil {
+			return nil, fmt.Errorf("failed to parse route delta: %w", err)
+		}
+	}
+	if len(delta.Add) == 0 && len(delta.Remove) == 0 {
+		return nil, fmt.Errorf("route delta adds and removes no nodes")
+	}
+	return &delta, nil
+}
+
+// Apply returns a copy of cfg with the nodes removed and then added, and
+// validated like a loaded config. Added nodes get their defaults; a node
+// removed and added again by the same delta is replaced. cfg and the nodes
+// it shares with the copy are left as they are.
+func (d *RouteDelta) Apply(cfg *Config) (*Config, error) {
+	next := *cfg
+	next.Services = slices.Clone(cfg.Services)
+
+	removed := make(map[string]bool, len(d.Remove))
+	for _, name := range d.Remove {
+		removed[name] = false
+	}
+	for i := range next.Services {
+		svc := &next.Services[i]
+		nodes := make([]Node, 0, len(svc.Forwarder.Nodes))
+		for _, node := range svc.Forwarder.Nodes {
+			if _, ok := removed[node.Name]; ok {
+				removed[node.Name] = true
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+		svc.Forwarder.Nodes = nodes
+	}
+	for _, name := range d.Remove {
+		if !removed[name] {
+			return nil, fmt.Errorf("invalid remove: no node %s", name)
+		}
+	}
+
+	for _, add := range d.Add {
+		node := add.Node
+		if node.Name == "" {
+			return nil, fmt.Errorf("invalid add to service %s: node name is required", add.Service)
+		}
+		if _, ok := indexNodes(&next)[node.Name]; ok {
+			return nil, fmt.Errorf("invalid add of node %s: node exists, remove it in the same delta to replace it", node.Name)
+		}
+		svc := findService(&next, add.Service)
+		if svc == nil {
+			return nil, fmt.Errorf("invalid add of node %s: no service %s", node.Name, add.Service)
+		}
+
+		pos := len(svc.Forwarder.Nodes)
+		if add.Before != "" {
+			pos = slices.IndexFunc(svc.Forwarder.Nodes, func(n Node) bool { return n.Name == add.Before })
+			if pos < 0 {
+				return nil, fmt.Errorf("invalid add of node %s: no node %s in service %s to add it before", node.Name, add.Before, add.Service)
+			}
+		}
+		setNodeDefaults(&next, &node)
+		svc.Forwarder.Nodes = slices.Insert(svc.Forwarder.Nodes, pos, node)
+	}
+
+	if err := ValidateConfig(&next); err != nil {
+		return nil, err
+	}
+	return &next, nil
+}
+
+// findService returns the service of cfg with the given name
+func findService(cfg *Config, name string) *Service {
+	for i := range cfg.Services {
+		if cfg.Services[i].Name == name {
+			return &cfg.Services[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretPattern matches the ${env:NAME} and ${file:path} placeholders of a
+// value, and the same with $${ for a literal ${
+var secretPattern = regexp.MustCompile(`\$?\$\{(env|file):([^}]*)\}`)
+
+// expandSecrets fills in the secret placeholders of the string values of
+// doc, so credentials can stay out of the file: ${env:NAME} is replaced
+// with an environment variable and ${file:path} with the contents of a
+// file, without a trailing newline. Other ${...} are left as they are.
+// Placeholders that can't be filled in fail the load.
+func expandSecrets(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := expandSecrets(child); err != nil {
+				return err
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if err := expandSecrets(node.Content[i+1]); err != nil {
+				return fmt.Errorf("%s: %w", node.Content[i].Value, err)
+			}
+		}
+	case yaml.ScalarNode:
+		if !strings.Contains(node.Value, "${") {
+			return nil
+		}
+		value, err := expandSecretValue(node.Value)
+		if err != nil {
+			return err
+		}
+		node.Value = value
+	}
+	return nil
+}
+
+// rejectSecrets fails for the first secret placeholder in doc. Documents
+// from outside, like route deltas posted to the admin API, must not read
+// the forwarder's environment or files.
+func rejectSecrets(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.DocumentNode, yaml.SequenceNode, yaml.MappingNode:
+		for _, child := range node.Content {
+			if err := rejectSecrets(child); err != nil {
+				return err
+			}
+		}
+	case yaml.ScalarNode:
+		for _, match := range secretPattern.FindAllString(node.Value, -1) {
+			if !strings.HasPrefix(match, "$$") {
+				return fmt.Errorf("secret placeholder %s is not allowed here", match)
+			}
+		}
+	}
+	return nil
+}
+
+// expandSecretValue fills in the placeholders of one value
+func expandSecretValue(value string) (string, error) {
+	var err error
+	expanded := secretPattern.ReplaceAllStringFunc(value, func(match string) string {
+		if strings.HasPrefix(match, "$$") {
+			return match[1:]
+		}
+		if err != nil {
+			return ""
+		}
+		m := secretPattern.FindStringSubmatch(match)
+		var secret string
+		secret, err = lookupSecret(m[1], m[2])
+		return secret
+	})
+	return expanded, err
+}
+
+// lookupSecret returns the secret a placeholder names
+func lookupSecret(kind, name string) (string, error) {
+	if name == "" {
+		return "", fmt.Errorf("${%s:} names no secret", kind)
+	}
+	switch kind {
+	case "env":
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	default:
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret file: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+}
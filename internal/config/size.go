@@ -0,0 +1,53 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ByteSize is a size in bytes that can be written as 512, 64kb, 10mb or 1gb
+type ByteSize int64
+
+// UnmarshalYAML parses plain integers and values with a kb/mb/gb suffix
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseByteSize(value.Value)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// ParseByteSize parses a size string such as "10mb"
+func ParseByteSize(s string) (ByteSize, error) {
+	str := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+
+	for _, unit := range []struct {
+		suffix string
+		factor int64
+	}{
+		{"gb", 1 << 30},
+		{"mb", 1 << 20},
+		{"kb", 1 << 10},
+		{"g", 1 << 30},
+		{"m", 1 << 20},
+		{"k", 1 << 10},
+		{"b", 1},
+	} {
+		if strings.HasSuffix(str, unit.suffix) {
+			str = strings.TrimSpace(strings.TrimSuffix(str, unit.suffix))
+			multiplier = unit.factor
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size: %s", s)
+	}
+	return ByteSize(n * multiplier), nil
+}
@@ -0,0 +1,257 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Source is where the configuration comes from: a local file or directory,
+// or a key of a remote store. Watch calls onChange with every new valid
+// configuration, the callback a Watcher takes for files.
+type Source interface {
+	// Load reads and parses the current configuration
+	Load() (*Config, error)
+	// Watch starts calling onChange in the background when the
+	// configuration changes
+	Watch(onChange func(*Config) error) error
+	// Stop stops watching
+	Stop() error
+	// String returns the location, without credentials
+	String() string
+}
+
+// SourceOptions configure how the configuration is read from a source
+type SourceOptions struct {
+	Format       string        // config format, by the file, key or URL extension when empty
+	PollInterval time.Duration // how often a config URL is fetched, default 30s
+}
+
+// OpenSource returns the source a -config location names. Locations of
+// the form etcd://host:2379/key or consul://host:8500/key read the key of
+// that store, with etcd+https and consul+https for TLS. http(s) URLs are
+// polled. Anything else is a file or directory path.
+func OpenSource(location string, opts SourceOptions) (Source, error) {
+	format := opts.Format
+	scheme, _, ok := strings.Cut(location, "://")
+	if !ok {
+		return &fileSource{path: location, format: format}, nil
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config location: %w", err)
+	}
+	var store kvStore
+	switch scheme {
+	case "etcd", "etcd+https":
+		store, err = newEtcdStore(u)
+	case "consul", "consul+https":
+		store, err = newConsulStore(u)
+	case "http", "https":
+		store = newHTTPStore(location, opts.PollInterval)
+	default:
+		return nil, fmt.Errorf("unknown config location scheme %q (must be etcd, etcd+https, consul, consul+https, http or https)", scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if format == "" {
+		format = DetectFormat(path.Base(u.Path))
+	}
+
+	// Mask the Consul token as well as passwords in logs
+	display := *u
+	if query := display.Query(); query.Has("token") {
+		query.Set("token", "xxxxx")
+		display.RawQuery = query.Encode()
+	}
+
+	return &remoteSource{
+		location: display.Redacted(),
+		format:   format,
+		store:    store,
+	}, nil
+}
+
+// fileSource reads a file or config directory and watches it with a
+// Watcher
+type fileSource struct {
+	path    string
+	format  string
+	watcher *Watcher
+}
+
+func (s *fileSource) Load() (*Config, error) {
+	return LoadConfigFormat(s.path, s.format)
+}
+
+func (s *fileSource) Watch(onChange func(*Config) error) error {
+	watcher, err := NewWatcher(s.path, onChange)
+	if err != nil {
+		return err
+	}
+	watcher.SetFormat(s.format)
+	if err := watcher.Start(); err != nil {
+		return err
+	}
+	s.watcher = watcher
+	return nil
+}
+
+func (s *fileSource) String() string {
+	return s.path
+}
+
+func (s *fileSource) Stop() error {
+	if s.watcher == nil {
+		return nil
+	}
+	return s.watcher.Stop()
+}
+
+// kvStore reads the config document from the key of a key-value store
+type kvStore interface {
+	// get returns the value of the key and its version. Given the
+	// version last read it waits for the value to change first, up to
+	// a wait time of the store, so it may return the same version.
+	get(ctx context.Context, version uint64) ([]byte, uint64, error)
+}
+
+const (
+	// remoteTimeout bounds reads of a remote config that don't wait for
+	// changes
+	remoteTimeout = 10 * time.Second
+	// remoteRetry is the delay after a failed read while watching, doubled
+	// for each failure in a row up to remoteMaxRetry
+	remoteRetry    = 5 * time.Second
+	remoteMaxRetry = 5 * time.Minute
+)
+
+// remoteSource reads the configuration from a key-value store and watches
+// the key for changes. While the store is unreachable the running
+// configuration stays in effect.
+type remoteSource struct {
+	location string // without credentials, for logs
+	format   string
+	store    kvStore
+
+	mu      sync.Mutex
+	data    []byte
+	version uint64
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+func (s *remoteSource) Load() (*Config, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), remoteTimeout)
+	defer cancel()
+
+	data, version, err := s.store.get(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config from %s: %w", s.location, err)
+	}
+	cfg, err := ParseFormat(data, s.format)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.data = data
+	s.version = version
+	s.mu.Unlock()
+	return cfg, nil
+}
+
+func (s *remoteSource) String() string {
+	return s.location
+}
+
+func (s *remoteSource) Watch(onChange func(*Config) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancel != nil {
+		return fmt.Errorf("already watching %s", s.location)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.watch(ctx, onChange)
+
+	log.Info().Str("source", s.location).Msg("config watcher started")
+	return nil
+}
+
+func (s *remoteSource) Stop() error {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.mu.Unlock()
+
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+
+	log.Info().Msg("config watcher stopped")
+	return nil
+}
+
+// watch waits for changes of the key and applies them until ctx is done
+func (s *remoteSource) watch(ctx context.Context, onChange func(*Config) error) {
+	defer close(s.done)
+
+	retry := remoteRetry
+	for {
+		s.mu.Lock()
+		last, version := s.data, s.version
+		s.mu.Unlock()
+
+		data, next, err := s.store.get(ctx, version)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Warn().Err(err).Str("source", s.location).Dur("retry_in", retry).Msg("failed to watch config, retrying")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			retry = min(2*retry, remoteMaxRetry)
+			continue
+		}
+		retry = remoteRetry
+
+		s.mu.Lock()
+		s.data = data
+		s.version = next
+		s.mu.Unlock()
+
+		// Waits time out with the same version, and stores may report
+		// writes that didn't change the document
+		if bytes.Equal(data, last) {
+			continue
+		}
+
+		log.Info().Str("source", s.location).Uint64("version", next).Msg("config changed, reloading")
+		cfg, err := ParseFormat(data, s.format)
+		if err != nil {
+			log.Error().Err(err).Msg("failed to reload config, keeping old config")
+			continue
+		}
+		if err := onChange(cfg); err != nil {
+			log.Error().Err(err).Msg("failed to apply new config, keeping old config")
+			continue
+		}
+		log.Info().Msg("config reloaded successfully")
+	}
+}
@@ -0,0 +1,51 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTransportDefaultsKeepExplicitZero(t *testing.T) {
+	const nodes = `
+server:
+  addr: ":8080"
+services:
+  - name: web
+    forwarder:
+      nodes:
+        - name: app
+          addr: 127.0.0.1:8081
+          filter: {host: app.test}
+`
+	tests := []struct {
+		name           string
+		doc            string
+		maxIdle        int
+		maxIdlePerHost int
+		tlsHandshake   time.Duration
+	}{
+		{"defaults", nodes, 100, 2, 10 * time.Second},
+		{"explicit zero", nodes + `
+transport:
+  max_idle_conns: 0
+  max_idle_conns_per_host: 0
+  tls_handshake_timeout: 0s
+`, 0, 0, 0},
+		{"per host default capped", nodes + `
+transport:
+  max_conns_per_host: 1
+`, 100, 1, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		cfg, err := Parse([]byte(tt.doc))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		tr := cfg.Transport
+		if *tr.MaxIdleConns != tt.maxIdle || *tr.MaxIdleConnsPerHost != tt.maxIdlePerHost || *tr.TLSHandshakeTimeout != tt.tlsHandshake {
+			t.Errorf("%s: max_idle_conns %d, max_idle_conns_per_host %d, tls_handshake_timeout %s, want %d, %d, %s",
+				tt.name, *tr.MaxIdleConns, *tr.MaxIdleConnsPerHost, *tr.TLSHandshakeTimeout,
+				tt.maxIdle, tt.maxIdlePerHost, tt.tlsHandshake)
+		}
+	}
+}
@@ -1,20 +1,41 @@
 package config
 
 import (
+	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/rs/zerolog/log"
 )
 
-// Watcher monitors configuration file changes
+// watchDebounce is how long file events must settle before the config is
+// reloaded, so a save that writes, renames and chmods reloads once
+const watchDebounce = 200 * time.Millisecond
+
+// k8sDataLink is the link Kubernetes swaps to update a mounted ConfigMap
+// or Secret at once
+const k8sDataLink = "..data"
+
+// Watcher monitors configuration file changes. It watches the directory
+// of the file rather than the file itself, so editors and ConfigMap
+// updates replacing the file by a rename don't end the watch.
 type Watcher struct {
 	configPath string
+	format     string // config format, by the file extension when empty
 	onChange   func(*Config) error
 	watcher    *fsnotify.Watcher
 	mu         sync.Mutex
 	stopped    bool
+
+	dir      string // directory watched, the config directory or the file's
+	isDir    bool
+	realPath string // file the config path resolves to through symlinks
+	data     []byte // contents of the config file last applied
+	lost     bool   // the watched directory went away, watch it again
 }
 
 // NewWatcher creates a new configuration file watcher
@@ -25,7 +46,7 @@ func NewWatcher(configPath string, onChange func(*Config) error) (*Watcher, erro
 	}
 
 	w := &Watcher{
-		configPath: configPath,
+		configPath: filepath.Clean(configPath),
 		onChange:   onChange,
 		watcher:    watcher,
 	}
@@ -33,9 +54,32 @@ func NewWatcher(configPath string, onChange func(*Config) error) (*Watcher, erro
 	return w, nil
 }
 
+// SetFormat sets the format the file is read in, instead of the one its
+// extension names
+func (w *Watcher) SetFormat(format string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.format = format
+}
+
 // Start begins watching the configuration file
 func (w *Watcher) Start() error {
-	if err := w.watcher.Add(w.configPath); err != nil {
+	info, err := os.Stat(w.configPath)
+	if err != nil {
+		return fmt.Errorf("failed to watch config file: %w", err)
+	}
+
+	w.mu.Lock()
+	w.isDir = info.IsDir()
+	w.dir = w.configPath
+	if !w.isDir {
+		w.dir = filepath.Dir(w.configPath)
+		w.realPath, _ = filepath.EvalSymlinks(w.configPath)
+		w.data, _ = os.ReadFile(w.configPath)
+	}
+	w.mu.Unlock()
+
+	if err := w.watcher.Add(w.dir); err != nil {
 		return fmt.Errorf("failed to watch config file: %w", err)
 	}
 
@@ -63,20 +107,28 @@ func (w *Watcher) Stop() error {
 	return nil
 }
 
-// watch monitors file system events
+// watch monitors file system events, reloading once they settle
 func (w *Watcher) watch() {
+	var settled <-chan time.Time
+	var last fsnotify.Event
+
 	for {
 		select {
 		case event, ok := <-w.watcher.Events:
 			if !ok {
 				return
 			}
-
-			// Handle file write or create events
-			if event.Op&fsnotify.Write == fsnotify.Write || event.Op&fsnotify.Create == fsnotify.Create {
-				log.Info().Str("file", event.Name).Str("op", event.Op.String()).Msg("config file changed, reloading")
-				w.reload()
+			if !w.relevant(event) {
+				continue
 			}
+			log.Debug().Str("file", event.Name).Str("op", event.Op.String()).Msg("config file event")
+			last = event
+			settled = time.After(watchDebounce)
+
+		case <-settled:
+			settled = nil
+			log.Info().Str("file", last.Name).Str("op", last.Op.String()).Msg("config file changed, reloading")
+			w.reload()
 
 		case err, ok := <-w.watcher.Errors:
 			if !ok {
@@ -87,7 +139,36 @@ func (w *Watcher) watch() {
 	}
 }
 
-// reload loads and applies the new configuration
+// relevant reports whether event may have changed the configuration
+func (w *Watcher) relevant(event fsnotify.Event) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	name := filepath.Clean(event.Name)
+	if name == w.dir {
+		if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+			w.lost = true
+		}
+		return w.lost
+	}
+	if filepath.Base(name) == k8sDataLink {
+		return true
+	}
+	if w.isDir {
+		// Fragments changing, appearing or going away, other files don't
+		return isFragment(name)
+	}
+	if name == w.configPath {
+		return true
+	}
+	// The config path is a symlink whose target was replaced
+	realPath, err := filepath.EvalSymlinks(w.configPath)
+	return err == nil && realPath != w.realPath
+}
+
+// reload loads and applies the new configuration. A config file whose
+// contents didn't change since it was last applied, say after a chmod,
+// isn't applied again.
 func (w *Watcher) reload() {
 	w.mu.Lock()
 	defer w.mu.Unlock()
@@ -96,8 +177,37 @@ func (w *Watcher) reload() {
 		return
 	}
 
+	if w.lost {
+		if err := w.watcher.Add(w.dir); err != nil {
+			log.Warn().Err(err).Str("path", w.dir).Msg("config directory is gone, no longer watching it")
+		} else {
+			w.lost = false
+		}
+	}
+
 	// Load new config
-	cfg, err := LoadConfig(w.configPath)
+	var cfg *Config
+	var data []byte
+	var err error
+	if w.isDir {
+		cfg, err = LoadConfigFormat(w.configPath, w.format)
+	} else {
+		w.realPath, _ = filepath.EvalSymlinks(w.configPath)
+		data, err = os.ReadFile(w.configPath)
+		if err == nil && w.data != nil && bytes.Equal(data, w.data) {
+			log.Debug().Str("path", w.configPath).Msg("config file unchanged, not reloading")
+			return
+		}
+		if err != nil {
+			err = fmt.Errorf("failed to read config file: %w", err)
+		} else {
+			format := w.format
+			if format == "" {
+				format = DetectFormat(w.configPath)
+			}
+			cfg, err = ParseFormat(data, format)
+		}
+	}
 	if err != nil {
 		log.Error().Err(err).Msg("failed to reload config, keeping old config")
 		return
@@ -108,6 +218,9 @@ func (w *Watcher) reload() {
 		log.Error().Err(err).Msg("failed to apply new config, keeping old config")
 		return
 	}
+	if data != nil {
+		w.data = data
+	}
 
 	log.Info().Msg("config reloaded successfully")
 }
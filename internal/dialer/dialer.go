@@ -0,0 +1,361 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// IP family preferences
+const (
+	FamilyAuto       = "auto"        // resolver order decides which family goes first
+	FamilyPreferIPv4 = "prefer_ipv4" // race with IPv4 first, IPv6 as fallback
+	FamilyPreferIPv6 = "prefer_ipv6" // race with IPv6 first, IPv4 as fallback
+	FamilyIPv4       = "ipv4"        // IPv4 only
+	FamilyIPv6       = "ipv6"        // IPv6 only
+)
+
+// Defaults used when a field is left zero
+const (
+	DefaultTimeout       = 30 * time.Second
+	DefaultFallbackDelay = 300 * time.Millisecond
+)
+
+// Dialer opens TCP connections using a happy-eyeballs strategy: addresses
+// of the preferred family are tried first and, if they haven't connected
+// within FallbackDelay, the other family is raced in parallel. This keeps
+// dual-stack hosts with broken IPv6 (or IPv4) from hanging until timeout.
+type Dialer struct {
+	Family        string
+	FallbackDelay time.Duration
+	Timeout       time.Duration
+	Resolver      *net.Resolver
+
+	// SourceIP or Interface pin outbound connections to a local address.
+	// Remote addresses of the other IP family are skipped.
+	SourceIP  net.IP
+	Interface string
+
+	// Socket options, zero values keep the system defaults
+	DSCP        int           // DiffServ code point marked on outgoing packets
+	NoDelay     *bool         // TCP_NODELAY, Go enables it by default
+	KeepAlive   time.Duration // keepalive interval, negative disables
+	UserTimeout time.Duration // TCP_USER_TIMEOUT, ignored outside Linux
+}
+
+// Default is a dialer with default settings
+var Default = &Dialer{}
+
+// New creates a dialer from a node's dial config, nil uses the defaults
+func New(cfg *config.Dial) *Dialer {
+	if cfg == nil {
+		return Default
+	}
+	return &Dialer{
+		Family:        cfg.IPFamily,
+		FallbackDelay: cfg.FallbackDelay,
+		Timeout:       cfg.Timeout,
+		SourceIP:      net.ParseIP(cfg.SourceIP),
+		Interface:     cfg.Interface,
+		DSCP:          cfg.DSCP,
+		NoDelay:       cfg.NoDelay,
+		KeepAlive:     cfg.KeepAlive,
+		UserTimeout:   cfg.UserTimeout,
+	}
+}
+
+// Key identifies the dialer's settings, dialers with equal keys behave the same
+func (d *Dialer) Key() string {
+	noDelay := "default"
+	if d.NoDelay != nil {
+		noDelay = fmt.Sprint(*d.NoDelay)
+	}
+	return fmt.Sprintf("%s|%s|%s|%s|%s|%d|%s|%s|%s", d.Family, d.FallbackDelay, d.Timeout,
+		d.SourceIP, d.Interface, d.DSCP, noDelay, d.KeepAlive, d.UserTimeout)
+}
+
+// DialContext connects to addr on the named network. Errors are reported as
+// *net.OpError like those of net.Dialer.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		var opErr *net.OpError
+		if !errors.As(err, &opErr) {
+			err = &net.OpError{Op: "dial", Net: network, Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial resolves addr and races connections to its addresses
+func (d *Dialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// IP literals need no resolution or racing
+	if ip := net.ParseIP(host); ip != nil {
+		if !d.allows(ip) {
+			return nil, fmt.Errorf("address %s not allowed by ip_family %s", host, d.Family)
+		}
+		return d.dialOne(ctx, network, net.JoinHostPort(host, port))
+	}
+
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	primary, fallback := d.partition(addrs)
+	if len(primary) == 0 {
+		return nil, fmt.Errorf("no addresses for %s match ip_family %s", host, d.Family)
+	}
+
+	return d.race(ctx, network, port, primary, fallback)
+}
+
+// Dial connects to addr on the named network
+func (d *Dialer) Dial(network, addr string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, addr)
+}
+
+// allows reports whether ip is permitted by the family setting
+func (d *Dialer) allows(ip net.IP) bool {
+	switch d.Family {
+	case FamilyIPv4:
+		return ip.To4() != nil
+	case FamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// partition splits resolved addresses into the primary and fallback lists
+func (d *Dialer) partition(addrs []net.IPAddr) (primary, fallback []net.IP) {
+	var v4, v6 []net.IP
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			v4 = append(v4, a.IP)
+		} else {
+			v6 = append(v6, a.IP)
+		}
+	}
+
+	switch d.Family {
+	case FamilyIPv4:
+		return v4, nil
+	case FamilyIPv6:
+		return v6, nil
+	case FamilyPreferIPv4:
+		if len(v4) == 0 {
+			return v6, nil
+		}
+		return v4, v6
+	case FamilyPreferIPv6:
+		if len(v6) == 0 {
+			return v4, nil
+		}
+		return v6, v4
+	default:
+		// Follow the resolver's ordering for the first family
+		if len(addrs) > 0 && addrs[0].IP.To4() == nil {
+			if len(v6) == 0 {
+				return v4, nil
+			}
+			return v6, v4
+		}
+		if len(v4) == 0 {
+			return v6, nil
+		}
+		return v4, v6
+	}
+}
+
+// race dials the primary addresses, starting the fallback addresses after
+// the fallback delay or as soon as the primaries have all failed
+func (d *Dialer) race(ctx context.Context, network, port string, primary, fallback []net.IP) (net.Conn, error) {
+	if len(fallback) == 0 {
+		return d.dialSerial(ctx, network, port, primary)
+	}
+
+	delay := d.FallbackDelay
+	if delay == 0 {
+		delay = DefaultFallbackDelay
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	start := func(ips []net.IP, isPrimary bool) {
+		conn, err := d.dialSerial(raceCtx, network, port, ips)
+		results <- result{conn: conn, err: err, primary: isPrimary}
+	}
+
+	go start(primary, true)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var firstErr error
+	pending := 1
+	fallbackStarted := false
+
+	for pending > 0 || !fallbackStarted {
+		select {
+		case <-timer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go start(fallback, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close a connection that might still be established by the loser
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}
+				}(pending)
+				return res.conn, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+			if !fallbackStarted {
+				timer.Stop()
+				fallbackStarted = true
+				pending++
+				go start(fallback, false)
+			}
+		case <-ctx.Done():
+			go func(n int) {
+				for i := 0; i < n; i++ {
+					if late := <-results; late.conn != nil {
+						late.conn.Close()
+					}
+				}
+			}(pending)
+			return nil, ctx.Err()
+		}
+	}
+
+	return nil, firstErr
+}
+
+// dialSerial tries each address in turn until one connects
+func (d *Dialer) dialSerial(ctx context.Context, network, port string, ips []net.IP) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		conn, err := d.dialOne(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = errors.New("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// dialOne connects to a single resolved address
+func (d *Dialer) dialOne(ctx context.Context, network, addr string) (net.Conn, error) {
+	nd := &net.Dialer{
+		// Racing is handled here, so disable the standard library's own
+		FallbackDelay: -1,
+		KeepAlive:     d.KeepAlive,
+	}
+	if d.DSCP != 0 || d.UserTimeout != 0 {
+		nd.Control = d.control
+	}
+
+	if d.SourceIP != nil || d.Interface != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		local, err := d.localAddr(net.ParseIP(host))
+		if err != nil {
+			return nil, err
+		}
+		nd.LocalAddr = local
+	}
+
+	conn, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && d.NoDelay != nil {
+		if err := tcp.SetNoDelay(*d.NoDelay); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// localAddr returns the local address to bind when connecting to remote
+func (d *Dialer) localAddr(remote net.IP) (*net.TCPAddr, error) {
+	wantV4 := remote.To4() != nil
+
+	if d.SourceIP != nil {
+		if (d.SourceIP.To4() != nil) != wantV4 {
+			return nil, fmt.Errorf("source IP %s cannot reach %s", d.SourceIP, remote)
+		}
+		return &net.TCPAddr{IP: d.SourceIP}, nil
+	}
+
+	iface, err := net.InterfaceByName(d.Interface)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up interface %s: %w", d.Interface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list addresses of %s: %w", d.Interface, err)
+	}
+
+	// Prefer a global address, link-local ones need a zone to be usable
+	var fallback net.IP
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || (ipNet.IP.To4() != nil) != wantV4 {
+			continue
+		}
+		if !ipNet.IP.IsLinkLocalUnicast() {
+			return &net.TCPAddr{IP: ipNet.IP}, nil
+		}
+		if fallback == nil {
+			fallback = ipNet.IP
+		}
+	}
+	if fallback != nil {
+		return &net.TCPAddr{IP: fallback, Zone: d.Interface}, nil
+	}
+	return nil, fmt.Errorf("interface %s has no address to reach %s", d.Interface, remote)
+}
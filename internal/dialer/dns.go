@@ -0,0 +1,201 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// DNS failure classes
+const (
+	dnsNXDomain  = "nxdomain"  // the host doesn't exist
+	dnsTimeout   = "timeout"   // no answer in time
+	dnsTemporary = "temporary" // SERVFAIL, refused or an unreachable server
+	dnsOther     = "other"
+)
+
+// maxNXDomains caps the hosts remembered as nonexistent, which clients of
+// CONNECT tunnels choose freely
+const maxNXDomains = 4096
+
+// otherHost labels failures of hosts that aren't in the config
+const otherHost = "other"
+
+var (
+	dnsFailures = metrics.NewCounterVec(
+		"forwarder_dns_failures_total",
+		"Failed lookups of upstream hosts, by configured host or other and by class nxdomain, timeout, temporary or other",
+		"host", "class",
+	)
+	dnsNXDomainCached = metrics.NewCounterVec(
+		"forwarder_dns_nxdomain_cached_total",
+		"Dials failed from the cache of hosts that don't exist, without a lookup",
+		"host",
+	)
+)
+
+// nxdomains remembers hosts whose lookup found they don't exist
+var nxdomains = nxdomainCache{hosts: make(map[nxdomainKey]nxdomain)}
+
+// metricHosts are the hosts failures are counted under by name
+var metricHosts atomic.Pointer[map[string]bool]
+
+// SetMetricHosts sets the hosts DNS failures are counted under by name,
+// those of the backends, proxies and dialers in the config. Other hosts,
+// like the targets CONNECT clients choose, are counted as "other" so they
+// can't grow the series without bound.
+func SetMetricHosts(hosts []string) {
+	known := make(map[string]bool, len(hosts))
+	for _, h := range hosts {
+		known[h] = true
+	}
+	metricHosts.Store(&known)
+}
+
+// metricHost returns the label host is counted under
+func metricHost(host string) string {
+	if known := metricHosts.Load(); known != nil && (*known)[host] {
+		return host
+	}
+	return otherHost
+}
+
+// nxdomainKey identifies a cached failure. Resolvers may disagree about a
+// host, so each keeps its own answers.
+type nxdomainKey struct {
+	resolver *net.Resolver
+	host     string
+}
+
+// nxdomain is a cached lookup failure
+type nxdomain struct {
+	err     *net.DNSError
+	expires time.Time
+}
+
+// nxdomainCache answers lookups of hosts known not to exist for a while,
+// so a mistyped backend doesn't send a query per request
+type nxdomainCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	hosts map[nxdomainKey]nxdomain
+}
+
+// SetNXDomainTTL sets how long a host found not to exist fails without a
+// new lookup. Zero or less turns the cache off.
+func SetNXDomainTTL(ttl time.Duration) {
+	nxdomains.mu.Lock()
+	defer nxdomains.mu.Unlock()
+
+	nxdomains.ttl = max(ttl, 0)
+	if nxdomains.ttl == 0 {
+		nxdomains.hosts = make(map[nxdomainKey]nxdomain)
+	}
+}
+
+// get returns the cached failure of host, if it is still fresh
+func (c *nxdomainCache) get(key nxdomainKey) (*net.DNSError, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.hosts[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.hosts, key)
+		return nil, false
+	}
+	return e.err, true
+}
+
+// add remembers that a host doesn't exist. Expired entries make room when
+// the cache is full, without room the failure isn't cached.
+func (c *nxdomainCache) add(key nxdomainKey, err *net.DNSError) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ttl == 0 {
+		return
+	}
+	now := time.Now()
+	if len(c.hosts) >= maxNXDomains {
+		for k, e := range c.hosts {
+			if now.After(e.expires) {
+				delete(c.hosts, k)
+			}
+		}
+		if len(c.hosts) >= maxNXDomains {
+			return
+		}
+	}
+	c.hosts[key] = nxdomain{err: err, expires: now.Add(c.ttl)}
+}
+
+// lookup resolves host with the dialer's resolver. Failures are logged with
+// the resolver, the query time and their class, and counted per configured
+// host; hosts that don't exist are cached per resolver.
+func (d *Dialer) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	resolver, name := d.Resolver, "custom"
+	if resolver == nil {
+		resolver, name = net.DefaultResolver, "system"
+	}
+
+	key := nxdomainKey{resolver: resolver, host: host}
+	if err, ok := nxdomains.get(key); ok {
+		dnsNXDomainCached.With(metricHost(host)).Inc()
+		return nil, err
+	}
+
+	start := time.Now()
+	addrs, err := resolver.LookupIPAddr(ctx, host)
+	if err == nil {
+		return addrs, nil
+	}
+
+	class := dnsClass(err)
+	dnsFailures.With(metricHost(host), class).Inc()
+	event := log.Warn().
+		Err(err).
+		Str("host", host).
+		Str("resolver", name).
+		Dur("query_time", time.Since(start)).
+		Str("class", class)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		if dnsErr.Server != "" {
+			event = event.Str("server", dnsErr.Server)
+		}
+		if class == dnsNXDomain {
+			nxdomains.add(key, dnsErr)
+		}
+	}
+	event.Msg("upstream DNS lookup failed")
+	return nil, err
+}
+
+// dnsClass returns the class of a failed lookup
+func dnsClass(err error) string {
+	var dnsErr *net.DNSError
+	switch {
+	case !errors.As(err, &dnsErr):
+		if errors.Is(err, context.DeadlineExceeded) {
+			return dnsTimeout
+		}
+		return dnsOther
+	case dnsErr.IsNotFound:
+		return dnsNXDomain
+	case dnsErr.IsTimeout:
+		return dnsTimeout
+	case dnsErr.IsTemporary:
+		return dnsTemporary
+	default:
+		return dnsOther
+	}
+}
@@ -0,0 +1,80 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// ContextDialer opens connections like net.Dialer. Nodes that name a dialer
+// open every backend connection through it, so transports such as VPN
+// tunnels or overlay networks plug in without changes to the forwarder.
+// Dialers holding connections of their own may implement io.Closer, they
+// are closed once a reload replaces them.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// Factory creates a dialer of a registered type from its config entry
+type Factory func(name string, cfg config.Dialer) (ContextDialer, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// RegisterType makes a dialer type available to the dialers section of the
+// config. Embedders register their types before the config is loaded; the
+// built-in types can't be replaced.
+func RegisterType(typ string, factory Factory) {
+	switch typ {
+	case config.DialerDirect, config.DialerProxy, config.DialerSOCKS5, config.DialerSSH:
+		panic(fmt.Sprintf("dialer: type %s is built in", typ))
+	}
+
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+	factories[typ] = factory
+}
+
+// Open creates the dialer of a config entry. Proxy dialers need the
+// server's proxy pool and are created there.
+func Open(name string, cfg config.Dialer) (ContextDialer, error) {
+	switch cfg.Type {
+	case config.DialerDirect:
+		return New(cfg.Dial), nil
+	case config.DialerSOCKS5:
+		return newSOCKS5(cfg)
+	case config.DialerSSH:
+		return newSSH(cfg)
+	}
+
+	factoriesMu.RLock()
+	factory, ok := factories[cfg.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown dialer type %s", cfg.Type)
+	}
+	return factory(name, cfg)
+}
+
+// Close closes d if it holds connections of its own
+func Close(d ContextDialer) {
+	if c, ok := d.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+// KeyOf identifies the settings of d, so clients and pooled connections
+// can be shared between dialers with equal keys. Dialers without a Key
+// method are told apart by identity.
+func KeyOf(d ContextDialer) string {
+	if k, ok := d.(interface{ Key() string }); ok {
+		return k.Key()
+	}
+	return fmt.Sprintf("%T@%p", d, d)
+}
@@ -0,0 +1,10 @@
+//go:build unix && !linux
+
+package dialer
+
+import "time"
+
+// setUserTimeout is a no-op, TCP_USER_TIMEOUT is Linux only
+func setUserTimeout(fd int, timeout time.Duration) error {
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package dialer
+
+import "syscall"
+
+// control is a no-op, socket options are only supported on Unix systems
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	return nil
+}
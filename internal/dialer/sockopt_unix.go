@@ -0,0 +1,38 @@
+//go:build unix
+
+package dialer
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// control applies socket options before the connection is established
+func (d *Dialer) control(network, address string, c syscall.RawConn) error {
+	var opErr error
+	err := c.Control(func(fd uintptr) {
+		if d.DSCP != 0 {
+			tos := d.DSCP << 2
+			if network == "tcp6" {
+				opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IPV6, unix.IPV6_TCLASS, tos)
+			} else {
+				opErr = unix.SetsockoptInt(int(fd), unix.IPPROTO_IP, unix.IP_TOS, tos)
+			}
+			if opErr != nil {
+				opErr = fmt.Errorf("failed to set DSCP: %w", opErr)
+				return
+			}
+		}
+		if d.UserTimeout != 0 {
+			if opErr = setUserTimeout(int(fd), d.UserTimeout); opErr != nil {
+				opErr = fmt.Errorf("failed to set TCP user timeout: %w", opErr)
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return opErr
+}
@@ -0,0 +1,30 @@
+package dialer
+
+import (
+	"fmt"
+	"net/url"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"golang.org/x/net/proxy"
+)
+
+// newSOCKS5 creates a dialer connecting through the SOCKS5 proxy of
+// cfg.URL. Target host names are passed to the proxy unresolved.
+func newSOCKS5(cfg config.Dialer) (ContextDialer, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid socks5 url: %w", err)
+	}
+
+	var auth *proxy.Auth
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = &proxy.Auth{User: u.User.Username(), Password: password}
+	}
+
+	d, err := proxy.SOCKS5("tcp", u.Host, auth, New(cfg.Dial))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socks5 dialer: %w", err)
+	}
+	return d.(ContextDialer), nil
+}
@@ -0,0 +1,137 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshDialer opens connections as direct-tcpip channels of one SSH
+// connection, which is opened on the first dial and again after it drops
+type sshDialer struct {
+	addr   string
+	config *ssh.ClientConfig
+	dialer *Dialer
+
+	mu     sync.Mutex
+	client *ssh.Client
+	closed bool
+}
+
+// newSSH creates a dialer tunneling through the SSH server of cfg.URL,
+// authenticating with the key file or the password in the url
+func newSSH(cfg config.Dialer) (ContextDialer, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ssh url: %w", err)
+	}
+
+	hostKeys, err := knownhosts.New(cfg.KnownHosts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read known_hosts: %w", err)
+	}
+
+	var methods []ssh.AuthMethod
+	if cfg.KeyFile != "" {
+		pem, err := os.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key_file: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse key_file: %w", err)
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok {
+		methods = append(methods, ssh.Password(password))
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+
+	return &sshDialer{
+		addr:   addr,
+		dialer: New(cfg.Dial),
+		config: &ssh.ClientConfig{
+			User:            u.User.Username(),
+			Auth:            methods,
+			HostKeyCallback: hostKeys,
+		},
+	}, nil
+}
+
+// DialContext opens a channel to addr. Only TCP targets can be reached.
+func (s *sshDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	client, err := s.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return client.DialContext(ctx, network, addr)
+}
+
+// connect returns the SSH connection, opening it if there is none
+func (s *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, errors.New("ssh dialer closed")
+	}
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	conn, err := s.dialer.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ssh server: %w", err)
+	}
+
+	// The handshake doesn't take a context, bound it by a deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed ssh handshake: %w", err)
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	s.client = client
+
+	// Forget the connection once it drops, the next dial opens another
+	go func() {
+		client.Wait()
+		s.mu.Lock()
+		if s.client == client {
+			s.client = nil
+		}
+		s.mu.Unlock()
+	}()
+	return client, nil
+}
+
+// Close closes the SSH connection, with the channels open over it
+func (s *sshDialer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	if s.client == nil {
+		return nil
+	}
+	return s.client.Close()
+}
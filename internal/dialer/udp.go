@@ -0,0 +1,63 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// ListenUDP opens a UDP socket for talking to addr, as QUIC does. addr is
+// resolved to the first address of the preferred family; there is no
+// racing, a QUIC handshake that fails falls back to TCP instead. The socket
+// is bound to the source IP or interface like TCP connections are.
+func (d *Dialer) ListenUDP(ctx context.Context, addr string) (*net.UDPConn, *net.UDPAddr, error) {
+	timeout := d.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	portNum, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		addrs, err := d.lookup(ctx, host)
+		if err != nil {
+			return nil, nil, err
+		}
+		primary, _ := d.partition(addrs)
+		if len(primary) == 0 {
+			return nil, nil, fmt.Errorf("no addresses for %s match ip_family %s", host, d.Family)
+		}
+		ip = primary[0]
+	} else if !d.allows(ip) {
+		return nil, nil, fmt.Errorf("address %s not allowed by ip_family %s", host, d.Family)
+	}
+
+	local := &net.UDPAddr{}
+	if d.SourceIP != nil || d.Interface != "" {
+		tcpAddr, err := d.localAddr(ip)
+		if err != nil {
+			return nil, nil, err
+		}
+		local.IP = tcpAddr.IP
+	}
+
+	network := "udp4"
+	if ip.To4() == nil {
+		network = "udp6"
+	}
+	conn, err := net.ListenUDP(network, local)
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, &net.UDPAddr{IP: ip, Port: portNum}, nil
+}
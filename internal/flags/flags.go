@@ -0,0 +1,221 @@
+package flags
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// maxDocument caps the size of a fetched flag document
+const maxDocument = 1 << 20
+
+var flagFetches = metrics.NewCounterVec(
+	"forwarder_flag_fetches_total",
+	"Fetches of the feature flag document by result (updated, unchanged or error)",
+	"result",
+)
+
+// EvaluationContext describes what a flag is evaluated for, such as the
+// node and the request host. Providers may use it for targeting.
+type EvaluationContext map[string]string
+
+// Provider evaluates feature flags. It follows the shape of OpenFeature
+// providers, so another flag system can be plugged in with a thin
+// adapter. Evaluations run on every request and must not block.
+type Provider interface {
+	BooleanEvaluation(ctx context.Context, flag string, defaultValue bool, evalCtx EvaluationContext) bool
+	IntEvaluation(ctx context.Context, flag string, defaultValue int64, evalCtx EvaluationContext) int64
+	Shutdown()
+}
+
+// Noop returns a provider that answers every flag with its default
+func Noop() Provider {
+	return noop{}
+}
+
+type noop struct{}
+
+func (noop) BooleanEvaluation(_ context.Context, _ string, def bool, _ EvaluationContext) bool {
+	return def
+}
+
+func (noop) IntEvaluation(_ context.Context, _ string, def int64, _ EvaluationContext) int64 {
+	return def
+}
+
+func (noop) Shutdown() {}
+
+// Poller provides flags from a JSON object of flag names and values, read
+// from a file or an http(s) URL at an interval. The last good document
+// stays in effect while fetches fail. The evaluation context is ignored.
+type Poller struct {
+	source   string
+	interval time.Duration
+	client   *http.Client
+
+	mu      sync.RWMutex
+	values  map[string]any
+	etag    string
+	updated time.Time
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewPoller fetches the flag document from source once, then refreshes it
+// every interval in the background
+func NewPoller(source string, interval, timeout time.Duration) *Poller {
+	p := &Poller{
+		source:   source,
+		interval: interval,
+		client:   &http.Client{Timeout: timeout},
+		values:   make(map[string]any),
+		done:     make(chan struct{}),
+	}
+	p.refresh()
+	go p.run()
+	return p
+}
+
+// BooleanEvaluation returns the flag's boolean value, or def when the flag
+// is unknown or not a boolean
+func (p *Poller) BooleanEvaluation(_ context.Context, flag string, def bool, _ EvaluationContext) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if v, ok := p.values[flag].(bool); ok {
+		return v
+	}
+	return def
+}
+
+// IntEvaluation returns the flag's integer value, or def when the flag is
+// unknown or not a whole number
+func (p *Poller) IntEvaluation(_ context.Context, flag string, def int64, _ EvaluationContext) int64 {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if v, ok := p.values[flag].(float64); ok && v == float64(int64(v)) {
+		return int64(v)
+	}
+	return def
+}
+
+// Shutdown stops refreshing
+func (p *Poller) Shutdown() {
+	p.once.Do(func() { close(p.done) })
+}
+
+// Snapshot returns the current flag values and when they were last updated
+func (p *Poller) Snapshot() (map[string]any, time.Time) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	values := make(map[string]any, len(p.values))
+	for k, v := range p.values {
+		values[k] = v
+	}
+	return values, p.updated
+}
+
+// Source returns where flags are read from
+func (p *Poller) Source() string {
+	return p.source
+}
+
+func (p *Poller) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+			p.refresh()
+		}
+	}
+}
+
+// errNotModified reports a document unchanged since the last fetch
+var errNotModified = errors.New("not modified")
+
+// refresh fetches the document and replaces the flag values
+func (p *Poller) refresh() {
+	data, etag, err := p.fetch()
+	if errors.Is(err, errNotModified) {
+		flagFetches.With("unchanged").Inc()
+		return
+	}
+	if err == nil {
+		var values map[string]any
+		if err = json.Unmarshal(data, &values); err != nil {
+			err = fmt.Errorf("failed to parse flags: %w", err)
+		} else {
+			p.mu.Lock()
+			p.values = values
+			p.etag = etag
+			p.updated = time.Now()
+			p.mu.Unlock()
+			flagFetches.With("updated").Inc()
+			log.Debug().Str("source", p.source).Int("flags", len(values)).Msg("feature flags updated")
+			return
+		}
+	}
+
+	flagFetches.With("error").Inc()
+	log.Warn().Err(err).Str("source", p.source).Msg("failed to refresh feature flags, keeping previous values")
+}
+
+// fetch reads the document from a file or URL. URLs are fetched
+// conditionally with the ETag of the last document.
+func (p *Poller) fetch() ([]byte, string, error) {
+	if !strings.HasPrefix(p.source, "http://") && !strings.HasPrefix(p.source, "https://") {
+		data, err := os.ReadFile(p.source)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read flags: %w", err)
+		}
+		return data, "", nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, p.source, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to create flags request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	p.mu.RLock()
+	if p.etag != "" {
+		req.Header.Set("If-None-Match", p.etag)
+	}
+	p.mu.RUnlock()
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch flags: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, "", errNotModified
+	default:
+		return nil, "", fmt.Errorf("failed to fetch flags: unexpected status %s", resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDocument))
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch flags: %w", err)
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
@@ -0,0 +1,126 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// SetAuthHeaders attaches the node's backend credentials to h, replacing
+// any the client sent
+func SetAuthHeaders(h http.Header, auth *config.Auth) {
+	if auth == nil {
+		return
+	}
+
+	switch {
+	case auth.Username != "":
+		credentials := base64.StdEncoding.EncodeToString([]byte(auth.Username + ":" + auth.Password))
+		h.Set("Authorization", "Basic "+credentials)
+	case auth.Token != "":
+		h.Set("Authorization", "Bearer "+auth.Token)
+	case auth.Header != "":
+		h.Set(auth.Header, auth.Value)
+	}
+}
+
+// authKind names the credentials SetAuthHeaders adds, without their value
+func authKind(auth *config.Auth) string {
+	switch {
+	case auth == nil:
+		return ""
+	case auth.Username != "":
+		return "basic"
+	case auth.Token != "":
+		return "bearer"
+	case auth.Header != "":
+		return "header " + auth.Header
+	}
+	return ""
+}
+
+// NodeTLSConfig returns the TLS config for connections to the node's
+// backends, presenting its client certificate if one is configured
+func (f *Forwarder) NodeTLSConfig(node *config.Node) *tls.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.nodeTLSConfig(node.Auth)
+}
+
+// nodeTLSConfig builds a TLS config with the client certificate from auth.
+// f.mu must be held.
+func (f *Forwarder) nodeTLSConfig(auth *config.Auth) *tls.Config {
+	cfg := f.tls.Clone()
+	if auth == nil || auth.ClientCert == "" {
+		return cfg
+	}
+
+	key := auth.ClientCert + "|" + auth.ClientKey
+	cert, ok := f.certs[key]
+	if !ok {
+		cert = &clientCert{certFile: auth.ClientCert, keyFile: auth.ClientKey}
+		f.certs[key] = cert
+	}
+	cfg.GetClientCertificate = cert.get
+	return cfg
+}
+
+// clientCert loads a client certificate and reloads it when its files
+// change, so certificates rotated on disk are picked up without a reload
+type clientCert struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// get returns the current certificate, for tls.Config.GetClientCertificate
+func (c *clientCert) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := c.lastModified()
+	if err != nil && c.cert == nil {
+		return nil, err
+	}
+	if c.cert != nil && (err != nil || !modTime.After(c.modTime)) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		if c.cert != nil {
+			log.Warn().Err(err).Str("cert", c.certFile).Msg("failed to reload client certificate, keeping the previous one")
+			return c.cert, nil
+		}
+		return nil, fmt.Errorf("failed to load client certificate: %w", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+// lastModified returns the later modification time of the two files
+func (c *clientCert) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("failed to stat client certificate: %w", err)
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
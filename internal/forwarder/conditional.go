@@ -0,0 +1,124 @@
+package forwarder
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// defaultETagMaxSize is the largest body hashed when max_size is unset
+const defaultETagMaxSize = 1 << 20
+
+var notModifiedTotal = metrics.NewCounterVec(
+	"forwarder_not_modified_total",
+	"Full backend responses answered with 304 Not Modified by the forwarder",
+	"node",
+)
+
+// checkConditional adds an ETag to a successful response that lacks one,
+// if configured, and reports whether the client's copy is still current
+// so 304 can be sent instead of the body
+func checkConditional(r *http.Request, resp *http.Response, cfg *config.Conditional) (bool, error) {
+	if cfg == nil || resp.StatusCode != http.StatusOK {
+		return false, nil
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false, nil
+	}
+
+	if cfg.ETag && r.Method == http.MethodGet && resp.Header.Get("ETag") == "" {
+		if err := addETag(resp, cfg); err != nil {
+			return false, err
+		}
+	}
+	return notModified(r, resp.Header), nil
+}
+
+// addETag hashes the response body into a strong ETag. Bodies larger than
+// the limit are left without one.
+func addETag(resp *http.Response, cfg *config.Conditional) error {
+	maxSize := int64(cfg.MaxSize)
+	if maxSize == 0 {
+		maxSize = defaultETagMaxSize
+	}
+	if resp.ContentLength > maxSize || isEventStream(resp) {
+		return nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > maxSize {
+		// Too large after all, send what was read followed by the rest
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(body), resp.Body), resp.Body}
+		return nil
+	}
+	resp.Body = readCloser{bytes.NewReader(body), resp.Body}
+
+	sum := sha256.Sum256(body)
+	resp.Header.Set("ETag", fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:16])))
+	return nil
+}
+
+// notModified evaluates If-None-Match, or If-Modified-Since without it,
+// against the response validators
+func notModified(r *http.Request, h http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := h.Get("ETag")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || weakMatch(candidate, etag) {
+				return true
+			}
+		}
+		return false
+	}
+
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(h.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	return !modified.After(ims)
+}
+
+// weakMatch compares two entity tags ignoring the weak prefix
+func weakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// writeNotModified answers 304 without the headers that describe a body
+func writeNotModified(w http.ResponseWriter) {
+	h := w.Header()
+	delete(h, "Content-Type")
+	delete(h, "Content-Length")
+	delete(h, "Content-Encoding")
+	if h.Get("ETag") != "" {
+		delete(h, "Last-Modified")
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
+
+// readCloser reads from r and closes c
+type readCloser struct {
+	io.Reader
+	c io.Closer
+}
+
+func (rc readCloser) Close() error {
+	return rc.c.Close()
+}
@@ -0,0 +1,83 @@
+package forwarder
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/vars"
+)
+
+var errorPagesServed = metrics.NewCounterVec(
+	"forwarder_error_pages_total",
+	"Backend error responses whose body was replaced by an error page",
+	"node", "status",
+)
+
+// entityHeaders describe the backend's body and are dropped along with it
+var entityHeaders = []string{
+	"Content-Length",
+	"Content-Encoding",
+	"Content-Range",
+	"Content-Type",
+	"ETag",
+	"Last-Modified",
+}
+
+// errorPageFor returns the first error page intercepting status, or nil
+func errorPageFor(status int, pages []config.ErrorPage) *config.ErrorPage {
+	for i := range pages {
+		if statusMatches(status, pages[i].Statuses) {
+			return &pages[i]
+		}
+	}
+	return nil
+}
+
+// writeErrorPage answers with the backend's status and headers but the
+// error page as body. The page file is read on each use, so edits apply
+// without a reload.
+func writeErrorPage(w http.ResponseWriter, r *http.Request, resp *http.Response, node *config.Node, page *config.ErrorPage) {
+	body := page.Body
+	if page.Page != "" {
+		data, err := os.ReadFile(page.Page)
+		if err != nil {
+			log.Error().Err(err).Str("node", node.Name).Str("page", page.Page).Msg("failed to read error page")
+			body = http.StatusText(resp.StatusCode)
+		} else {
+			body = string(data)
+		}
+	}
+	local := nodeVars(node)
+	local["status"] = strconv.Itoa(resp.StatusCode)
+	local["status_text"] = http.StatusText(resp.StatusCode)
+	body = vars.Expand(body, r, local)
+
+	contentType := page.ContentType
+	if contentType == "" {
+		contentType = "text/html; charset=utf-8"
+	}
+
+	h := w.Header()
+	for _, name := range entityHeaders {
+		h.Del(name)
+	}
+	h.Set("Content-Type", contentType)
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+
+	errorPagesServed.With(node.Name, strconv.Itoa(resp.StatusCode)).Inc()
+	log.Debug().
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Int("status", resp.StatusCode).
+		Msg("replaced backend error body")
+
+	w.WriteHeader(resp.StatusCode)
+	if r.Method != http.MethodHead {
+		w.Write([]byte(body))
+	}
+}
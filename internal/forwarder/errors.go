@@ -0,0 +1,214 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// ErrorKind classifies why forwarding a request failed
+type ErrorKind string
+
+// Error kinds, also used as the "kind" metrics label
+const (
+	KindDNS               ErrorKind = "dns"
+	KindDialTimeout       ErrorKind = "dial_timeout"
+	KindConnRefused       ErrorKind = "connection_refused"
+	KindTLS               ErrorKind = "tls"
+	KindProxyAuthRequired ErrorKind = "proxy_auth_required"
+	KindTimeout           ErrorKind = "timeout"
+	KindUpstream5xx       ErrorKind = "upstream_5xx"
+	KindInvalidResponse   ErrorKind = "invalid_response"
+	KindResponseTooLarge  ErrorKind = "response_too_large"
+	KindClientCanceled    ErrorKind = "client_canceled"
+	KindOther             ErrorKind = "other"
+)
+
+// StatusClientClosedRequest is the non-standard status recorded for
+// requests the client abandoned before the response was complete
+const StatusClientClosedRequest = 499
+
+var (
+	forwardErrors = metrics.NewCounterVec(
+		"forwarder_upstream_errors_total",
+		"Failed forwards by node and error kind",
+		"node", "kind",
+	)
+	gatewayTimeouts = metrics.NewCounterVec(
+		"forwarder_gateway_timeouts_total",
+		"Requests answered with 504 because the upstream timed out",
+		"node",
+	)
+	clientCanceled = metrics.NewCounterVec(
+		"forwarder_client_canceled_total",
+		"Requests abandoned by the client before the response was complete",
+		"node",
+	)
+)
+
+// Error is returned by Forward when a request could not be forwarded
+type Error struct {
+	Kind ErrorKind
+	Err  error
+
+	// Responded is set when a response has already been (at least
+	// partially) sent to the client, so no error page may be written
+	Responded bool
+}
+
+func (e *Error) Error() string {
+	return string(e.Kind) + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// StatusCode returns the status the client should receive for this error
+func (e *Error) StatusCode() int {
+	switch e.Kind {
+	case KindDialTimeout, KindTimeout:
+		return http.StatusGatewayTimeout
+	case KindConnRefused:
+		return http.StatusServiceUnavailable
+	case KindClientCanceled:
+		return StatusClientClosedRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// StatusCode returns the client status for an error returned by Forward
+func StatusCode(err error) int {
+	var fe *Error
+	if errors.As(err, &fe) {
+		return fe.StatusCode()
+	}
+	return http.StatusBadGateway
+}
+
+// IsTimeout reports whether err means the upstream didn't answer in time
+func IsTimeout(err error) bool {
+	return StatusCode(err) == http.StatusGatewayTimeout
+}
+
+// ClientCanceled reports whether err means the client went away, which is
+// not the upstream's fault
+func ClientCanceled(err error) bool {
+	var fe *Error
+	return errors.As(err, &fe) && fe.Kind == KindClientCanceled
+}
+
+// Responded reports whether a response was already sent before err occurred
+func Responded(err error) bool {
+	var fe *Error
+	return errors.As(err, &fe) && fe.Responded
+}
+
+// newError creates a forward error and records it in metrics for the node.
+// Client cancellations are counted apart from upstream failures.
+func newError(node string, kind ErrorKind, err error, responded bool) *Error {
+	e := &Error{Kind: kind, Err: err, Responded: responded}
+	if kind == KindClientCanceled {
+		clientCanceled.With(node).Inc()
+		return e
+	}
+	forwardErrors.With(node, string(kind)).Inc()
+	if !responded && e.StatusCode() == http.StatusGatewayTimeout {
+		gatewayTimeouts.With(node).Inc()
+	}
+	return e
+}
+
+// clientWriteError marks a failure to write the response to the client
+type clientWriteError struct {
+	err error
+}
+
+func (e *clientWriteError) Error() string { return e.err.Error() }
+func (e *clientWriteError) Unwrap() error { return e.err }
+
+// clientWriter tags write errors as the client's
+type clientWriter struct {
+	w io.Writer
+}
+
+func (c clientWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		err = &clientWriteError{err}
+	}
+	return n, err
+}
+
+// clientGone reports whether the request failed because the client went
+// away: a write to it failed, or its context was canceled by the server
+// rather than by a deadline or a cause of the forwarder's own
+func clientGone(ctx context.Context, err error) bool {
+	var we *clientWriteError
+	if errors.As(err, &we) {
+		return true
+	}
+	return errors.Is(ctx.Err(), context.Canceled) && context.Cause(ctx) == context.Canceled
+}
+
+// classify maps a transport error to an error kind
+func classify(err error) ErrorKind {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return KindDNS
+	}
+
+	if isTLSError(err) {
+		return KindTLS
+	}
+
+	// The transport reports a proxy's CONNECT refusal with its status text
+	if strings.Contains(err.Error(), http.StatusText(http.StatusProxyAuthRequired)) {
+		return KindProxyAuthRequired
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		if opErr.Timeout() {
+			return KindDialTimeout
+		}
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return KindConnRefused
+		}
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return KindTimeout
+	}
+
+	return KindOther
+}
+
+// isTLSError reports whether err came from the TLS handshake or certificate checks
+func isTLSError(err error) bool {
+	var (
+		recordErr   tls.RecordHeaderError
+		alertErr    tls.AlertError
+		verifyErr   *tls.CertificateVerificationError
+		authErr     x509.UnknownAuthorityError
+		hostnameErr x509.HostnameError
+		invalidErr  x509.CertificateInvalidError
+	)
+	return errors.As(err, &recordErr) ||
+		errors.As(err, &alertErr) ||
+		errors.As(err, &verifyErr) ||
+		errors.As(err, &authErr) ||
+		errors.As(err, &hostnameErr) ||
+		errors.As(err, &invalidErr) ||
+		strings.Contains(err.Error(), "tls: ")
+}
@@ -1,33 +1,162 @@
 package forwarder
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/netutil"
+	"github.com/simman/go-forwarder/internal/proxyauth"
+	"github.com/simman/go-forwarder/internal/trace"
+	"github.com/simman/go-forwarder/internal/vars"
 	"golang.org/x/net/http2"
 )
 
 // Forwarder forwards requests to backend servers through a proxy
 type Forwarder struct {
-	clients map[string]*http.Client // keyed by proxy URL
+	clients map[string]*http.Client // keyed by proxy URL, dial policy and client certificate
+	certs   map[string]*clientCert  // keyed by certificate and key file
+	tlsCfg  config.UpstreamTLS
+	tls     *tls.Config
+	tuning  config.Transport
+	expect  time.Duration // wait for 100 Continue before sending a body
+	header  time.Duration // default wait for response headers once a request is written
+	pool    *connPool     // tracks and reaps upstream connections
+	mu      sync.Mutex
+
+	// Named dialers nodes may select
+	dialers map[string]dialer.ContextDialer
+
+	// Backends whose QUIC handshake failed, until HTTP/3 is tried again
+	h3Failed map[string]time.Time
 }
 
 // NewForwarder creates a new forwarder
-func NewForwarder() *Forwarder {
+func NewForwarder(tlsCfg config.UpstreamTLS) *Forwarder {
 	return &Forwarder{
 		clients: make(map[string]*http.Client),
+		certs:   make(map[string]*clientCert),
+		tlsCfg:  tlsCfg,
+		tls:     newTLSConfig(tlsCfg),
+		expect:  time.Second,
+		pool:    newConnPool(90 * time.Second),
+
+		h3Failed: make(map[string]time.Time),
+	}
+}
+
+// SetUpstreamTLS applies new upstream TLS settings. Clients built with the
+// old settings are dropped, so new connections pick up the change.
+func (f *Forwarder) SetUpstreamTLS(tlsCfg config.UpstreamTLS) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if reflect.DeepEqual(tlsCfg, f.tlsCfg) {
+		return
+	}
+	f.closeClients()
+	f.tlsCfg = tlsCfg
+	f.tls = newTLSConfig(tlsCfg)
+}
+
+// SetTransport applies new pooling limits to the clients. Clients built
+// with the old limits are dropped, so new connections pick up the change.
+func (f *Forwarder) SetTransport(tuning config.Transport) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if reflect.DeepEqual(tuning, f.tuning) {
+		return
+	}
+	f.closeClients()
+	f.tuning = tuning
+}
+
+// SetExpectContinueTimeout sets how long requests with "Expect:
+// 100-continue" wait for the backend's interim response before the body is
+// sent anyway. Clients are rebuilt if the timeout changes.
+func (f *Forwarder) SetExpectContinueTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if d == f.expect {
+		return
+	}
+	f.closeClients()
+	f.expect = d
+}
+
+// SetDialers sets the named dialers nodes may select. Clients are rebuilt
+// if a dialer was added, removed or replaced.
+func (f *Forwarder) SetDialers(dialers map[string]dialer.ContextDialer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := len(dialers) != len(f.dialers)
+	for name, d := range dialers {
+		if old, ok := f.dialers[name]; !ok || dialer.KeyOf(old) != dialer.KeyOf(d) {
+			changed = true
+		}
+	}
+	if changed {
+		f.closeClients()
 	}
+	f.dialers = dialers
 }
 
-// Forward forwards the request to the target node
+// Dialer returns what opens the connections of node: its named dialer, or
+// a dialer of its dial policy
+func (f *Forwarder) Dialer(node *config.Node) dialer.ContextDialer {
+	if node.Dialer != "" {
+		f.mu.Lock()
+		d, ok := f.dialers[node.Dialer]
+		f.mu.Unlock()
+		if ok {
+			return d
+		}
+	}
+	return dialer.New(node.Dial)
+}
+
+// SetUpstreamIdleTimeout sets how long keep-alive connections to backends
+// and proxies may stay unused before they are closed. Clients are rebuilt
+// if the timeout changes.
+func (f *Forwarder) SetUpstreamIdleTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if d == f.pool.timeout {
+		return
+	}
+	f.closeClients()
+	f.pool.setTimeout(d)
+}
+
+// TLSClientConfig returns the TLS config used for upstream connections
+func (f *Forwarder) TLSClientConfig() *tls.Config {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.tls.Clone()
+}
+
+// Forward forwards the request to the target node, once, within the
+// deadline of its context. Failures are returned as *Error, which
+// classifies the cause and the status to answer with.
 func (f *Forwarder) Forward(w http.ResponseWriter, r *http.Request, node *config.Node) error {
-	// Get or create HTTP client for this proxy
-	client, err := f.getClient(node.Proxy)
+	// Get or create HTTP client for this proxy, dial policy and credentials
+	client, err := f.getClient(node.ProxyURL(), f.Dialer(node), node.Auth)
 	if err != nil {
 		return fmt.Errorf("failed to get client: %w", err)
 	}
@@ -35,43 +164,141 @@ func (f *Forwarder) Forward(w http.ResponseWriter, r *http.Request, node *config
 	// Build target URL
 	targetURL := f.buildTargetURL(r, node)
 
+	// The request's context carries the deadlines of the route and of this
+	// attempt
+	ctx := r.Context()
+
+	// Count upstream TLS handshakes and session resumption
+	ctx = httptrace.WithClientTrace(ctx, handshakeTrace(node.Name))
+
+	// Mark the upstream connection busy until the response is relayed
+	busy, release := f.pool.trace()
+	defer release()
+	ctx = httptrace.WithClientTrace(ctx, busy)
+
 	// Create proxy request
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	proxyReq, err := http.NewRequestWithContext(ctx, r.Method, targetURL, r.Body)
 	if err != nil {
 		return fmt.Errorf("failed to create proxy request: %w", err)
 	}
 
-	// Copy headers
+	proxyReq.ContentLength = r.ContentLength
+
+	// Copy headers and inject the node's own
 	copyHeaders(proxyReq.Header, r.Header)
+	ApplyHeaderPolicy(proxyReq.Header, node.RequestHeaders, r, nodeVars(node))
+	if node.RequestHeaders != nil && trace.Enabled(r.Context()) {
+		trace.Add(r.Context(), "headers", "request header policy %s", describeHeaderPolicy(node.RequestHeaders))
+	}
+	SetAuthHeaders(proxyReq.Header, node.Auth)
 
-	// Set proper host header
-	proxyReq.Host = node.Addr
-	if idx := len(node.Addr) - 1; idx >= 0 && node.Addr[idx] >= '0' && node.Addr[idx] <= '9' {
-		// If addr ends with port number, strip it for host header
-		if colonIdx := len(node.Addr) - 1; colonIdx >= 0 {
-			for colonIdx >= 0 && node.Addr[colonIdx] != ':' {
-				colonIdx--
-			}
-			if colonIdx > 0 {
-				proxyReq.Host = node.Addr[:colonIdx]
-			}
+	// Set proper host header, without the port, for the host the target
+	// URL names. Through an upstream proxy a plain HTTP request is sent in
+	// absolute form, built from the Host, which then has to keep the port.
+	proxyReq.Host = netutil.HostHeader(proxyReq.URL.Host)
+	if proxyReq.URL.Scheme == "http" && node.ProxyURL() != "" {
+		proxyReq.Host = proxyReq.URL.Host
+	}
+
+	if kind := authKind(node.Auth); kind != "" {
+		trace.Add(r.Context(), "auth", "%s credentials added", kind)
+	}
+
+	// Sign for AWS once the request is final
+	if node.SigV4 != nil {
+		if err := signRequest(proxyReq, node.SigV4); err != nil {
+			return newError(node.Name, KindOther, fmt.Errorf("failed to sign request: %w", err), false)
 		}
+		trace.Add(r.Context(), "auth", "signed with SigV4 for %s in %s", node.SigV4.Service, node.SigV4.Region)
 	}
 
-	// Perform request
+	// Perform request, over HTTP/3 first if the node asks for it. Each
+	// attempt gives up on a backend that accepted the request but doesn't
+	// answer on a context of its own, so a late HTTP/3 attempt can't cut
+	// off the TCP fallback.
+	headerTimeout := f.responseHeaderTimeout(node)
 	start := time.Now()
-	resp, err := client.Do(proxyReq)
+	var resp *http.Response
+	var headers *headerTimer
+	sent := false
+	if h3Key := node.Addr + "|" + node.ProxyURL(); f.useHTTP3(node, targetURL, h3Key) {
+		h3Req, h3Headers := withHeaderTimeout(proxyReq, headerTimeout)
+		// HTTP/3 doesn't report when the request is written, its wait
+		// starts as it is sent
+		if h3Headers != nil {
+			h3Headers.start()
+		}
+		resp, sent, err = f.doHTTP3(h3Req, node, h3Key)
+		if sent {
+			headers = h3Headers
+		} else {
+			if h3Headers != nil {
+				h3Headers.release()
+			}
+			trace.Add(r.Context(), "forward", "HTTP/3 unavailable, falling back to TCP: %v", err)
+			log.Warn().Err(err).Str("target", targetURL).Str("node", node.Name).Msg("HTTP/3 unavailable, falling back to TCP")
+		}
+	}
+	if !sent {
+		var tcpReq *http.Request
+		tcpReq, headers = withHeaderTimeout(proxyReq, headerTimeout)
+		resp, err = client.Do(tcpReq)
+	}
+	if headers != nil {
+		defer headers.release()
+	}
+	if headers != nil && headers.expired() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		trace.Add(r.Context(), "timeout", "no response headers within response_header_timeout %s", headerTimeout)
+		log.Error().
+			Str("target", targetURL).
+			Str("node", node.Name).
+			Dur("timeout", headerTimeout).
+			Msg("no response headers from backend in time")
+		return newError(node.Name, KindTimeout, fmt.Errorf("no response headers within %s", headerTimeout), false)
+	}
 	if err != nil {
+		trace.Add(r.Context(), "forward", "%s %s failed after %s: %v", r.Method, targetURL, time.Since(start).Round(time.Microsecond), err)
+		if clientGone(r.Context(), err) {
+			log.Debug().Err(err).Str("target", targetURL).Str("node", node.Name).Msg("client canceled request")
+			return newError(node.Name, KindClientCanceled, fmt.Errorf("client canceled request: %w", err), false)
+		}
 		log.Error().
 			Err(err).
 			Str("target", targetURL).
 			Str("node", node.Name).
 			Msg("request failed")
-		return fmt.Errorf("failed to forward request: %w", err)
+		return newError(node.Name, classify(err), fmt.Errorf("failed to forward request: %w", err), false)
 	}
 	defer resp.Body.Close()
 
+	// A 407 on a plain HTTP request comes from the upstream proxy, not the
+	// backend, and the client has no way to answer it
+	if proxy := node.ProxyURL(); resp.StatusCode == http.StatusProxyAuthRequired && proxy != "" {
+		return newError(node.Name, KindProxyAuthRequired, fmt.Errorf("proxy %s requires authentication", proxy), false)
+	}
+
+	// Refuse responses that announce a body over the limit, and cut off
+	// those that turn out larger while streaming
+	if limit := int64(node.MaxResponseSize); limit > 0 {
+		if resp.ContentLength > limit {
+			responsesTooLarge.With(node.Name, "headers").Inc()
+			log.Warn().
+				Str("node", node.Name).
+				Str("target", targetURL).
+				Int64("content_length", resp.ContentLength).
+				Int64("limit", limit).
+				Msg("upstream response too large, refused")
+			trace.Add(r.Context(), "limit", "response of %d bytes refused, over max_response_size %d", resp.ContentLength, limit)
+			return newError(node.Name, KindResponseTooLarge, fmt.Errorf("%w: %d bytes", ErrResponseTooLarge, resp.ContentLength), false)
+		}
+		resp.Body = limitBody(resp.Body, limit)
+	}
+
 	duration := time.Since(start)
+	trace.Add(r.Context(), "forward", "%s %s over %s: status %d after %s", r.Method, targetURL, resp.Proto, resp.StatusCode, duration.Round(time.Microsecond))
 
 	// Log request
 	log.Info().
@@ -84,61 +311,176 @@ func (f *Forwarder) Forward(w http.ResponseWriter, r *http.Request, node *config
 		Dur("duration", duration).
 		Msg("request forwarded")
 
-	// Copy response headers
+	// Check the response against the node's assertions, rejected responses
+	// never reach the client
+	invalid := checkResponse(resp, duration, node.Validate)
+	if invalid != nil {
+		log.Warn().
+			Err(invalid).
+			Str("node", node.Name).
+			Str("target", targetURL).
+			Int("status", resp.StatusCode).
+			Dur("duration", duration).
+			Msg("upstream response failed validation")
+		trace.Add(r.Context(), "validate", "response failed validation, reject %t: %v", node.Validate.Reject, invalid)
+		if node.Validate.Reject {
+			return newError(node.Name, KindInvalidResponse, fmt.Errorf("invalid upstream response: %w", invalid), false)
+		}
+	}
+
+	// Add ETags and answer revalidations the backend didn't
+	current, err := checkConditional(r, resp, node.Conditional)
+	if err != nil {
+		kind := classify(err)
+		if errors.Is(err, ErrResponseTooLarge) {
+			// Found while hashing the body, before anything was sent
+			responsesTooLarge.With(node.Name, "headers").Inc()
+			kind = KindResponseTooLarge
+		}
+		return newError(node.Name, kind, fmt.Errorf("failed to read response: %w", err), false)
+	}
+
+	// Copy response headers and enforce the node's header policy
 	copyHeaders(w.Header(), resp.Header)
+	ApplyHeaderPolicy(w.Header(), node.ResponseHeaders, r, nodeVars(node))
+	if node.ResponseHeaders != nil && trace.Enabled(r.Context()) {
+		trace.Add(r.Context(), "headers", "response header policy %s", describeHeaderPolicy(node.ResponseHeaders))
+	}
+
+	if current {
+		notModifiedTotal.With(node.Name).Inc()
+		trace.Add(r.Context(), "conditional", "answered 304 Not Modified")
+		writeNotModified(w)
+		return invalidError(node.Name, invalid)
+	}
 
-	// Write status code
-	w.WriteHeader(resp.StatusCode)
+	if page := errorPageFor(resp.StatusCode, node.ErrorPages); page != nil {
+		// Replace the backend's error body with the node's page
+		trace.Add(r.Context(), "errorpage", "replaced the %d response body with the error page", resp.StatusCode)
+		writeErrorPage(w, r, resp, node, page)
+	} else {
+		// Write status code
+		w.WriteHeader(resp.StatusCode)
 
-	// Copy response body
-	_, err = io.Copy(w, resp.Body)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to copy response body")
-		return fmt.Errorf("failed to copy response: %w", err)
+		// Copy response body
+		err = copyBody(w, resp)
+		if err != nil {
+			if errors.Is(err, ErrResponseTooLarge) {
+				responsesTooLarge.With(node.Name, "stream").Inc()
+				log.Warn().
+					Str("node", node.Name).
+					Str("target", targetURL).
+					Int64("limit", int64(node.MaxResponseSize)).
+					Msg("upstream response too large, truncated")
+				trace.Add(r.Context(), "limit", "response cut off at max_response_size %d", node.MaxResponseSize)
+				return newError(node.Name, KindResponseTooLarge, err, true)
+			}
+			if clientGone(r.Context(), err) {
+				log.Debug().Err(err).Str("node", node.Name).Msg("client went away during response")
+				return newError(node.Name, KindClientCanceled, fmt.Errorf("client canceled request: %w", err), true)
+			}
+			log.Error().Err(err).Msg("failed to copy response body")
+			return newError(node.Name, classify(err), fmt.Errorf("failed to copy response: %w", err), true)
+		}
+	}
+
+	// Invalid responses and server errors are relayed as-is but still
+	// counted as upstream failures
+	if invalid != nil {
+		return invalidError(node.Name, invalid)
+	}
+	if resp.StatusCode >= 500 {
+		return newError(node.Name, KindUpstream5xx, fmt.Errorf("upstream returned %s", resp.Status), true)
 	}
 
 	return nil
 }
 
+// defaultTarget is the target URL of nodes without a target template: the
+// request URI on node.Addr, over the scheme the client used
+const defaultTarget = "{scheme}://{addr}{request_uri}"
+
 // buildTargetURL constructs the target URL from request and node
 func (f *Forwarder) buildTargetURL(r *http.Request, node *config.Node) string {
-	scheme := "https"
-	if r.TLS == nil {
-		scheme = "http"
+	target := node.Target
+	if target == "" {
+		target = defaultTarget
 	}
+	return vars.Expand(target, r, nodeVars(node))
+}
 
-	// Use node.Addr which includes host:port
-	return fmt.Sprintf("%s://%s%s", scheme, node.Addr, r.URL.RequestURI())
+// nodeVars holds the variables node templates may use besides the request
+// variables
+func nodeVars(node *config.Node) map[string]string {
+	return map[string]string{"node": node.Name, "addr": node.Addr}
 }
 
-// getClient returns or creates an HTTP client for the given proxy URL
-func (f *Forwarder) getClient(proxyURL string) (*http.Client, error) {
+// getClient returns or creates an HTTP client for the given proxy URL,
+// dialer and client certificate
+func (f *Forwarder) getClient(proxyURL string, d dialer.ContextDialer, auth *config.Auth) (*http.Client, error) {
 	if proxyURL == "" {
 		proxyURL = "direct" // special key for direct connection
 	}
+	key := proxyURL + "|" + dialer.KeyOf(d)
+	if auth != nil && auth.ClientCert != "" {
+		key += "|" + auth.ClientCert + "|" + auth.ClientKey
+	}
 
-	if client, ok := f.clients[proxyURL]; ok {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if client, ok := f.clients[key]; ok {
 		return client, nil
 	}
 
 	// Create new client
-	client, err := createClient(proxyURL)
+	client, err := createClient(proxyURL, f.pool, d, f.nodeTLSConfig(auth), f.expect, &f.tuning)
 	if err != nil {
 		return nil, err
 	}
 
-	f.clients[proxyURL] = client
+	f.clients[key] = client
 	return client, nil
 }
 
-// createClient creates a new HTTP client with the specified proxy
-func createClient(proxyURL string) (*http.Client, error) {
+// closeClients drops all clients, closing their idle connections. f.mu must be held.
+func (f *Forwarder) closeClients() {
+	for _, client := range f.clients {
+		closeIdle(client)
+	}
+	f.clients = make(map[string]*http.Client)
+}
+
+// createClient creates a new HTTP client with the specified proxy, dialer,
+// TLS config, 100-continue timeout and pooling limits. Its connections are
+// tracked by pool, whose reaper closes them once idle, so the transport has
+// no idle timeout of its own unless tuning sets a shorter one.
+func createClient(proxyURL string, pool *connPool, d dialer.ContextDialer, tlsConfig *tls.Config, expect time.Duration, tuning *config.Transport) (*http.Client, error) {
+	kind := "backend"
+	if proxyURL != "" && proxyURL != "direct" {
+		kind = "proxy"
+	}
+
 	transport := &http.Transport{
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ForceAttemptHTTP2:     true,
+		DialContext:           pool.dialContext(d, kind),
+		TLSClientConfig:       tlsConfig,
+		MaxConnsPerHost:       tuning.MaxConnsPerHost,
+		IdleConnTimeout:       tuning.IdleConnTimeout,
+		ExpectContinueTimeout: expect,
+		ForceAttemptHTTP2:     !tuning.DisableHTTP2,
+	}
+	if n := tuning.MaxIdleConns; n != nil {
+		transport.MaxIdleConns = *n
+	}
+	if n := tuning.MaxIdleConnsPerHost; n != nil {
+		// The transport reads 0 as its default, keeping none is negative
+		transport.MaxIdleConnsPerHost = *n
+		if *n == 0 {
+			transport.MaxIdleConnsPerHost = -1
+		}
+	}
+	if d := tuning.TLSHandshakeTimeout; d != nil {
+		transport.TLSHandshakeTimeout = *d
 	}
 
 	// Configure proxy if specified
@@ -147,17 +489,22 @@ func createClient(proxyURL string) (*http.Client, error) {
 		if err != nil {
 			return nil, fmt.Errorf("invalid proxy URL: %w", err)
 		}
-		transport.Proxy = http.ProxyURL(proxy)
+		// Credentials are looked up per request so rotated ones take effect
+		// on new connections; the pool keys connections by them
+		transport.Proxy = func(*http.Request) (*url.URL, error) {
+			return proxyauth.Apply(proxy), nil
+		}
 	}
 
-	// Enable HTTP/2
-	if err := http2.ConfigureTransport(transport); err != nil {
+	// Enable HTTP/2, or keep TLS backends from negotiating it
+	if tuning.DisableHTTP2 {
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	} else if err := http2.ConfigureTransport(transport); err != nil {
 		log.Warn().Err(err).Msg("failed to configure HTTP/2 transport")
 	}
 
 	return &http.Client{
 		Transport: transport,
-		Timeout:   60 * time.Second,
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			// Don't follow redirects
 			return http.ErrUseLastResponse
@@ -165,6 +512,42 @@ func createClient(proxyURL string) (*http.Client, error) {
 	}, nil
 }
 
+// copyBody copies the response body to the client. Streaming responses
+// (server-sent events or bodies of unknown length) are flushed after every
+// read so clients see data as soon as the backend sends it.
+func copyBody(w http.ResponseWriter, resp *http.Response) error {
+	if !isEventStream(resp) && resp.ContentLength != -1 {
+		_, err := io.Copy(clientWriter{w}, resp.Body)
+		return err
+	}
+
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return &clientWriteError{err}
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return &clientWriteError{err}
+			}
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		if rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// isEventStream reports whether the response is a server-sent event stream
+func isEventStream(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
 // copyHeaders copies HTTP headers from src to dst
 func copyHeaders(dst, src http.Header) {
 	for k, vv := range src {
@@ -176,10 +559,12 @@ func copyHeaders(dst, src http.Header) {
 
 // Close closes all HTTP clients
 func (f *Forwarder) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
 	for _, client := range f.clients {
-		if transport, ok := client.Transport.(*http.Transport); ok {
-			transport.CloseIdleConnections()
-		}
+		closeIdle(client)
 	}
+	f.pool.stop()
 	return nil
 }
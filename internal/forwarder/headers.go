@@ -0,0 +1,52 @@
+package forwarder
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/vars"
+)
+
+// describeHeaderPolicy lists the headers the policy removes, sets and adds
+func describeHeaderPolicy(p *config.HeaderPolicy) string {
+	var parts []string
+	if len(p.Remove) > 0 {
+		parts = append(parts, "removed "+strings.Join(p.Remove, ", "))
+	}
+	for _, op := range []struct {
+		verb    string
+		headers map[string]string
+	}{{"set", p.Set}, {"added", p.Add}} {
+		if len(op.headers) == 0 {
+			continue
+		}
+		names := make([]string, 0, len(op.headers))
+		for name := range op.headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parts = append(parts, op.verb+" "+strings.Join(names, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// ApplyHeaderPolicy edits h as the policy describes: removals first, then
+// overwrites, then additions. Values are expanded for r, with local
+// holding the caller's variables.
+func ApplyHeaderPolicy(h http.Header, p *config.HeaderPolicy, r *http.Request, local map[string]string) {
+	if p == nil {
+		return
+	}
+
+	for _, name := range p.Remove {
+		h.Del(name)
+	}
+	for name, value := range p.Set {
+		h.Set(name, vars.Expand(value, r, local))
+	}
+	for name, value := range p.Add {
+		h.Add(name, vars.Expand(value, r, local))
+	}
+}
@@ -0,0 +1,90 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// errHeaderTimeout is the cause of attempts canceled by a headerTimer
+var errHeaderTimeout = errors.New("no response headers in time")
+
+// headerTimer cancels an upstream attempt whose response headers don't
+// arrive within timeout of its request being written, body included. Each
+// attempt has its own, a fired timer can't be undone.
+type headerTimer struct {
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	timeout time.Duration
+
+	mu    sync.Mutex
+	timer *time.Timer
+	done  bool
+}
+
+// withHeaderTimeout returns req on a context of its own for one upstream
+// attempt, canceled when its response headers are late. Without a timeout
+// req is returned as it is, with a nil timer.
+func withHeaderTimeout(req *http.Request, timeout time.Duration) (*http.Request, *headerTimer) {
+	if timeout <= 0 {
+		return req, nil
+	}
+	ctx, cancel := context.WithCancelCause(req.Context())
+	h := &headerTimer{cancel: cancel, timeout: timeout}
+	h.ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) { h.start() },
+	})
+	return req.WithContext(h.ctx), h
+}
+
+// start begins the wait, once per attempt
+func (h *headerTimer) start() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.timer == nil && !h.done {
+		h.timer = time.AfterFunc(h.timeout, func() { h.cancel(errHeaderTimeout) })
+	}
+}
+
+// expired ends the wait once the round trip returned, reporting whether
+// the headers were late and the attempt canceled for it
+func (h *headerTimer) expired() bool {
+	h.mu.Lock()
+	h.done = true
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.mu.Unlock()
+	return context.Cause(h.ctx) == errHeaderTimeout
+}
+
+// release frees the context once the response was relayed
+func (h *headerTimer) release() {
+	h.expired()
+	h.cancel(context.Canceled)
+}
+
+// SetResponseHeaderTimeout sets how long backends of nodes without their
+// own response_header_timeout may take to send the response headers after
+// the request was written. Zero leaves the wait to the attempt's deadline.
+func (f *Forwarder) SetResponseHeaderTimeout(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.header = d
+}
+
+// responseHeaderTimeout returns the response header limit of node, zero
+// when there is none
+func (f *Forwarder) responseHeaderTimeout(node *config.Node) time.Duration {
+	if node.ResponseHeaderTimeout > 0 {
+		return node.ResponseHeaderTimeout
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.header
+}
@@ -0,0 +1,46 @@
+package forwarder
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHeaderTimeoutPerAttempt(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://backend.test/", nil)
+
+	// The first attempt's headers are late
+	first, headers := withHeaderTimeout(req, 10*time.Millisecond)
+	headers.start()
+	select {
+	case <-first.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatal("first attempt not canceled after its header timeout")
+	}
+	if !headers.expired() {
+		t.Fatal("first attempt not reported as expired")
+	}
+	headers.release()
+
+	// The fallback starts over on a context of its own
+	second, headers := withHeaderTimeout(req, time.Second)
+	if err := second.Context().Err(); err != nil {
+		t.Fatalf("second attempt starts canceled: %v", err)
+	}
+	headers.start()
+	if headers.expired() {
+		t.Fatal("second attempt reported as expired")
+	}
+	headers.release()
+	if err := req.Context().Err(); err != nil {
+		t.Fatalf("request context canceled by an attempt: %v", err)
+	}
+}
+
+func TestHeaderTimeoutDisabled(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://backend.test/", nil)
+	got, headers := withHeaderTimeout(req, 0)
+	if got != req || headers != nil {
+		t.Fatalf("withHeaderTimeout(req, 0) = %p, %v, want the request and no timer", got, headers)
+	}
+}
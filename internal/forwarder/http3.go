@@ -0,0 +1,252 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/netutil"
+	"github.com/simman/go-forwarder/internal/proxyauth"
+)
+
+// h3RetryAfter is how long a backend whose QUIC handshake failed is sent
+// requests over TCP before HTTP/3 is tried again
+const h3RetryAfter = 5 * time.Minute
+
+var (
+	http3Requests = metrics.NewCounterVec(
+		"forwarder_http3_requests_total",
+		"Upstream requests sent over HTTP/3",
+		"node",
+	)
+	http3Fallbacks = metrics.NewCounterVec(
+		"forwarder_http3_fallbacks_total",
+		"Upstream requests sent over TCP because the QUIC handshake failed",
+		"node",
+	)
+)
+
+// h3DialError is a failure to set up a QUIC connection. Nothing of the
+// request was sent yet, so it can be retried over TCP.
+type h3DialError struct {
+	err error
+}
+
+func (e *h3DialError) Error() string { return "http3: " + e.err.Error() }
+func (e *h3DialError) Unwrap() error { return e.err }
+
+// useHTTP3 reports whether a request to target should be tried over
+// HTTP/3. QUIC needs TLS, so only https targets qualify, and backends
+// whose handshake recently failed are skipped.
+func (f *Forwarder) useHTTP3(node *config.Node, target, key string) bool {
+	if node.BackendProtocol != "h3" || !isHTTPS(target) {
+		return false
+	}
+	proxy := node.ProxyURL()
+	if proxy != "" && !isHTTPS(proxy) {
+		return false
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	until, ok := f.h3Failed[key]
+	if ok && time.Now().Before(until) {
+		return false
+	}
+	delete(f.h3Failed, key)
+	return true
+}
+
+// http3Failed records a failed QUIC handshake for key
+func (f *Forwarder) http3Failed(key string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.h3Failed[key] = time.Now().Add(h3RetryAfter)
+}
+
+// getHTTP3Client returns or creates an HTTP/3 client for the given proxy
+// URL, dialer and client certificate
+func (f *Forwarder) getHTTP3Client(proxyURL string, d *dialer.Dialer, auth *config.Auth) (*http.Client, error) {
+	key := "h3|" + proxyURL + "|" + d.Key()
+	if auth != nil && auth.ClientCert != "" {
+		key += "|" + auth.ClientCert + "|" + auth.ClientKey
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if client, ok := f.clients[key]; ok {
+		return client, nil
+	}
+
+	client, err := createHTTP3Client(proxyURL, d, f.nodeTLSConfig(auth), f.tls.Clone(), f.pool.timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	f.clients[key] = client
+	return client, nil
+}
+
+// createHTTP3Client creates a client sending requests over QUIC. With an
+// https proxy, connections go to the proxy instead, which receives the
+// target as the request's authority the way HTTP/2 and HTTP/3 proxies do.
+func createHTTP3Client(proxyURL string, d *dialer.Dialer, tlsConfig, proxyTLS *tls.Config, idle time.Duration) (*http.Client, error) {
+	var proxy *url.URL
+	if proxyURL != "" {
+		var err error
+		if proxy, err = url.Parse(proxyURL); err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %w", err)
+		}
+		proxyTLS.ServerName = proxy.Hostname()
+	}
+
+	// Connections close themselves once idle, like the TCP ones the pool
+	// reaps
+	quicConfig := &quic.Config{
+		HandshakeIdleTimeout: 5 * time.Second,
+		MaxIdleTimeout:       idle,
+	}
+
+	transport := &http3.RoundTripper{
+		TLSClientConfig: tlsConfig,
+		QuicConfig:      quicConfig,
+		Dial: func(ctx context.Context, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+			if proxy != nil {
+				addr = netutil.URLAddr(proxy)
+				tlsCfg = proxyTLS.Clone()
+				tlsCfg.NextProtos = []string{http3.NextProtoH3}
+			}
+			conn, err := dialQUIC(ctx, d, addr, tlsCfg, cfg)
+			if err != nil {
+				return nil, &h3DialError{err}
+			}
+			return conn, nil
+		},
+	}
+
+	var rt http.RoundTripper = transport
+	if proxy != nil {
+		rt = proxyAuthRoundTripper{proxy: proxy, next: transport}
+	}
+
+	return &http.Client{
+		Transport: rt,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Don't follow redirects
+			return http.ErrUseLastResponse
+		},
+	}, nil
+}
+
+// dialQUIC opens a QUIC connection and waits for its handshake, so a
+// backend that doesn't speak QUIC fails here rather than mid-request
+func dialQUIC(ctx context.Context, d *dialer.Dialer, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	udpConn, remote, err := d.ListenUDP(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	tr := &quic.Transport{Conn: udpConn}
+	release := func() {
+		tr.Close()
+		udpConn.Close()
+	}
+
+	conn, err := tr.DialEarly(ctx, remote, tlsCfg, cfg)
+	if err != nil {
+		release()
+		return nil, err
+	}
+
+	select {
+	case <-conn.HandshakeComplete():
+	case <-conn.Context().Done():
+		release()
+		return nil, context.Cause(conn.Context())
+	case <-ctx.Done():
+		conn.CloseWithError(0, "")
+		release()
+		return nil, ctx.Err()
+	}
+
+	// Release the socket with the connection
+	go func() {
+		<-conn.Context().Done()
+		release()
+	}()
+	return conn, nil
+}
+
+// proxyAuthRoundTripper adds the proxy's credentials to requests sent to it
+type proxyAuthRoundTripper struct {
+	proxy *url.URL
+	next  http.RoundTripper
+}
+
+func (rt proxyAuthRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	user := proxyauth.Userinfo(rt.proxy)
+	if user == nil {
+		return rt.next.RoundTrip(req)
+	}
+	password, _ := user.Password()
+	req = req.Clone(req.Context())
+	credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+	req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	return rt.next.RoundTrip(req)
+}
+
+// doHTTP3 sends req over HTTP/3. ok is false when no QUIC connection could
+// be set up and the request should go over TCP instead.
+func (f *Forwarder) doHTTP3(req *http.Request, node *config.Node, key string) (resp *http.Response, ok bool, err error) {
+	client, err := f.getHTTP3Client(node.ProxyURL(), dialer.New(node.Dial), node.Auth)
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Keep the body open for a retry over TCP, a failed dial leaves it unread
+	h3Req := req.Clone(req.Context())
+	if req.Body != nil {
+		h3Req.Body = io.NopCloser(req.Body)
+	}
+
+	resp, err = client.Do(h3Req)
+	var dialErr *h3DialError
+	if errors.As(err, &dialErr) && req.Context().Err() == nil {
+		f.http3Failed(key)
+		http3Fallbacks.With(node.Name).Inc()
+		return nil, false, dialErr
+	}
+	http3Requests.With(node.Name).Inc()
+	return resp, true, err
+}
+
+// closeIdle closes the idle connections of a TCP or HTTP/3 client
+func closeIdle(client *http.Client) {
+	switch transport := client.Transport.(type) {
+	case *http.Transport:
+		transport.CloseIdleConnections()
+	case *http3.RoundTripper:
+		transport.CloseIdleConnections()
+	case proxyAuthRoundTripper:
+		closeIdle(&http.Client{Transport: transport.next})
+	}
+}
+
+// isHTTPS reports whether a URL uses the https scheme
+func isHTTPS(rawURL string) bool {
+	u, err := url.Parse(rawURL)
+	return err == nil && u.Scheme == "https"
+}
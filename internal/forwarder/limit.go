@@ -0,0 +1,48 @@
+package forwarder
+
+import (
+	"errors"
+	"io"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// ErrResponseTooLarge is returned when a response body exceeds the node's
+// max_response_size
+var ErrResponseTooLarge = errors.New("response body too large")
+
+var responsesTooLarge = metrics.NewCounterVec(
+	"forwarder_responses_too_large_total",
+	"Responses over max_response_size, refused from their headers or cut off mid-stream",
+	"node", "stage",
+)
+
+// limitedBody fails reads once the body goes past its limit, returning
+// the bytes up to the limit first
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+// limitBody caps body at limit bytes
+func limitBody(body io.ReadCloser, limit int64) io.ReadCloser {
+	return &limitedBody{ReadCloser: body, remaining: limit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.remaining < 0 {
+		return 0, ErrResponseTooLarge
+	}
+
+	// Read one byte past the limit to tell a body of exactly the limit
+	// from a longer one
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.remaining -= int64(n)
+	if b.remaining < 0 {
+		return n + int(b.remaining), ErrResponseTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,213 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	upstreamConns = metrics.NewGaugeVec(
+		"forwarder_upstream_conns",
+		"Open connections to backends and upstream proxies",
+		"addr", "kind",
+	)
+	upstreamIdleConns = metrics.NewGaugeVec(
+		"forwarder_upstream_idle_conns",
+		"Upstream connections waiting in the keep-alive pool for the next request",
+		"addr", "kind",
+	)
+	upstreamConnsReaped = metrics.NewCounterVec(
+		"forwarder_upstream_conns_reaped_total",
+		"Idle upstream connections closed by the reaper",
+		"addr", "kind",
+	)
+)
+
+// connPool tracks the connections clients dial to backends and proxies.
+// Request traces report which connection serves each request, and a
+// reaper closes connections that served none for longer than the timeout,
+// also those held by clients that were dropped on a reload. HTTP/2
+// connections count as idle once all their requests are done.
+type connPool struct {
+	mu      sync.Mutex
+	conns   map[*trackedConn]struct{}
+	timeout time.Duration
+	done    chan struct{}
+}
+
+// trackedConn is an upstream connection known to the pool
+type trackedConn struct {
+	net.Conn
+	pool   *connPool
+	addr   string
+	kind   string    // "backend" or "proxy"
+	active int       // requests using the connection
+	idle   time.Time // when the last request finished, zero while in use
+}
+
+func newConnPool(timeout time.Duration) *connPool {
+	p := &connPool{
+		conns:   make(map[*trackedConn]struct{}),
+		timeout: timeout,
+		done:    make(chan struct{}),
+	}
+	go p.reap()
+	return p
+}
+
+// dialContext returns a dial function for a transport that tracks the
+// connections d opens. kind labels them as going to a backend or a proxy.
+// A new connection counts as idle until a request takes it.
+func (p *connPool) dialContext(d dialer.ContextDialer, kind string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := d.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		c := &trackedConn{Conn: conn, pool: p, addr: addr, kind: kind, idle: time.Now()}
+		p.mu.Lock()
+		p.conns[c] = struct{}{}
+		p.mu.Unlock()
+		upstreamConns.With(addr, kind).Inc()
+		upstreamIdleConns.With(addr, kind).Inc()
+		return c, nil
+	}
+}
+
+// trace returns hooks marking the connections used by one request busy,
+// and a release func to call once the response has been relayed
+func (p *connPool) trace() (*httptrace.ClientTrace, func()) {
+	var mu sync.Mutex
+	var used []*trackedConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c := unwrapTracked(info.Conn)
+			if c == nil {
+				return
+			}
+			p.acquire(c)
+			mu.Lock()
+			used = append(used, c)
+			mu.Unlock()
+		},
+	}
+	release := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range used {
+			p.release(c)
+		}
+		used = nil
+	}
+	return trace, release
+}
+
+// unwrapTracked returns the tracked connection under conn, or nil for
+// connections opened elsewhere
+func unwrapTracked(conn net.Conn) *trackedConn {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	c, _ := conn.(*trackedConn)
+	return c
+}
+
+// acquire marks c busy with one more request
+func (p *connPool) acquire(c *trackedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.active++
+	if _, ok := p.conns[c]; ok && !c.idle.IsZero() {
+		c.idle = time.Time{}
+		upstreamIdleConns.With(c.addr, c.kind).Dec()
+	}
+}
+
+// release marks one request on c as done
+func (p *connPool) release(c *trackedConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c.active--
+	if _, ok := p.conns[c]; ok && c.active == 0 {
+		c.idle = time.Now()
+		upstreamIdleConns.With(c.addr, c.kind).Inc()
+	}
+}
+
+// removeLocked forgets c. p.mu must be held.
+func (p *connPool) removeLocked(c *trackedConn) {
+	if _, ok := p.conns[c]; !ok {
+		return
+	}
+	delete(p.conns, c)
+	upstreamConns.With(c.addr, c.kind).Dec()
+	if !c.idle.IsZero() {
+		upstreamIdleConns.With(c.addr, c.kind).Dec()
+	}
+}
+
+// Close closes the connection and removes it from the pool
+func (c *trackedConn) Close() error {
+	c.pool.mu.Lock()
+	c.pool.removeLocked(c)
+	c.pool.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// setTimeout changes how long connections may stay idle. The reaper picks
+// it up on its next run.
+func (p *connPool) setTimeout(d time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.timeout = d
+}
+
+// reap periodically closes connections idle for longer than the timeout
+func (p *connPool) reap() {
+	for {
+		p.mu.Lock()
+		interval := p.timeout / 2
+		p.mu.Unlock()
+
+		select {
+		case <-p.done:
+			return
+		case <-time.After(interval):
+		}
+
+		now := time.Now()
+		var expired []*trackedConn
+		p.mu.Lock()
+		for c := range p.conns {
+			if !c.idle.IsZero() && now.Sub(c.idle) >= p.timeout {
+				expired = append(expired, c)
+			}
+		}
+		for _, c := range expired {
+			p.removeLocked(c)
+		}
+		p.mu.Unlock()
+
+		// The transport notices the closed connection and drops it
+		for _, c := range expired {
+			upstreamConnsReaped.With(c.addr, c.kind).Inc()
+			c.Conn.Close()
+		}
+	}
+}
+
+// stop ends the reaper
+func (p *connPool) stop() {
+	close(p.done)
+}
@@ -0,0 +1,61 @@
+package forwarder
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/sigv4"
+)
+
+// maxSignedBody is the largest request body buffered to compute its hash
+const maxSignedBody = 10 << 20
+
+// ErrBodyTooLarge is returned when a request body is too large to sign
+var ErrBodyTooLarge = errors.New("request body too large to sign")
+
+// signRequest signs req for the node's AWS service. Bodies are hashed,
+// except for S3 which accepts unsigned payloads and so can stream them.
+func signRequest(req *http.Request, cfg *config.SigV4) error {
+	signer := &sigv4.Signer{
+		Credentials: sigv4.CredentialsFromEnv(sigv4.Credentials{
+			AccessKeyID:     cfg.AccessKeyID,
+			SecretAccessKey: cfg.SecretAccessKey,
+			SessionToken:    cfg.SessionToken,
+		}),
+		Region:  cfg.Region,
+		Service: cfg.Service,
+	}
+
+	payloadHash, err := hashBody(req, cfg.Service == "s3")
+	if err != nil {
+		return err
+	}
+	return signer.Sign(req, payloadHash, time.Now())
+}
+
+// hashBody returns the payload hash of req, buffering the body to read it
+func hashBody(req *http.Request, unsigned bool) (string, error) {
+	if req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0 {
+		return sigv4.HashPayload(nil), nil
+	}
+	if unsigned {
+		return sigv4.UnsignedPayload, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+	if err != nil {
+		return "", fmt.Errorf("failed to read request body: %w", err)
+	}
+	if len(body) > maxSignedBody {
+		return "", ErrBodyTooLarge
+	}
+
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	return sigv4.HashPayload(body), nil
+}
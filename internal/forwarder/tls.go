@@ -0,0 +1,46 @@
+package forwarder
+
+import (
+	"crypto/tls"
+	"net/http/httptrace"
+	"strconv"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// defaultSessionCacheSize is the number of TLS sessions kept for resumption
+const defaultSessionCacheSize = 256
+
+var tlsHandshakes = metrics.NewCounterVec(
+	"forwarder_tls_handshakes_total",
+	"Upstream TLS handshakes by node and whether the session was resumed",
+	"node", "resumed",
+)
+
+// newTLSConfig builds the client TLS config shared by backend and proxy
+// connections. One session cache is shared so every transport can resume
+// sessions to the same servers.
+func newTLSConfig(cfg config.UpstreamTLS) *tls.Config {
+	if cfg.SessionTickets != nil && !*cfg.SessionTickets {
+		return &tls.Config{SessionTicketsDisabled: true}
+	}
+
+	size := cfg.SessionCacheSize
+	if size == 0 {
+		size = defaultSessionCacheSize
+	}
+	return &tls.Config{ClientSessionCache: tls.NewLRUClientSessionCache(size)}
+}
+
+// handshakeTrace records upstream TLS handshakes of one request
+func handshakeTrace(node string) *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				return
+			}
+			tlsHandshakes.With(node, strconv.FormatBool(state.DidResume)).Inc()
+		},
+	}
+}
@@ -0,0 +1,60 @@
+package forwarder
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// checkResponse returns why resp breaks the node's response assertions, or
+// nil if it satisfies them
+func checkResponse(resp *http.Response, latency time.Duration, v *config.ResponseValidation) error {
+	if v == nil {
+		return nil
+	}
+
+	var problems []string
+	if len(v.Statuses) > 0 && !statusMatches(resp.StatusCode, v.Statuses) {
+		problems = append(problems, fmt.Sprintf("status %d not allowed", resp.StatusCode))
+	}
+	for _, name := range v.RequireHeaders {
+		if len(resp.Header.Values(name)) == 0 {
+			problems = append(problems, "missing header "+name)
+		}
+	}
+	if v.MaxLatency > 0 && latency > v.MaxLatency {
+		problems = append(problems, fmt.Sprintf("latency %s exceeds %s", latency.Round(time.Millisecond), v.MaxLatency))
+	}
+
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, ", "))
+}
+
+// invalidError records a relayed response that failed validation as an
+// upstream failure, or returns nil if it passed
+func invalidError(node string, invalid error) error {
+	if invalid == nil {
+		return nil
+	}
+	return newError(node, KindInvalidResponse, fmt.Errorf("invalid upstream response: %w", invalid), true)
+}
+
+// statusMatches reports whether code matches one of the listed codes or
+// classes like 2xx
+func statusMatches(code int, patterns []string) bool {
+	s := strconv.Itoa(code)
+	for _, a := range patterns {
+		a = strings.ToLower(a)
+		if a == s || (strings.HasSuffix(a, "xx") && a[0] == s[0]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,267 @@
+package geoip
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var dbEntries = metrics.NewGaugeVec(
+	"forwarder_geoip_entries",
+	"IP ranges listed in a loaded GeoIP database",
+	"file",
+)
+
+// Kind is what a database maps IP ranges to
+type Kind int
+
+const (
+	Country Kind = iota // ISO 3166 country codes
+	ASN                 // autonomous system numbers
+)
+
+func (k Kind) String() string {
+	if k == ASN {
+		return "asn"
+	}
+	return "country"
+}
+
+// DB is a compiled IP range database
+type DB struct {
+	File   string
+	Loaded time.Time
+	ranges []ipRange // sorted by start, not overlapping
+}
+
+type ipRange struct {
+	start, end netip.Addr
+	value      string
+}
+
+// Lookup returns the country code or AS number ip belongs to
+func (db *DB) Lookup(ip netip.Addr) (string, bool) {
+	ip = ip.Unmap()
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return ip.Less(db.ranges[i].start)
+	})
+	if i == 0 {
+		return "", false
+	}
+	r := db.ranges[i-1]
+	if r.end.Less(ip) {
+		return "", false
+	}
+	return r.value, true
+}
+
+// Len returns the number of ranges
+func (db *DB) Len() int {
+	return len(db.ranges)
+}
+
+// active holds the databases the matchers consult, by kind
+var active [2]atomic.Pointer[DB]
+
+// Use makes db the database of its kind the matchers consult. A nil db
+// leaves matchers of that kind matching nothing.
+func Use(kind Kind, db *DB) {
+	active[kind].Store(db)
+}
+
+// Active returns the database of kind in use, or nil
+func Active(kind Kind) *DB {
+	return active[kind].Load()
+}
+
+// Lookup returns what ip maps to in the database of kind in use
+func Lookup(kind Kind, ip net.IP) (string, bool) {
+	db := active[kind].Load()
+	if db == nil {
+		return "", false
+	}
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return "", false
+	}
+	return db.Lookup(addr)
+}
+
+// NormalizeASN returns an AS number without the optional "AS" prefix, or
+// false if s is not one
+func NormalizeASN(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return "", false
+	}
+	return strconv.FormatUint(n, 10), true
+}
+
+// cached is a compiled file and the state of the file it was read from
+type cached struct {
+	db      *DB
+	size    int64
+	modTime time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]cached)
+)
+
+// Load reads and compiles the database of kind in path. The compiled
+// database is kept until the file changes, so loading an unchanged file
+// again, as every reload does, is cheap.
+func Load(path string, kind Kind) (*DB, error) {
+	return load(path, kind, false)
+}
+
+// Reload reads the database in path even if the file looks unchanged
+func Reload(path string, kind Kind) (*DB, error) {
+	return load(path, kind, true)
+}
+
+func load(path string, kind Kind, force bool) (*DB, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s database: %w", kind, err)
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	key := kind.String() + ":" + path
+	if c, ok := cache[key]; ok && !force && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.db, nil
+	}
+
+	db, err := parse(path, kind)
+	if err != nil {
+		return nil, err
+	}
+	cache[key] = cached{db: db, size: info.Size(), modTime: info.ModTime()}
+	dbEntries.With(path).Set(float64(db.Len()))
+
+	log.Info().Str("file", path).Str("kind", kind.String()).Int("ranges", db.Len()).Msg("GeoIP database loaded")
+	return db, nil
+}
+
+// parse compiles a database file. Each line holds either a first and last
+// address followed by the value, as in the iptoasn.com TSV files, or a
+// CIDR prefix followed by the value. Further fields, such as the country
+// and owner columns of an ASN file, are ignored, and so are ranges of AS
+// number 0, which marks unrouted space. Blank lines and lines starting
+// with # are skipped.
+func parse(path string, kind Kind) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s database: %w", kind, err)
+	}
+	defer f.Close()
+
+	db := &DB{File: path, Loaded: time.Now()}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		var r ipRange
+		var value string
+		if strings.Contains(fields[0], "/") {
+			prefix, err := netip.ParsePrefix(fields[0])
+			if err != nil || len(fields) < 2 {
+				return nil, fmt.Errorf("%s:%d: expected a CIDR prefix and a value", path, line)
+			}
+			prefix = prefix.Masked()
+			r.start, r.end = prefix.Addr().Unmap(), lastAddr(prefix)
+			value = fields[1]
+		} else {
+			if len(fields) < 3 {
+				return nil, fmt.Errorf("%s:%d: expected a first and last address and a value", path, line)
+			}
+			r.start, err = netip.ParseAddr(fields[0])
+			if err == nil {
+				r.end, err = netip.ParseAddr(fields[1])
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: invalid address: %w", path, line, err)
+			}
+			r.start, r.end = r.start.Unmap(), r.end.Unmap()
+			if r.start.Is4() != r.end.Is4() || r.end.Less(r.start) {
+				return nil, fmt.Errorf("%s:%d: invalid range %s-%s", path, line, fields[0], fields[1])
+			}
+			value = fields[2]
+		}
+
+		switch kind {
+		case ASN:
+			asn, ok := NormalizeASN(value)
+			if !ok {
+				return nil, fmt.Errorf("%s:%d: invalid AS number %s", path, line, value)
+			}
+			if asn == "0" {
+				continue
+			}
+			r.value = asn
+		default:
+			if len(value) != 2 {
+				return nil, fmt.Errorf("%s:%d: invalid country code %s", path, line, value)
+			}
+			r.value = strings.ToUpper(value)
+		}
+		db.ranges = append(db.ranges, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s database: %w", kind, err)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	for i := 1; i < len(db.ranges); i++ {
+		prev, r := db.ranges[i-1], db.ranges[i]
+		if prev.start.Is4() == r.start.Is4() && !prev.end.Less(r.start) {
+			return nil, fmt.Errorf("%s: overlapping ranges at %s", path, r.start)
+		}
+	}
+
+	return db, nil
+}
+
+// lastAddr returns the highest address in prefix
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().Unmap()
+	b := addr.AsSlice()
+	bits := prefix.Bits()
+	if addr.Is4() && prefix.Addr().Is4In6() {
+		bits -= 96
+	}
+	for i := range b {
+		if keep := bits - i*8; keep <= 0 {
+			b[i] = 0xff
+		} else if keep < 8 {
+			b[i] |= 0xff >> keep
+		}
+	}
+	last, _ := netip.AddrFromSlice(b)
+	return last
+}
@@ -0,0 +1,148 @@
+package hostmap
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/netutil"
+)
+
+var mapEntries = metrics.NewGaugeVec(
+	"forwarder_host_map_entries",
+	"Hosts listed in a loaded host map file",
+	"file",
+)
+
+// Map is a compiled host to backend mapping. Exact hosts are looked up
+// directly. A "*.example.com" entry covers example.com and its subdomains
+// at any depth, and the longest matching wildcard wins. Exact entries
+// take precedence over wildcards.
+type Map struct {
+	exact    map[string]string
+	wildcard map[string]string // keyed by the domain after "*."
+}
+
+// Lookup returns the backend address for host, which may carry a port
+func (m *Map) Lookup(host string) (string, bool) {
+	host = strings.TrimSuffix(strings.ToLower(netutil.Hostname(host)), ".")
+	if addr, ok := m.exact[host]; ok {
+		return addr, true
+	}
+	if len(m.wildcard) == 0 {
+		return "", false
+	}
+	for domain := host; domain != ""; {
+		if addr, ok := m.wildcard[domain]; ok {
+			return addr, true
+		}
+		_, parent, found := strings.Cut(domain, ".")
+		if !found {
+			break
+		}
+		domain = parent
+	}
+	return "", false
+}
+
+// Len returns the number of entries
+func (m *Map) Len() int {
+	return len(m.exact) + len(m.wildcard)
+}
+
+// cached is a compiled file and the state of the file it was read from
+type cached struct {
+	m       *Map
+	size    int64
+	modTime time.Time
+}
+
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]cached)
+)
+
+// Load reads and compiles the host map in path. The compiled map is kept
+// until the file changes, so loading an unchanged file again, as every
+// reload does, is cheap.
+func Load(path string) (*Map, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host map: %w", err)
+	}
+
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if c, ok := cache[path]; ok && c.size == info.Size() && c.modTime.Equal(info.ModTime()) {
+		return c.m, nil
+	}
+
+	m, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	cache[path] = cached{m: m, size: info.Size(), modTime: info.ModTime()}
+	mapEntries.With(path).Set(float64(m.Len()))
+
+	log.Info().Str("file", path).Int("entries", m.Len()).Msg("host map loaded")
+	return m, nil
+}
+
+// parse compiles a host map file. Each line holds a host and a backend
+// address separated by whitespace. Blank lines and lines starting with #
+// are ignored.
+func parse(path string) (*Map, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host map: %w", err)
+	}
+	defer f.Close()
+
+	m := &Map{
+		exact:    make(map[string]string),
+		wildcard: make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a host and a backend address", path, line)
+		}
+		host := strings.TrimSuffix(strings.ToLower(fields[0]), ".")
+		addr := fields[1]
+
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid backend address: %w", path, line, err)
+		}
+
+		entries := m.exact
+		if domain, ok := strings.CutPrefix(host, "*."); ok {
+			entries, host = m.wildcard, domain
+		}
+		if host == "" || strings.Contains(host, "*") {
+			return nil, fmt.Errorf("%s:%d: invalid host %s", path, line, fields[0])
+		}
+		if _, dup := entries[host]; dup {
+			return nil, fmt.Errorf("%s:%d: duplicate host %s", path, line, fields[0])
+		}
+		entries[host] = addr
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read host map: %w", err)
+	}
+
+	return m, nil
+}
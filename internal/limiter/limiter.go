@@ -0,0 +1,100 @@
+package limiter
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	// ErrQueueFull is returned when the limiter and its queue are both full
+	ErrQueueFull = errors.New("concurrency limit reached and queue is full")
+
+	// ErrQueueTimeout is returned when a request waited too long for a slot
+	ErrQueueTimeout = errors.New("timed out waiting in queue")
+)
+
+var (
+	queueDepth = metrics.NewGaugeVec(
+		"forwarder_queue_depth",
+		"Number of requests currently waiting for a concurrency slot",
+		"node",
+	)
+	queueRejected = metrics.NewCounterVec(
+		"forwarder_queue_rejected_total",
+		"Requests rejected by the concurrency limiter",
+		"node", "reason",
+	)
+)
+
+// Limiter bounds the number of concurrent requests to a node and lets
+// excess requests wait in a bounded queue for a limited time
+type Limiter struct {
+	name         string
+	slots        chan struct{}
+	queueSize    int64
+	queueTimeout time.Duration
+	waiting      atomic.Int64
+}
+
+// New creates a limiter allowing maxConcurrent requests at once, with up to
+// queueSize requests waiting at most queueTimeout for a free slot
+func New(name string, maxConcurrent, queueSize int, queueTimeout time.Duration) *Limiter {
+	queueDepth.With(name).Set(0)
+	return &Limiter{
+		name:         name,
+		slots:        make(chan struct{}, maxConcurrent),
+		queueSize:    int64(queueSize),
+		queueTimeout: queueTimeout,
+	}
+}
+
+// Acquire obtains a concurrency slot, waiting in the queue if necessary.
+// The returned function must be called to release the slot.
+func (l *Limiter) Acquire(ctx context.Context) (func(), error) {
+	// Fast path: a slot is free
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	default:
+	}
+
+	// Join the queue if there is room
+	if l.waiting.Add(1) > l.queueSize {
+		l.waiting.Add(-1)
+		queueRejected.With(l.name, "queue_full").Inc()
+		return nil, ErrQueueFull
+	}
+	queueDepth.With(l.name).Inc()
+	defer func() {
+		l.waiting.Add(-1)
+		queueDepth.With(l.name).Dec()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return l.release, nil
+	case <-timer.C:
+		queueRejected.With(l.name, "timeout").Inc()
+		return nil, ErrQueueTimeout
+	case <-ctx.Done():
+		queueRejected.With(l.name, "canceled").Inc()
+		return nil, ctx.Err()
+	}
+}
+
+// QueueDepth returns the number of requests currently waiting
+func (l *Limiter) QueueDepth() int {
+	return int(l.waiting.Load())
+}
+
+// release frees a previously acquired slot
+func (l *Limiter) release() {
+	<-l.slots
+}
@@ -0,0 +1,87 @@
+package limiter
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	// ErrTooManyTunnels is returned when a node has no tunnel slots left
+	ErrTooManyTunnels = errors.New("too many tunnels to node")
+
+	// ErrTooManyClientTunnels is returned when one client holds too many tunnels
+	ErrTooManyClientTunnels = errors.New("too many tunnels from client")
+)
+
+var (
+	tunnelsActive = metrics.NewGaugeVec(
+		"forwarder_tunnels_active",
+		"Number of open CONNECT and WebSocket tunnels",
+		"node",
+	)
+	tunnelsRejected = metrics.NewCounterVec(
+		"forwarder_tunnels_rejected_total",
+		"Tunnels refused by the tunnel limits",
+		"node", "reason",
+	)
+)
+
+// TunnelLimiter caps the number of simultaneous tunnels to a node, overall
+// and per client
+type TunnelLimiter struct {
+	name      string
+	max       int
+	perClient int
+
+	mu      sync.Mutex
+	total   int
+	clients map[string]int
+}
+
+// NewTunnelLimiter creates a limiter allowing max tunnels in total and
+// perClient tunnels from one client. Zero means unlimited.
+func NewTunnelLimiter(name string, max, perClient int) *TunnelLimiter {
+	tunnelsActive.With(name).Set(0)
+	return &TunnelLimiter{
+		name:      name,
+		max:       max,
+		perClient: perClient,
+		clients:   make(map[string]int),
+	}
+}
+
+// Acquire reserves a tunnel slot for client. The returned function must be
+// called when the tunnel closes.
+func (l *TunnelLimiter) Acquire(client string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perClient > 0 && l.clients[client] >= l.perClient {
+		tunnelsRejected.With(l.name, "client").Inc()
+		return nil, ErrTooManyClientTunnels
+	}
+	if l.max > 0 && l.total >= l.max {
+		tunnelsRejected.With(l.name, "node").Inc()
+		return nil, ErrTooManyTunnels
+	}
+
+	l.total++
+	l.clients[client]++
+	tunnelsActive.With(l.name).Inc()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.total--
+			if l.clients[client]--; l.clients[client] == 0 {
+				delete(l.clients, client)
+			}
+			tunnelsActive.With(l.name).Dec()
+		})
+	}, nil
+}
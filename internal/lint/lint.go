@@ -0,0 +1,285 @@
+package lint
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/router"
+	"github.com/simman/go-forwarder/internal/router/matchers"
+)
+
+// Warning is a problem in a valid configuration that is likely a mistake
+type Warning struct {
+	Node    string
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Node == "" {
+		return w.Message
+	}
+	return "node " + w.Node + ": " + w.Message
+}
+
+// route is a node with its parsed rule
+type route struct {
+	node *config.Node
+	rule router.Rule
+	desc string
+}
+
+// Check looks for nodes no request can reach, nodes that would send
+// requests back to the forwarder itself, and route timeouts the write
+// timeout cuts short. cfg must already be valid.
+func Check(cfg *config.Config) []Warning {
+	var warnings []Warning
+	var routes []route
+
+	for _, svc := range cfg.Services {
+		opts := router.ParseOptions{SingleLabelWildcard: svc.HostWildcard == "single"}
+		for i := range svc.Forwarder.Nodes {
+			node := &svc.Forwarder.Nodes[i]
+			rule, err := router.NodeRule(node, opts)
+			if err != nil {
+				continue
+			}
+			r := route{node: node, rule: rule, desc: describe(node)}
+			warnings = append(warnings, missingDatabases(r, &cfg.GeoIP)...)
+			if w, ok := http3Unusable(node); ok {
+				warnings = append(warnings, w)
+			}
+			if w, ok := shadowed(r, routes); ok {
+				warnings = append(warnings, w)
+			}
+			routes = append(routes, r)
+		}
+	}
+
+	warnings = append(warnings, cutTimeouts(cfg)...)
+
+	listeners := listenAddrs(cfg)
+	for _, r := range routes {
+		if w, ok := loops(r.node, listeners); ok {
+			warnings = append(warnings, w)
+		}
+	}
+
+	return warnings
+}
+
+// shadowed reports whether an earlier route matches every request r does,
+// so r never receives traffic. Routes are matched in order across services.
+// Routes switched by a feature flag may step aside and shadow nothing.
+func shadowed(r route, earlier []route) (Warning, bool) {
+	hosts := requiredHosts(r.rule)
+	for _, e := range earlier {
+		if e.node.Flags != nil && e.node.Flags.Enabled != "" {
+			continue
+		}
+		switch {
+		case catchAll(e.rule):
+			return Warning{r.node.Name, fmt.Sprintf("unreachable, node %s matches every request first", e.node.Name)}, true
+		case e.desc == r.desc:
+			return Warning{r.node.Name, fmt.Sprintf("duplicate rule %s, node %s matches it first", r.desc, e.node.Name)}, true
+		}
+		if host, ok := hostOnly(e.rule); ok {
+			for _, h := range hosts {
+				if host.Match(&http.Request{Host: h}) {
+					return Warning{r.node.Name, fmt.Sprintf("unreachable, node %s matches every request for %s first", e.node.Name, h)}, true
+				}
+			}
+		}
+	}
+	return Warning{}, false
+}
+
+// missingDatabases warns about Country and ASN matchers without the
+// database they look addresses up in, which never match
+func missingDatabases(r route, g *config.GeoIP) []Warning {
+	var warnings []Warning
+	country, asn := usesGeoIP(r.rule)
+	if country && g.CountryDB == "" {
+		warnings = append(warnings, Warning{r.node.Name, "Country matcher never matches, geoip.country_db is not configured"})
+	}
+	if asn && g.ASNDB == "" {
+		warnings = append(warnings, Warning{r.node.Name, "ASN matcher never matches, geoip.asn_db is not configured"})
+	}
+	return warnings
+}
+
+// http3Unusable warns about backend_protocol h3 on a node whose proxy is
+// reached over plain HTTP, which QUIC cannot carry
+func http3Unusable(node *config.Node) (Warning, bool) {
+	proxy := node.ProxyURL()
+	if node.BackendProtocol != "h3" || proxy == "" || strings.HasPrefix(proxy, "https://") {
+		return Warning{}, false
+	}
+	return Warning{node.Name, "backend_protocol h3 is never used, the node's proxy is not https"}, true
+}
+
+// cutTimeouts warns about route timeouts longer than the server's write
+// timeout, which ends the upstream work first
+func cutTimeouts(cfg *config.Config) []Warning {
+	limit := cfg.Server.WriteTimeout
+	if limit <= 0 {
+		return nil
+	}
+
+	var warnings []Warning
+	if route := cfg.Server.Timeouts.Route; route > limit {
+		warnings = append(warnings, Warning{"", fmt.Sprintf("server timeouts.route %s is cut to write_timeout %s", route, limit)})
+	}
+	for _, svc := range cfg.Services {
+		for i := range svc.Forwarder.Nodes {
+			node := &svc.Forwarder.Nodes[i]
+			if node.Timeout > limit {
+				warnings = append(warnings, Warning{node.Name, fmt.Sprintf("timeout %s is cut to the server write_timeout %s", node.Timeout, limit)})
+			}
+		}
+	}
+	return warnings
+}
+
+// usesGeoIP reports whether rule contains Country or ASN matchers
+func usesGeoIP(rule router.Rule) (country, asn bool) {
+	switch r := rule.(type) {
+	case *matchers.CountryMatcher:
+		return true, false
+	case *matchers.ASNMatcher:
+		return false, true
+	case *router.AndRule:
+		lc, la := usesGeoIP(r.Left)
+		rc, ra := usesGeoIP(r.Right)
+		return lc || rc, la || ra
+	case *router.OrRule:
+		lc, la := usesGeoIP(r.Left)
+		rc, ra := usesGeoIP(r.Right)
+		return lc || rc, la || ra
+	case *router.NotRule:
+		return usesGeoIP(r.Inner)
+	}
+	return false, false
+}
+
+// catchAll reports whether rule matches every request
+func catchAll(rule router.Rule) bool {
+	switch r := rule.(type) {
+	case *matchers.PathPrefixMatcher:
+		return r.Prefix == "" || r.Prefix == "/"
+	case *router.AndRule:
+		return catchAll(r.Left) && catchAll(r.Right)
+	case *router.OrRule:
+		return catchAll(r.Left) || catchAll(r.Right)
+	}
+	return false
+}
+
+// hostOnly returns the host matcher of a rule that matches on the host alone
+func hostOnly(rule router.Rule) (*matchers.HostMatcher, bool) {
+	switch r := rule.(type) {
+	case *matchers.HostMatcher:
+		return r, true
+	case *router.AndRule:
+		if catchAll(r.Right) {
+			return hostOnly(r.Left)
+		}
+		if catchAll(r.Left) {
+			return hostOnly(r.Right)
+		}
+	}
+	return nil, false
+}
+
+// requiredHosts returns the exact hosts a request must have to match rule
+func requiredHosts(rule router.Rule) []string {
+	switch r := rule.(type) {
+	case *matchers.HostMatcher:
+		if !strings.Contains(r.Pattern, "*") {
+			return []string{r.Pattern}
+		}
+	case *router.AndRule:
+		return append(requiredHosts(r.Left), requiredHosts(r.Right)...)
+	}
+	return nil
+}
+
+// describe returns the rule of a node as written in the config
+func describe(node *config.Node) string {
+	var rule string
+	if node.Filter != nil {
+		rule = "Host{" + node.Filter.Host + "}"
+	}
+	if node.Matcher != nil {
+		rule = strings.Join(strings.Fields(node.Matcher.Rule), " ")
+	}
+	if node.HostMap != "" {
+		rule = strings.TrimSuffix("HostMap{"+node.HostMap+"} && "+rule, " && ")
+	}
+	return rule
+}
+
+// listenAddrs returns the addresses the forwarder accepts requests on
+func listenAddrs(cfg *config.Config) []string {
+	addrs := []string{cfg.Server.Addr}
+	for _, svc := range cfg.Services {
+		if svc.Addr != "" {
+			addrs = append(addrs, svc.Addr)
+		}
+	}
+	return addrs
+}
+
+// loops reports whether a node without a proxy sends requests to one of
+// the forwarder's own listeners
+func loops(node *config.Node, listeners []string) (Warning, bool) {
+	if node.ProxyURL() != "" {
+		return Warning{}, false
+	}
+
+	targets := append([]string{node.Addr}, node.Backends...)
+	if node.Canary != nil && node.Canary.Proxy == "" {
+		targets = append(targets, node.Canary.Addr)
+	}
+	for _, target := range targets {
+		for _, listener := range listeners {
+			if sameEndpoint(target, listener) {
+				return Warning{node.Name, fmt.Sprintf("addr %s is the forwarder's own listener %s, requests would loop", target, listener)}, true
+			}
+		}
+	}
+	return Warning{}, false
+}
+
+// sameEndpoint reports whether target reaches listener on this machine.
+// Names other than localhost are not resolved.
+func sameEndpoint(target, listener string) bool {
+	thost, tport, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	lhost, lport, err := net.SplitHostPort(listener)
+	if err != nil || tport != lport {
+		return false
+	}
+	if strings.EqualFold(thost, lhost) {
+		return true
+	}
+	// A listener on all interfaces is reached through any local address
+	return isLocal(thost) && (lhost == "" || isUnspecified(lhost) || isLocal(lhost))
+}
+
+func isLocal(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsUnspecified())
+}
+
+func isUnspecified(host string) bool {
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
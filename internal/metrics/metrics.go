@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// collector is implemented by every metric family that can be exported
+type collector interface {
+	describe() (name, help, kind string)
+	write(w io.Writer)
+}
+
+// Registry holds a set of metric families
+type Registry struct {
+	mu         sync.RWMutex
+	collectors map[string]collector
+}
+
+// Default is the registry used by the package-level constructors
+var Default = NewRegistry()
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{
+		collectors: make(map[string]collector),
+	}
+}
+
+// register adds a collector to the registry, panicking on duplicate names
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	name, _, _ := c.describe()
+	if _, exists := r.collectors[name]; exists {
+		panic(fmt.Sprintf("metrics: duplicate metric %s", name))
+	}
+	r.collectors[name] = c
+}
+
+// Write writes all metrics in the Prometheus text exposition format
+func (r *Registry) Write(w io.Writer) {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.collectors))
+	for name := range r.collectors {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		r.mu.RLock()
+		c := r.collectors[name]
+		r.mu.RUnlock()
+
+		_, help, kind := c.describe()
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+		c.write(w)
+	}
+}
+
+// Handler returns an HTTP handler serving the default registry
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		Default.Write(w)
+	})
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels renders label names and values as {a="x",b="y"}
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// escapeLabel escapes a label value for the text format
+func escapeLabel(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	v = strings.ReplaceAll(v, "\n", `\n`)
+	return strings.ReplaceAll(v, `"`, `\"`)
+}
+
+// checkLabels panics if the number of label values is wrong
+func checkLabels(name string, names, values []string) {
+	if len(names) != len(values) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", name, len(names), len(values)))
+	}
+}
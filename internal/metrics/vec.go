@@ -0,0 +1,202 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// value is an atomically updated float64
+type value struct {
+	bits uint64
+}
+
+func (v *value) add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		next := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, next) {
+			return
+		}
+	}
+}
+
+func (v *value) set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) get() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// series holds one labelled value of a counter or gauge family
+type series struct {
+	labels []string
+	value
+}
+
+// family is the shared implementation behind CounterVec and GaugeVec
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.RWMutex
+	series map[string]*series
+}
+
+func newFamily(name, help, kind string, labels []string) *family {
+	return &family{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		series: make(map[string]*series),
+	}
+}
+
+func (f *family) describe() (string, string, string) {
+	return f.name, f.help, f.kind
+}
+
+// get returns the series for the given label values, creating it if needed
+func (f *family) get(values []string) *series {
+	checkLabels(f.name, f.labels, values)
+	key := labelKey(values)
+
+	f.mu.RLock()
+	s, ok := f.series[key]
+	f.mu.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if s, ok = f.series[key]; ok {
+		return s
+	}
+	s = &series{labels: append([]string(nil), values...)}
+	f.series[key] = s
+	return s
+}
+
+// delete removes the series for the given label values
+func (f *family) delete(values []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.series, labelKey(values))
+}
+
+func (f *family) write(w io.Writer) {
+	f.mu.RLock()
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	rows := make([]*series, len(keys))
+	for i, k := range keys {
+		rows[i] = f.series[k]
+	}
+	f.mu.RUnlock()
+
+	for _, s := range rows {
+		fmt.Fprintf(w, "%s%s %v\n", f.name, formatLabels(f.labels, s.labels), s.get())
+	}
+}
+
+// CounterVec is a family of monotonically increasing counters
+type CounterVec struct {
+	*family
+}
+
+// Counter is a single labelled counter
+type Counter struct {
+	s *series
+}
+
+// NewCounterVec creates and registers a counter family in the default registry
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{family: newFamily(name, help, "counter", labels)}
+	Default.register(c)
+	return c
+}
+
+// With returns the counter for the given label values
+func (c *CounterVec) With(values ...string) Counter {
+	return Counter{s: c.get(values)}
+}
+
+// Delete removes the counter for the given label values
+func (c *CounterVec) Delete(values ...string) {
+	c.delete(values)
+}
+
+// Inc increments the counter by one
+func (c Counter) Inc() {
+	c.s.add(1)
+}
+
+// Add increments the counter by delta, which must not be negative
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		return
+	}
+	c.s.add(delta)
+}
+
+// GaugeVec is a family of gauges that can go up and down
+type GaugeVec struct {
+	*family
+}
+
+// Gauge is a single labelled gauge
+type Gauge struct {
+	s *series
+}
+
+// NewGaugeVec creates and registers a gauge family in the default registry
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{family: newFamily(name, help, "gauge", labels)}
+	Default.register(g)
+	return g
+}
+
+// With returns the gauge for the given label values
+func (g *GaugeVec) With(values ...string) Gauge {
+	return Gauge{s: g.get(values)}
+}
+
+// Delete removes the gauge for the given label values
+func (g *GaugeVec) Delete(values ...string) {
+	g.delete(values)
+}
+
+// Set sets the gauge to v
+func (g Gauge) Set(v float64) {
+	g.s.set(v)
+}
+
+// Inc increments the gauge by one
+func (g Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec decrements the gauge by one
+func (g Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// Add adds delta to the gauge
+func (g Gauge) Add(delta float64) {
+	g.s.add(delta)
+}
+
+// Value returns the current gauge value
+func (g Gauge) Value() float64 {
+	return g.s.get()
+}
@@ -0,0 +1,264 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+)
+
+// DefaultSniffTimeout is how long a connection may stay silent before it
+// is treated as a protocol where the server speaks first
+const DefaultSniffTimeout = 300 * time.Millisecond
+
+// sniffLen is the number of bytes read to tell protocols apart, enough
+// for the longest common request method and a space
+const sniffLen = 10
+
+// helloTimeout bounds the wait for the rest of a ClientHello record once
+// its first bytes arrived
+const helloTimeout = 5 * time.Second
+
+// maxRecordLen is the largest TLS record payload
+const maxRecordLen = 16384
+
+var connections = metrics.NewCounterVec(
+	"forwarder_mux_connections_total",
+	"Connections accepted on mux listeners by detected protocol",
+	"addr", "protocol",
+)
+
+// Options controls how a Listener dispatches connections
+type Options struct {
+	TLSConfig    *tls.Config    // terminates TLS for HTTPS, nil treats TLS as raw traffic
+	Raw          func(net.Conn) // handles traffic that isn't HTTP, nil closes it
+	SniffTimeout time.Duration  // default DefaultSniffTimeout
+
+	// Passthrough is offered every TLS connection, with the server name
+	// its ClientHello asks for, before it is terminated. It returns the
+	// func that relays the connection without decrypting it, or nil to
+	// leave the connection to termination or Raw.
+	Passthrough func(conn net.Conn, serverName string) func()
+}
+
+// Listener serves plain HTTP, HTTPS and raw TCP on one port. It peeks at
+// the first bytes of every connection: HTTP and, with a TLS config,
+// TLS-terminated HTTPS are returned from Accept for an http.Server, TLS
+// the Passthrough handler takes is relayed as is, and anything else is
+// passed to the Raw handler.
+type Listener struct {
+	net.Listener
+	opts Options
+
+	conns chan net.Conn
+	errs  chan error
+	done  chan struct{}
+	once  sync.Once
+}
+
+// New wraps inner and starts dispatching its connections
+func New(inner net.Listener, opts Options) *Listener {
+	if opts.SniffTimeout == 0 {
+		opts.SniffTimeout = DefaultSniffTimeout
+	}
+
+	l := &Listener{
+		Listener: inner,
+		opts:     opts,
+		conns:    make(chan net.Conn),
+		errs:     make(chan error),
+		done:     make(chan struct{}),
+	}
+	go l.serve()
+	return l
+}
+
+// Accept returns the next HTTP or HTTPS connection
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections
+func (l *Listener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return l.Listener.Close()
+}
+
+// serve accepts connections from the wrapped listener and sniffs each one
+// in its own goroutine, so a slow client doesn't hold up the others
+func (l *Listener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.dispatch(conn)
+	}
+}
+
+// dispatch detects the protocol of conn and hands it on
+func (l *Listener) dispatch(conn net.Conn) {
+	br := bufio.NewReaderSize(conn, 4096)
+
+	conn.SetReadDeadline(time.Now().Add(l.opts.SniffTimeout))
+	head, err := br.Peek(sniffLen)
+	conn.SetReadDeadline(time.Time{})
+
+	var ne net.Error
+	silent := len(head) == 0 && errors.As(err, &ne) && ne.Timeout()
+	if len(head) == 0 && !silent {
+		conn.Close()
+		return
+	}
+
+	peeked := &peekedConn{Conn: conn, r: br}
+	addr := l.Listener.Addr().String()
+
+	tlsHello := isTLS(head) && (l.opts.TLSConfig != nil || l.opts.Passthrough != nil)
+	var relay func()
+	if tlsHello {
+		l.fingerprint(peeked, br)
+		if l.opts.Passthrough != nil {
+			relay = l.opts.Passthrough(peeked, serverName(peeked))
+		}
+	}
+
+	switch {
+	case isHTTP(head):
+		connections.With(addr, "http").Inc()
+		l.deliver(peeked)
+	case relay != nil:
+		connections.With(addr, "sni").Inc()
+		relay()
+	case tlsHello && l.opts.TLSConfig != nil:
+		connections.With(addr, "https").Inc()
+		l.deliver(tls.Server(peeked, l.opts.TLSConfig))
+	case l.opts.Raw != nil:
+		connections.With(addr, "raw").Inc()
+		l.opts.Raw(peeked)
+	default:
+		connections.With(addr, "rejected").Inc()
+		conn.Close()
+	}
+}
+
+// fingerprint reads the ClientHello record of conn from br to compute its
+// JA3 and JA4 fingerprints, and puts the record back for the TLS handshake
+func (l *Listener) fingerprint(conn *peekedConn, br *bufio.Reader) {
+	head, err := br.Peek(5)
+	if err != nil {
+		return
+	}
+	n := int(head[3])<<8 | int(head[4])
+	if n > maxRecordLen {
+		return
+	}
+
+	record := make([]byte, 5+n)
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	read, err := io.ReadFull(br, record)
+	conn.SetReadDeadline(time.Time{})
+	conn.r = io.MultiReader(bytes.NewReader(record[:read]), br)
+	if err != nil {
+		return
+	}
+
+	fp, err := tlsfp.Parse(record)
+	if err != nil {
+		log.Debug().Err(err).Str("client", conn.RemoteAddr().String()).Msg("failed to fingerprint client hello")
+		return
+	}
+	conn.fp = fp
+	log.Debug().
+		Str("client", conn.RemoteAddr().String()).
+		Str("ja3", fp.JA3).
+		Str("ja4", fp.JA4).
+		Msg("client hello fingerprinted")
+}
+
+// Fingerprint returns the TLS fingerprint of the client of conn, a
+// connection accepted from a Listener, or nil when it has none
+func Fingerprint(conn net.Conn) *tlsfp.Fingerprint {
+	if tc, ok := conn.(*tls.Conn); ok {
+		conn = tc.NetConn()
+	}
+	if pc, ok := conn.(*peekedConn); ok {
+		return pc.fp
+	}
+	return nil
+}
+
+// serverName returns the SNI of the ClientHello read from conn
+func serverName(conn *peekedConn) string {
+	if conn.fp == nil {
+		return ""
+	}
+	return conn.fp.ServerName
+}
+
+// deliver passes conn to Accept
+func (l *Listener) deliver(conn net.Conn) {
+	select {
+	case l.conns <- conn:
+	case <-l.done:
+		conn.Close()
+	}
+}
+
+// isTLS reports whether head starts a TLS handshake record
+func isTLS(head []byte) bool {
+	return len(head) >= 3 && head[0] == 0x16 && head[1] == 0x03
+}
+
+// isHTTP reports whether head starts with a request method: upper-case
+// letters followed by a space, as in "GET /" or "PRI * HTTP/2.0"
+func isHTTP(head []byte) bool {
+	for i, b := range head {
+		switch {
+		case b == ' ':
+			return i >= 3
+		case b < 'A' || b > 'Z':
+			return false
+		}
+	}
+	return false
+}
+
+// peekedConn is a connection whose first bytes were read into r
+type peekedConn struct {
+	net.Conn
+	r  io.Reader
+	fp *tlsfp.Fingerprint // of a TLS client
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// NetConn returns the accepted connection
+func (c *peekedConn) NetConn() net.Conn {
+	return c.Conn
+}
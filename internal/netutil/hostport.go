@@ -0,0 +1,54 @@
+package netutil
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Hostname returns the host part of a "host", "host:port", "[v6]" or
+// "[v6]:port" string, with any IPv6 brackets removed. A zone escaped as
+// %25, as in URLs and Host headers, is unescaped like net/url does.
+func Hostname(hostport string) string {
+	host := hostport
+	if h, _, err := net.SplitHostPort(hostport); err == nil {
+		host = h
+	} else if strings.HasPrefix(hostport, "[") && strings.HasSuffix(hostport, "]") {
+		// No port: strip brackets of an IPv6 literal
+		host = hostport[1 : len(hostport)-1]
+	}
+	if strings.Contains(host, ":") {
+		host = strings.Replace(host, "%25", "%", 1)
+	}
+	return host
+}
+
+// HostHeader returns the Host header value for an upstream address: the
+// host without its port, with IPv6 literals kept in brackets. The zone only
+// means something to this machine and is left out, like net/http does.
+func HostHeader(addr string) string {
+	host := Hostname(addr)
+	if strings.Contains(host, ":") {
+		host, _, _ = strings.Cut(host, "%")
+		return "[" + host + "]"
+	}
+	return host
+}
+
+// URLAddr returns host:port of a URL, adding the scheme's default port
+func URLAddr(u *url.URL) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// BracketedIPv6 reports whether an address containing an IPv6 literal uses
+// the required [v6]:port form, so the port can be told apart
+func BracketedIPv6(addr string) bool {
+	return strings.Count(addr, ":") < 2 || strings.HasPrefix(addr, "[")
+}
@@ -0,0 +1,93 @@
+package netutil
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestHostname(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "example.com"},
+		{"example.com:8080", "example.com"},
+		{"127.0.0.1:80", "127.0.0.1"},
+		{"[::1]:8080", "::1"},
+		{"[::1]", "::1"},
+		{"::1", "::1"},
+		{"[fe80::1%25eth0]:8080", "fe80::1%eth0"},
+		{"[fe80::1%25eth0]", "fe80::1%eth0"},
+		{"[fe80::1%eth0]:8080", "fe80::1%eth0"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Hostname(tt.in); got != tt.want {
+			t.Errorf("Hostname(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"example.com:8080", "example.com"},
+		{"example.com", "example.com"},
+		{"[::1]:8080", "[::1]"},
+		{"[::1]", "[::1]"},
+		{"[fe80::1%25eth0]:8080", "[fe80::1]"},
+		{"[fe80::1%eth0]", "[fe80::1]"},
+	}
+	for _, tt := range tests {
+		if got := HostHeader(tt.in); got != tt.want {
+			t.Errorf("HostHeader(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestURLAddr(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"http://example.com/", "example.com:80"},
+		{"https://example.com/", "example.com:443"},
+		{"http://example.com:8080/", "example.com:8080"},
+		{"http://[::1]:8080/", "[::1]:8080"},
+		{"http://[::1]/", "[::1]:80"},
+		{"https://[::1]/", "[::1]:443"},
+		{"http://[fe80::1%25eth0]/", "[fe80::1%eth0]:80"},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.in)
+		if err != nil {
+			t.Fatalf("url.Parse(%q): %v", tt.in, err)
+		}
+		if got := URLAddr(u); got != tt.want {
+			t.Errorf("URLAddr(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBracketedIPv6(t *testing.T) {
+	tests := []struct {
+		in   string
+		want bool
+	}{
+		{"example.com:8080", true},
+		{"127.0.0.1:80", true},
+		{"[::1]:8080", true},
+		{"[::1]", true},
+		{"[fe80::1%25eth0]:8080", true},
+		{"::1", false},
+		{"::1:8080", false},
+		{"fe80::1%eth0", false},
+	}
+	for _, tt := range tests {
+		if got := BracketedIPv6(tt.in); got != tt.want {
+			t.Errorf("BracketedIPv6(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
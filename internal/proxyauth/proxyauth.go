@@ -0,0 +1,293 @@
+package proxyauth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/netutil"
+)
+
+// maxSecret caps the size of a fetched secret
+const maxSecret = 1 << 16
+
+var credentialRefreshes = metrics.NewCounterVec(
+	"forwarder_proxy_credential_refreshes_total",
+	"Checks for new upstream proxy credentials by result (rotated, unchanged or error)",
+	"proxy", "result",
+)
+
+var (
+	mu      sync.RWMutex
+	current = make(map[string]*url.Userinfo) // keyed by proxy scheme and address
+)
+
+// key identifies a proxy by scheme, host and port
+func key(proxy *url.URL) string {
+	return proxy.Scheme + "://" + strings.ToLower(netutil.URLAddr(proxy))
+}
+
+// Userinfo returns the login to present to proxy: the current rotated
+// credentials when some are configured for it, else those in the URL
+func Userinfo(proxy *url.URL) *url.Userinfo {
+	mu.RLock()
+	user, ok := current[key(proxy)]
+	mu.RUnlock()
+
+	if ok {
+		return user
+	}
+	return proxy.User
+}
+
+// Apply returns proxy with the login to present to it
+func Apply(proxy *url.URL) *url.URL {
+	user := Userinfo(proxy)
+	if user == proxy.User {
+		return proxy
+	}
+	u := *proxy
+	u.User = user
+	return &u
+}
+
+// set publishes the credentials for a proxy
+func set(k string, user *url.Userinfo) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if user == nil {
+		delete(current, k)
+	} else {
+		current[k] = user
+	}
+}
+
+// Refresher keeps the credentials of the configured proxies current. The
+// first fetch happens before Start returns, so requests are authenticated
+// from the start. Later failures keep the last good credentials.
+type Refresher struct {
+	sources []*source
+	done    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+// source fetches the credentials of one proxy
+type source struct {
+	cfg    config.ProxyCredential
+	key    string
+	label  string
+	client *http.Client
+
+	// State of the last read file, to skip unchanged ones
+	size    int64
+	modTime time.Time
+	last    string
+}
+
+// Start fetches the credentials of every configured proxy and refreshes
+// them in the background until Stop
+func Start(cfgs []config.ProxyCredential) *Refresher {
+	r := &Refresher{done: make(chan struct{})}
+	for _, cfg := range cfgs {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			continue
+		}
+		src := &source{
+			cfg:    cfg,
+			key:    key(proxy),
+			label:  proxy.Host,
+			client: &http.Client{Timeout: 10 * time.Second},
+		}
+		r.sources = append(r.sources, src)
+
+		next := src.refresh()
+		r.wg.Add(1)
+		go r.run(src, next)
+	}
+	return r
+}
+
+// Stop ends the refreshes. The last credentials stay in effect until the
+// next Start replaces them.
+func (r *Refresher) Stop() {
+	if r == nil {
+		return
+	}
+	r.once.Do(func() {
+		close(r.done)
+		r.wg.Wait()
+	})
+}
+
+// Forget stops the refreshes and drops the credentials they published,
+// for proxies no longer configured
+func (r *Refresher) Forget(keep []config.ProxyCredential) {
+	if r == nil {
+		return
+	}
+	r.Stop()
+
+	kept := make(map[string]bool)
+	for _, cfg := range keep {
+		if proxy, err := url.Parse(cfg.Proxy); err == nil {
+			kept[key(proxy)] = true
+		}
+	}
+	for _, src := range r.sources {
+		if !kept[src.key] {
+			set(src.key, nil)
+		}
+	}
+}
+
+func (r *Refresher) run(src *source, next time.Duration) {
+	defer r.wg.Done()
+
+	for {
+		timer := time.NewTimer(next)
+		select {
+		case <-r.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		next = src.refresh()
+	}
+}
+
+// refresh fetches the credentials once and returns when to check again
+func (src *source) refresh() time.Duration {
+	next := src.cfg.Refresh
+	var (
+		login   string
+		lease   time.Duration
+		changed bool
+		err     error
+	)
+	if src.cfg.Vault != nil {
+		login, lease, err = src.readVault()
+		changed = err == nil && login != src.last
+		if lease > 0 {
+			// Fetch new credentials well before the lease runs out
+			next = min(next, lease*2/3)
+		}
+	} else {
+		login, changed, err = src.readFile()
+	}
+
+	switch {
+	case err != nil:
+		credentialRefreshes.With(src.label, "error").Inc()
+		log.Error().Err(err).Str("proxy", src.label).Msg("failed to refresh proxy credentials, keeping previous ones")
+	case !changed:
+		credentialRefreshes.With(src.label, "unchanged").Inc()
+	default:
+		user, password, _ := strings.Cut(login, ":")
+		set(src.key, url.UserPassword(user, password))
+		src.last = login
+		credentialRefreshes.With(src.label, "rotated").Inc()
+		log.Info().Str("proxy", src.label).Str("user", user).Msg("proxy credentials rotated")
+	}
+	return max(next, time.Second)
+}
+
+// readFile reads user:password from the file, reporting changed only when
+// the file was modified and holds a different login
+func (src *source) readFile() (string, bool, error) {
+	info, err := os.Stat(src.cfg.File)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read credential file: %w", err)
+	}
+	if src.last != "" && info.Size() == src.size && info.ModTime().Equal(src.modTime) {
+		return src.last, false, nil
+	}
+
+	data, err := os.ReadFile(src.cfg.File)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to read credential file: %w", err)
+	}
+	login, _, _ := strings.Cut(strings.TrimSpace(string(data)), "\n")
+	login = strings.TrimSpace(login)
+	if !strings.Contains(login, ":") {
+		return "", false, errors.New("credential file must hold user:password")
+	}
+
+	src.size, src.modTime = info.Size(), info.ModTime()
+	return login, login != src.last, nil
+}
+
+// vaultResponse is the part of a Vault read response used here. KV
+// version 2 nests the secret in data.data.
+type vaultResponse struct {
+	LeaseDuration int            `json:"lease_duration"`
+	Data          map[string]any `json:"data"`
+}
+
+// readVault reads the login from Vault and returns it with its lease
+func (src *source) readVault() (string, time.Duration, error) {
+	v := src.cfg.Vault
+	addr := v.Addr
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if addr == "" {
+		return "", 0, errors.New("vault addr is not set and VAULT_ADDR is empty")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if v.TokenFile != "" {
+		data, err := os.ReadFile(v.TokenFile)
+		if err != nil {
+			return "", 0, fmt.Errorf("failed to read vault token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(v.Path, "/"), nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid vault request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	resp, err := src.client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to read vault secret: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("failed to read vault secret: %s", resp.Status)
+	}
+
+	var secret vaultResponse
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxSecret)).Decode(&secret); err != nil {
+		return "", 0, fmt.Errorf("invalid vault response: %w", err)
+	}
+	fields := secret.Data
+	if nested, ok := fields["data"].(map[string]any); ok {
+		fields = nested
+	}
+	user, _ := fields[v.UsernameField].(string)
+	password, _ := fields[v.PasswordField].(string)
+	if user == "" {
+		return "", 0, fmt.Errorf("vault secret has no %s field", v.UsernameField)
+	}
+
+	return user + ":" + password, time.Duration(secret.LeaseDuration) * time.Second, nil
+}
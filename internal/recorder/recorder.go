@@ -0,0 +1,294 @@
+package recorder
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// redacted replaces the values of redacted headers, fields and patterns
+const redacted = "[redacted]"
+
+// redactSlack is how far bodies are captured past max_body_size, so a
+// secret starting before the cut is seen whole when it is redacted
+const redactSlack = 256
+
+// alwaysRedacted are headers carrying credentials, never recorded
+var alwaysRedacted = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// Message is a recorded request or response
+type Message struct {
+	Method    string      `json:"method,omitempty"`
+	URL       string      `json:"url,omitempty"`
+	Status    int         `json:"status,omitempty"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body,omitempty"`
+	BodySize  int64       `json:"body_size"`           // bytes sent, of which body keeps the first
+	Truncated bool        `json:"truncated,omitempty"` // body was cut at max_body_size
+	Binary    bool        `json:"binary,omitempty"`    // body isn't text and wasn't kept
+}
+
+// Recording is a request and the response it got
+type Recording struct {
+	ID       uint64    `json:"id"`
+	Node     string    `json:"node"`
+	Time     time.Time `json:"time"`
+	Duration float64   `json:"duration_ms"`
+	Client   string    `json:"client"`
+	Request  Message   `json:"request"`
+	Response Message   `json:"response"`
+}
+
+// Recorder keeps the most recent sampled recordings of a node
+type Recorder struct {
+	node    string
+	cfg     config.Recording
+	headers []string
+	fields  []redaction
+	bodies  []*regexp.Regexp
+
+	mu         sync.Mutex
+	recordings []Recording
+	next       int
+	full       bool
+	id         uint64
+}
+
+// New creates a recorder from node configuration. Patterns were checked
+// when the configuration was validated.
+func New(node string, cfg *config.Recording) *Recorder {
+	r := &Recorder{
+		node:       node,
+		cfg:        *cfg,
+		headers:    append(append([]string{}, alwaysRedacted...), cfg.RedactHeaders...),
+		recordings: make([]Recording, cfg.Size),
+	}
+	for _, field := range cfg.RedactFields {
+		name := regexp.QuoteMeta(field)
+		// Scalar JSON members at any depth, even in a body cut short,
+		// and form and query fields
+		r.fields = append(r.fields,
+			redaction{regexp.MustCompile(`("` + name + `"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s{\[][^,}\]\s]*)`), `${1}"` + redacted + `"`},
+			redaction{regexp.MustCompile(`((?:^|[?&])` + name + `=)[^&]*`), "${1}" + redacted},
+		)
+	}
+	for _, pattern := range cfg.RedactPatterns {
+		r.bodies = append(r.bodies, regexp.MustCompile(pattern))
+	}
+	return r
+}
+
+// Config returns the configuration the recorder was created from
+func (r *Recorder) Config() config.Recording {
+	return r.cfg
+}
+
+// Session records one exchange, filled in while the request is handled
+type Session struct {
+	recorder *Recorder
+	start    time.Time
+	rec      Recording
+	reqBody  *capture
+	respBody capture
+}
+
+// Start begins recording req if it is sampled, returning nil otherwise.
+// The request body is captured as it is read, so req.Body is replaced.
+func (r *Recorder) Start(req *http.Request, client string) *Session {
+	if r.cfg.Size == 0 || rand.Float64() >= r.cfg.SampleRate {
+		return nil
+	}
+
+	s := &Session{
+		recorder: r,
+		start:    time.Now(),
+		rec: Recording{
+			Node:   r.node,
+			Time:   time.Now(),
+			Client: client,
+			Request: Message{
+				Method: req.Method,
+				URL:    r.redactFields(req.URL.RequestURI()),
+				Header: r.redactHeader(req.Header),
+			},
+		},
+		respBody: capture{limit: int64(r.cfg.MaxBodySize) + redactSlack},
+	}
+	if req.Host != "" {
+		s.rec.Request.Header.Set("Host", req.Host)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		s.reqBody = &capture{limit: int64(r.cfg.MaxBodySize) + redactSlack}
+		req.Body = &teeBody{ReadCloser: req.Body, capture: s.reqBody}
+	}
+	return s
+}
+
+// WriteHeader records the response status and headers
+func (s *Session) WriteHeader(status int, header http.Header) {
+	s.rec.Response.Status = status
+	s.rec.Response.Header = s.recorder.redactHeader(header)
+}
+
+// Write records a chunk of the response body
+func (s *Session) Write(b []byte) {
+	s.respBody.write(b)
+}
+
+// Finish stores the recording
+func (s *Session) Finish() {
+	r := s.recorder
+	s.rec.Duration = float64(time.Since(s.start).Microseconds()) / 1000
+	if s.reqBody != nil {
+		r.fillBody(&s.rec.Request, s.reqBody)
+	}
+	r.fillBody(&s.rec.Response, &s.respBody)
+	if s.rec.Response.Header == nil {
+		s.rec.Response.Header = http.Header{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id++
+	s.rec.ID = r.id
+	r.recordings[r.next] = s.rec
+	r.next = (r.next + 1) % len(r.recordings)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Recordings returns the kept recordings, newest first
+func (r *Recorder) Recordings() []Recording {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.recordings)
+	}
+	out := make([]Recording, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, r.recordings[(r.next-i+len(r.recordings))%len(r.recordings)])
+	}
+	return out
+}
+
+// Clear drops the kept recordings
+func (r *Recorder) Clear() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.recordings = make([]Recording, len(r.recordings))
+	r.next = 0
+	r.full = false
+}
+
+// redactHeader returns a copy of header with redacted values replaced
+func (r *Recorder) redactHeader(header http.Header) http.Header {
+	out := header.Clone()
+	if out == nil {
+		out = http.Header{}
+	}
+	for _, name := range r.headers {
+		if _, ok := out[http.CanonicalHeaderKey(name)]; ok {
+			out.Set(name, redacted)
+		}
+	}
+	return out
+}
+
+// fillBody stores the captured body in msg, redacted and then cut at
+// max_body_size, or marks it binary
+func (r *Recorder) fillBody(msg *Message, c *capture) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	max := int(r.cfg.MaxBodySize)
+	msg.BodySize = c.size
+	msg.Truncated = c.size > int64(max)
+	if len(c.buf) == 0 || max == 0 {
+		return
+	}
+
+	body := c.buf
+	if c.size > int64(len(body)) {
+		// Don't judge the body by half a character at the end
+		for i := 0; i < utf8.UTFMax-1 && len(body) > 0 && !utf8.Valid(body); i++ {
+			body = body[:len(body)-1]
+		}
+	}
+	if !utf8.Valid(body) || bytes.IndexByte(body, 0) >= 0 {
+		msg.Binary = true
+		return
+	}
+
+	text := r.redactFields(string(body))
+	for _, re := range r.bodies {
+		text = re.ReplaceAllLiteralString(text, redacted)
+	}
+	if msg.Truncated && len(text) > max {
+		cut := max
+		for cut > 0 && !utf8.RuneStart(text[cut]) {
+			cut--
+		}
+		text = text[:cut]
+	}
+	msg.Body = text
+}
+
+// redaction replaces the value of a field
+type redaction struct {
+	re   *regexp.Regexp
+	repl string
+}
+
+// redactFields replaces the values of redacted fields in text
+func (r *Recorder) redactFields(text string) string {
+	for _, f := range r.fields {
+		text = f.re.ReplaceAllString(text, f.repl)
+	}
+	return text
+}
+
+// capture keeps the first limit bytes written to it and counts the rest.
+// Request bodies may still be read by the transport when the exchange is
+// finished, so it is locked.
+type capture struct {
+	mu    sync.Mutex
+	limit int64
+	buf   []byte
+	size  int64
+}
+
+func (c *capture) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size += int64(len(b))
+	if room := c.limit - int64(len(c.buf)); room > 0 {
+		if int64(len(b)) > room {
+			b = b[:room]
+		}
+		c.buf = append(c.buf, b...)
+	}
+}
+
+// teeBody captures a request body as it is read
+type teeBody struct {
+	io.ReadCloser
+	capture *capture
+}
+
+func (t *teeBody) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.capture.write(p[:n])
+	return n, err
+}
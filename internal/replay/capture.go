@@ -0,0 +1,198 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/accesslog"
+)
+
+// Request is a recorded request to replay
+type Request struct {
+	Offset time.Duration // since the first request of the capture
+	Method string
+	Host   string
+	URI    string // path and query
+	Header http.Header
+	Body   []byte
+	Status int    // recorded response status, 0 if unknown
+	Node   string // node that served it, if the capture says
+}
+
+// Load reads a capture: a HAR file as exported by browsers and proxies
+// like Proxyman, or a forwarder access log in JSON lines. Requests are
+// returned in the order they were made.
+func Load(path string) ([]Request, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read capture: %w", err)
+	}
+
+	var reqs []Request
+	if isHAR(data) {
+		reqs, err = parseHAR(data)
+	} else {
+		reqs, err = parseAccessLog(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reqs) == 0 {
+		return nil, errors.New("capture holds no requests")
+	}
+
+	sort.SliceStable(reqs, func(i, j int) bool { return reqs[i].Offset < reqs[j].Offset })
+	first := reqs[0].Offset
+	for i := range reqs {
+		reqs[i].Offset -= first
+	}
+	return reqs, nil
+}
+
+// isHAR reports whether data is a HAR document rather than JSON lines
+func isHAR(data []byte) bool {
+	var doc struct {
+		Log json.RawMessage `json:"log"`
+	}
+	return json.Unmarshal(data, &doc) == nil && doc.Log != nil
+}
+
+type harFile struct {
+	Log struct {
+		Entries []harEntry `json:"entries"`
+	} `json:"log"`
+}
+
+type harEntry struct {
+	StartedDateTime time.Time `json:"startedDateTime"`
+	Request         struct {
+		Method   string      `json:"method"`
+		URL      string      `json:"url"`
+		Headers  []harHeader `json:"headers"`
+		PostData *struct {
+			Text string `json:"text"`
+		} `json:"postData"`
+	} `json:"request"`
+	Response struct {
+		Status int `json:"status"`
+	} `json:"response"`
+}
+
+type harHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// skipHeaders are recorded headers not replayed: framing is redone for the
+// replayed body and hop-by-hop headers belong to the recorded connection
+var skipHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Proxy-Connection":  true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Te":                true,
+}
+
+func parseHAR(data []byte) ([]Request, error) {
+	var har harFile
+	if err := json.Unmarshal(data, &har); err != nil {
+		return nil, fmt.Errorf("invalid HAR file: %w", err)
+	}
+
+	reqs := make([]Request, 0, len(har.Log.Entries))
+	for i, e := range har.Log.Entries {
+		if e.Request.Method == http.MethodConnect {
+			continue
+		}
+		u, err := url.Parse(e.Request.URL)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid HAR entry %d: bad url %q", i, e.Request.URL)
+		}
+
+		req := Request{
+			Method: e.Request.Method,
+			Host:   u.Host,
+			URI:    u.RequestURI(),
+			Header: make(http.Header),
+			Status: e.Response.Status,
+			Offset: time.Duration(e.StartedDateTime.UnixNano()),
+		}
+		for _, h := range e.Request.Headers {
+			// HTTP/2 captures list pseudo-headers like :authority
+			if strings.HasPrefix(h.Name, ":") {
+				if h.Name == ":authority" {
+					req.Host = h.Value
+				}
+				continue
+			}
+			name := http.CanonicalHeaderKey(h.Name)
+			if name == "Host" {
+				req.Host = h.Value
+			}
+			if !skipHeaders[name] {
+				req.Header.Add(name, h.Value)
+			}
+		}
+		if e.Request.PostData != nil {
+			req.Body = []byte(e.Request.PostData.Text)
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+// parseAccessLog reads access log entries. They carry no bodies and only
+// the headers listed in access_log.headers, and paths without the query.
+func parseAccessLog(data []byte) ([]Request, error) {
+	var reqs []Request
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var e accesslog.Entry
+		if err := json.Unmarshal(text, &e); err != nil {
+			return nil, fmt.Errorf("invalid capture at line %d: neither HAR nor access log: %w", line, err)
+		}
+		if e.Method == "" || e.Method == http.MethodConnect {
+			continue
+		}
+
+		req := Request{
+			Method: e.Method,
+			Host:   e.Host,
+			URI:    (&url.URL{Path: e.Path}).RequestURI(),
+			Header: make(http.Header),
+			Status: e.Status,
+			Node:   e.Node,
+			Offset: time.Duration(e.Time.UnixNano()),
+		}
+		for name, value := range e.Headers {
+			if !skipHeaders[http.CanonicalHeaderKey(name)] {
+				req.Header.Set(name, value)
+			}
+		}
+		if e.UserAgent != "" && req.Header.Get("User-Agent") == "" {
+			req.Header.Set("User-Agent", e.UserAgent)
+		}
+		reqs = append(reqs, req)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read capture: %w", err)
+	}
+	return reqs, nil
+}
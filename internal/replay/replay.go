@@ -0,0 +1,235 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+// changeExamples is how many requests are listed per routing change
+const changeExamples = 3
+
+// Options control a replay
+type Options struct {
+	Target      *url.URL      // forwarder to send requests to, only scheme and host are used
+	Rate        float64       // requests per second, 0 keeps the recorded timing
+	Speed       float64       // multiplies the recorded pace, default 1
+	Concurrency int           // most requests in flight, default 32
+	Timeout     time.Duration // per request, default 30s
+	Insecure    bool          // skip certificate verification of an https target
+
+	// Route returns the node a request is routed to. When nil, the node is
+	// read from the X-Forwarder-Node debug header of the response.
+	Route func(*http.Request) string
+}
+
+// Report summarizes a replay
+type Report struct {
+	Requests      int           `json:"requests"`
+	Errors        int           `json:"errors"`
+	Statuses      map[int]int   `json:"statuses"`
+	StatusChanged int           `json:"status_changed"` // answered with another status than recorded
+	Duration      time.Duration `json:"duration_ns"`
+	Latency       Latency       `json:"latency"`
+	Changes       []Change      `json:"routing_changes"`
+}
+
+// Latency percentiles of complete responses
+type Latency struct {
+	P50 time.Duration `json:"p50_ns"`
+	P90 time.Duration `json:"p90_ns"`
+	P99 time.Duration `json:"p99_ns"`
+	Max time.Duration `json:"max_ns"`
+}
+
+// Change counts requests routed to another node than recorded
+type Change struct {
+	From     string   `json:"from"` // recorded node
+	To       string   `json:"to"`   // node now, empty when unmatched
+	Count    int      `json:"count"`
+	Examples []string `json:"examples"`
+}
+
+// result is the outcome of one replayed request
+type result struct {
+	req      *Request
+	status   int
+	node     string
+	routed   bool // node is known
+	duration time.Duration
+	err      error
+}
+
+// Run replays reqs against the target. Requests are sent at their recorded
+// offsets, or evenly at the configured rate; when the concurrency limit is
+// reached later requests wait and the replay runs behind schedule.
+func Run(ctx context.Context, reqs []Request, opts Options) *Report {
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 32
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	transport := &http.Transport{
+		MaxIdleConnsPerHost: opts.Concurrency,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: opts.Insecure},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   opts.Timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			// Redirects are results like any other response
+			return http.ErrUseLastResponse
+		},
+	}
+
+	results := make([]result, len(reqs))
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+
+schedule:
+	for i := range reqs {
+		due := time.Duration(float64(reqs[i].Offset) / opts.Speed)
+		if opts.Rate > 0 {
+			due = time.Duration(float64(i) / opts.Rate * float64(time.Second))
+		}
+		if wait := time.Until(start.Add(due)); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+				break schedule
+			}
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break schedule
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = send(ctx, client, &reqs[i], opts)
+		}(i)
+	}
+	wg.Wait()
+
+	return summarize(results, time.Since(start))
+}
+
+// send replays one request and reads the whole response
+func send(ctx context.Context, client *http.Client, rec *Request, opts Options) result {
+	res := result{req: rec}
+
+	u := *opts.Target
+	u.Path, u.RawQuery = "", ""
+	req, err := http.NewRequestWithContext(ctx, rec.Method, u.String()+rec.URI, bytes.NewReader(rec.Body))
+	if err != nil {
+		res.err = err
+		return res
+	}
+	req.Host = rec.Host
+	req.Header = rec.Header.Clone()
+	if len(rec.Body) == 0 {
+		req.Body, req.ContentLength = http.NoBody, 0
+	}
+
+	if opts.Route != nil {
+		res.node, res.routed = opts.Route(req), true
+	}
+
+	started := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.err = err
+		return res
+	}
+	_, err = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	res.duration = time.Since(started)
+	res.status = resp.StatusCode
+	res.err = err
+
+	if node := resp.Header.Get("X-Forwarder-Node"); opts.Route == nil && node != "" {
+		res.node, res.routed = node, true
+	}
+	return res
+}
+
+// summarize builds the report of a replay that took elapsed
+func summarize(results []result, elapsed time.Duration) *Report {
+	report := &Report{
+		Statuses: make(map[int]int),
+		Duration: elapsed,
+		Changes:  make([]Change, 0),
+	}
+
+	var durations []time.Duration
+	changes := make(map[[2]string]*Change)
+	for _, res := range results {
+		if res.req == nil {
+			continue // not sent, the replay was canceled
+		}
+		report.Requests++
+		if res.err != nil {
+			report.Errors++
+			continue
+		}
+		report.Statuses[res.status]++
+		durations = append(durations, res.duration)
+		if res.req.Status != 0 && res.req.Status != res.status {
+			report.StatusChanged++
+		}
+
+		if !res.routed || res.req.Node == "" || res.req.Node == res.node {
+			continue
+		}
+		key := [2]string{res.req.Node, res.node}
+		c, ok := changes[key]
+		if !ok {
+			c = &Change{From: res.req.Node, To: res.node}
+			changes[key] = c
+		}
+		c.Count++
+		if len(c.Examples) < changeExamples {
+			c.Examples = append(c.Examples, res.req.Method+" "+res.req.Host+res.req.URI)
+		}
+	}
+
+	for _, c := range changes {
+		report.Changes = append(report.Changes, *c)
+	}
+	sort.Slice(report.Changes, func(i, j int) bool {
+		a, b := report.Changes[i], report.Changes[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.From+a.To < b.From+b.To
+	})
+
+	if len(durations) > 0 {
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		at := func(p float64) time.Duration {
+			return durations[int(p*float64(len(durations)-1))]
+		}
+		report.Latency = Latency{P50: at(0.5), P90: at(0.9), P99: at(0.99), Max: durations[len(durations)-1]}
+	}
+	return report
+}
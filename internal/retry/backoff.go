@@ -0,0 +1,31 @@
+package retry
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Backoff computes jittered exponential delays between attempts
+type Backoff struct {
+	Base   time.Duration // delay before the first retry
+	Max    time.Duration // upper bound of the delay
+	Jitter float64       // fraction of the delay randomized, 0-1
+}
+
+// Delay returns the wait before retry number n, starting at 1
+func (b Backoff) Delay(n int) time.Duration {
+	d := b.Base
+	for i := 1; i < n && d < b.Max; i++ {
+		d *= 2
+	}
+	if b.Max > 0 && d > b.Max {
+		d = b.Max
+	}
+
+	// Spread retries of concurrent requests so they don't arrive in waves
+	if b.Jitter > 0 {
+		spread := float64(d) * b.Jitter
+		d = time.Duration(float64(d) - spread + rand.Float64()*2*spread)
+	}
+	return d
+}
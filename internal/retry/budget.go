@@ -0,0 +1,81 @@
+package retry
+
+import (
+	"sync"
+	"time"
+)
+
+// window is the span over which the budget compares retries to requests
+const window = 10 * time.Second
+
+// Budget caps retries to a share of recent traffic so that retries can't
+// multiply the load on an upstream that is already failing
+type Budget struct {
+	ratio     float64
+	minPerSec int
+
+	mu      sync.Mutex
+	buckets [10]bucket // one per second of the window
+}
+
+type bucket struct {
+	second   int64
+	requests int
+	retries  int
+}
+
+// NewBudget creates a budget allowing retries of up to ratio of the
+// requests seen in the last ten seconds, and at least minPerSec retries
+// per second regardless of traffic
+func NewBudget(ratio float64, minPerSec int) *Budget {
+	return &Budget{ratio: ratio, minPerSec: minPerSec}
+}
+
+// Request records a first attempt
+func (b *Budget) Request() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.current(time.Now()).requests++
+}
+
+// Withdraw reserves a retry, reporting false when the budget is spent
+func (b *Budget) Withdraw() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	requests, retries := b.totals(now)
+	allowed := b.ratio * float64(requests)
+	if floor := float64(b.minPerSec) * window.Seconds(); allowed < floor {
+		allowed = floor
+	}
+	if float64(retries) >= allowed {
+		return false
+	}
+
+	b.current(now).retries++
+	return true
+}
+
+// current returns the bucket for now, resetting it if it is stale
+func (b *Budget) current(now time.Time) *bucket {
+	sec := now.Unix()
+	bk := &b.buckets[sec%int64(len(b.buckets))]
+	if bk.second != sec {
+		*bk = bucket{second: sec}
+	}
+	return bk
+}
+
+// totals sums requests and retries over the window
+func (b *Budget) totals(now time.Time) (requests, retries int) {
+	oldest := now.Unix() - int64(len(b.buckets)) + 1
+	for _, bk := range b.buckets {
+		if bk.second >= oldest {
+			requests += bk.requests
+			retries += bk.retries
+		}
+	}
+	return requests, retries
+}
@@ -0,0 +1,362 @@
+package revocation
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// DefaultCacheTTL is the longest an OCSP answer is reused
+	DefaultCacheTTL = time.Hour
+
+	// DefaultTimeout bounds one OCSP request
+	DefaultTimeout = 5 * time.Second
+
+	// crlRecheck is how often CRL files are checked for changes
+	crlRecheck = 30 * time.Second
+
+	// maxOCSPResponse bounds the size of an OCSP response
+	maxOCSPResponse = 1 << 20
+)
+
+// ErrRevoked is returned for certificates their CA has revoked
+var ErrRevoked = errors.New("certificate revoked")
+
+var checksTotal = metrics.NewCounterVec(
+	"forwarder_client_cert_checks_total",
+	"Client certificate revocation checks by source and result",
+	"source", "result",
+)
+
+// Options controls how certificates are checked
+type Options struct {
+	CRLFiles []string            // PEM or DER CRLs, issued by one of Issuers
+	OCSP     bool                // ask the responder named in each certificate
+	OCSPURL  string              // ask this responder instead
+	CacheTTL time.Duration       // default DefaultCacheTTL
+	Timeout  time.Duration       // default DefaultTimeout
+	FailOpen bool                // accept certificates whose status can't be learned
+	Issuers  []*x509.Certificate // CAs CRLs are verified against
+}
+
+// Checker rejects revoked certificates, looking them up in CRLs and
+// asking OCSP responders, whose answers are cached
+type Checker struct {
+	opts   Options
+	client *http.Client
+
+	mu       sync.Mutex
+	crls     map[string]*crlFile // by path
+	checked  time.Time           // when CRL files were last looked at
+	answers  map[string]answer   // OCSP answers by issuer and serial
+	inflight map[string]*call    // OCSP requests in progress
+}
+
+// crlFile is a loaded CRL and the file state it was read at
+type crlFile struct {
+	modTime time.Time
+	size    int64
+	issuer  []byte              // raw subject of the issuing CA
+	revoked map[string]struct{} // serial numbers
+}
+
+// answer is a cached OCSP status
+type answer struct {
+	status  int
+	expires time.Time
+}
+
+// call is an OCSP request other checks of the same certificate wait for
+type call struct {
+	done   chan struct{}
+	status int
+	err    error
+}
+
+// New loads the CRLs and returns a checker
+func New(opts Options) (*Checker, error) {
+	if opts.CacheTTL <= 0 {
+		opts.CacheTTL = DefaultCacheTTL
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = DefaultTimeout
+	}
+
+	c := &Checker{
+		opts:     opts,
+		client:   &http.Client{Timeout: opts.Timeout},
+		crls:     make(map[string]*crlFile),
+		answers:  make(map[string]answer),
+		inflight: make(map[string]*call),
+	}
+	for _, path := range opts.CRLFiles {
+		crl, err := c.loadCRL(path)
+		if err != nil {
+			return nil, err
+		}
+		c.crls[path] = crl
+	}
+	c.checked = time.Now()
+	return c, nil
+}
+
+// Check returns an error wrapping ErrRevoked if the first certificate of a
+// verified chain is revoked, or another error if its status can't be
+// learned and the checker doesn't fail open
+func (c *Checker) Check(chain []*x509.Certificate) error {
+	if len(chain) == 0 {
+		return nil
+	}
+	cert := chain[0]
+
+	if len(c.opts.CRLFiles) > 0 {
+		if c.revokedByCRL(cert) {
+			checksTotal.With("crl", "revoked").Inc()
+			return c.revoked(cert, "crl")
+		}
+		checksTotal.With("crl", "good").Inc()
+	}
+
+	if !c.opts.OCSP && c.opts.OCSPURL == "" {
+		return nil
+	}
+	if len(chain) < 2 {
+		// Self-signed, nobody to ask
+		return nil
+	}
+
+	status, err := c.ocspStatus(cert, chain[1])
+	switch {
+	case err != nil:
+		checksTotal.With("ocsp", "error").Inc()
+		log.Warn().
+			Err(err).
+			Str("subject", cert.Subject.String()).
+			Str("serial", cert.SerialNumber.Text(16)).
+			Bool("fail_open", c.opts.FailOpen).
+			Msg("client certificate status unknown")
+		if c.opts.FailOpen {
+			return nil
+		}
+		return fmt.Errorf("failed to check certificate status: %w", err)
+	case status == ocsp.Revoked:
+		checksTotal.With("ocsp", "revoked").Inc()
+		return c.revoked(cert, "ocsp")
+	case status == ocsp.Unknown:
+		checksTotal.With("ocsp", "unknown").Inc()
+		if c.opts.FailOpen {
+			return nil
+		}
+		return fmt.Errorf("certificate %s unknown to its OCSP responder", cert.SerialNumber.Text(16))
+	}
+	checksTotal.With("ocsp", "good").Inc()
+	return nil
+}
+
+// revoked logs a rejected certificate and returns its error
+func (c *Checker) revoked(cert *x509.Certificate, source string) error {
+	log.Warn().
+		Str("subject", cert.Subject.String()).
+		Str("issuer", cert.Issuer.String()).
+		Str("serial", cert.SerialNumber.Text(16)).
+		Str("source", source).
+		Msg("client certificate revoked")
+	return fmt.Errorf("%w: serial %s", ErrRevoked, cert.SerialNumber.Text(16))
+}
+
+// revokedByCRL looks the certificate up in the CRLs of its issuer,
+// reloading CRL files that changed
+func (c *Checker) revokedByCRL(cert *x509.Certificate) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.checked) >= crlRecheck {
+		c.checked = time.Now()
+		c.reloadCRLs()
+	}
+
+	serial := cert.SerialNumber.String()
+	for _, crl := range c.crls {
+		if !bytes.Equal(crl.issuer, cert.RawIssuer) {
+			continue
+		}
+		if _, ok := crl.revoked[serial]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// reloadCRLs re-reads CRL files whose size or modification time changed.
+// A file that fails to load keeps its previous contents.
+func (c *Checker) reloadCRLs() {
+	for _, path := range c.opts.CRLFiles {
+		info, err := os.Stat(path)
+		if err != nil {
+			log.Error().Err(err).Str("file", path).Msg("failed to check CRL file")
+			continue
+		}
+		if old := c.crls[path]; old != nil && info.ModTime().Equal(old.modTime) && info.Size() == old.size {
+			continue
+		}
+
+		crl, err := c.loadCRL(path)
+		if err != nil {
+			log.Error().Err(err).Str("file", path).Msg("failed to reload CRL, keeping the previous one")
+			continue
+		}
+		c.crls[path] = crl
+		log.Info().Str("file", path).Int("revoked", len(crl.revoked)).Msg("CRL reloaded")
+	}
+}
+
+// loadCRL reads a PEM or DER CRL and verifies it was signed by one of the
+// issuers
+func (c *Checker) loadCRL(path string) (*crlFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRL %s: %w", path, err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CRL %s: %w", path, err)
+	}
+	if block, _ := pem.Decode(data); block != nil {
+		data = block.Bytes
+	}
+
+	list, err := x509.ParseRevocationList(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse CRL %s: %w", path, err)
+	}
+
+	var issuer *x509.Certificate
+	for _, ca := range c.opts.Issuers {
+		if bytes.Equal(ca.RawSubject, list.RawIssuer) && list.CheckSignatureFrom(ca) == nil {
+			issuer = ca
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("CRL %s is not signed by a client CA", path)
+	}
+	if !list.NextUpdate.IsZero() && time.Now().After(list.NextUpdate) {
+		log.Warn().Str("file", path).Time("next_update", list.NextUpdate).Msg("CRL is out of date")
+	}
+
+	crl := &crlFile{
+		modTime: info.ModTime(),
+		size:    info.Size(),
+		issuer:  list.RawIssuer,
+		revoked: make(map[string]struct{}, len(list.RevokedCertificateEntries)),
+	}
+	for _, entry := range list.RevokedCertificateEntries {
+		crl.revoked[entry.SerialNumber.String()] = struct{}{}
+	}
+	return crl, nil
+}
+
+// ocspStatus returns the cached OCSP status of cert, asking its responder
+// when there is none. Concurrent checks of one certificate share a
+// request.
+func (c *Checker) ocspStatus(cert, issuer *x509.Certificate) (int, error) {
+	key := string(cert.RawIssuer) + "|" + cert.SerialNumber.String()
+
+	c.mu.Lock()
+	if a, ok := c.answers[key]; ok && time.Now().Before(a.expires) {
+		c.mu.Unlock()
+		return a.status, nil
+	}
+	if cl, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		<-cl.done
+		return cl.status, cl.err
+	}
+	cl := &call{done: make(chan struct{})}
+	c.inflight[key] = cl
+	c.mu.Unlock()
+
+	var expires time.Time
+	cl.status, expires, cl.err = c.askOCSP(cert, issuer)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if cl.err == nil {
+		// Drop expired answers now and then, the cache holds one entry
+		// per client certificate seen
+		now := time.Now()
+		for k, a := range c.answers {
+			if now.After(a.expires) {
+				delete(c.answers, k)
+			}
+		}
+		c.answers[key] = answer{status: cl.status, expires: expires}
+	}
+	c.mu.Unlock()
+	close(cl.done)
+
+	return cl.status, cl.err
+}
+
+// askOCSP asks the responder for the status of cert and returns it with
+// the time it may be reused until
+func (c *Checker) askOCSP(cert, issuer *x509.Certificate) (int, time.Time, error) {
+	url := c.opts.OCSPURL
+	if url == "" {
+		if len(cert.OCSPServer) == 0 {
+			return 0, time.Time{}, fmt.Errorf("certificate names no OCSP responder")
+		}
+		url = cert.OCSPServer[0]
+	}
+
+	der, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.opts.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(der))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to create OCSP request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to reach OCSP responder: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, time.Time{}, fmt.Errorf("OCSP responder answered %s", resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxOCSPResponse))
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("failed to read OCSP response: %w", err)
+	}
+
+	res, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return 0, time.Time{}, fmt.Errorf("invalid OCSP response: %w", err)
+	}
+
+	expires := time.Now().Add(c.opts.CacheTTL)
+	if !res.NextUpdate.IsZero() && res.NextUpdate.Before(expires) {
+		expires = res.NextUpdate
+	}
+	return res.Status, expires, nil
+}
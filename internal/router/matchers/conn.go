@@ -0,0 +1,83 @@
+package matchers
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ListenerMatcher matches requests by the local address they arrived on.
+// An address without a host, or with an unspecified one such as 0.0.0.0,
+// matches on the port alone.
+type ListenerMatcher struct {
+	Addrs []string
+}
+
+// Match checks if the request arrived on one of the listener addresses
+func (m *ListenerMatcher) Match(req *http.Request) bool {
+	local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(local.String())
+	if err != nil {
+		return false
+	}
+
+	for _, addr := range m.Addrs {
+		wantHost, wantPort, err := net.SplitHostPort(addr)
+		if err != nil || wantPort != port {
+			continue
+		}
+		if wantHost == "" || strings.EqualFold(wantHost, host) {
+			return true
+		}
+		if ip := net.ParseIP(wantHost); ip != nil && (ip.IsUnspecified() || ip.Equal(net.ParseIP(host))) {
+			return true
+		}
+	}
+	return false
+}
+
+// Protocols understood by ProtoMatcher
+var Protocols = map[string]bool{
+	"http/1.0": true,
+	"http/1.1": true,
+	"h2":       true,
+	"tls":      true,
+	"tunnel":   true,
+}
+
+// ProtoMatcher matches requests by how they reached the forwarder: the
+// negotiated HTTP version (http/1.0, http/1.1 or h2), tls when the client
+// connection is encrypted, or tunnel for CONNECT and protocol upgrade
+// requests that open a tunnel
+type ProtoMatcher struct {
+	Protos []string
+}
+
+// Match checks if the request has any of the protocols
+func (m *ProtoMatcher) Match(req *http.Request) bool {
+	for _, proto := range m.Protos {
+		if requestHasProto(req, strings.ToLower(proto)) {
+			return true
+		}
+	}
+	return false
+}
+
+func requestHasProto(req *http.Request, proto string) bool {
+	switch proto {
+	case "http/1.0":
+		return req.ProtoMajor == 1 && req.ProtoMinor == 0
+	case "http/1.1":
+		return req.ProtoMajor == 1 && req.ProtoMinor == 1
+	case "h2":
+		return req.ProtoMajor == 2
+	case "tls":
+		return req.TLS != nil
+	case "tunnel":
+		return req.Method == http.MethodConnect || req.Header.Get("Upgrade") != ""
+	}
+	return false
+}
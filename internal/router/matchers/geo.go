@@ -0,0 +1,43 @@
+package matchers
+
+import (
+	"net/http"
+
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/geoip"
+)
+
+// CountryMatcher matches requests by the country of the client address,
+// as listed in the GeoIP country database in use
+type CountryMatcher struct {
+	Codes []string // upper case ISO 3166 codes
+}
+
+// Match checks if the client address is in one of the countries
+func (m *CountryMatcher) Match(req *http.Request) bool {
+	return lookupAny(geoip.Country, req, m.Codes)
+}
+
+// ASNMatcher matches requests by the autonomous system announcing the
+// client address, as listed in the GeoIP ASN database in use
+type ASNMatcher struct {
+	Numbers []string // AS numbers without the "AS" prefix
+}
+
+// Match checks if the client address belongs to one of the networks
+func (m *ASNMatcher) Match(req *http.Request) bool {
+	return lookupAny(geoip.ASN, req, m.Numbers)
+}
+
+func lookupAny(kind geoip.Kind, req *http.Request, values []string) bool {
+	value, ok := geoip.Lookup(kind, acl.ClientIP(req))
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
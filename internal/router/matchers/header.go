@@ -31,3 +31,8 @@ func (m *HeaderRegexMatcher) Match(req *http.Request) bool {
 	}
 	return m.Pattern.MatchString(headerValue)
 }
+
+// Captures returns the groups the pattern captured from the header value
+func (m *HeaderRegexMatcher) Captures(req *http.Request) map[string]string {
+	return captures(m.Pattern, req.Header.Get(m.Key))
+}
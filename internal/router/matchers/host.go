@@ -3,11 +3,17 @@ package matchers
 import (
 	"net/http"
 	"strings"
+
+	"github.com/simman/go-forwarder/internal/netutil"
 )
 
-// HostMatcher matches requests based on the Host header
+// HostMatcher matches requests based on the Host header.
+//
+// A "**." prefix matches subdomains at any depth. A "*." prefix matches any
+// depth and the bare domain too, or exactly one label when SingleLabel is set.
 type HostMatcher struct {
-	Pattern string
+	Pattern     string
+	SingleLabel bool
 }
 
 // Match checks if the request matches the host pattern
@@ -16,20 +22,28 @@ func (m *HostMatcher) Match(req *http.Request) bool {
 	if host == "" {
 		host = req.URL.Host
 	}
-
-	// Remove port if present
-	if idx := strings.Index(host, ":"); idx != -1 {
-		host = host[:idx]
-	}
+	// Remove port and IPv6 brackets if present
+	host = strings.ToLower(netutil.Hostname(host))
+	pattern := strings.ToLower(netutil.Hostname(m.Pattern))
 
 	// Exact match
-	if m.Pattern == host {
+	if pattern == host {
 		return true
 	}
 
+	// Multi-level wildcard match (**.example.com)
+	if strings.HasPrefix(pattern, "**.") {
+		domain := pattern[3:] // Remove "**."
+		return strings.HasSuffix(host, "."+domain)
+	}
+
 	// Wildcard match (*.example.com)
-	if strings.HasPrefix(m.Pattern, "*.") {
-		domain := m.Pattern[2:] // Remove "*."
+	if strings.HasPrefix(pattern, "*.") {
+		domain := pattern[2:] // Remove "*."
+		if m.SingleLabel {
+			sub, ok := strings.CutSuffix(host, "."+domain)
+			return ok && sub != "" && !strings.Contains(sub, ".")
+		}
 		return strings.HasSuffix(host, "."+domain) || host == domain
 	}
 
@@ -0,0 +1,36 @@
+package matchers
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHostMatcherIPv6(t *testing.T) {
+	tests := []struct {
+		pattern string
+		host    string
+		want    bool
+	}{
+		{"[::1]", "[::1]:8080", true},
+		{"[::1]", "[::1]", true},
+		{"::1", "[::1]:8080", true},
+		{"[::1]:9090", "[::1]:8080", true},
+		{"[::1]", "[::2]:8080", false},
+		{"[::1]", "127.0.0.1:8080", false},
+		{"[fe80::1%eth0]", "[fe80::1%25eth0]:8080", true},
+		{"[fe80::1%eth0]", "[fe80::1%25eth0]", true},
+		{"[fe80::1%25eth0]", "[fe80::1%25eth0]:8080", true},
+		{"[fe80::1%eth0]", "[fe80::1%25eth1]:8080", false},
+		{"[fe80::1%eth0]", "[fe80::1]:8080", false},
+		{"example.com", "example.com:8080", true},
+		{"*.example.com", "api.example.com:8443", true},
+	}
+	for _, tt := range tests {
+		m := &HostMatcher{Pattern: tt.pattern}
+		req := httptest.NewRequest("GET", "http://placeholder/", nil)
+		req.Host = tt.host
+		if got := m.Match(req); got != tt.want {
+			t.Errorf("pattern %q, host %q: got %v, want %v", tt.pattern, tt.host, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package matchers
+
+import (
+	"net/http"
+
+	"github.com/simman/go-forwarder/internal/hostmap"
+)
+
+// HostMapMatcher matches requests whose host is listed in a host map
+type HostMapMatcher struct {
+	File string
+	Map  *hostmap.Map
+}
+
+// Match checks if the request host has an entry in the map
+func (m *HostMapMatcher) Match(req *http.Request) bool {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	_, ok := m.Map.Lookup(host)
+	return ok
+}
@@ -2,6 +2,8 @@ package matchers
 
 import (
 	"net/http"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -24,3 +26,38 @@ type PathPrefixMatcher struct {
 func (m *PathPrefixMatcher) Match(req *http.Request) bool {
 	return strings.HasPrefix(req.URL.Path, m.Prefix)
 }
+
+// PathRegexMatcher matches requests whose path matches a regex
+type PathRegexMatcher struct {
+	Pattern *regexp.Regexp
+}
+
+// Match checks if the request path matches the regex pattern
+func (m *PathRegexMatcher) Match(req *http.Request) bool {
+	return m.Pattern.MatchString(req.URL.Path)
+}
+
+// Captures returns the groups the pattern captured from the request path
+func (m *PathRegexMatcher) Captures(req *http.Request) map[string]string {
+	return captures(m.Pattern, req.URL.Path)
+}
+
+// captures maps the groups of pattern matched in s by number and, for named
+// groups, by name
+func captures(pattern *regexp.Regexp, s string) map[string]string {
+	match := pattern.FindStringSubmatch(s)
+	if match == nil {
+		return nil
+	}
+	groups := make(map[string]string, len(match)-1)
+	for i, name := range pattern.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+		groups[strconv.Itoa(i)] = match[i]
+		if name != "" {
+			groups[name] = match[i]
+		}
+	}
+	return groups
+}
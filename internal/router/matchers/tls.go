@@ -0,0 +1,53 @@
+package matchers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/tlsfp"
+)
+
+// JA3Matcher matches requests whose client sent a TLS ClientHello with one
+// of the JA3 hashes
+type JA3Matcher struct {
+	Hashes []string
+}
+
+// Match checks if the client's JA3 hash is one of the hashes
+func (m *JA3Matcher) Match(req *http.Request) bool {
+	fp := tlsfp.From(req.Context())
+	if fp == nil {
+		return false
+	}
+	for _, hash := range m.Hashes {
+		if strings.EqualFold(hash, fp.JA3) {
+			return true
+		}
+	}
+	return false
+}
+
+// JA4Matcher matches requests by the JA4 fingerprint of their TLS client.
+// A fingerprint may end in * to match on a prefix, such as the readable
+// first section.
+type JA4Matcher struct {
+	Fingerprints []string
+}
+
+// Match checks if the client's JA4 fingerprint is one of the fingerprints
+func (m *JA4Matcher) Match(req *http.Request) bool {
+	fp := tlsfp.From(req.Context())
+	if fp == nil {
+		return false
+	}
+	for _, want := range m.Fingerprints {
+		if prefix, ok := strings.CutSuffix(want, "*"); ok {
+			if strings.HasPrefix(fp.JA4, strings.ToLower(prefix)) {
+				return true
+			}
+		} else if strings.EqualFold(want, fp.JA4) {
+			return true
+		}
+	}
+	return false
+}
@@ -2,17 +2,34 @@ package router
 
 import (
 	"fmt"
+	"net"
 	"regexp"
 	"strings"
 
+	"github.com/simman/go-forwarder/internal/geoip"
 	"github.com/simman/go-forwarder/internal/router/matchers"
 )
 
+// ja3Pattern matches a JA3 hash
+var ja3Pattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// ParseOptions tunes how rules are parsed
+type ParseOptions struct {
+	// SingleLabelWildcard makes *.example.com match exactly one label
+	SingleLabelWildcard bool
+}
+
 // ParseRule parses a rule string into a Rule object
 func ParseRule(ruleStr string) (Rule, error) {
+	return ParseRuleWithOptions(ruleStr, ParseOptions{})
+}
+
+// ParseRuleWithOptions parses a rule string into a Rule object using opts
+func ParseRuleWithOptions(ruleStr string, opts ParseOptions) (Rule, error) {
 	p := &parser{
 		input: strings.TrimSpace(ruleStr),
 		pos:   0,
+		opts:  opts,
 	}
 	return p.parse()
 }
@@ -20,6 +37,7 @@ func ParseRule(ruleStr string) (Rule, error) {
 type parser struct {
 	input string
 	pos   int
+	opts  ParseOptions
 }
 
 // parse is the entry point for parsing
@@ -164,7 +182,7 @@ func (p *parser) parseMatcher() (Rule, error) {
 func (p *parser) createMatcher(name, value string) (Rule, error) {
 	switch name {
 	case "Host":
-		return &matchers.HostMatcher{Pattern: value}, nil
+		return &matchers.HostMatcher{Pattern: value, SingleLabel: p.opts.SingleLabelWildcard}, nil
 
 	case "Path":
 		return &matchers.PathMatcher{Path: value}, nil
@@ -172,6 +190,13 @@ func (p *parser) createMatcher(name, value string) (Rule, error) {
 	case "PathPrefix":
 		return &matchers.PathPrefixMatcher{Prefix: value}, nil
 
+	case "PathRegex":
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex pattern: %w", err)
+		}
+		return &matchers.PathRegexMatcher{Pattern: pattern}, nil
+
 	case "Method":
 		methods := strings.Split(value, ",")
 		for i := range methods {
@@ -213,6 +238,67 @@ func (p *parser) createMatcher(name, value string) (Rule, error) {
 			Value: strings.TrimSpace(parts[1]),
 		}, nil
 
+	case "Listener":
+		addrs := strings.Split(value, ",")
+		for i := range addrs {
+			addrs[i] = strings.TrimSpace(addrs[i])
+			if _, _, err := net.SplitHostPort(addrs[i]); err != nil {
+				return nil, fmt.Errorf("invalid Listener address %s, expected host:port or :port", addrs[i])
+			}
+		}
+		return &matchers.ListenerMatcher{Addrs: addrs}, nil
+
+	case "Proto":
+		protos := strings.Split(value, ",")
+		for i := range protos {
+			protos[i] = strings.ToLower(strings.TrimSpace(protos[i]))
+			if !matchers.Protocols[protos[i]] {
+				return nil, fmt.Errorf("invalid Proto %s, expected http/1.0, http/1.1, h2, tls or tunnel", protos[i])
+			}
+		}
+		return &matchers.ProtoMatcher{Protos: protos}, nil
+
+	case "Country":
+		codes := strings.Split(value, ",")
+		for i := range codes {
+			codes[i] = strings.ToUpper(strings.TrimSpace(codes[i]))
+			if len(codes[i]) != 2 {
+				return nil, fmt.Errorf("invalid Country code %s, expected two letters", codes[i])
+			}
+		}
+		return &matchers.CountryMatcher{Codes: codes}, nil
+
+	case "ASN":
+		numbers := strings.Split(value, ",")
+		for i := range numbers {
+			asn, ok := geoip.NormalizeASN(numbers[i])
+			if !ok {
+				return nil, fmt.Errorf("invalid ASN %s, expected an AS number", strings.TrimSpace(numbers[i]))
+			}
+			numbers[i] = asn
+		}
+		return &matchers.ASNMatcher{Numbers: numbers}, nil
+
+	case "JA3":
+		hashes := strings.Split(value, ",")
+		for i := range hashes {
+			hashes[i] = strings.ToLower(strings.TrimSpace(hashes[i]))
+			if !ja3Pattern.MatchString(hashes[i]) {
+				return nil, fmt.Errorf("invalid JA3 hash %s, expected 32 hex digits", hashes[i])
+			}
+		}
+		return &matchers.JA3Matcher{Hashes: hashes}, nil
+
+	case "JA4":
+		fingerprints := strings.Split(value, ",")
+		for i := range fingerprints {
+			fingerprints[i] = strings.ToLower(strings.TrimSpace(fingerprints[i]))
+			if fingerprints[i] == "" || fingerprints[i] == "*" {
+				return nil, fmt.Errorf("invalid JA4 fingerprint %q", fingerprints[i])
+			}
+		}
+		return &matchers.JA4Matcher{Fingerprints: fingerprints}, nil
+
 	default:
 		return nil, fmt.Errorf("unknown matcher: %s", name)
 	}
@@ -1,26 +1,35 @@
 package router
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/hostmap"
 	"github.com/simman/go-forwarder/internal/router/matchers"
+	"github.com/simman/go-forwarder/internal/trace"
 )
 
+// errNoRule is returned for a node with neither filter nor matcher
+var errNoRule = errors.New("node must have either filter or matcher")
+
 // Router routes requests to backend nodes based on matching rules
 type Router struct {
 	routes []Route
+	sni    bool // routes the nodes of sni services instead of all others
 	mu     sync.RWMutex
 }
 
 // Route represents a routing rule with its associated node
 type Route struct {
-	Name string
-	Rule Rule
-	Node *config.Node
+	Name    string
+	Service string
+	Rule    Rule
+	Node    *config.Node
 }
 
 // NewRouter creates a new router
@@ -30,45 +39,97 @@ func NewRouter() *Router {
 	}
 }
 
+// NewSNIRouter creates a router for the nodes of sni services, which
+// route TLS connections by the server name they ask for
+func NewSNIRouter() *Router {
+	return &Router{
+		routes: make([]Route, 0),
+		sni:    true,
+	}
+}
+
 // UpdateRoutes updates the routing table from configuration
 func (r *Router) UpdateRoutes(services []config.Service) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	apply, err := r.PrepareRoutes(services)
+	if err != nil {
+		return err
+	}
+	apply()
+	return nil
+}
 
+// PrepareRoutes builds the routing table of services without using it yet,
+// so routers updated together can all be built before any of them changes.
+// The returned function puts the table in use.
+func (r *Router) PrepareRoutes(services []config.Service) (func(), error) {
+	routes, err := buildRoutes(services, r.sni)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		r.mu.Lock()
+		r.routes = routes
+		r.mu.Unlock()
+
+		if r.sni {
+			log.Info().Int("count", len(routes)).Msg("sni routes updated")
+		} else {
+			log.Info().Int("count", len(routes)).Msg("routes updated")
+		}
+	}, nil
+}
+
+// Build returns a router for services, e.g. to try a candidate config
+// without touching the running one
+func Build(services []config.Service) (*Router, error) {
+	routes, err := buildRoutes(services, false)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{routes: routes}, nil
+}
+
+// BuildSNI returns a router for the nodes of the sni services of
+// services, like Build
+func BuildSNI(services []config.Service) (*Router, error) {
+	routes, err := buildRoutes(services, true)
+	if err != nil {
+		return nil, err
+	}
+	return &Router{routes: routes, sni: true}, nil
+}
+
+// buildRoutes creates the routes of all nodes, in order, of either the
+// sni services or the others
+func buildRoutes(services []config.Service, sni bool) ([]Route, error) {
 	var routes []Route
 
 	for _, svc := range services {
-		for _, node := range svc.Forwarder.Nodes {
-			route, err := r.buildRoute(&node)
+		if (svc.Handler.Type == "sni") != sni {
+			continue
+		}
+		for i := range svc.Forwarder.Nodes {
+			node := &svc.Forwarder.Nodes[i]
+			route, err := buildRoute(node, ParseOptions{
+				SingleLabelWildcard: svc.HostWildcard == "single",
+			})
 			if err != nil {
-				return fmt.Errorf("failed to build route for node %s: %w", node.Name, err)
+				return nil, fmt.Errorf("failed to build route for node %s: %w", node.Name, err)
 			}
+			route.Service = svc.Name
 			routes = append(routes, route)
 		}
 	}
 
-	r.routes = routes
-	log.Info().Int("count", len(routes)).Msg("routes updated")
-
-	return nil
+	return routes, nil
 }
 
 // buildRoute creates a Route from a Node configuration
-func (r *Router) buildRoute(node *config.Node) (Route, error) {
-	var rule Rule
-	var err error
-
-	// Use filter (simple host matching) if specified
-	if node.Filter != nil {
-		rule = &matchers.HostMatcher{Pattern: node.Filter.Host}
-	} else if node.Matcher != nil {
-		// Use matcher (complex rule) if specified
-		rule, err = ParseRule(node.Matcher.Rule)
-		if err != nil {
-			return Route{}, fmt.Errorf("failed to parse rule: %w", err)
-		}
-	} else {
-		return Route{}, fmt.Errorf("node must have either filter or matcher")
+func buildRoute(node *config.Node, opts ParseOptions) (Route, error) {
+	rule, err := NodeRule(node, opts)
+	if err != nil {
+		return Route{}, err
 	}
 
 	return Route{
@@ -78,28 +139,144 @@ func (r *Router) buildRoute(node *config.Node) (Route, error) {
 	}, nil
 }
 
+// NodeRule builds the rule a node's requests are matched with. A node
+// with a host map only matches hosts listed in it.
+func NodeRule(node *config.Node, opts ParseOptions) (Rule, error) {
+	var hostMap Rule
+	if node.HostMap != "" {
+		m, err := hostmap.Load(node.HostMap)
+		if err != nil {
+			return nil, err
+		}
+		hostMap = &matchers.HostMapMatcher{File: node.HostMap, Map: m}
+	}
+
+	rule, err := filterRule(node, opts)
+	switch {
+	case errors.Is(err, errNoRule) && hostMap != nil:
+		return hostMap, nil
+	case err != nil:
+		return nil, err
+	case hostMap != nil:
+		return &AndRule{Left: hostMap, Right: rule}, nil
+	}
+	return rule, nil
+}
+
+// RuleText returns the rule of a node as text: the matcher rule as
+// written, or a Host rule for a filter, and the host map a node with one
+// also requires
+func RuleText(node *config.Node) string {
+	var text string
+	switch {
+	case node.Filter != nil:
+		text = "Host{" + node.Filter.Host + "}"
+	case node.Matcher != nil:
+		text = node.Matcher.Rule
+	}
+
+	if node.HostMap == "" {
+		return text
+	}
+	hostMap := "HostMap{" + node.HostMap + "}"
+	if text == "" {
+		return hostMap
+	}
+	return hostMap + " && (" + text + ")"
+}
+
+// filterRule builds the rule of a node's filter or matcher
+func filterRule(node *config.Node, opts ParseOptions) (Rule, error) {
+	// Use filter (simple host matching) if specified
+	if node.Filter != nil {
+		return &matchers.HostMatcher{Pattern: node.Filter.Host, SingleLabel: opts.SingleLabelWildcard}, nil
+	}
+
+	// Use matcher (complex rule) if specified
+	if node.Matcher != nil {
+		rule, err := ParseRuleWithOptions(node.Matcher.Rule, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse rule: %w", err)
+		}
+		return rule, nil
+	}
+
+	return nil, errNoRule
+}
+
 // Match finds the first matching route for the request
 func (r *Router) Match(req *http.Request) (*config.Node, bool) {
+	route, ok := r.MatchRoute(req)
+	if !ok {
+		return nil, false
+	}
+	return route.Node, true
+}
+
+// MatchRoute finds the first matching route for the request, including the
+// service it belongs to
+func (r *Router) MatchRoute(req *http.Request) (Route, bool) {
+	return r.MatchEnabled(req, nil)
+}
+
+// MatchEnabled finds the first matching route whose node is enabled.
+// Routes of disabled nodes are passed over, so the request can fall
+// through to a later route. A nil enabled func enables every node.
+func (r *Router) MatchEnabled(req *http.Request, enabled func(*config.Node) bool) (Route, bool) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
+	traced := trace.Enabled(req.Context())
 	for _, route := range r.routes {
-		if route.Rule.Match(req) {
+		var start time.Time
+		if traced {
+			start = time.Now()
+		}
+		if !route.Rule.Match(req) {
+			if traced {
+				trace.Add(req.Context(), "match", "%s: no match (%s)", route.Name, time.Since(start))
+			}
+			continue
+		}
+		if enabled != nil && !enabled(route.Node) {
+			trace.Add(req.Context(), "match", "%s: matched, but node is disabled", route.Name)
 			log.Debug().
 				Str("route", route.Name).
 				Str("host", req.Host).
-				Str("path", req.URL.Path).
-				Msg("route matched")
-			return route.Node, true
+				Msg("route matched, but node is disabled")
+			continue
+		}
+		if traced {
+			trace.Add(req.Context(), "match", "%s: matched (%s)", route.Name, time.Since(start))
 		}
+		log.Debug().
+			Str("route", route.Name).
+			Str("host", req.Host).
+			Str("path", req.URL.Path).
+			Msg("route matched")
+		return route, true
 	}
 
+	trace.Add(req.Context(), "match", "no route matched")
 	log.Debug().
 		Str("host", req.Host).
 		Str("path", req.URL.Path).
 		Msg("no route matched")
 
-	return nil, false
+	return Route{}, false
+}
+
+// Lookup returns the route of the node with the given name
+func (r *Router) Lookup(name string) (Route, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, route := range r.routes {
+		if route.Node.Name == name {
+			return route, true
+		}
+	}
+	return Route{}, false
 }
 
 // GetRoutes returns all configured routes (for debugging/monitoring)
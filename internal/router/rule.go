@@ -38,3 +38,36 @@ type NotRule struct {
 func (r *NotRule) Match(req *http.Request) bool {
 	return !r.Inner.Match(req)
 }
+
+// Capturer is a rule that captures parts of the request it matches, such
+// as regex groups
+type Capturer interface {
+	Captures(req *http.Request) map[string]string
+}
+
+// Captures collects what the capturing rules that decided the match of
+// rule captured from req. Later captures override earlier ones of the same
+// name.
+func Captures(rule Rule, req *http.Request) map[string]string {
+	out := make(map[string]string)
+	collectCaptures(rule, req, out)
+	return out
+}
+
+func collectCaptures(rule Rule, req *http.Request, out map[string]string) {
+	switch r := rule.(type) {
+	case *AndRule:
+		collectCaptures(r.Left, req, out)
+		collectCaptures(r.Right, req, out)
+	case *OrRule:
+		if r.Left.Match(req) {
+			collectCaptures(r.Left, req, out)
+		} else {
+			collectCaptures(r.Right, req, out)
+		}
+	case Capturer:
+		for name, value := range r.Captures(req) {
+			out[name] = value
+		}
+	}
+}
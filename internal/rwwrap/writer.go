@@ -0,0 +1,154 @@
+package rwwrap
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Writer wraps an http.ResponseWriter to record the status code and body
+// size while keeping the optional capabilities of the writer it wraps.
+// Flushing, hijacking and deadlines are delegated through
+// http.NewResponseController, so they keep working however many wrappers
+// are stacked, and Unwrap lets callers reach the original writer.
+type Writer struct {
+	http.ResponseWriter
+	status   int
+	bytes    int64
+	hijacked bool
+	onHeader []func(status int)
+	onWrite  []func(b []byte)
+}
+
+// Wrap returns a Writer around w. Wrapping a *Writer returns it unchanged so
+// middleware can share a single recorder.
+func Wrap(w http.ResponseWriter) *Writer {
+	if rw, ok := w.(*Writer); ok {
+		return rw
+	}
+	return &Writer{ResponseWriter: w}
+}
+
+// Unwrap returns the wrapped writer, for http.NewResponseController
+func (w *Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// OnWriteHeader registers fn to run just before the final status is sent,
+// while response headers can still be changed
+func (w *Writer) OnWriteHeader(fn func(status int)) {
+	w.onHeader = append(w.onHeader, fn)
+}
+
+// OnWrite registers fn to see every chunk of the body as it is written.
+// fn must not keep b.
+func (w *Writer) OnWrite(fn func(b []byte)) {
+	w.onWrite = append(w.onWrite, fn)
+}
+
+// setStatus records the final status and runs the header hooks
+func (w *Writer) setStatus(code int) {
+	w.status = code
+	for _, fn := range w.onHeader {
+		fn(code)
+	}
+}
+
+// WriteHeader records the status code
+func (w *Writer) WriteHeader(code int) {
+	// 1xx responses are informational; the final status comes later
+	if w.status == 0 && (code < 100 || code > 199 || code == http.StatusSwitchingProtocols) {
+		w.setStatus(code)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write records the number of body bytes written
+func (w *Writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.setStatus(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	for _, fn := range w.onWrite {
+		fn(b[:n])
+	}
+	return n, err
+}
+
+// ReadFrom lets io.Copy use the underlying writer's ReadFrom, which enables
+// sendfile on plain HTTP/1.1 connections
+func (w *Writer) ReadFrom(r io.Reader) (int64, error) {
+	if w.status == 0 {
+		w.setStatus(http.StatusOK)
+	}
+	// Body hooks need to see the bytes, which sendfile would skip
+	if len(w.onWrite) > 0 {
+		return io.Copy(writerOnly{w}, r)
+	}
+	var n int64
+	var err error
+	if rf, ok := w.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(r)
+	} else {
+		n, err = io.Copy(writerOnly{w.ResponseWriter}, r)
+	}
+	w.bytes += n
+	return n, err
+}
+
+// Flush sends buffered data to the client, if the underlying writer supports it
+func (w *Writer) Flush() {
+	w.FlushError()
+}
+
+// FlushError flushes and reports http.ErrNotSupported if flushing is unavailable
+func (w *Writer) FlushError() error {
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// Hijack takes over the underlying connection
+func (w *Writer) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, brw, err := http.NewResponseController(w.ResponseWriter).Hijack()
+	if err == nil {
+		w.hijacked = true
+	}
+	return conn, brw, err
+}
+
+// SetReadDeadline sets the read deadline of the underlying connection
+func (w *Writer) SetReadDeadline(deadline time.Time) error {
+	return http.NewResponseController(w.ResponseWriter).SetReadDeadline(deadline)
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection
+func (w *Writer) SetWriteDeadline(deadline time.Time) error {
+	return http.NewResponseController(w.ResponseWriter).SetWriteDeadline(deadline)
+}
+
+// Status returns the recorded status code, or 0 if nothing was written
+func (w *Writer) Status() int {
+	return w.status
+}
+
+// BytesWritten returns the number of body bytes written
+func (w *Writer) BytesWritten() int64 {
+	return w.bytes
+}
+
+// Hijacked reports whether the connection was hijacked
+func (w *Writer) Hijacked() bool {
+	return w.hijacked
+}
+
+// WroteHeader reports whether a final status has been sent
+func (w *Writer) WroteHeader() bool {
+	return w.status != 0
+}
+
+// writerOnly hides any ReadFrom method so io.Copy doesn't recurse
+type writerOnly struct {
+	io.Writer
+}
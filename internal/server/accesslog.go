@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/accesslog"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+)
+
+// newAccessLogSink creates the configured access log sink, or nil if none
+func newAccessLogSink(cfg *config.AccessLog) accesslog.Sink {
+	if cfg.S3 == nil {
+		return nil
+	}
+
+	sink, err := accesslog.NewS3Sink(cfg.S3)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create S3 access log sink")
+		return nil
+	}
+
+	log.Info().
+		Str("bucket", cfg.S3.Bucket).
+		Str("prefix", cfg.S3.Prefix).
+		Msg("shipping access logs to S3")
+	return sink
+}
+
+// logAccess sends an access log entry for a finished request
+func (s *Server) logAccess(rw *rwwrap.Writer, r *http.Request, info *requestInfo) {
+	s.mu.RLock()
+	sink := s.accessLog
+	names := s.config.AccessLog.Headers
+	s.mu.RUnlock()
+
+	if sink == nil {
+		return
+	}
+
+	status := rw.Status()
+	if info.canceled {
+		status = forwarder.StatusClientClosedRequest
+	}
+	if rw.Hijacked() && status == 0 {
+		// Tunnels write their status line on the raw connection
+		status = http.StatusSwitchingProtocols
+		if r.Method == http.MethodConnect {
+			status = http.StatusOK
+		}
+	}
+
+	var headers map[string]string
+	if len(names) > 0 {
+		headers = make(map[string]string, len(names))
+		for _, name := range names {
+			if values := r.Header[name]; len(values) > 0 {
+				headers[name] = strings.Join(values, ", ")
+			}
+		}
+	}
+
+	var ja3, ja4 string
+	if fp := tlsfp.From(r.Context()); fp != nil {
+		ja3, ja4 = fp.JA3, fp.JA4
+	}
+
+	sink.Log(&accesslog.Entry{
+		Time:       info.start,
+		RemoteAddr: r.RemoteAddr,
+		Method:     r.Method,
+		Host:       r.Host,
+		Path:       r.URL.Path,
+		Proto:      r.Proto,
+		Status:     status,
+		Bytes:      rw.BytesWritten(),
+		Duration:   time.Since(info.start),
+		Node:       info.node,
+		Upstream:   info.upstream,
+		UserAgent:  r.UserAgent(),
+		JA3:        ja3,
+		JA4:        ja4,
+		Headers:    headers,
+	})
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// startAdmin starts the admin listener serving metrics and the admin API, if configured
+func (s *Server) startAdmin() error {
+	addr := s.config.Admin.Addr
+	if addr == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.HandleFunc("/api/canary", s.handleAdminCanaryList)
+	mux.HandleFunc("/api/canary/", s.handleAdminCanary)
+	mux.HandleFunc("/api/maintenance", s.handleAdminMaintenanceList)
+	mux.HandleFunc("/api/maintenance/", s.handleAdminMaintenance)
+	mux.HandleFunc("/api/faults", s.handleAdminFaultsList)
+	mux.HandleFunc("/api/faults/", s.handleAdminFaults)
+	mux.HandleFunc("/api/audit", s.handleAdminAudit)
+	mux.HandleFunc("/api/flags", s.handleAdminFlags)
+	mux.HandleFunc("/api/shadow", s.handleAdminShadow)
+	mux.HandleFunc("/api/geoip", s.handleAdminGeoIP)
+	mux.HandleFunc("/api/geoip/reload", s.handleAdminGeoIPReload)
+	mux.HandleFunc("/api/sessions", s.handleAdminSessions)
+	mux.HandleFunc("/api/connections", s.handleAdminConnections)
+	mux.HandleFunc("/api/connections/", s.handleAdminConnection)
+	mux.HandleFunc("/api/cluster", s.handleAdminCluster)
+	mux.HandleFunc("/api/slo", s.handleAdminSLO)
+	mux.HandleFunc("/api/slo/", s.handleAdminSLO)
+	mux.HandleFunc("/api/recordings", s.handleAdminRecordings)
+	mux.HandleFunc("/api/recordings/", s.handleAdminRecordings)
+	mux.HandleFunc("/api/listeners", s.handleAdminListeners)
+	mux.HandleFunc("/api/routes", s.handleAdminRoutes)
+	mux.HandleFunc("/api/config/rollback", s.handleAdminRollback)
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: s.adminAuthMiddleware(mux),
+	}
+
+	listener, systemd, err := s.bind(addr)
+	s.recordBind(addr, true, systemd, err)
+	if err != nil {
+		return err
+	}
+
+	s.servers = append(s.servers, srv)
+
+	go func() {
+		log.Info().Str("addr", addr).Msg("admin server started")
+		if err := srv.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Error().Err(err).Str("addr", addr).Msg("admin server error")
+		}
+	}()
+
+	return nil
+}
+
+// canaryStatus is the admin API view of a node's canary
+type canaryStatus struct {
+	Node             string `json:"node"`
+	Addr             string `json:"addr"`
+	Weight           int    `json:"weight"`
+	ConfiguredWeight int    `json:"configured_weight"`
+	Overridden       bool   `json:"overridden"`
+	Flag             string `json:"flag,omitempty"` // flag overriding the configured weight
+}
+
+func newCanaryStatus(name string, c *canaryState) canaryStatus {
+	return canaryStatus{
+		Node:             name,
+		Addr:             c.cfg.Addr,
+		Weight:           c.Weight(),
+		ConfiguredWeight: c.cfg.Weight,
+		Overridden:       c.Overridden(),
+		Flag:             c.flag,
+	}
+}
+
+// handleAdminCanaryList lists all nodes with a canary configured
+func (s *Server) handleAdminCanaryList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	result := make([]canaryStatus, 0)
+	for name, st := range s.nodes {
+		if st.canary != nil {
+			result = append(result, newCanaryStatus(name, st.canary))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Node < result[j].Node })
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// handleAdminCanary reads, overrides or resets the canary weight of one node.
+// PUT takes {"weight": N}; DELETE restores the configured weight.
+func (s *Server) handleAdminCanary(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/canary/")
+
+	s.mu.RLock()
+	st, ok := s.nodes[name]
+	s.mu.RUnlock()
+	if !ok || st.canary == nil {
+		writeAdminError(w, http.StatusNotFound, "no canary configured for node")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Weight *int `json:"weight"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Weight == nil {
+			writeAdminError(w, http.StatusBadRequest, "body must be {\"weight\": 0-100}")
+			return
+		}
+		if *req.Weight < 0 || *req.Weight > 100 {
+			writeAdminError(w, http.StatusBadRequest, "weight must be between 0 and 100")
+			return
+		}
+		st.canary.SetWeight(*req.Weight)
+		log.Info().Str("node", name).Int("weight", *req.Weight).Msg("canary weight overridden")
+	case http.MethodDelete:
+		st.canary.ResetWeight()
+		log.Info().Str("node", name).Msg("canary weight reset")
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, newCanaryStatus(name, st.canary))
+}
+
+// maintenanceStatus is the admin API view of a node's maintenance mode
+type maintenanceStatus struct {
+	Node       string `json:"node"`
+	Enabled    bool   `json:"enabled"`
+	Configured bool   `json:"configured"`
+	Overridden bool   `json:"overridden"`
+}
+
+func newMaintenanceStatus(name string, m *maintenanceState) maintenanceStatus {
+	return maintenanceStatus{
+		Node:       name,
+		Enabled:    m.Enabled(),
+		Configured: m.cfg.Enabled,
+		Overridden: m.Overridden(),
+	}
+}
+
+// handleAdminMaintenanceList lists the maintenance state of every node
+func (s *Server) handleAdminMaintenanceList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	result := make([]maintenanceStatus, 0, len(s.nodes))
+	for name, st := range s.nodes {
+		result = append(result, newMaintenanceStatus(name, st.maintenance))
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Node < result[j].Node })
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// handleAdminMaintenance reads or toggles maintenance mode for one node.
+// PUT takes {"enabled": true|false}; DELETE restores the configured flag.
+func (s *Server) handleAdminMaintenance(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/maintenance/")
+
+	s.mu.RLock()
+	st, ok := s.nodes[name]
+	s.mu.RUnlock()
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			writeAdminError(w, http.StatusBadRequest, "body must be {\"enabled\": true|false}")
+			return
+		}
+		st.maintenance.SetEnabled(*req.Enabled)
+		log.Info().Str("node", name).Bool("enabled", *req.Enabled).Msg("maintenance mode toggled")
+	case http.MethodDelete:
+		st.maintenance.Reset()
+		log.Info().Str("node", name).Msg("maintenance mode reset")
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, newMaintenanceStatus(name, st.maintenance))
+}
+
+// writeAdminJSON writes a JSON admin API response
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("failed to encode admin response")
+	}
+}
+
+// writeAdminError writes a JSON admin API error
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminJSON(w, status, map[string]string{"error": message})
+}
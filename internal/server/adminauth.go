@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// adminAccess decides who may use the admin listener
+type adminAccess struct {
+	token    string
+	allowIPs *acl.ACL // nil lets every client in
+}
+
+// newAdminAccess builds the admin access policy from config
+func newAdminAccess(cfg *config.AdminConfig) *adminAccess {
+	a := &adminAccess{token: cfg.Token}
+	if len(cfg.AllowIPs) > 0 {
+		allowIPs, err := acl.New(cfg.AllowIPs)
+		if err != nil {
+			// Validated on load; a nil ACL would let everyone in, an
+			// empty one lets nobody in
+			log.Error().Err(err).Msg("invalid admin allow_ips")
+			allowIPs = &acl.ACL{}
+		}
+		a.allowIPs = allowIPs
+	}
+	return a
+}
+
+// authorized reports whether the token of r matches, for the API paths
+func (a *adminAccess) authorized(r *http.Request) bool {
+	if a.token == "" || !strings.HasPrefix(r.URL.Path, "/api/") {
+		return true
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+// adminAuthMiddleware refuses clients outside admin allow_ips, and API
+// requests without the admin token when one is set
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		access := s.admin
+		s.mu.RUnlock()
+
+		if access.allowIPs != nil && !access.allowIPs.Contains(acl.ClientIP(r)) {
+			writeAdminError(w, http.StatusForbidden, "client not allowed")
+			return
+		}
+		if !access.authorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="forwarder admin"`)
+			writeAdminError(w, http.StatusUnauthorized, "admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
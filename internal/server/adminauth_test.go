@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+func newAdminServer(t *testing.T, admin string) *Server {
+	t.Helper()
+
+	cfg, err := config.Parse([]byte(admin + `
+services:
+  - name: web
+    forwarder:
+      nodes:
+        - name: app
+          addr: 127.0.0.1:1
+          filter: {host: app.test}
+`))
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	return s
+}
+
+func TestAdminAuth(t *testing.T) {
+	s := newAdminServer(t, `
+admin:
+  addr: ":0"
+  token: s3cret
+  allow_ips: [192.0.2.0/24]
+`)
+	h := s.adminAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		remote string
+		path   string
+		auth   string
+		want   int
+	}{
+		{"192.0.2.7:4000", "/api/routes", "Bearer s3cret", http.StatusNoContent},
+		{"192.0.2.7:4000", "/api/routes", "Bearer wrong", http.StatusUnauthorized},
+		{"192.0.2.7:4000", "/api/config/rollback", "", http.StatusUnauthorized},
+		{"192.0.2.7:4000", "/metrics", "", http.StatusNoContent},
+		{"198.51.100.1:4000", "/api/routes", "Bearer s3cret", http.StatusForbidden},
+		{"198.51.100.1:4000", "/metrics", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, tt.path, nil)
+		req.RemoteAddr = tt.remote
+		if tt.auth != "" {
+			req.Header.Set("Authorization", tt.auth)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s from %s with %q: status %d, want %d", tt.path, tt.remote, tt.auth, rec.Code, tt.want)
+		}
+	}
+}
+
+func TestAdminAddrDefaultsToLoopback(t *testing.T) {
+	tests := []struct {
+		admin string
+		want  string
+	}{
+		{"admin: {addr: \":9901\"}", "127.0.0.1:9901"},
+		{"admin: {addr: \":9901\", token: s3cret}", ":9901"},
+		{"admin: {addr: \":9901\", allow_ips: [10.0.0.0/8]}", ":9901"},
+		{"admin: {addr: \"0.0.0.0:9901\"}", "0.0.0.0:9901"},
+	}
+	for _, tt := range tests {
+		if got := newAdminServer(t, tt.admin).config.Admin.Addr; got != tt.want {
+			t.Errorf("%s: addr %q, want %q", tt.admin, got, tt.want)
+		}
+	}
+}
+
+func TestImportRoutesRefusals(t *testing.T) {
+	s := newAdminServer(t, "")
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+	}{
+		{"", `{"remove": ["app"]}`, http.StatusUnsupportedMediaType},
+		{"text/plain", `{"remove": ["app"]}`, http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", `{"remove": ["app"]}`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"add": [{"service": "web", "node": {"name": "x", "addr": "${file:/etc/passwd}"}}]}`, http.StatusBadRequest},
+		{"application/yaml; charset=utf-8", "add: [{service: web, node: {name: x, addr: '${env:HOME}'}}]", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/routes?dry_run=true", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		rec := httptest.NewRecorder()
+		s.importRoutes(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%q %s: status %d, want %d: %s", tt.contentType, tt.body, rec.Code, tt.want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"encoding/csv"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	auditEntries = metrics.NewGaugeVec(
+		"forwarder_audit_entries",
+		"Distinct outbound connections recorded by the audit",
+	)
+	auditDropped = metrics.NewCounterVec(
+		"forwarder_audit_dropped_total",
+		"Outbound connections not recorded because the audit was full",
+	)
+)
+
+// auditKey is one distinct outbound connection: who asked for it, where it
+// went and which node and proxy carried it
+type auditKey struct {
+	Client      string `json:"client"`
+	Destination string `json:"destination"`
+	Node        string `json:"node"`
+	Proxy       string `json:"proxy"`
+}
+
+// auditEntry is an audited connection with when and how often it was seen
+type auditEntry struct {
+	auditKey
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	Count     int64     `json:"count"`
+}
+
+// auditLog records the distinct outbound connections the forwarder makes.
+// Entries survive reloads; once it holds max entries new ones are dropped.
+type auditLog struct {
+	mu      sync.Mutex
+	enabled bool
+	max     int
+	entries map[auditKey]*auditEntry
+}
+
+func newAuditLog(cfg *config.Audit) *auditLog {
+	a := &auditLog{entries: make(map[auditKey]*auditEntry)}
+	a.configure(cfg)
+	return a
+}
+
+// configure applies new audit settings, keeping what was recorded so far
+func (a *auditLog) configure(cfg *config.Audit) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.enabled = cfg.Enabled
+	a.max = cfg.MaxEntries
+	if a.max == 0 {
+		a.max = 10000
+	}
+}
+
+// record notes a connection from client to destination through node and proxy
+func (a *auditLog) record(client, destination, node, proxy string) {
+	key := auditKey{
+		Client:      client,
+		Destination: destination,
+		Node:        node,
+		Proxy:       redactProxy(proxy),
+	}
+	now := time.Now()
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if !a.enabled {
+		return
+	}
+	if e, ok := a.entries[key]; ok {
+		e.LastSeen = now
+		e.Count++
+		return
+	}
+	if len(a.entries) >= a.max {
+		auditDropped.With().Inc()
+		return
+	}
+
+	a.entries[key] = &auditEntry{auditKey: key, FirstSeen: now, LastSeen: now, Count: 1}
+	auditEntries.With().Set(float64(len(a.entries)))
+	log.Info().
+		Str("client", key.Client).
+		Str("destination", key.Destination).
+		Str("node", key.Node).
+		Str("proxy", key.Proxy).
+		Msg("new outbound connection audited")
+}
+
+// snapshot returns the entries matching filter, where empty fields match
+// anything, ordered by destination
+func (a *auditLog) snapshot(filter auditKey) []auditEntry {
+	a.mu.Lock()
+	result := make([]auditEntry, 0, len(a.entries))
+	for key, e := range a.entries {
+		if (filter.Client == "" || filter.Client == key.Client) &&
+			(filter.Destination == "" || filter.Destination == key.Destination) &&
+			(filter.Node == "" || filter.Node == key.Node) &&
+			(filter.Proxy == "" || filter.Proxy == key.Proxy) {
+			result = append(result, *e)
+		}
+	}
+	a.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Destination != result[j].Destination {
+			return result[i].Destination < result[j].Destination
+		}
+		if result[i].Client != result[j].Client {
+			return result[i].Client < result[j].Client
+		}
+		if result[i].Node != result[j].Node {
+			return result[i].Node < result[j].Node
+		}
+		return result[i].Proxy < result[j].Proxy
+	})
+	return result
+}
+
+// reset forgets every recorded connection
+func (a *auditLog) reset() {
+	a.mu.Lock()
+	a.entries = make(map[auditKey]*auditEntry)
+	a.mu.Unlock()
+	auditEntries.With().Set(0)
+}
+
+// redactProxy hides the password of a proxy URL, "direct" stands for none
+func redactProxy(proxy string) string {
+	if proxy == "" {
+		return config.DirectProxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return proxy
+	}
+	return u.Redacted()
+}
+
+// auditRequest records the connection a request is about to make to node
+func (s *Server) auditRequest(r *http.Request, node *config.Node) {
+	client := r.RemoteAddr
+	if ip := acl.ClientIP(r); ip != nil {
+		client = ip.String()
+	}
+	s.audit.record(client, node.Addr, node.Name, node.ProxyURL())
+}
+
+// auditConn records a raw connection relayed from conn to destination
+func (s *Server) auditConn(conn net.Conn, destination string) {
+	client := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	s.audit.record(client, destination, "", "")
+}
+
+// handleAdminAudit lists the audited connections, as JSON or, with
+// ?format=csv, as CSV. The client, destination, node and proxy parameters
+// filter the list. DELETE clears it.
+func (s *Server) handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		s.audit.reset()
+		log.Info().Msg("outbound audit cleared")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	q := r.URL.Query()
+	entries := s.audit.snapshot(auditKey{
+		Client:      q.Get("client"),
+		Destination: q.Get("destination"),
+		Node:        q.Get("node"),
+		Proxy:       q.Get("proxy"),
+	})
+
+	if q.Get("format") != "csv" && !strings.Contains(r.Header.Get("Accept"), "text/csv") {
+		writeAdminJSON(w, http.StatusOK, entries)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"client", "destination", "node", "proxy", "first_seen", "last_seen", "count"})
+	for _, e := range entries {
+		cw.Write([]string{
+			e.Client,
+			e.Destination,
+			e.Node,
+			e.Proxy,
+			e.FirstSeen.UTC().Format(time.RFC3339),
+			e.LastSeen.UTC().Format(time.RFC3339),
+			strconv.FormatInt(e.Count, 10),
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		log.Error().Err(err).Msg("failed to write audit csv")
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+var (
+	backpressurePauses = metrics.NewCounterVec(
+		"forwarder_backpressure_pauses_total",
+		"Backend pauses started by 429 and 503 answers carrying Retry-After",
+		"node", "status",
+	)
+	backpressureDeferred = metrics.NewCounterVec(
+		"forwarder_backpressure_deferred_total",
+		"Requests held until a paused backend could take them",
+		"node",
+	)
+	backpressureRejected = metrics.NewCounterVec(
+		"forwarder_backpressure_rejected_total",
+		"Requests answered 503 without contacting a paused backend",
+		"node", "reason",
+	)
+	backpressureHeld = metrics.NewGaugeVec(
+		"forwarder_backpressure_held",
+		"Requests currently held for a paused backend",
+		"node",
+	)
+)
+
+// backpressureState remembers which backends of a node asked for a pause
+type backpressureState struct {
+	cfg  config.Backpressure
+	held atomic.Int64
+
+	mu    sync.Mutex
+	until map[string]time.Time // backend addr -> end of its pause
+}
+
+// newBackpressureState creates the pause tracker of a node, carrying over
+// pauses still running when the settings are unchanged
+func newBackpressureState(node *config.Node, old *backpressureState) *backpressureState {
+	if node.Backpressure == nil {
+		return nil
+	}
+	if old != nil && old.cfg == *node.Backpressure {
+		return old
+	}
+	return &backpressureState{cfg: *node.Backpressure, until: make(map[string]time.Time)}
+}
+
+// pausedUntil returns the end of the pause of addr, zero when it isn't paused
+func (b *backpressureState) pausedUntil(addr string) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.until[addr]
+	if ok && !time.Now().Before(until) {
+		delete(b.until, addr)
+		return time.Time{}
+	}
+	return until
+}
+
+// pause holds requests to addr until the given time, capped by max_pause,
+// unless a longer pause is running
+func (b *backpressureState) pause(addr string, until time.Time) {
+	if limit := time.Now().Add(b.cfg.MaxPause); until.After(limit) {
+		until = limit
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if until.After(b.until[addr]) {
+		b.until[addr] = until
+	}
+}
+
+// observe starts a pause of addr when the response asks for one, and
+// returns its end, zero when it doesn't
+func (b *backpressureState) observe(node, addr string, status int, header http.Header) time.Time {
+	if status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable {
+		return time.Time{}
+	}
+	wait, ok := parseRetryAfter(header.Get("Retry-After"), time.Now())
+	if !ok || wait <= 0 {
+		return time.Time{}
+	}
+	if wait > b.cfg.MaxPause {
+		wait = b.cfg.MaxPause
+	}
+	until := time.Now().Add(wait)
+	b.pause(addr, until)
+
+	backpressurePauses.With(node, strconv.Itoa(status)).Inc()
+	log.Warn().
+		Str("node", node).
+		Str("backend", addr).
+		Int("status", status).
+		Dur("pause", wait).
+		Msg("backend asked for a pause")
+	return until
+}
+
+// parseRetryAfter reads a Retry-After value in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if secs < 0 || secs > math.MaxInt64/int64(time.Second) {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		return at.Sub(now), true
+	}
+	return 0, false
+}
+
+// awaitBackend holds the request while addr is paused. It reports false,
+// having answered 503 with the time left, when the pause outlasts max_wait,
+// too many requests are held or the client gave up.
+func (s *Server) awaitBackend(w http.ResponseWriter, r *http.Request, node *config.Node, addr string) bool {
+	b := s.nodeState(node.Name).backpressure
+	if b == nil {
+		return true
+	}
+	until := b.pausedUntil(addr)
+	if until.IsZero() {
+		return true
+	}
+
+	wait := time.Until(until)
+	reason := ""
+	switch {
+	case wait > b.cfg.MaxWait:
+		reason = "wait"
+	case b.held.Add(1) > int64(b.cfg.MaxQueued):
+		b.held.Add(-1)
+		reason = "queue"
+	}
+	if reason != "" {
+		trace.Add(r.Context(), "backpressure", "backend %s paused for %s, rejected: %s", addr, wait.Round(time.Millisecond), reason)
+		s.rejectPaused(w, r, node, addr, wait, reason)
+		return false
+	}
+
+	backpressureDeferred.With(node.Name).Inc()
+	backpressureHeld.With(node.Name).Inc()
+	defer func() {
+		b.held.Add(-1)
+		backpressureHeld.With(node.Name).Dec()
+	}()
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		trace.Add(r.Context(), "backpressure", "held %s while backend %s was paused", wait.Round(time.Millisecond), addr)
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// rejectPaused answers 503 for a paused backend, passing on the time left
+func (s *Server) rejectPaused(w http.ResponseWriter, r *http.Request, node *config.Node, addr string, wait time.Duration, reason string) {
+	backpressureRejected.With(node.Name, reason).Inc()
+	log.Warn().
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Str("backend", addr).
+		Str("reason", reason).
+		Msg("request rejected while backend is paused")
+
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	s.handleError(w, r, http.StatusServiceUnavailable, "backend is paused")
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// stickyCookie prefixes the names of backend affinity cookies
+const stickyCookie = "fwd_affinity_"
+
+// balancer spreads requests over a node's backends in round-robin order
+type balancer struct {
+	backends []string
+	sticky   bool
+	next     atomic.Uint64
+}
+
+// newBalancer creates a balancer for the node, or nil if it has a single backend
+func newBalancer(node *config.Node) *balancer {
+	if len(node.Backends) == 0 {
+		return nil
+	}
+	return &balancer{
+		backends: append([]string(nil), node.Backends...),
+		sticky:   node.Sticky == "cookie",
+	}
+}
+
+// pick returns the next backend in rotation
+func (b *balancer) pick() string {
+	n := b.next.Add(1) - 1
+	return b.backends[n%uint64(len(b.backends))]
+}
+
+// contains reports whether addr is one of the balancer's backends
+func (b *balancer) contains(addr string) bool {
+	for _, backend := range b.backends {
+		if backend == addr {
+			return true
+		}
+	}
+	return false
+}
+
+// newStickyKey returns the key used to sign affinity cookies. Without a
+// configured secret a random key is used, so cookies only survive as long
+// as the process.
+func newStickyKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Error().Err(err).Msg("failed to generate sticky cookie key")
+	}
+	return key
+}
+
+// signAffinity encodes a node/backend pair as a signed cookie value
+func signAffinity(key []byte, node, backend string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(backend)) + "." + affinityMAC(key, node, backend)
+}
+
+// verifyAffinity decodes a signed cookie value and returns its backend
+func verifyAffinity(key []byte, node, value string) (string, bool) {
+	encoded, mac, ok := strings.Cut(value, ".")
+	if !ok {
+		return "", false
+	}
+
+	backend, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", false
+	}
+
+	if !hmac.Equal([]byte(mac), []byte(affinityMAC(key, node, string(backend)))) {
+		return "", false
+	}
+	return string(backend), true
+}
+
+// affinityMAC computes the signature binding a backend to a node
+func affinityMAC(key []byte, node, backend string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(node + "|" + backend))
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+// affinityCookie returns the name of the node's affinity cookie. Nodes
+// sharing a host each keep their own, instead of overwriting one another's.
+func affinityCookie(node string) string {
+	sum := sha256.Sum256([]byte(node))
+	return stickyCookie + hex.EncodeToString(sum[:4])
+}
+
+// selectBackend picks the backend the host map lists for the request host,
+// or one of the node's backends, honoring and setting the affinity cookie
+// in sticky mode
+func (s *Server) selectBackend(w http.ResponseWriter, r *http.Request, node *config.Node, st *nodeState) *config.Node {
+	if st.hostMap != nil {
+		if backend, ok := st.hostMap.Lookup(r.Host); ok {
+			trace.Add(r.Context(), "upstream", "host map sends %s to %s", r.Host, backend)
+			return withAddr(node, backend)
+		}
+		trace.Add(r.Context(), "upstream", "%s not in the host map", r.Host)
+		return node
+	}
+
+	b := st.backends()
+	if b == nil {
+		return node
+	}
+	if b == st.standby {
+		trace.Add(r.Context(), "upstream", "primary backends down, using standby backends")
+	}
+
+	s.mu.RLock()
+	key := s.stickyKey
+	s.mu.RUnlock()
+
+	if b.sticky {
+		if cookie, err := r.Cookie(affinityCookie(node.Name)); err == nil {
+			if backend, ok := verifyAffinity(key, node.Name, cookie.Value); ok && b.contains(backend) {
+				trace.Add(r.Context(), "upstream", "affinity cookie pins backend %s", backend)
+				return withAddr(node, backend)
+			}
+		}
+	}
+
+	backend := b.pick()
+	trace.Add(r.Context(), "upstream", "balancer picked backend %s", backend)
+
+	if b.sticky {
+		http.SetCookie(w, &http.Cookie{
+			Name:     affinityCookie(node.Name),
+			Value:    signAffinity(key, node.Name, backend),
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+
+	return withAddr(node, backend)
+}
+
+// resolveTarget decides which backend serves the request: the canary when
+// it is chosen, otherwise one of the node's backends
+func (s *Server) resolveTarget(w http.ResponseWriter, r *http.Request, node *config.Node) *config.Node {
+	st := s.nodeState(node.Name)
+
+	target, ok := s.selectVariant(w, r, node, st)
+	if !ok {
+		target = s.selectBackend(w, r, node, st)
+	}
+
+	// Use the fastest upstream proxy unless the target names its own
+	if st.proxySelector != nil && target.Proxy == "" {
+		if target == node {
+			target = withAddr(node, node.Addr)
+		}
+		target.Proxy = st.proxySelector.Current()
+		trace.Add(r.Context(), "upstream", "proxy selection chose %s", redactProxy(target.Proxy))
+	}
+
+	s.recordTarget(r, node, target)
+	return target
+}
+
+// recordTarget notes the backend chosen for the request for logging and
+// the outbound audit
+func (s *Server) recordTarget(r *http.Request, node, target *config.Node) {
+	if info := getRequestInfo(r); info != nil {
+		info.route = describeRoute(node)
+		info.node = target.Name
+		info.upstream = target.Addr
+	}
+	if trace.Enabled(r.Context()) {
+		trace.Add(r.Context(), "upstream", "route %s: node %s, addr %s, proxy %s", describeRoute(node), target.Name, target.Addr, redactProxy(target.Proxy))
+	}
+	s.auditRequest(r, target)
+}
+
+// withAddr returns a copy of node pointing at addr
+func withAddr(node *config.Node, addr string) *config.Node {
+	target := *node
+	target.Addr = addr
+	return &target
+}
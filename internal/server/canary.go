@@ -0,0 +1,126 @@
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync/atomic"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/flags"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+const (
+	// variantHeader reports which variant served the request
+	variantHeader = "X-Forwarder-Variant"
+
+	variantStable = "stable"
+	variantCanary = "canary"
+)
+
+// canaryState tracks the configured canary and any runtime weight override
+type canaryState struct {
+	cfg      config.Canary
+	override atomic.Int32 // -1 when the configured weight applies
+
+	node  string
+	flag  string // flag overriding the configured weight, if any
+	flags flags.Provider
+}
+
+// newCanaryState creates canary state, carrying over a runtime override.
+// A weight flag on the node takes precedence over the configured weight.
+func newCanaryState(node *config.Node, prev *canaryState, provider flags.Provider) *canaryState {
+	c := &canaryState{cfg: *node.Canary, node: node.Name, flags: provider}
+	if node.Flags != nil {
+		c.flag = node.Flags.CanaryWeight
+	}
+	c.override.Store(-1)
+	if prev != nil {
+		c.override.Store(prev.override.Load())
+	}
+	return c
+}
+
+// Weight returns the effective canary percentage: the runtime override,
+// then the weight flag, then the configured weight
+func (c *canaryState) Weight() int {
+	if w := c.override.Load(); w >= 0 {
+		return int(w)
+	}
+	if c.flag != "" {
+		return canaryFlagWeight(c.flags, c.node, c.flag, c.cfg.Weight)
+	}
+	return c.cfg.Weight
+}
+
+// SetWeight overrides the configured weight at runtime
+func (c *canaryState) SetWeight(weight int) {
+	c.override.Store(int32(weight))
+}
+
+// ResetWeight drops the runtime override
+func (c *canaryState) ResetWeight() {
+	c.override.Store(-1)
+}
+
+// Overridden reports whether a runtime override is active
+func (c *canaryState) Overridden() bool {
+	return c.override.Load() >= 0
+}
+
+// choose decides whether the request goes to the canary. An explicit
+// header or cookie wins over the percentage split.
+func (c *canaryState) choose(r *http.Request) bool {
+	if forced, ok := parseCanaryOverride(r.Header.Get(c.cfg.Header)); ok {
+		return forced
+	}
+	if cookie, err := r.Cookie(c.cfg.Cookie); err == nil {
+		if forced, ok := parseCanaryOverride(cookie.Value); ok {
+			return forced
+		}
+	}
+
+	weight := c.Weight()
+	if weight <= 0 {
+		return false
+	}
+	if weight >= 100 {
+		return true
+	}
+	return rand.Intn(100) < weight
+}
+
+// parseCanaryOverride interprets an override header or cookie value
+func parseCanaryOverride(v string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "1", "true", "always", "canary":
+		return true, true
+	case "0", "false", "never", "stable":
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+// selectVariant routes the request to the canary when chosen, stamping the
+// variant into the response headers. It reports false for stable traffic.
+func (s *Server) selectVariant(w http.ResponseWriter, r *http.Request, node *config.Node, st *nodeState) (*config.Node, bool) {
+	canary := st.canary
+	if canary == nil {
+		return node, false
+	}
+
+	if !canary.choose(r) {
+		trace.Add(r.Context(), "upstream", "canary not chosen, using stable")
+		w.Header().Set(variantHeader, variantStable)
+		return node, false
+	}
+
+	trace.Add(r.Context(), "upstream", "canary chosen: %s", canary.cfg.Addr)
+	w.Header().Set(variantHeader, variantCanary)
+	target := withAddr(node, canary.cfg.Addr)
+	target.Proxy = canary.cfg.Proxy
+	return target, true
+}
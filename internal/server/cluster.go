@@ -0,0 +1,69 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/cluster"
+)
+
+// startCluster joins the cluster when one is configured. Its settings take
+// effect when the forwarder starts. The caller must hold s.mu.
+func (s *Server) startCluster() error {
+	cfg := s.config.Cluster
+	if cfg == nil {
+		return nil
+	}
+
+	c, err := cluster.New(cluster.Options{
+		Name:     s.instance,
+		Bind:     cfg.Bind,
+		Peers:    cfg.Peers,
+		Secret:   cfg.Secret,
+		Interval: cfg.Interval,
+		Fanout:   cfg.Fanout,
+		OnPause:  s.learnPause,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start cluster: %w", err)
+	}
+	s.cluster = c
+	c.Start()
+	return nil
+}
+
+// sharePause tells the peers about a backend that asked for a pause
+func (s *Server) sharePause(node, addr string, until time.Time) {
+	if s.cluster == nil {
+		return
+	}
+	s.cluster.Pause(cluster.Pause{Node: node, Backend: addr, Until: until})
+}
+
+// learnPause applies a pause a peer saw, on nodes with backpressure
+func (s *Server) learnPause(p cluster.Pause) {
+	b := s.nodeState(p.Node).backpressure
+	if b == nil {
+		return
+	}
+	b.pause(p.Backend, p.Until)
+	log.Info().
+		Str("node", p.Node).
+		Str("backend", p.Backend).
+		Dur("pause", time.Until(p.Until).Round(time.Millisecond)).
+		Msg("backend pause learned from cluster")
+}
+
+// handleAdminCluster shows this instance and its peers
+func (s *Server) handleAdminCluster(w http.ResponseWriter, r *http.Request) {
+	if s.cluster == nil {
+		writeAdminError(w, http.StatusNotFound, "clustering is not enabled")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, map[string]any{
+		"instance": s.instance,
+		"peers":    s.cluster.Peers(),
+	})
+}
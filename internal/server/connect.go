@@ -1,27 +1,61 @@
 package server
 
 import (
-	"fmt"
-	"io"
+	"context"
+	"crypto/tls"
+	"errors"
 	"net"
 	"net/http"
-	"net/url"
-	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/limiter"
+	"github.com/simman/go-forwarder/internal/tunnel"
 )
 
 // handleConnect handles HTTPS CONNECT requests for tunneling
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	// Match route based on host
-	node, matched := s.router.Match(r)
+	route, matched := s.matchRoute(w, r)
 	if !matched {
+		return
+	}
+	node := route.Node
+
+	// Enforce the service's CONNECT policy
+	if status := s.serviceState(route.Service).connect.authorize(r); status != 0 {
 		log.Warn().
 			Str("host", r.Host).
-			Msg("no matching route for CONNECT")
-		http.Error(w, "No matching route found", http.StatusBadGateway)
+			Str("service", route.Service).
+			Str("client", r.RemoteAddr).
+			Int("status", status).
+			Msg("CONNECT rejected by service policy")
+		if status == http.StatusProxyAuthRequired {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="go-forwarder"`)
+		}
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	// Serve the maintenance page instead of forwarding
+	if s.handleMaintenance(w, r, node) {
+		return
+	}
+
+	// Reserve a tunnel slot on the node
+	release, ok := s.acquireTunnel(w, r, node)
+	if !ok {
 		return
 	}
+	defer release()
+
+	// Count the tunnel as in-flight work so a reload can drain the node
+	ctx, done := s.trackWork(r.Context(), node.Name)
+	defer done()
+
+	// Pick the backend that serves this request
+	node = s.resolveTarget(w, r, node)
 
 	log.Debug().
 		Str("host", r.Host).
@@ -32,12 +66,16 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	var targetConn net.Conn
 	var err error
 
-	if node.Proxy != "" {
+	d := s.forwarder.Dialer(node)
+	if proxy := node.ProxyURL(); proxy != "" {
 		// Connect through proxy
-		targetConn, err = s.connectThroughProxy(node.Proxy, node.Addr)
+		s.mu.RLock()
+		proxies := s.proxies
+		s.mu.RUnlock()
+		targetConn, err = proxies.Dial(ctx, d, proxy, node.Addr)
 	} else {
 		// Connect directly
-		targetConn, err = net.DialTimeout("tcp", node.Addr, 30*time.Second)
+		targetConn, err = d.DialContext(ctx, "tcp", node.Addr)
 	}
 
 	if err != nil {
@@ -52,14 +90,7 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 	defer targetConn.Close()
 
 	// Hijack the client connection
-	hijacker, ok := w.(http.Hijacker)
-	if !ok {
-		log.Error().Msg("ResponseWriter does not support hijacking")
-		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
-		return
-	}
-
-	clientConn, _, err := hijacker.Hijack()
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
 	if err != nil {
 		log.Error().Err(err).Msg("failed to hijack connection")
 		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
@@ -74,71 +105,153 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Forward anything the client sent before the tunnel was established
+	if n := clientBuf.Reader.Buffered(); n > 0 {
+		pending, _ := clientBuf.Reader.Peek(n)
+		if _, err := targetConn.Write(pending); err != nil {
+			log.Debug().Err(err).Msg("failed to forward buffered client data")
+			return
+		}
+	}
+
+	// Close the tunnel if the node's drain grace period runs out
+	stop := context.AfterFunc(ctx, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
+	defer stop()
+
 	// Start bidirectional copy
 	log.Info().
 		Str("host", r.Host).
 		Str("node", node.Name).
 		Msg("CONNECT tunnel established")
 
-	errCh := make(chan error, 2)
-
-	go func() {
-		_, err := io.Copy(targetConn, clientConn)
-		errCh <- err
-	}()
+	// List the tunnel for the admin API
+	conn := &relayedConn{
+		kind:    connKindConnect,
+		client:  r.RemoteAddr,
+		node:    node.Name,
+		route:   describeRoute(node),
+		backend: node.Addr,
+		host:    r.Host,
+		close: func() {
+			clientConn.Close()
+			targetConn.Close()
+		},
+	}
+	defer s.conns.add(conn)()
 
-	go func() {
-		_, err := io.Copy(clientConn, targetConn)
-		errCh <- err
-	}()
+	s.mu.RLock()
+	opts := tunnelOptions(&s.config.Server.Tunnel)
+	s.mu.RUnlock()
+	opts.Fair, opts.Client = s.fairness(node.ProxyURL()), acl.ClientIP(r).String()
+	opts.Progress = &conn.progress
 
-	// Wait for one direction to finish
-	err = <-errCh
-	if err != nil && err != io.EOF {
-		log.Debug().Err(err).Msg("tunnel copy error")
+	stats := tunnel.Relay(clientConn, targetConn, opts)
+	if stats.Err != nil {
+		if tunnel.IsTimeout(stats.Err) {
+			log.Info().Err(stats.Err).Str("host", r.Host).Str("node", node.Name).Msg("tunnel deadline exceeded")
+		} else {
+			log.Debug().Err(stats.Err).Msg("tunnel copy error")
+		}
 	}
 
 	log.Debug().
 		Str("host", r.Host).
 		Str("node", node.Name).
+		Int64("bytes_up", stats.BytesUp).
+		Int64("bytes_down", stats.BytesDown).
 		Msg("CONNECT tunnel closed")
 }
 
-// connectThroughProxy connects to the target through an HTTP proxy
-func (s *Server) connectThroughProxy(proxyURL, targetAddr string) (net.Conn, error) {
-	proxy, err := url.Parse(proxyURL)
-	if err != nil {
-		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+// acquireTunnel reserves a relay and one of the node's tunnel slots for the
+// client. When max_relays are open or the node is full it answers 503,
+// when the client already holds its share it answers 429, and reports
+// false.
+func (s *Server) acquireTunnel(w http.ResponseWriter, r *http.Request, node *config.Node) (func(), bool) {
+	kind := connKindUpgrade
+	switch {
+	case r.Method == http.MethodConnect:
+		kind = connKindConnect
+	case isWebSocketUpgrade(r):
+		kind = connKindWebSocket
+	}
+	relayed, ok := s.relays.acquire(kind)
+	if !ok {
+		log.Warn().
+			Str("host", r.Host).
+			Str("node", node.Name).
+			Str("client", r.RemoteAddr).
+			Str("kind", kind).
+			Msg("relay rejected, max_relays open")
+		http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return nil, false
 	}
 
-	// Connect to proxy
-	proxyConn, err := net.DialTimeout("tcp", proxy.Host, 30*time.Second)
-	if err != nil {
-		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	lim := s.nodeState(node.Name).tunnels
+	if lim == nil {
+		return relayed, true
 	}
 
-	// Send CONNECT request to proxy
-	connectReq := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", targetAddr, targetAddr)
-	_, err = proxyConn.Write([]byte(connectReq))
+	client := acl.ClientIP(r).String()
+	release, err := lim.Acquire(client)
 	if err != nil {
-		proxyConn.Close()
-		return nil, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+		relayed()
+		log.Warn().
+			Err(err).
+			Str("host", r.Host).
+			Str("node", node.Name).
+			Str("client", client).
+			Msg("tunnel rejected by limit")
+		status := http.StatusServiceUnavailable
+		if errors.Is(err, limiter.ErrTooManyClientTunnels) {
+			status = http.StatusTooManyRequests
+		}
+		http.Error(w, http.StatusText(status), status)
+		return nil, false
 	}
+	return func() {
+		release()
+		relayed()
+	}, true
+}
 
-	// Read response from proxy
-	buf := make([]byte, 1024)
-	n, err := proxyConn.Read(buf)
-	if err != nil {
-		proxyConn.Close()
-		return nil, fmt.Errorf("failed to read proxy response: %w", err)
+// tunnelOptions converts tunnel config into relay options
+func tunnelOptions(cfg *config.TunnelConfig) tunnel.Options {
+	return tunnel.Options{
+		ClientReadTimeout:    cfg.ClientReadTimeout,
+		ClientWriteTimeout:   cfg.ClientWriteTimeout,
+		UpstreamReadTimeout:  cfg.UpstreamReadTimeout,
+		UpstreamWriteTimeout: cfg.UpstreamWriteTimeout,
+	}
+}
+
+// fairness returns the bandwidth schedulers of tunnels through proxy, or
+// nil when tunnels aren't fair-queued
+func (s *Server) fairness(proxy string) *tunnel.Fairness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cfg := s.config.Server.Tunnel.Fairness
+	if cfg == nil {
+		return nil
 	}
 
-	// Check for 200 Connection Established
-	response := string(buf[:n])
-	if len(response) < 12 || response[9:12] != "200" {
-		proxyConn.Close()
-		return nil, fmt.Errorf("proxy returned non-200 response: %s", response)
+	name := redactProxy(proxy)
+	f, ok := s.fair[name]
+	if !ok {
+		f = tunnel.NewFairness(name, int64(cfg.Bandwidth))
+		s.fair[name] = f
 	}
+	return f
+}
 
-	return proxyConn, nil
+// newProxyPool creates the pool of connections to upstream proxies
+func newProxyPool(cfg *config.ProxyPool, tlsCfg *tls.Config) *tunnel.ProxyPool {
+	return tunnel.NewProxyPool(tunnel.ProxyOptions{
+		Idle:        cfg.Idle,
+		IdleTimeout: cfg.IdleTimeout,
+		TLS:         tlsCfg,
+	})
 }
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var clientConns = metrics.NewGaugeVec(
+	"forwarder_client_conns",
+	"Open client connections by listener and state (new, active or idle)",
+	"addr", "state",
+)
+
+// clientConnState returns a ConnState hook counting the client connections
+// of the listener on addr. Idle connections are closed by the server after
+// idle_timeout.
+func clientConnState(addr string) func(net.Conn, http.ConnState) {
+	var states sync.Map // net.Conn -> http.ConnState
+	return func(conn net.Conn, state http.ConnState) {
+		if prev, ok := states.Load(conn); ok {
+			clientConns.With(addr, prev.(http.ConnState).String()).Dec()
+		}
+		switch state {
+		case http.StateHijacked, http.StateClosed:
+			states.Delete(conn)
+		default:
+			states.Store(conn, state)
+			clientConns.With(addr, state.String()).Inc()
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/tunnel"
+)
+
+// Kinds of relayed connections
+const (
+	connKindConnect     = "connect"
+	connKindUpgrade     = "upgrade"
+	connKindWebSocket   = "websocket"
+	connKindPassthrough = "passthrough"
+	connKindSNI         = "sni"
+)
+
+var (
+	relayedConns = metrics.NewGaugeVec(
+		"forwarder_relayed_conns",
+		"Open tunnels, upgraded connections, WebSockets and passthrough connections",
+		"kind",
+	)
+	connsKilledTotal = metrics.NewCounterVec(
+		"forwarder_conns_killed_total",
+		"Relayed connections terminated through the admin API",
+		"kind",
+	)
+)
+
+// relayedConn is a long-lived connection the forwarder relays bytes for
+type relayedConn struct {
+	id       string
+	kind     string
+	client   string
+	node     string
+	route    string
+	backend  string
+	host     string
+	started  time.Time
+	progress tunnel.Progress
+	close    func() // closes both sides
+
+	killOnce sync.Once
+}
+
+// connView is the admin API view of a relayed connection
+type connView struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Client    string    `json:"client"`
+	Node      string    `json:"node,omitempty"`
+	Route     string    `json:"route,omitempty"`
+	Backend   string    `json:"backend"`
+	Host      string    `json:"host,omitempty"`
+	Started   time.Time `json:"started"`
+	Age       float64   `json:"age_seconds"`
+	BytesUp   int64     `json:"bytes_up"`
+	BytesDown int64     `json:"bytes_down"`
+}
+
+// connTable lists the connections being relayed, so they can be looked
+// at and terminated during an incident
+type connTable struct {
+	mu    sync.Mutex
+	conns map[string]*relayedConn
+}
+
+func newConnTable() *connTable {
+	return &connTable{conns: make(map[string]*relayedConn)}
+}
+
+// add lists c until the returned func is called
+func (t *connTable) add(c *relayedConn) func() {
+	var id [8]byte
+	rand.Read(id[:])
+	c.id = hex.EncodeToString(id[:])
+	c.started = time.Now()
+
+	t.mu.Lock()
+	t.conns[c.id] = c
+	t.mu.Unlock()
+	relayedConns.With(c.kind).Inc()
+
+	return func() {
+		t.mu.Lock()
+		delete(t.conns, c.id)
+		t.mu.Unlock()
+		relayedConns.With(c.kind).Dec()
+	}
+}
+
+// find returns the connections matching the filters, oldest first. Empty
+// filters match everything.
+func (t *connTable) find(id, node, client, kind string) []*relayedConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var conns []*relayedConn
+	for _, c := range t.conns {
+		switch {
+		case id != "" && c.id != id:
+		case node != "" && c.node != node:
+		case kind != "" && c.kind != kind:
+		case client != "" && !sameClient(c.client, client):
+		default:
+			conns = append(conns, c)
+		}
+	}
+	sort.Slice(conns, func(i, j int) bool { return conns[i].started.Before(conns[j].started) })
+	return conns
+}
+
+// kill closes both sides of the connection
+func (c *relayedConn) kill() {
+	c.killOnce.Do(func() {
+		connsKilledTotal.With(c.kind).Inc()
+		log.Warn().
+			Str("id", c.id).
+			Str("kind", c.kind).
+			Str("client", c.client).
+			Str("node", c.node).
+			Str("backend", c.backend).
+			Msg("connection terminated by admin")
+		c.close()
+	})
+}
+
+func (c *relayedConn) view(now time.Time) connView {
+	return connView{
+		ID:        c.id,
+		Kind:      c.kind,
+		Client:    c.client,
+		Node:      c.node,
+		Route:     c.route,
+		Backend:   c.backend,
+		Host:      c.host,
+		Started:   c.started,
+		Age:       now.Sub(c.started).Seconds(),
+		BytesUp:   c.progress.Up.Load(),
+		BytesDown: c.progress.Down.Load(),
+	}
+}
+
+// sameClient reports whether client names the client address addr, or
+// its IP alone
+func sameClient(addr, client string) bool {
+	if client == addr {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(strings.Trim(client, "[]"))
+	return ip != nil && ip.Equal(net.ParseIP(host))
+}
+
+// handleAdminConnections lists relayed connections, filtered by ?node=,
+// ?client= (IP or address) and ?kind=. DELETE terminates the matching
+// connections, and needs a node or client so one call can't drop them all.
+func (s *Server) handleAdminConnections(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	node, client, kind := q.Get("node"), q.Get("client"), q.Get("kind")
+
+	switch r.Method {
+	case http.MethodGet:
+		now := time.Now()
+		result := make([]connView, 0)
+		for _, c := range s.conns.find("", node, client, kind) {
+			result = append(result, c.view(now))
+		}
+		writeAdminJSON(w, http.StatusOK, result)
+	case http.MethodDelete:
+		if node == "" && client == "" {
+			writeAdminError(w, http.StatusBadRequest, "node or client is required")
+			return
+		}
+		conns := s.conns.find("", node, client, kind)
+		for _, c := range conns {
+			c.kill()
+		}
+		writeAdminJSON(w, http.StatusOK, map[string]int{"killed": len(conns)})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// handleAdminConnection shows or, with DELETE, terminates one connection
+func (s *Server) handleAdminConnection(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/connections/")
+	conns := s.conns.find(id, "", "", "")
+	if id == "" || len(conns) == 0 {
+		writeAdminError(w, http.StatusNotFound, "no such connection")
+		return
+	}
+	c := conns[0]
+
+	switch r.Method {
+	case http.MethodGet:
+		writeAdminJSON(w, http.StatusOK, c.view(time.Now()))
+	case http.MethodDelete:
+		c.kill()
+		writeAdminJSON(w, http.StatusOK, map[string]int{"killed": 1})
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
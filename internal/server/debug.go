@@ -0,0 +1,111 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+)
+
+// debugPolicy decides which responses carry X-Forwarder-* debug headers
+type debugPolicy struct {
+	always   bool
+	header   string
+	trace    string // request header asking for a decision trace
+	allowIPs *acl.ACL
+}
+
+// newDebugPolicy builds the debug policy from config
+func newDebugPolicy(cfg *config.DebugConfig) *debugPolicy {
+	allowIPs, err := acl.New(cfg.AllowIPs)
+	if err != nil {
+		// Validated on load; a nil ACL allows nobody
+		log.Error().Err(err).Msg("invalid debug allow_ips")
+	}
+	return &debugPolicy{
+		always:   cfg.Headers,
+		header:   cfg.Header,
+		trace:    cfg.TraceHeader,
+		allowIPs: allowIPs,
+	}
+}
+
+// enabled reports whether r gets debug headers. The request header only
+// counts when the client is in allow_ips.
+func (p *debugPolicy) enabled(r *http.Request) bool {
+	if p.always {
+		return true
+	}
+	if r.Header.Get(p.header) == "" {
+		return false
+	}
+	return p.allowIPs.Contains(acl.ClientIP(r))
+}
+
+// traced reports whether r gets a decision trace. Unlike debug headers,
+// traces are only ever given to clients in allow_ips.
+func (p *debugPolicy) traced(r *http.Request) bool {
+	if v := r.Header.Get(p.trace); v == "" || v == "0" {
+		return false
+	}
+	return p.allowIPs.Contains(acl.ClientIP(r))
+}
+
+// debugMiddleware adds headers explaining how a request was routed
+func (s *Server) debugMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		policy := s.debug
+		s.mu.RUnlock()
+
+		enabled := policy.enabled(r)
+
+		// The toggle is meant for the forwarder, not the backend
+		r.Header.Del(policy.header)
+
+		info := getRequestInfo(r)
+		if !enabled || info == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rw := rwwrap.Wrap(w)
+		rw.OnWriteHeader(func(int) {
+			h := rw.Header()
+			if info.route != "" {
+				h.Set("X-Forwarder-Route", info.route)
+			}
+			if info.node != "" {
+				h.Set("X-Forwarder-Node", info.node)
+			}
+			if info.upstream != "" {
+				h.Set("X-Forwarder-Upstream", info.upstream)
+			}
+			h.Set("X-Forwarder-Duration", time.Since(info.start).Round(time.Microsecond).String())
+		})
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// describeRoute returns the filter or matcher rule a node was matched by,
+// preceded by its host map
+func describeRoute(node *config.Node) string {
+	var rule string
+	switch {
+	case node.Filter != nil:
+		rule = "Host{" + node.Filter.Host + "}"
+	case node.Matcher != nil:
+		rule = node.Matcher.Rule
+	}
+	if node.HostMap == "" {
+		return rule
+	}
+	if rule == "" {
+		return "HostMap{" + node.HostMap + "}"
+	}
+	return "HostMap{" + node.HostMap + "} && " + rule
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"reflect"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/netutil"
+)
+
+// namedDialer is a dialer of the dialers section with the config it was
+// created from
+type namedDialer struct {
+	cfg    config.Dialer
+	dialer dialer.ContextDialer
+}
+
+// buildDialers creates the named dialers of cfgs, carrying over those of
+// old whose config is unchanged, so SSH connections and pooled backend
+// connections survive a reload
+func (s *Server) buildDialers(cfgs map[string]config.Dialer, old map[string]namedDialer) (map[string]namedDialer, error) {
+	dialers := make(map[string]namedDialer, len(cfgs))
+	for name, cfg := range cfgs {
+		if prev, ok := old[name]; ok && reflect.DeepEqual(prev.cfg, cfg) {
+			dialers[name] = prev
+			continue
+		}
+
+		var d dialer.ContextDialer
+		var err error
+		if cfg.Type == config.DialerProxy {
+			d = &proxyDialer{server: s, dialer: dialer.New(cfg.Dial), proxy: cfg.URL}
+		} else {
+			d, err = dialer.Open(name, cfg)
+		}
+		if err != nil {
+			releaseDialers(dialers, old)
+			return nil, fmt.Errorf("failed to create dialer %s: %w", name, err)
+		}
+		dialers[name] = namedDialer{cfg: cfg, dialer: d}
+	}
+	return dialers, nil
+}
+
+// releaseDialers closes the dialers of old that next doesn't carry over
+func releaseDialers(old, next map[string]namedDialer) {
+	for name, nd := range old {
+		if kept, ok := next[name]; ok && dialer.KeyOf(kept.dialer) == dialer.KeyOf(nd.dialer) {
+			continue
+		}
+		dialer.Close(nd.dialer)
+	}
+}
+
+// forwarderDialers returns the dialers by name, as the forwarder takes them
+func forwarderDialers(dialers map[string]namedDialer) map[string]dialer.ContextDialer {
+	m := make(map[string]dialer.ContextDialer, len(dialers))
+	for name, nd := range dialers {
+		m[name] = nd.dialer
+	}
+	return m
+}
+
+// applyDNS applies the dns section of cfg and names the hosts DNS failures
+// are counted under
+func applyDNS(cfg *config.Config) {
+	if ttl := cfg.DNS.NXDomainTTL; ttl != nil {
+		dialer.SetNXDomainTTL(*ttl)
+	}
+	dialer.SetMetricHosts(upstreamHosts(cfg))
+}
+
+// upstreamHosts returns the hosts of the backends, proxies and dialers in
+// cfg, the ones the forwarder looks up on its own account
+func upstreamHosts(cfg *config.Config) []string {
+	var hosts []string
+	addr := func(hostport string) {
+		if hostport != "" {
+			hosts = append(hosts, netutil.Hostname(hostport))
+		}
+	}
+	proxy := func(raw string) {
+		if u, err := url.Parse(raw); err == nil && u.Host != "" {
+			hosts = append(hosts, u.Hostname())
+		}
+	}
+
+	proxy(cfg.DefaultProxy)
+	for _, d := range cfg.Dialers {
+		proxy(d.URL)
+	}
+	for _, svc := range cfg.Services {
+		for _, node := range svc.Forwarder.Nodes {
+			addr(node.Addr)
+			for _, b := range node.Backends {
+				addr(b)
+			}
+			if node.Standby != nil {
+				for _, b := range node.Standby.Backends {
+					addr(b)
+				}
+			}
+			if node.Canary != nil {
+				addr(node.Canary.Addr)
+				proxy(node.Canary.Proxy)
+			}
+			proxy(node.Proxy)
+			for _, p := range node.Proxies {
+				proxy(p)
+			}
+		}
+	}
+	return hosts
+}
+
+// proxyDialer opens connections as CONNECT tunnels through an upstream
+// proxy, using the server's proxy pool, which a reload may replace
+type proxyDialer struct {
+	server *Server
+	dialer *dialer.Dialer
+	proxy  string
+}
+
+func (p *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	p.server.mu.RLock()
+	proxies := p.server.proxies
+	p.server.mu.RUnlock()
+	return proxies.Dial(ctx, p.dialer, p.proxy, addr)
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// errDrained is the cancel cause of work cut off by a drain, telling it
+// apart from clients that went away
+var errDrained = errors.New("node drain grace period expired")
+
+// workTracker counts the requests and tunnels in flight to a node, so a node
+// that was removed or changed by a reload can be drained gracefully
+type workTracker struct {
+	mu       sync.Mutex
+	next     uint64
+	active   map[uint64]context.CancelCauseFunc
+	draining bool
+	idle     chan struct{} // closed once draining and nothing is active
+	idleOnce sync.Once     // work begun after the drain may finish it again
+}
+
+func newWorkTracker() *workTracker {
+	return &workTracker{
+		active: make(map[uint64]context.CancelCauseFunc),
+		idle:   make(chan struct{}),
+	}
+}
+
+// begin registers a unit of work. The returned context is canceled if the
+// node is still busy when its drain grace period ends, and done must be
+// called when the work has finished.
+func (t *workTracker) begin(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+
+	t.mu.Lock()
+	id := t.next
+	t.next++
+	t.active[id] = cancel
+	t.mu.Unlock()
+
+	var once sync.Once
+	return ctx, func() {
+		once.Do(func() {
+			cancel(nil)
+			t.mu.Lock()
+			delete(t.active, id)
+			if t.draining && len(t.active) == 0 {
+				t.markIdle()
+			}
+			t.mu.Unlock()
+		})
+	}
+}
+
+// markIdle reports that nothing is active any more. A request may still
+// begin on a drained tracker, having read the node's state before the
+// reload, so this can happen more than once.
+func (t *workTracker) markIdle() {
+	t.idleOnce.Do(func() { close(t.idle) })
+}
+
+// drain waits up to grace for in-flight work to finish, then cancels
+// whatever is left
+func (t *workTracker) drain(node string, grace time.Duration) {
+	t.mu.Lock()
+	if t.draining {
+		t.mu.Unlock()
+		return
+	}
+	t.draining = true
+	pending := len(t.active)
+	if pending == 0 {
+		t.markIdle()
+	}
+	t.mu.Unlock()
+
+	if pending == 0 {
+		return
+	}
+
+	log.Info().
+		Str("node", node).
+		Int("in_flight", pending).
+		Dur("grace", grace).
+		Msg("draining node")
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-t.idle:
+		log.Info().Str("node", node).Msg("node drained")
+	case <-timer.C:
+		t.mu.Lock()
+		remaining := len(t.active)
+		for _, cancel := range t.active {
+			cancel(errDrained)
+		}
+		t.mu.Unlock()
+		log.Warn().
+			Str("node", node).
+			Int("in_flight", remaining).
+			Msg("drain grace period expired, closing remaining work")
+	}
+}
+
+// clientGone reports whether ctx ended because the client went away, rather
+// than being cut off by a drain or another cause of the forwarder's own
+func clientGone(ctx context.Context) bool {
+	return ctx.Err() != nil && context.Cause(ctx) == ctx.Err()
+}
+
+// trackWork registers work for the named node with the current generation
+// of its runtime state
+func (s *Server) trackWork(ctx context.Context, node string) (context.Context, func()) {
+	if st := s.nodeState(node); st.work != nil {
+		return st.work.begin(ctx)
+	}
+	return ctx, func() {}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestWorkTrackerBeginAfterDrain(t *testing.T) {
+	tracker := newWorkTracker()
+
+	// Nothing in flight, the drain finishes at once
+	tracker.drain("node", time.Second)
+	select {
+	case <-tracker.idle:
+	default:
+		t.Fatal("idle not signaled after draining an idle tracker")
+	}
+
+	// A request that read the old node state begins on the drained tracker
+	ctx, done := tracker.begin(context.Background())
+	if ctx.Err() != nil {
+		t.Fatalf("work context canceled on begin: %v", ctx.Err())
+	}
+	done()
+	done()
+
+	// And so does another, after the first one finished
+	_, done = tracker.begin(context.Background())
+	done()
+}
+
+func TestWorkTrackerDrainCancelsAfterGrace(t *testing.T) {
+	tracker := newWorkTracker()
+	ctx, done := tracker.begin(context.Background())
+	defer done()
+
+	tracker.drain("node", 10*time.Millisecond)
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("work not canceled after the grace period")
+	}
+	if cause := context.Cause(ctx); !errors.Is(cause, errDrained) {
+		t.Fatalf("cause = %v, want %v", cause, errDrained)
+	}
+	if clientGone(ctx) {
+		t.Fatal("drained work counted as the client going away")
+	}
+}
@@ -0,0 +1,213 @@
+package server
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+var faultsInjected = metrics.NewCounterVec(
+	"forwarder_faults_injected_total",
+	"Faults injected into requests by node and fault (delay, abort or reset)",
+	"node", "fault",
+)
+
+// faultState holds the configured faults of a node and the runtime toggle
+type faultState struct {
+	cfg         config.Faults
+	matchHeader string
+	matchValue  string
+	override    atomic.Int32 // -1 when the configured flag applies, otherwise 0 or 1
+}
+
+// newFaultState creates the fault state of a node, carrying over a runtime
+// toggle. Nodes without faults have none.
+func newFaultState(node *config.Node, prev *faultState) *faultState {
+	if node.Faults == nil {
+		return nil
+	}
+	f := &faultState{cfg: *node.Faults}
+	f.override.Store(-1)
+	if prev != nil {
+		f.override.Store(prev.override.Load())
+	}
+	if name, value, ok := strings.Cut(f.cfg.Header, "="); ok {
+		f.matchHeader = strings.TrimSpace(name)
+		f.matchValue = strings.TrimSpace(value)
+	}
+	return f
+}
+
+// Enabled reports whether faults are currently injected
+func (f *faultState) Enabled() bool {
+	if o := f.override.Load(); o >= 0 {
+		return o == 1
+	}
+	return f.cfg.Enabled
+}
+
+// SetEnabled toggles fault injection at runtime
+func (f *faultState) SetEnabled(enabled bool) {
+	if enabled {
+		f.override.Store(1)
+	} else {
+		f.override.Store(0)
+	}
+}
+
+// Reset drops the runtime toggle
+func (f *faultState) Reset() {
+	f.override.Store(-1)
+}
+
+// Overridden reports whether a runtime toggle is active
+func (f *faultState) Overridden() bool {
+	return f.override.Load() >= 0
+}
+
+// applies reports whether the request is subject to the faults
+func (f *faultState) applies(r *http.Request) bool {
+	return f.matchHeader == "" || r.Header.Get(f.matchHeader) == f.matchValue
+}
+
+// faultHit picks a share of requests, given in percent
+func faultHit(percent float64) bool {
+	return rand.Float64()*100 < percent
+}
+
+// injectFaults delays, aborts or resets the request as the node's faults
+// say. It reports whether the request was answered, or the client gave up
+// during the delay.
+func (s *Server) injectFaults(w http.ResponseWriter, r *http.Request, node *config.Node) bool {
+	f := s.nodeState(node.Name).faults
+	if f == nil || !f.Enabled() || !f.applies(r) {
+		return false
+	}
+
+	if d := f.cfg.Delay; d != nil && faultHit(d.Percent) {
+		delay := d.Duration
+		if d.Jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(d.Jitter) + 1))
+		}
+		faultsInjected.With(node.Name, "delay").Inc()
+		trace.Add(r.Context(), "fault", "delayed %s", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			if info := getRequestInfo(r); info != nil {
+				info.canceled = true
+			}
+			return true
+		}
+	}
+
+	if a := f.cfg.Abort; a != nil && faultHit(a.Percent) {
+		faultsInjected.With(node.Name, "abort").Inc()
+		trace.Add(r.Context(), "fault", "aborted with %d", a.Status)
+		log.Debug().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("node", node.Name).
+			Int("status", a.Status).
+			Msg("fault injected, request aborted")
+		s.handleError(w, r, a.Status, "fault injected")
+		return true
+	}
+
+	if rs := f.cfg.Reset; rs != nil && faultHit(rs.Percent) {
+		faultsInjected.With(node.Name, "reset").Inc()
+		log.Debug().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("node", node.Name).
+			Msg("fault injected, connection reset")
+		resetConnection(w)
+		return true
+	}
+	return false
+}
+
+// faultStatus is the admin API view of a node's faults
+type faultStatus struct {
+	Node       string `json:"node"`
+	Enabled    bool   `json:"enabled"`
+	Configured bool   `json:"configured"`
+	Overridden bool   `json:"overridden"`
+}
+
+func newFaultStatus(name string, f *faultState) faultStatus {
+	return faultStatus{
+		Node:       name,
+		Enabled:    f.Enabled(),
+		Configured: f.cfg.Enabled,
+		Overridden: f.Overridden(),
+	}
+}
+
+// handleAdminFaultsList lists the nodes with faults configured
+func (s *Server) handleAdminFaultsList(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	result := make([]faultStatus, 0)
+	for name, st := range s.nodes {
+		if st.faults != nil {
+			result = append(result, newFaultStatus(name, st.faults))
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Node < result[j].Node })
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+// handleAdminFaults reads or toggles fault injection for one node. PUT
+// takes {"enabled": true|false}; DELETE restores the configured state.
+func (s *Server) handleAdminFaults(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/faults/")
+
+	s.mu.RLock()
+	st, ok := s.nodes[name]
+	s.mu.RUnlock()
+	if !ok || st.faults == nil {
+		writeAdminError(w, http.StatusNotFound, "no faults configured for node")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut, http.MethodPost:
+		var req struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Enabled == nil {
+			writeAdminError(w, http.StatusBadRequest, "body must be {\"enabled\": true|false}")
+			return
+		}
+		st.faults.SetEnabled(*req.Enabled)
+		log.Warn().Str("node", name).Bool("enabled", *req.Enabled).Msg("fault injection toggled")
+	case http.MethodDelete:
+		st.faults.Reset()
+		log.Info().Str("node", name).Msg("fault injection reset")
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeAdminJSON(w, http.StatusOK, newFaultStatus(name, st.faults))
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/flags"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var flagDisabled = metrics.NewCounterVec(
+	"forwarder_flag_disabled_total",
+	"Requests that matched a node switched off by its enabled flag",
+	"node",
+)
+
+// newFlagProvider starts the configured feature flag provider, or returns
+// one that answers every flag with its default
+func newFlagProvider(cfg *config.FeatureFlags) flags.Provider {
+	if cfg == nil {
+		return flags.Noop()
+	}
+	return flags.NewPoller(cfg.Source, cfg.Refresh, cfg.Timeout)
+}
+
+// flagProvider returns the current feature flag provider
+func (s *Server) flagProvider() flags.Provider {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.flags
+}
+
+// nodeEnabled returns a check of the nodes' enabled flags for r. Nodes
+// without one, or whose flag is unknown, are enabled.
+func (s *Server) nodeEnabled(r *http.Request) func(*config.Node) bool {
+	provider := s.flagProvider()
+	return func(node *config.Node) bool {
+		if node.Flags == nil || node.Flags.Enabled == "" {
+			return true
+		}
+		enabled := provider.BooleanEvaluation(r.Context(), node.Flags.Enabled, true, flags.EvaluationContext{
+			"node": node.Name,
+			"host": r.Host,
+		})
+		if !enabled {
+			flagDisabled.With(node.Name).Inc()
+		}
+		return enabled
+	}
+}
+
+// flagsStatus is the admin API view of the feature flags
+type flagsStatus struct {
+	Source  string         `json:"source"`
+	Updated *time.Time     `json:"updated,omitempty"`
+	Flags   map[string]any `json:"flags"`
+}
+
+// handleAdminFlags shows the flag values currently in effect
+func (s *Server) handleAdminFlags(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	poller, ok := s.flagProvider().(*flags.Poller)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, "feature flags are not configured")
+		return
+	}
+
+	values, updated := poller.Snapshot()
+	status := flagsStatus{Source: poller.Source(), Flags: values}
+	if !updated.IsZero() {
+		status.Updated = &updated
+	}
+	writeAdminJSON(w, http.StatusOK, status)
+}
+
+// canaryFlagWeight evaluates a node's canary weight flag
+func canaryFlagWeight(provider flags.Provider, node, flag string, def int) int {
+	w := provider.IntEvaluation(context.Background(), flag, int64(def), flags.EvaluationContext{"node": node})
+	return int(min(max(w, 0), 100))
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/geoip"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var geoIPReloads = metrics.NewCounterVec(
+	"forwarder_geoip_reloads_total",
+	"GeoIP database reloads outside config reloads, by outcome",
+	"kind", "result",
+)
+
+// geoIPFiles returns the configured database files by kind
+func geoIPFiles(cfg *config.GeoIP) map[geoip.Kind]string {
+	files := make(map[geoip.Kind]string)
+	if cfg.CountryDB != "" {
+		files[geoip.Country] = cfg.CountryDB
+	}
+	if cfg.ASNDB != "" {
+		files[geoip.ASN] = cfg.ASNDB
+	}
+	return files
+}
+
+// loadGeoIP compiles the configured databases without putting them to use.
+// Kinds without a database map to nil.
+func loadGeoIP(cfg *config.GeoIP) (map[geoip.Kind]*geoip.DB, error) {
+	dbs := map[geoip.Kind]*geoip.DB{geoip.Country: nil, geoip.ASN: nil}
+	for kind, file := range geoIPFiles(cfg) {
+		db, err := geoip.Load(file, kind)
+		if err != nil {
+			return nil, err
+		}
+		dbs[kind] = db
+	}
+	return dbs, nil
+}
+
+// useGeoIP puts databases returned by loadGeoIP to use
+func useGeoIP(dbs map[geoip.Kind]*geoip.DB) {
+	for kind, db := range dbs {
+		geoip.Use(kind, db)
+	}
+}
+
+// reloadGeoIP reads a database file again and puts it to use, keeping the
+// previous one if the file is invalid
+func reloadGeoIP(file string, kind geoip.Kind, force bool) error {
+	load := geoip.Load
+	if force {
+		load = geoip.Reload
+	}
+	db, err := load(file, kind)
+	if err != nil {
+		geoIPReloads.With(kind.String(), "error").Inc()
+		return err
+	}
+	geoip.Use(kind, db)
+	geoIPReloads.With(kind.String(), "ok").Inc()
+	return nil
+}
+
+// geoIPWatcher reloads the databases when their files change. It watches
+// the directories, so files replaced by a rename are picked up too.
+type geoIPWatcher struct {
+	watcher *fsnotify.Watcher
+	files   map[string]geoip.Kind
+}
+
+// newGeoIPWatcher starts watching the configured databases, or returns nil
+// when watching is off
+func newGeoIPWatcher(cfg *config.GeoIP) *geoIPWatcher {
+	if !cfg.Watch {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to watch GeoIP databases")
+		return nil
+	}
+
+	w := &geoIPWatcher{watcher: watcher, files: make(map[string]geoip.Kind)}
+	for kind, file := range geoIPFiles(cfg) {
+		file = filepath.Clean(file)
+		w.files[file] = kind
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			log.Error().Err(err).Str("file", file).Msg("failed to watch GeoIP database")
+		}
+	}
+	go w.watch()
+	return w
+}
+
+// watch reloads a database once its file has been quiet for a moment, so
+// a file being written is not read half way
+func (w *geoIPWatcher) watch() {
+	const settle = 500 * time.Millisecond
+
+	pending := make(map[string]bool)
+	timer := time.NewTimer(settle)
+	timer.Stop()
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if _, watched := w.files[filepath.Clean(event.Name)]; !watched {
+				continue
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+				pending[filepath.Clean(event.Name)] = true
+				timer.Reset(settle)
+			}
+
+		case <-timer.C:
+			for file := range pending {
+				kind := w.files[file]
+				if err := reloadGeoIP(file, kind, false); err != nil {
+					log.Error().Err(err).Str("file", file).Msg("failed to reload GeoIP database, keeping old one")
+				}
+			}
+			pending = make(map[string]bool)
+
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Error().Err(err).Msg("GeoIP watcher error")
+		}
+	}
+}
+
+// close stops watching
+func (w *geoIPWatcher) close() {
+	if w != nil {
+		w.watcher.Close()
+	}
+}
+
+// geoIPStatus describes a database in use
+type geoIPStatus struct {
+	Kind   string    `json:"kind"`
+	File   string    `json:"file"`
+	Ranges int       `json:"ranges"`
+	Loaded time.Time `json:"loaded"`
+}
+
+// handleAdminGeoIP lists the databases in use
+func (s *Server) handleAdminGeoIP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeAdminJSON(w, http.StatusOK, geoIPStatuses())
+}
+
+// handleAdminGeoIPReload reads the configured databases again, even if
+// their files look unchanged
+func (s *Server) handleAdminGeoIPReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	files := geoIPFiles(&s.config.GeoIP)
+	s.mu.RUnlock()
+	if len(files) == 0 {
+		writeAdminError(w, http.StatusNotFound, "no GeoIP databases are configured")
+		return
+	}
+
+	for kind, file := range files {
+		if err := reloadGeoIP(file, kind, true); err != nil {
+			writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+	}
+	writeAdminJSON(w, http.StatusOK, geoIPStatuses())
+}
+
+func geoIPStatuses() []geoIPStatus {
+	statuses := make([]geoIPStatus, 0, 2)
+	for _, kind := range []geoip.Kind{geoip.Country, geoip.ASN} {
+		if db := geoip.Active(kind); db != nil {
+			statuses = append(statuses, geoIPStatus{
+				Kind:   kind.String(),
+				File:   db.File,
+				Ranges: db.Len(),
+				Loaded: db.Loaded,
+			})
+		}
+	}
+	return statuses
+}
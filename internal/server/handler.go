@@ -1,30 +1,150 @@
 package server
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"io"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/router"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+	"github.com/simman/go-forwarder/internal/trace"
+	"github.com/simman/go-forwarder/internal/transform"
+	"github.com/simman/go-forwarder/internal/vars"
 )
 
 // handleHTTP handles regular HTTP requests
 func (s *Server) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Find matching route
-	node, matched := s.router.Match(r)
+	route, matched := s.matchRoute(w, r)
 	if !matched {
-		s.handleNoMatch(w, r)
+		return
+	}
+	node := route.Node
+
+	// Make the route's regex captures available to templates
+	r = r.WithContext(vars.With(r.Context(), router.Captures(route.Rule, r)))
+
+	// Serve the maintenance page instead of forwarding
+	if s.handleMaintenance(w, r, node) {
+		trace.Add(r.Context(), "maintenance", "served the maintenance page of %s", node.Name)
+		return
+	}
+
+	// Record the exchange if the node samples it
+	defer s.startRecording(w, r, node)()
+
+	// Refuse requests without a valid signature before they use capacity
+	if !s.verifySignature(w, r, node) {
+		return
+	}
+
+	// Delay, fail or drop the request to test how clients cope, without
+	// counting it against the node's objectives
+	if s.injectFaults(w, r, node) {
+		return
+	}
+
+	// Count the request against the node's objectives once answered
+	defer s.observeSLO(w, r, node)()
+
+	// Shed the request if the forwarder is overloaded
+	finish, ok := s.admit(w, r, node)
+	if !ok {
+		trace.Add(r.Context(), "shed", "refused by load shedding, priority %q", node.Priority)
+		return
+	}
+	defer finish()
+
+	// Count the request as in-flight work so a reload can drain the node
+	ctx, done := s.trackWork(r.Context(), node.Name)
+	defer done()
+	r = r.WithContext(ctx)
+
+	// Wait for a concurrency slot if the node is limited
+	if lim := s.nodeState(node.Name).limiter; lim != nil {
+		waited := time.Now()
+		release, err := lim.Acquire(r.Context())
+		if err != nil {
+			trace.Add(r.Context(), "limit", "no concurrency slot: %v", err)
+			if clientGone(r.Context()) {
+				return
+			}
+			// Cut off by a drain while the client is still waiting
+			if r.Context().Err() != nil {
+				err = context.Cause(r.Context())
+			}
+			log.Warn().
+				Err(err).
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("node", node.Name).
+				Msg("request rejected by concurrency limit")
+			s.handleError(w, r, http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		defer release()
+		trace.Add(r.Context(), "limit", "concurrency slot after %s", time.Since(waited).Round(time.Microsecond))
+	}
+
+	// Pick the backend that serves this request
+	node = s.resolveTarget(w, r, node)
+
+	// Hold the request while the backend asked for a pause
+	if !s.awaitBackend(w, r, route.Node, node.Addr) {
+		return
+	}
+
+	// Decompress, rewrite or compress the request body if configured
+	if !s.transformBody(w, r, node) {
 		return
 	}
 
 	// Forward request
-	if err := s.forwarder.Forward(w, r, node); err != nil {
+	err := s.forward(w, r, node)
+	if b := s.nodeState(route.Node.Name).backpressure; b != nil {
+		if until := b.observe(route.Node.Name, node.Addr, rwwrap.Wrap(w).Status(), w.Header()); !until.IsZero() {
+			s.sharePause(route.Node.Name, node.Addr, until)
+		}
+	}
+	if err != nil {
+		// Nobody is left to answer, record the abort for the access log
+		if forwarder.ClientCanceled(err) {
+			log.Debug().
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("node", node.Name).
+				Msg("client canceled request")
+			if info := getRequestInfo(r); info != nil {
+				info.canceled = true
+			}
+			return
+		}
+
 		log.Error().
 			Err(err).
 			Str("host", r.Host).
 			Str("path", r.URL.Path).
 			Str("node", node.Name).
 			Msg("failed to forward request")
-		s.handleError(w, r, http.StatusBadGateway, "failed to forward request")
+		switch {
+		case forwarder.Responded(err) && errors.Is(err, forwarder.ErrResponseTooLarge):
+			// A cut off body must not look complete to the client
+			resetConnection(w)
+		case forwarder.Responded(err):
+		case forwarder.IsTimeout(err):
+			s.handleGatewayTimeout(w, r)
+		case errors.Is(err, forwarder.ErrBodyTooLarge):
+			s.handleError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		default:
+			s.handleError(w, r, forwarder.StatusCode(err), "failed to forward request")
+		}
 		return
 	}
 }
@@ -67,3 +187,81 @@ func (s *Server) handleError(w http.ResponseWriter, r *http.Request, statusCode
 		log.Error().Err(err).Msg("failed to encode error response")
 	}
 }
+
+// gatewayTimeoutPage is served to browsers when the upstream times out
+const gatewayTimeoutPage = `<!DOCTYPE html>
+<html>
+<head><title>504 Gateway Timeout</title></head>
+<body>
+<h1>Gateway Timeout</h1>
+<p>The upstream server did not respond in time. Please try again.</p>
+</body>
+</html>
+`
+
+// handleGatewayTimeout answers with 504, as HTML for browsers and JSON otherwise
+func (s *Server) handleGatewayTimeout(w http.ResponseWriter, r *http.Request) {
+	if !prefersHTML(r) {
+		s.handleError(w, r, http.StatusGatewayTimeout, "upstream timed out")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusGatewayTimeout)
+	if _, err := io.WriteString(w, gatewayTimeoutPage); err != nil {
+		log.Debug().Err(err).Msg("failed to write gateway timeout page")
+	}
+}
+
+// prefersHTML reports whether the client asked for HTML over JSON
+func prefersHTML(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	html := strings.Index(accept, "text/html")
+	if html < 0 {
+		return false
+	}
+	json := strings.Index(accept, "application/json")
+	return json < 0 || html < json
+}
+
+// transformBody applies the node's changes to the request body. A gzip
+// body is decompressed first, so the rewrite sees its content, and bodies
+// are compressed last. A refused body is answered and reported as false.
+func (s *Server) transformBody(w http.ResponseWriter, r *http.Request, node *config.Node) bool {
+	st := s.nodeState(node.Name)
+
+	var err error
+	if st.encoder != nil {
+		var decoded bool
+		decoded, err = st.encoder.Decode(r)
+		if decoded || err != nil {
+			trace.Add(r.Context(), "encoding", "request body decompressed, error: %v", err)
+		}
+	}
+	if bt := st.bodyTransform; bt != nil && err == nil {
+		err = bt.Apply(r)
+		trace.Add(r.Context(), "transform", "request body transformed, error: %v", err)
+	}
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("node", node.Name).
+			Msg("failed to transform request body")
+		switch {
+		case errors.Is(err, transform.ErrBodyTooLarge):
+			s.handleError(w, r, http.StatusRequestEntityTooLarge, err.Error())
+		case errors.Is(err, transform.ErrInvalidBody):
+			s.handleError(w, r, http.StatusBadRequest, err.Error())
+		default:
+			s.handleError(w, r, http.StatusBadRequest, "failed to read request body")
+		}
+		return false
+	}
+
+	if st.encoder != nil && st.encoder.Encode(r) {
+		trace.Add(r.Context(), "encoding", "request body compressed")
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// clientConnMiddleware applies the client connection settings of the
+// listener a request came in on: connections are closed after a response
+// when keep-alive is off or the connection served max_requests, and
+// HTTP/1.0 clients get a default host and buffered responses.
+func (s *Server) clientConnMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, _ := r.Context().Value(listenAddrKey).(string)
+		s.mu.RLock()
+		cfg := s.listenerFor(addr)
+		s.mu.RUnlock()
+
+		// Like draining, the HTTP/2 server turns the header into a GOAWAY
+		tunnel := r.Method == http.MethodConnect || isUpgrade(r)
+		if !tunnel && !keepConn(&cfg, r) {
+			w.Header().Set("Connection", "close")
+		}
+
+		if r.ProtoMajor != 1 || r.ProtoMinor != 0 || cfg.HTTP10 == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if r.Host == "" && cfg.HTTP10.DefaultHost != "" {
+			trace.Add(r.Context(), "http10", "no host, using %q", cfg.HTTP10.DefaultHost)
+			r.Host = cfg.HTTP10.DefaultHost
+		}
+
+		// Only a client asking to keep the connection gains from a length,
+		// the others read until it closes anyway
+		if tunnel || cfg.HTTP10.BufferSize == 0 || w.Header().Get("Connection") == "close" ||
+			!headerHasToken(r.Header, "Connection", "keep-alive") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bw := &http10Writer{ResponseWriter: w, limit: int(cfg.HTTP10.BufferSize), head: r.Method == http.MethodHead}
+		next.ServeHTTP(rwwrap.Wrap(bw), r)
+		bw.finish()
+	})
+}
+
+// keepConn reports whether the client connection of r may stay open after
+// the response
+func keepConn(cfg *config.Listener, r *http.Request) bool {
+	if cfg.KeepAlive != nil && !*cfg.KeepAlive {
+		return false
+	}
+	if cfg.MaxRequests > 0 {
+		if n, ok := r.Context().Value(connRequestsKey).(*atomic.Int64); ok && n.Add(1) >= int64(cfg.MaxRequests) {
+			return false
+		}
+	}
+	return true
+}
+
+// http10Writer holds back a response of unknown length up to limit bytes,
+// so it can be sent with a Content-Length instead of until the connection
+// closes. Larger responses and event streams are streamed.
+type http10Writer struct {
+	http.ResponseWriter
+	limit     int
+	head      bool
+	status    int
+	buf       bytes.Buffer
+	streaming bool
+}
+
+// Unwrap returns the wrapped writer, for http.NewResponseController
+func (w *http10Writer) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *http10Writer) WriteHeader(code int) {
+	// HTTP/1.0 has no informational responses
+	if code >= 100 && code <= 199 || w.status != 0 {
+		return
+	}
+	w.status = code
+	if w.Header().Get("Content-Length") != "" || !bodyAllowed(code) || isEventStreamHeader(w.Header()) {
+		w.stream()
+	}
+}
+
+func (w *http10Writer) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.streaming && w.buf.Len()+len(b) > w.limit {
+		w.stream()
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.buf.Write(b)
+}
+
+// Flush sends buffered data to the client once the response streams
+func (w *http10Writer) Flush() {
+	w.FlushError()
+}
+
+// FlushError flushes a streaming response. Bodies of unknown length are
+// flushed after every read, so flushes are held while buffering.
+func (w *http10Writer) FlushError() error {
+	if !w.streaming {
+		return nil
+	}
+	return http.NewResponseController(w.ResponseWriter).Flush()
+}
+
+// stream sends the header and what was buffered, and passes the rest of
+// the response through
+func (w *http10Writer) stream() {
+	if w.streaming {
+		return
+	}
+	w.streaming = true
+	w.ResponseWriter.WriteHeader(w.status)
+	if w.buf.Len() > 0 {
+		w.ResponseWriter.Write(w.buf.Bytes())
+		w.buf.Reset()
+	}
+}
+
+// finish sends a buffered response with its length
+func (w *http10Writer) finish() {
+	if w.streaming || w.status == 0 {
+		return
+	}
+	// A HEAD response tells the length of the GET response, which isn't known
+	if !w.head {
+		w.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	}
+	w.stream()
+}
+
+// bodyAllowed reports whether a response with status may have a body
+func bodyAllowed(status int) bool {
+	return status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// isEventStreamHeader reports whether header announces server-sent events
+func isEventStreamHeader(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/mux"
+	"github.com/simman/go-forwarder/internal/revocation"
+	"github.com/simman/go-forwarder/internal/tunnel"
+)
+
+// listenerFor returns the listener settings of the services on addr
+func (s *Server) listenerFor(addr string) config.Listener {
+	for _, svc := range s.config.Services {
+		svcAddr := svc.Addr
+		if svcAddr == "" {
+			svcAddr = s.config.Server.Addr
+		}
+		if svcAddr == addr {
+			return svc.Listener
+		}
+	}
+	return config.Listener{Type: "tcp"}
+}
+
+// listen opens addr, wrapped in a mux listener when the services on it
+// ask for one. It reports whether the socket was passed by systemd.
+func (s *Server) listen(addr string) (net.Listener, bool, error) {
+	listener, systemd, err := s.bind(addr)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cfg := s.listenerFor(addr)
+	if cfg.Type != "mux" {
+		return listener, systemd, nil
+	}
+
+	// TLS for the nodes of sni services is relayed without terminating it
+	opts := mux.Options{SniffTimeout: cfg.SniffTimeout, Passthrough: s.sniPassthrough(addr)}
+	if cfg.TLS != nil {
+		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
+		if err != nil {
+			listener.Close()
+			return nil, false, fmt.Errorf("failed to load tls certificate: %w", err)
+		}
+		opts.TLSConfig = &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+		if err := requireClientCerts(opts.TLSConfig, cfg.TLS); err != nil {
+			listener.Close()
+			return nil, false, err
+		}
+	}
+	if cfg.Passthrough != "" {
+		target := cfg.Passthrough
+		opts.Raw = func(conn net.Conn) {
+			s.passthrough(conn, target)
+		}
+	}
+
+	log.Info().
+		Str("addr", addr).
+		Bool("tls", opts.TLSConfig != nil).
+		Bool("mtls", opts.TLSConfig != nil && opts.TLSConfig.ClientCAs != nil).
+		Str("passthrough", cfg.Passthrough).
+		Msg("mux listener enabled")
+
+	return mux.New(listener, opts), systemd, nil
+}
+
+// requireClientCerts makes the TLS config ask clients for a certificate
+// from the listener's client CAs and check it for revocation
+func requireClientCerts(tlsCfg *tls.Config, cfg *config.ListenerTLS) error {
+	if cfg.ClientCA == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(cfg.ClientCA)
+	if err != nil {
+		return fmt.Errorf("failed to read client_ca: %w", err)
+	}
+	pool := x509.NewCertPool()
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return fmt.Errorf("failed to parse client_ca: %w", err)
+		}
+		pool.AddCert(ca)
+		cas = append(cas, ca)
+	}
+	tlsCfg.ClientCAs = pool
+	tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+
+	r := cfg.Revocation
+	if r == nil {
+		return nil
+	}
+	checker, err := revocation.New(revocation.Options{
+		CRLFiles: r.CRLFiles,
+		OCSP:     r.OCSP,
+		OCSPURL:  r.OCSPURL,
+		CacheTTL: r.CacheTTL,
+		Timeout:  r.Timeout,
+		FailOpen: r.FailOpen,
+		Issuers:  cas,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set up revocation checks: %w", err)
+	}
+	tlsCfg.VerifyConnection = func(cs tls.ConnectionState) error {
+		if len(cs.VerifiedChains) == 0 {
+			return nil
+		}
+		return checker.Check(cs.VerifiedChains[0])
+	}
+	return nil
+}
+
+// passthrough relays a connection that isn't HTTP to target
+func (s *Server) passthrough(conn net.Conn, target string) {
+	defer conn.Close()
+
+	relayed, ok := s.relays.acquire(connKindPassthrough)
+	if !ok {
+		log.Warn().
+			Str("client", conn.RemoteAddr().String()).
+			Str("target", target).
+			Msg("passthrough connection rejected, max_relays open")
+		return
+	}
+	defer relayed()
+
+	upstream, err := dialer.Default.Dial("tcp", target)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("client", conn.RemoteAddr().String()).
+			Str("target", target).
+			Msg("failed to connect to passthrough target")
+		return
+	}
+	defer upstream.Close()
+	s.auditConn(conn, target)
+
+	// List the connection for the admin API
+	entry := &relayedConn{
+		kind:    connKindPassthrough,
+		client:  conn.RemoteAddr().String(),
+		backend: target,
+		close: func() {
+			conn.Close()
+			upstream.Close()
+		},
+	}
+	defer s.conns.add(entry)()
+
+	s.mu.RLock()
+	opts := tunnelOptions(&s.config.Server.Tunnel)
+	s.mu.RUnlock()
+	opts.Progress = &entry.progress
+
+	stats := tunnel.Relay(conn, upstream, opts)
+	if stats.Err != nil {
+		log.Debug().Err(stats.Err).Msg("passthrough copy error")
+	}
+
+	log.Debug().
+		Str("client", conn.RemoteAddr().String()).
+		Str("target", target).
+		Int64("bytes_up", stats.BytesUp).
+		Int64("bytes_down", stats.BytesDown).
+		Msg("passthrough connection closed")
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// hopsHeader counts the forwarders a request has passed through
+const hopsHeader = "X-Forwarder-Hops"
+
+var loopsDetected = metrics.NewCounterVec(
+	"forwarder_loops_detected_total",
+	"Requests refused with 508 because they were forwarding in a loop",
+	"reason",
+)
+
+// newInstanceName returns the pseudonym this forwarder signs Via headers
+// with, unique per process so a request coming back is recognized
+func newInstanceName() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "fwd-" + hex.EncodeToString(b)
+}
+
+// loopMiddleware refuses requests that already passed through this
+// forwarder, or through more forwarders than allowed, with 508 Loop
+// Detected. Other requests are stamped with a Via entry and hop count
+// before they are forwarded.
+func (s *Server) loopMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		maxHops := s.config.Loops.MaxHops
+		s.mu.RUnlock()
+
+		hops, _ := strconv.Atoi(r.Header.Get(hopsHeader))
+
+		reason := ""
+		switch {
+		case viaContains(r.Header, s.instance):
+			reason = "self"
+		case hops >= maxHops:
+			reason = "max_hops"
+		}
+		if reason != "" {
+			loopsDetected.With(reason).Inc()
+			log.Warn().
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("client", r.RemoteAddr).
+				Int("hops", hops).
+				Str("reason", reason).
+				Msg("forwarding loop detected")
+			s.handleError(w, r, http.StatusLoopDetected, "loop detected")
+			return
+		}
+
+		r.Header.Add("Via", fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, s.instance))
+		r.Header.Set(hopsHeader, strconv.Itoa(hops+1))
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// viaContains reports whether a Via entry was added by the named forwarder
+func viaContains(h http.Header, name string) bool {
+	for _, value := range h.Values("Via") {
+		for _, entry := range strings.Split(value, ",") {
+			fields := strings.Fields(entry)
+			if len(fields) >= 2 && fields[1] == name {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// defaultRetryAfter is advertised when no retry_after is configured
+const defaultRetryAfter = 5 * time.Minute
+
+// defaultMaintenancePage is served when no page is configured
+const defaultMaintenancePage = `<!DOCTYPE html>
+<html>
+<head><title>Service Unavailable</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>This service is temporarily unavailable. Please try again later.</p>
+</body>
+</html>
+`
+
+// maintenanceState tracks the configured maintenance mode and runtime toggles
+type maintenanceState struct {
+	cfg         config.Maintenance
+	body        []byte
+	allowIPs    *acl.ACL
+	allowHeader string
+	allowValue  string
+	override    atomic.Int32 // -1 when the configured flag applies, otherwise 0 or 1
+}
+
+// newMaintenanceState creates maintenance state for a node, carrying over a
+// runtime toggle. Nodes without maintenance config get the built-in page.
+func newMaintenanceState(node *config.Node, prev *maintenanceState) *maintenanceState {
+	m := &maintenanceState{
+		cfg: config.Maintenance{
+			ContentType: "text/html; charset=utf-8",
+			RetryAfter:  defaultRetryAfter,
+		},
+		body: []byte(defaultMaintenancePage),
+	}
+	m.override.Store(-1)
+	if prev != nil {
+		m.override.Store(prev.override.Load())
+	}
+
+	if node.Maintenance == nil {
+		return m
+	}
+	m.cfg = *node.Maintenance
+
+	if m.cfg.Page != "" {
+		body, err := os.ReadFile(m.cfg.Page)
+		if err != nil {
+			log.Error().Err(err).Str("node", node.Name).Msg("failed to read maintenance page, using default")
+		} else {
+			m.body = body
+		}
+	}
+
+	if len(m.cfg.AllowIPs) > 0 {
+		allow, err := acl.New(m.cfg.AllowIPs)
+		if err != nil {
+			log.Error().Err(err).Str("node", node.Name).Msg("invalid maintenance allow_ips")
+		}
+		m.allowIPs = allow
+	}
+
+	if name, value, ok := strings.Cut(m.cfg.AllowHeader, "="); ok {
+		m.allowHeader = strings.TrimSpace(name)
+		m.allowValue = strings.TrimSpace(value)
+	}
+
+	return m
+}
+
+// Enabled reports whether maintenance mode is currently active
+func (m *maintenanceState) Enabled() bool {
+	if o := m.override.Load(); o >= 0 {
+		return o == 1
+	}
+	return m.cfg.Enabled
+}
+
+// SetEnabled toggles maintenance mode at runtime
+func (m *maintenanceState) SetEnabled(enabled bool) {
+	if enabled {
+		m.override.Store(1)
+	} else {
+		m.override.Store(0)
+	}
+}
+
+// Reset drops the runtime toggle
+func (m *maintenanceState) Reset() {
+	m.override.Store(-1)
+}
+
+// Overridden reports whether a runtime toggle is active
+func (m *maintenanceState) Overridden() bool {
+	return m.override.Load() >= 0
+}
+
+// allowed reports whether the request may bypass maintenance mode
+func (m *maintenanceState) allowed(r *http.Request) bool {
+	if m.allowHeader != "" && m.allowValue != "" {
+		for _, v := range r.Header.Values(m.allowHeader) {
+			if subtle.ConstantTimeCompare([]byte(v), []byte(m.allowValue)) == 1 {
+				return true
+			}
+		}
+	}
+	return m.allowIPs.Contains(acl.ClientIP(r))
+}
+
+// handleMaintenance answers the request with the maintenance page when the
+// node is in maintenance mode. It reports whether the request was handled.
+// The bypass header is removed either way, so its secret never reaches the
+// backend.
+func (s *Server) handleMaintenance(w http.ResponseWriter, r *http.Request, node *config.Node) bool {
+	m := s.nodeState(node.Name).maintenance
+	if m == nil {
+		return false
+	}
+	blocked := m.Enabled() && !m.allowed(r)
+	if m.allowHeader != "" {
+		r.Header.Del(m.allowHeader)
+	}
+	if !blocked {
+		return false
+	}
+
+	log.Debug().
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Msg("node in maintenance, request rejected")
+
+	w.Header().Set("Content-Type", m.cfg.ContentType)
+	w.Header().Set("Retry-After", strconv.Itoa(int(m.cfg.RetryAfter.Seconds())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if r.Method != http.MethodHead {
+		w.Write(m.body)
+	}
+	return true
+}
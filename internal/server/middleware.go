@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/simman/go-forwarder/internal/rwwrap"
+)
+
+// middleware wraps a handler with cross-cutting behavior. Middleware that
+// needs to observe the response must wrap the writer with rwwrap.Wrap so
+// flushing, hijacking and response controllers keep working for CONNECT,
+// WebSocket and streaming responses.
+type middleware func(http.Handler) http.Handler
+
+// chain applies middleware so the first in the list runs outermost
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// accessLogMiddleware attaches request info and records an access log
+// entry once the request has been handled
+func (s *Server) accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, info := withRequestInfo(r)
+		rw := rwwrap.Wrap(w)
+		defer s.logAccess(rw, r, info)
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,149 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// newChainServer serves h behind the server's full middleware chain
+func newChainServer(t *testing.T, h http.HandlerFunc) *httptest.Server {
+	t.Helper()
+
+	cfg, err := config.Parse([]byte(`
+server:
+  addr: "127.0.0.1:0"
+services:
+  - name: web
+    forwarder:
+      nodes:
+        - name: app
+          addr: 127.0.0.1:1
+          filter: {host: app.test}
+`))
+	if err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	s, err := NewServer(cfg)
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+
+	ts := httptest.NewServer(s.middleware(h))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestMiddlewareChainFlush(t *testing.T) {
+	proceed := make(chan struct{})
+	ts := newChainServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Flusher); !ok {
+			t.Errorf("writer %T is not an http.Flusher", w)
+		}
+		io.WriteString(w, "first\n")
+		if err := http.NewResponseController(w).Flush(); err != nil {
+			t.Errorf("flush through the chain: %v", err)
+		}
+		<-proceed
+		io.WriteString(w, "second\n")
+	})
+	defer close(proceed)
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	// The first line arrives while the handler still waits
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the flushed line: %v", err)
+	}
+	if line != "first\n" {
+		t.Fatalf("flushed line = %q, want %q", line, "first\n")
+	}
+}
+
+func TestMiddlewareChainHijack(t *testing.T) {
+	ts := newChainServer(t, func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := w.(http.Hijacker); !ok {
+			t.Errorf("writer %T is not an http.Hijacker", w)
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Errorf("hijack through the chain: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		brw.Flush()
+		line, err := brw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		conn.Write([]byte(line))
+	})
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: app.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading the upgrade response: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	io.WriteString(conn, "ping\n")
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if line != "ping\n" {
+		t.Fatalf("echo = %q, want %q", line, "ping\n")
+	}
+}
+
+func TestMiddlewareChainResponseController(t *testing.T) {
+	ts := newChainServer(t, func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		deadline := time.Now().Add(time.Minute)
+		if err := rc.SetReadDeadline(deadline); err != nil {
+			t.Errorf("read deadline through the chain: %v", err)
+		}
+		if err := rc.SetWriteDeadline(deadline); err != nil {
+			t.Errorf("write deadline through the chain: %v", err)
+		}
+		if err := rc.EnableFullDuplex(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			t.Errorf("full duplex through the chain: %v", err)
+		}
+		io.WriteString(w, "ok")
+	})
+
+	resp, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if strings.TrimSpace(string(body)) != "ok" {
+		t.Fatalf("body = %q, want %q", body, "ok")
+	}
+}
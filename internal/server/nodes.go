@@ -0,0 +1,220 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/flags"
+	"github.com/simman/go-forwarder/internal/hostmap"
+	"github.com/simman/go-forwarder/internal/limiter"
+	"github.com/simman/go-forwarder/internal/recorder"
+	"github.com/simman/go-forwarder/internal/signature"
+	"github.com/simman/go-forwarder/internal/slo"
+	"github.com/simman/go-forwarder/internal/transform"
+	"github.com/simman/go-forwarder/internal/upstream"
+)
+
+// nodeState holds runtime state for a node that outlives a single request
+type nodeState struct {
+	cfg  config.Node
+	work *workTracker
+
+	limits   config.Limits
+	limiter  *limiter.Limiter
+	tunnels  *limiter.TunnelLimiter
+	canary   *canaryState
+	balancer *balancer
+	hostMap  *hostmap.Map
+
+	maintenance   *maintenanceState
+	faults        *faultState
+	bodyTransform *transform.BodyTransformer
+	encoder       *transform.RequestEncoder
+	signature     *signature.Verifier
+	recorder      *recorder.Recorder
+	wsPolicy      *wsPolicy
+	backpressure  *backpressureState
+	slo           *slo.Tracker
+
+	proxyKey      string
+	proxySelector *upstream.Selector
+
+	standby     *balancer // over the standby backends
+	failoverKey string
+	failover    *upstream.Failover
+}
+
+// buildNodeStates creates runtime state for every node in the config,
+// reusing state from the previous generation when its settings are unchanged
+func buildNodeStates(services []config.Service, prev map[string]*nodeState, provider flags.Provider) map[string]*nodeState {
+	states := make(map[string]*nodeState)
+
+	for _, svc := range services {
+		for i := range svc.Forwarder.Nodes {
+			node := &svc.Forwarder.Nodes[i]
+			if _, exists := states[node.Name]; exists {
+				continue
+			}
+			states[node.Name] = newNodeState(node, prev[node.Name], provider)
+		}
+	}
+
+	return states
+}
+
+// newNodeState creates the runtime state of one node, carrying over
+// long-lived components and runtime overrides from old when possible
+func newNodeState(node *config.Node, old *nodeState, provider flags.Provider) *nodeState {
+	if old == nil {
+		old = &nodeState{}
+	}
+
+	st := &nodeState{cfg: *node, balancer: newBalancer(node)}
+
+	// In-flight work keeps being counted on an unchanged node, a changed
+	// node starts over and the previous generation is drained
+	if old.work != nil && reflect.DeepEqual(old.cfg, st.cfg) {
+		st.work = old.work
+	} else {
+		st.work = newWorkTracker()
+	}
+
+	if node.Limits != nil {
+		st.limits = *node.Limits
+		if old.limiter != nil && old.limits == st.limits {
+			st.limiter = old.limiter
+		} else {
+			st.limiter = limiter.New(node.Name, node.Limits.MaxConcurrent, node.Limits.QueueSize, node.Limits.QueueTimeout)
+		}
+	}
+
+	// Open tunnels stay counted while the limits are unchanged
+	if node.Tunnels != nil {
+		if old.tunnels != nil && reflect.DeepEqual(old.cfg.Tunnels, node.Tunnels) {
+			st.tunnels = old.tunnels
+		} else {
+			st.tunnels = limiter.NewTunnelLimiter(node.Name, node.Tunnels.Max, node.Tunnels.MaxPerClient)
+		}
+	}
+
+	if node.Canary != nil {
+		st.canary = newCanaryState(node, old.canary, provider)
+	}
+
+	st.maintenance = newMaintenanceState(node, old.maintenance)
+	st.faults = newFaultState(node, old.faults)
+
+	if node.BodyTransform != nil {
+		st.bodyTransform = transform.NewBodyTransformer(node.BodyTransform)
+	}
+	if node.RequestEncoding != nil {
+		st.encoder = transform.NewRequestEncoder(node.RequestEncoding)
+	}
+	if node.Signature != nil {
+		st.signature = signature.New(node.Signature)
+	}
+	st.recorder = newRecorder(node, old.recorder)
+
+	st.wsPolicy = newWSPolicy(node.WebSocket)
+	st.backpressure = newBackpressureState(node, old.backpressure)
+	st.slo = newSLOTracker(node, old.slo)
+
+	// The router loaded the same file moments ago, so this is a cache hit
+	if node.HostMap != "" {
+		m, err := hostmap.Load(node.HostMap)
+		if err != nil {
+			log.Error().Err(err).Str("node", node.Name).Msg("failed to load host map")
+		}
+		st.hostMap = m
+	}
+
+	if len(node.Proxies) > 0 {
+		st.proxyKey = fmt.Sprintf("%v|%+v|%s", node.Proxies, *node.ProxySelect, dialer.New(node.Dial).Key())
+		if old.proxySelector != nil && old.proxyKey == st.proxyKey {
+			st.proxySelector = old.proxySelector
+		} else {
+			st.proxySelector = upstream.NewSelector(node.Name, node.Proxies, upstream.SelectorOptions{
+				Interval:   node.ProxySelect.ProbeInterval,
+				Timeout:    node.ProxySelect.ProbeTimeout,
+				Hysteresis: node.ProxySelect.Hysteresis,
+				Dial:       dialer.New(node.Dial).DialContext,
+			})
+			st.proxySelector.Start()
+		}
+	}
+
+	if node.Standby != nil {
+		st.standby = &balancer{
+			backends: slices.Clone(node.Standby.Backends),
+			sticky:   node.Sticky == "cookie",
+		}
+		primaries := node.Backends
+		if len(primaries) == 0 {
+			primaries = []string{node.Addr}
+		}
+		st.failoverKey = fmt.Sprintf("%v|%+v|%s", primaries, *node.Standby, dialer.New(node.Dial).Key())
+		if old.failover != nil && old.failoverKey == st.failoverKey {
+			st.failover = old.failover
+		} else {
+			st.failover = upstream.NewFailover(node.Name, primaries, node.Standby.Backends, upstream.FailoverOptions{
+				Interval:  node.Standby.ProbeInterval,
+				Timeout:   node.Standby.ProbeTimeout,
+				FailAfter: node.Standby.FailAfter,
+				FailBack:  node.Standby.FailBack,
+				Dial:      dialer.New(node.Dial).DialContext,
+			})
+			st.failover.Start()
+		}
+	}
+
+	return st
+}
+
+// backends returns the balancer over the backends serving the node: its
+// standbys while it is failed over, otherwise its own, nil when it has a
+// single backend
+func (st *nodeState) backends() *balancer {
+	if st.failover != nil && st.failover.OnStandby() {
+		return st.standby
+	}
+	return st.balancer
+}
+
+// releaseNodeStates stops background components of prev that were not
+// carried over into next, and drains removed or changed nodes within grace
+func releaseNodeStates(prev, next map[string]*nodeState, grace time.Duration) {
+	for name, old := range prev {
+		cur := next[name]
+		if cur == nil {
+			cur = &nodeState{}
+		}
+		if old.proxySelector != nil && old.proxySelector != cur.proxySelector {
+			old.proxySelector.Stop()
+		}
+		if old.failover != nil && old.failover != cur.failover {
+			old.failover.Stop()
+		}
+		if old.slo != nil && old.slo != cur.slo {
+			old.slo.Stop()
+		}
+		if old.work != nil && old.work != cur.work {
+			go old.work.drain(name, grace)
+		}
+	}
+}
+
+// nodeState returns the runtime state for the named node
+func (s *Server) nodeState(name string) *nodeState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if st, ok := s.nodes[name]; ok {
+		return st
+	}
+	return &nodeState{}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+var (
+	headersCollapsed = metrics.NewCounterVec(
+		"forwarder_headers_collapsed_total",
+		"Repeated request headers joined into one line",
+		"header",
+	)
+	headerRejections = metrics.NewCounterVec(
+		"forwarder_header_rejections_total",
+		"Requests refused for a header value over its length limit, by limit",
+		"header",
+	)
+)
+
+// listHeaders are request headers whose value is a comma-separated list,
+// so repeated lines may be joined into one (RFC 9110, section 5.3)
+var listHeaders = map[string]bool{
+	"Accept":          true,
+	"Accept-Charset":  true,
+	"Accept-Encoding": true,
+	"Accept-Language": true,
+	"Cache-Control":   true,
+	"Connection":      true,
+	"Expect":          true,
+	"Forwarded":       true,
+	"If-Match":        true,
+	"If-None-Match":   true,
+	"Pragma":          true,
+	"Prefer":          true,
+	"Te":              true,
+	"Trailer":         true,
+	"Upgrade":         true,
+	"Via":             true,
+	"X-Forwarded-For": true,
+}
+
+// tokenHeaders are hop-by-hop list headers where a repeated token means
+// nothing more, so duplicates are dropped when collapsing
+var tokenHeaders = map[string]bool{
+	"Connection": true,
+	"Te":         true,
+	"Trailer":    true,
+	"Upgrade":    true,
+}
+
+// normalizeMiddleware canonicalizes the Host and header names of every
+// request before it is matched, so equivalent spellings of a host hit the
+// same route, and optionally collapses repeated headers. Requests with a
+// malformed Host are rejected with 400, requests with a header value over
+// its length limit with 431.
+func (s *Server) normalizeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, err := normalizeHost(r.Host, r.Method == http.MethodConnect, r.TLS != nil)
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("host", r.Host).
+				Str("client", r.RemoteAddr).
+				Msg("rejected request with invalid host")
+			s.handleError(w, r, http.StatusBadRequest, "invalid host")
+			return
+		}
+
+		if host != r.Host {
+			trace.Add(r.Context(), "normalize", "host %q -> %q", r.Host, host)
+		}
+		r.Host = host
+		if r.URL.Host != "" {
+			r.URL.Host = host
+		}
+
+		s.mu.RLock()
+		cfg := s.config.Server.Headers
+		s.mu.RUnlock()
+
+		if collapsed := normalizeHeaders(r.Header, cfg.Collapse); len(collapsed) > 0 {
+			trace.Add(r.Context(), "normalize", "collapsed repeated %s", strings.Join(collapsed, ", "))
+		}
+		if name, limit, ok := checkHeaderLengths(r.Header, &cfg); !ok {
+			headerRejections.With(limit).Inc()
+			trace.Add(r.Context(), "normalize", "header %s over its length limit", name)
+			log.Warn().
+				Str("host", r.Host).
+				Str("client", r.RemoteAddr).
+				Str("header", name).
+				Msg("rejected request with oversized header")
+			s.handleError(w, r, http.StatusRequestHeaderFieldsTooLarge, "request header too large")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// normalizeHost lowercases host, drops a trailing dot and strips the port
+// when it is the default for the scheme. CONNECT targets keep their port.
+func normalizeHost(host string, connect, tls bool) (string, error) {
+	if host == "" {
+		return "", nil
+	}
+
+	name, port := host, ""
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		name, port = h, p
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		name = host[1 : len(host)-1]
+	} else if strings.Contains(host, ":") && net.ParseIP(host) == nil {
+		return "", fmt.Errorf("malformed host %q", host)
+	}
+
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return "", fmt.Errorf("invalid port %q", port)
+		}
+	}
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	if ip := net.ParseIP(name); ip != nil {
+		if ip.To4() == nil {
+			name = "[" + ip.String() + "]"
+		} else {
+			name = ip.String()
+		}
+	} else if !validHostname(name) {
+		return "", fmt.Errorf("invalid hostname %q", name)
+	}
+
+	if !connect && (port == "80" && !tls || port == "443" && tls) {
+		port = ""
+	}
+	if port == "" {
+		return name, nil
+	}
+	return name + ":" + port, nil
+}
+
+// validHostname reports whether name is made of dot-separated labels of
+// letters, digits, hyphens and underscores
+func validHostname(name string) bool {
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for i := 0; i < len(label); i++ {
+			c := label[i]
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// normalizeHeaders files every header under its canonical name, which
+// HTTP/1 parsing does not guarantee for unusual names, so logs and
+// lookups see one spelling. With collapse, repeated list headers are
+// joined into one line, and their names are returned.
+func normalizeHeaders(h http.Header, collapse bool) []string {
+	for name, values := range h {
+		if canonical := http.CanonicalHeaderKey(name); canonical != name {
+			delete(h, name)
+			h[canonical] = append(h[canonical], values...)
+		}
+	}
+	if !collapse {
+		return nil
+	}
+
+	var collapsed []string
+	for name, values := range h {
+		if len(values) < 2 {
+			continue
+		}
+		switch {
+		case name == "Cookie":
+			// Cookie lines join with semicolons (RFC 9113, section 8.2.3)
+			h[name] = []string{strings.Join(values, "; ")}
+		case tokenHeaders[name]:
+			h[name] = []string{strings.Join(uniqueTokens(values), ", ")}
+		case listHeaders[name]:
+			h[name] = []string{strings.Join(values, ", ")}
+		default:
+			continue
+		}
+		headersCollapsed.With(name).Inc()
+		collapsed = append(collapsed, name)
+	}
+	sort.Strings(collapsed)
+	return collapsed
+}
+
+// uniqueTokens returns the comma-separated tokens of values, dropping
+// repeats regardless of case
+func uniqueTokens(values []string) []string {
+	var tokens []string
+	seen := make(map[string]bool)
+	for _, v := range values {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			key := strings.ToLower(token)
+			if token == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+// checkHeaderLengths reports the first header with a value over its limit
+// and the limit it broke, the header name for a per-header limit or "*"
+// for max_value_length
+func checkHeaderLengths(h http.Header, cfg *config.HeaderNormalization) (string, string, bool) {
+	if cfg.MaxValueLength == 0 && len(cfg.Limits) == 0 {
+		return "", "", true
+	}
+	for name, values := range h {
+		limit, label := cfg.MaxValueLength, "*"
+		if l, ok := cfg.Limits[name]; ok {
+			limit, label = l, name
+		}
+		if limit == 0 {
+			continue
+		}
+		for _, v := range values {
+			if len(v) > limit {
+				return name, label, false
+			}
+		}
+	}
+	return "", "", true
+}
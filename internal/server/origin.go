@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// originAllowed reports whether a WebSocket handshake may reach the node.
+// Requests without an Origin come from non-browser clients and pass.
+// Browsers must be on the requested host or match an allowed origin, so
+// other sites can't open connections with their users' cookies.
+func originAllowed(r *http.Request, cfg *config.WebSocket) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme := strings.ToLower(u.Scheme)
+	host, err := normalizeHost(u.Host, false, scheme == "https")
+	if err != nil {
+		return false
+	}
+
+	if host == r.Host {
+		return true
+	}
+	if cfg == nil {
+		return false
+	}
+	for _, pattern := range cfg.AllowedOrigins {
+		if matchOrigin(pattern, scheme, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchOrigin matches a normalized origin against an allowed_origins entry
+func matchOrigin(pattern, scheme, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+
+	pattern = strings.ToLower(pattern)
+	if s, rest, ok := strings.Cut(pattern, "://"); ok {
+		if s != scheme {
+			return false
+		}
+		pattern = rest
+	}
+
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return pattern == host
+}
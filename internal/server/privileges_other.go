@@ -0,0 +1,18 @@
+//go:build !unix
+
+package server
+
+import (
+	"fmt"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// dropPrivileges fails when a user or group is configured, switching them
+// is only supported on Unix systems
+func dropPrivileges(cfg *config.ListenConfig) error {
+	if cfg.User == "" && cfg.Group == "" {
+		return nil
+	}
+	return fmt.Errorf("switching to user %q and group %q is only supported on Unix systems", cfg.User, cfg.Group)
+}
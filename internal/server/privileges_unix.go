@@ -0,0 +1,64 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// dropPrivileges switches the process to the configured user and group
+// once the listen addresses are bound, so ports below 1024 can be bound
+// as root without serving as root. It does nothing unless running as root.
+func dropPrivileges(cfg *config.ListenConfig) error {
+	if cfg.User == "" && cfg.Group == "" {
+		return nil
+	}
+	if os.Geteuid() != 0 {
+		log.Warn().Str("user", cfg.User).Str("group", cfg.Group).Msg("not running as root, keeping the current user")
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if cfg.User != "" {
+		u, err := user.Lookup(cfg.User)
+		if err != nil {
+			if u, err = user.LookupId(cfg.User); err != nil {
+				return fmt.Errorf("failed to look up user %s: %w", cfg.User, err)
+			}
+		}
+		uid, _ = strconv.Atoi(u.Uid)
+		gid, _ = strconv.Atoi(u.Gid)
+	}
+	if cfg.Group != "" {
+		g, err := user.LookupGroup(cfg.Group)
+		if err != nil {
+			if g, err = user.LookupGroupId(cfg.Group); err != nil {
+				return fmt.Errorf("failed to look up group %s: %w", cfg.Group, err)
+			}
+		}
+		gid, _ = strconv.Atoi(g.Gid)
+	}
+
+	// The group goes first, a process that gave up root can't change it
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("failed to set supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to switch to group %d: %w", gid, err)
+	}
+	if uid >= 0 {
+		if err := syscall.Setuid(uid); err != nil {
+			return fmt.Errorf("failed to switch to user %d: %w", uid, err)
+		}
+	}
+
+	log.Info().Int("uid", os.Getuid()).Int("gid", os.Getgid()).Msg("dropped root privileges")
+	return nil
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/recorder"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+)
+
+// newRecorder creates the recorder of a node, keeping old and its
+// recordings while the recording settings are unchanged
+func newRecorder(node *config.Node, old *recorder.Recorder) *recorder.Recorder {
+	if node.Recording == nil {
+		return nil
+	}
+	if old != nil && reflect.DeepEqual(old.Config(), *node.Recording) {
+		return old
+	}
+	return recorder.New(node.Name, node.Recording)
+}
+
+// startRecording records the request and its response when the node
+// samples it. The returned func stores the recording once the request
+// has been answered.
+func (s *Server) startRecording(w http.ResponseWriter, r *http.Request, node *config.Node) func() {
+	rec := s.nodeState(node.Name).recorder
+	if rec == nil {
+		return func() {}
+	}
+	session := rec.Start(r, acl.ClientIP(r).String())
+	if session == nil {
+		return func() {}
+	}
+
+	rw := rwwrap.Wrap(w)
+	rw.OnWriteHeader(func(status int) {
+		session.WriteHeader(status, rw.Header())
+	})
+	rw.OnWrite(session.Write)
+	return session.Finish
+}
+
+// handleAdminRecordings lists the recordings of every node, or of the node
+// named in the path, newest first. limit caps how many are listed and
+// DELETE drops them.
+func (s *Server) handleAdminRecordings(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/recordings"), "/")
+
+	s.mu.RLock()
+	recorders := make(map[string]*recorder.Recorder)
+	for node, st := range s.nodes {
+		if st.recorder != nil && (name == "" || node == name) {
+			recorders[node] = st.recorder
+		}
+	}
+	s.mu.RUnlock()
+
+	if name != "" && recorders[name] == nil {
+		writeAdminError(w, http.StatusNotFound, "node not found or has no recording")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		for node, rec := range recorders {
+			rec.Clear()
+			log.Info().Str("node", node).Msg("recordings cleared")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	limit := -1
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			writeAdminError(w, http.StatusBadRequest, "limit must be a positive number")
+			return
+		}
+		limit = n
+	}
+
+	recordings := make([]recorder.Recording, 0)
+	for _, rec := range recorders {
+		recordings = append(recordings, rec.Recordings()...)
+	}
+	sort.SliceStable(recordings, func(i, j int) bool { return recordings[i].Time.After(recordings[j].Time) })
+	if limit >= 0 && len(recordings) > limit {
+		recordings = recordings[:limit]
+	}
+	writeAdminJSON(w, http.StatusOK, recordings)
+}
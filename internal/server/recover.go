@@ -0,0 +1,85 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+)
+
+var panicsTotal = metrics.NewCounterVec(
+	"forwarder_panics_total",
+	"Panics recovered while handling requests",
+	"node",
+)
+
+// recoverMiddleware turns a panic while handling a request into a 500
+// response carrying a request ID, so one misbehaving matcher or transform
+// fails its request instead of the process. The stack is logged under the
+// same ID.
+func (s *Server) recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rw := rwwrap.Wrap(w)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// Deliberate aborts are how handlers drop a connection
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			id := r.Header.Get("X-Request-Id")
+			if id == "" {
+				id = newRequestID()
+			}
+			node := ""
+			if info := getRequestInfo(r); info != nil {
+				node = info.node
+			}
+			panicsTotal.With(node).Inc()
+
+			log.Error().
+				Str("request_id", id).
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("method", r.Method).
+				Str("node", node).
+				Str("panic", fmt.Sprint(v)).
+				Str("stack", string(debug.Stack())).
+				Msg("recovered from panic while handling request")
+
+			// Once the response has started the client can only be cut off
+			if rw.Status() != 0 || rw.Hijacked() {
+				panic(http.ErrAbortHandler)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Request-Id", id)
+			w.WriteHeader(http.StatusInternalServerError)
+			response := map[string]string{
+				"error":      "internal server error",
+				"request_id": id,
+			}
+			if err := json.NewEncoder(w).Encode(response); err != nil {
+				log.Error().Err(err).Msg("failed to encode error response")
+			}
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// newRequestID returns a random identifier for a request
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// acmeChallengePath is where ACME servers fetch HTTP-01 challenge tokens
+const acmeChallengePath = "/.well-known/acme-challenge/"
+
+var redirectRequestsTotal = metrics.NewCounterVec(
+	"forwarder_redirect_requests_total",
+	"Requests answered by a redirect service, by kind https or acme",
+	"service", "kind",
+)
+
+// handleRedirect answers the requests coming in on the listener of a
+// redirect service, reporting whether it did. Synthetic routes of the
+// service are left to handleSynthetic.
+func (s *Server) handleRedirect(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.RLock()
+	svc := s.redirectService(r)
+	synthetic := false
+	if svc != nil && r.Method != http.MethodConnect {
+		_, route := s.syntheticRoute(r)
+		synthetic = route != nil
+	}
+	s.mu.RUnlock()
+
+	if svc == nil || synthetic {
+		return false
+	}
+	rd := svc.Redirect
+	info := getRequestInfo(r)
+
+	switch {
+	case r.Method == http.MethodConnect:
+		s.handleError(w, r, http.StatusMethodNotAllowed, "redirect service doesn't accept CONNECT")
+
+	case rd.ACME != "" && strings.HasPrefix(r.URL.Path, acmeChallengePath):
+		redirectRequestsTotal.With(svc.Name, "acme").Inc()
+		trace.Add(r.Context(), "redirect", "ACME challenge of service %s passed to %s", svc.Name, rd.ACME)
+		if info != nil {
+			info.route = "acme " + rd.ACME
+		}
+		s.forwardChallenge(w, r, svc)
+
+	case r.Host == "":
+		s.handleError(w, r, http.StatusBadRequest, "host required to redirect to HTTPS")
+
+	default:
+		redirectRequestsTotal.With(svc.Name, "https").Inc()
+		location := "https://" + httpsHost(r.Host, rd.Port) + r.URL.RequestURI()
+		trace.Add(r.Context(), "redirect", "service %s redirects to %s", svc.Name, location)
+		if info != nil {
+			info.route = "redirect https"
+		}
+		http.Redirect(w, r, location, rd.Status)
+	}
+	return true
+}
+
+// redirectService returns the redirect service listening where the request
+// came in, nil when it came in elsewhere. The caller must hold s.mu.
+func (s *Server) redirectService(r *http.Request) *config.Service {
+	addr := s.requestListener(r)
+	for i := range s.config.Services {
+		svc := &s.config.Services[i]
+		if svc.Handler.Type == "redirect" && s.serviceListener(svc) == addr {
+			return svc
+		}
+	}
+	return nil
+}
+
+// forwardChallenge passes an ACME HTTP-01 challenge request to the ACME
+// client of a redirect service
+func (s *Server) forwardChallenge(w http.ResponseWriter, r *http.Request, svc *config.Service) {
+	node := &config.Node{
+		Name:   svc.Name + "-acme",
+		Addr:   svc.Redirect.ACME,
+		Target: "http://{addr}{request_uri}",
+	}
+	err := s.forwarder.Forward(w, r, node)
+	if err == nil || forwarder.ClientCanceled(err) || forwarder.Responded(err) {
+		return
+	}
+	log.Error().
+		Err(err).
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("acme", node.Addr).
+		Msg("failed to forward ACME challenge")
+	s.handleError(w, r, forwarder.StatusCode(err), "failed to forward ACME challenge")
+}
+
+// httpsHost returns the host of the request with the HTTPS port in place
+// of its own, left out when it's the standard one
+func httpsHost(host string, port int) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if port == 443 {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var relaysRejected = metrics.NewCounterVec(
+	"forwarder_relays_rejected_total",
+	"Relays refused because max_relays were open, by kind",
+	"kind",
+)
+
+// relayGate caps the relays open at once across all listeners. Each relay
+// holds the goroutine that accepted it and two copying goroutines with
+// their buffers for as long as it stays open, so a flood of tunnels is
+// refused instead of growing memory without bound.
+type relayGate struct {
+	max    atomic.Int64 // 0 is unlimited
+	active atomic.Int64
+}
+
+// setMax changes the cap. Relays already open beyond a lowered cap are
+// left alone.
+func (g *relayGate) setMax(max int) {
+	g.max.Store(int64(max))
+}
+
+// acquire reserves a relay of kind, reporting false when the cap is
+// reached. The returned function must be called when the relay closes.
+func (g *relayGate) acquire(kind string) (func(), bool) {
+	if n, max := g.active.Add(1), g.max.Load(); max > 0 && n > max {
+		g.active.Add(-1)
+		relaysRejected.With(kind).Inc()
+		return nil, false
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { g.active.Add(-1) })
+	}, true
+}
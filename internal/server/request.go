@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/mux"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+)
+
+type contextKey int
+
+const (
+	requestInfoKey  contextKey = iota
+	listenAddrKey              // configured address of the listener a request came in on
+	connRequestsKey            // *atomic.Int64 counting the requests of the client connection
+)
+
+// requestInfo collects routing decisions made while handling a request
+type requestInfo struct {
+	start    time.Time
+	route    string
+	node     string
+	upstream string
+	canceled bool // the client went away before the response was complete
+}
+
+// withRequestInfo attaches fresh request info to the request context
+func withRequestInfo(r *http.Request) (*http.Request, *requestInfo) {
+	info := &requestInfo{start: time.Now()}
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info)), info
+}
+
+// getRequestInfo returns the request info attached to r, if any
+func getRequestInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey).(*requestInfo)
+	return info
+}
+
+// listenContext returns a BaseContext hook recording the configured address
+// of the listener on addr in its requests
+func listenContext(addr string) func(net.Listener) context.Context {
+	return func(net.Listener) context.Context {
+		return context.WithValue(context.Background(), listenAddrKey, addr)
+	}
+}
+
+// connContext is a ConnContext hook recording the TLS fingerprint of the
+// client and a request counter in the requests of its connection
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	if fp := mux.Fingerprint(conn); fp != nil {
+		ctx = tlsfp.With(ctx, fp)
+	}
+	return context.WithValue(ctx, connRequestsKey, new(atomic.Int64))
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/retry"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+var (
+	retriesTotal = metrics.NewCounterVec(
+		"forwarder_retries_total",
+		"Requests re-sent to the upstream after a failed attempt",
+		"node",
+	)
+	retryBudgetExhausted = metrics.NewCounterVec(
+		"forwarder_retry_budget_exhausted_total",
+		"Retries skipped because the retry budget was spent",
+		"node",
+	)
+)
+
+// forward sends the request upstream, retrying failures that happened
+// before any response reached the client as allowed by the node's retry
+// policy and the global retry budget. All attempts share the route's
+// deadline.
+func (s *Server) forward(w http.ResponseWriter, r *http.Request, node *config.Node) error {
+	s.mu.RLock()
+	budget := s.budget
+	s.mu.RUnlock()
+
+	ctx, cancel := s.routeContext(r, node)
+	defer cancel()
+	r = r.WithContext(ctx)
+
+	budget.Request()
+	err := s.forwardAttempt(w, r, node)
+
+	policy := node.Retry
+	if policy == nil {
+		return err
+	}
+	backoff := retry.Backoff{Base: policy.Backoff, Max: policy.MaxBackoff, Jitter: policy.Jitter}
+
+	for attempt := 1; attempt <= policy.Attempts && retryable(r, err); attempt++ {
+		if !budget.Withdraw() {
+			retryBudgetExhausted.With(node.Name).Inc()
+			trace.Add(r.Context(), "retry", "retry budget exhausted after: %v", err)
+			log.Warn().
+				Str("host", r.Host).
+				Str("node", node.Name).
+				Msg("retry budget exhausted, not retrying")
+			break
+		}
+
+		delay := backoff.Delay(attempt)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			timer.Stop()
+			return err
+		}
+
+		retriesTotal.With(node.Name).Inc()
+		trace.Add(r.Context(), "retry", "attempt %d after %s backoff, previous: %v", attempt+1, delay, err)
+		log.Debug().
+			Err(err).
+			Str("host", r.Host).
+			Str("node", node.Name).
+			Int("attempt", attempt+1).
+			Dur("backoff", delay).
+			Msg("retrying request")
+
+		err = s.forwardAttempt(w, r, node)
+	}
+
+	return err
+}
+
+// retryable reports whether the request can safely be sent again after err
+func retryable(r *http.Request, err error) bool {
+	if err == nil || forwarder.Responded(err) || r.Context().Err() != nil {
+		return false
+	}
+
+	// The body has been consumed by the failed attempt
+	if r.ContentLength != 0 {
+		return false
+	}
+
+	// Nothing reached the upstream if the connection couldn't be opened
+	var fe *forwarder.Error
+	if errors.As(err, &fe) {
+		switch fe.Kind {
+		case forwarder.KindDNS, forwarder.KindDialTimeout, forwarder.KindConnRefused:
+			return true
+		}
+	}
+
+	return idempotent(r.Method)
+}
+
+// idempotent reports whether repeating a request with method has no
+// additional effect
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return false
+	}
+}
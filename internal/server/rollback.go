@@ -0,0 +1,172 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var configRollbacks = metrics.NewCounterVec(
+	"forwarder_config_rollbacks_total",
+	"Configurations rolled back to the previous one, by reason admin or no_match",
+	"reason",
+)
+
+// errNoPrevious is returned by a rollback with nothing to roll back to
+var errNoPrevious = errors.New("no previous configuration to roll back to")
+
+// noMatchWatch counts the requests matching no route after a reload, to
+// roll back a reload that broke routing
+type noMatchWatch struct {
+	requests  atomic.Int64
+	unmatched atomic.Int64
+	armed     atomic.Bool // the current config may still be rolled back
+
+	mu       sync.Mutex
+	cfg      config.Rollback
+	until    time.Time // end of the watch window
+	baseline float64   // unmatched share under the previous config
+}
+
+// reset starts counting for a new config. The share of unmatched requests
+// seen so far becomes the baseline the new config is held to.
+func (w *noMatchWatch) reset(cfg *config.Rollback) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.baseline = 0
+	if requests := w.requests.Load(); requests > 0 {
+		w.baseline = float64(w.unmatched.Load()) / float64(requests)
+	}
+	w.requests.Store(0)
+	w.unmatched.Store(0)
+	w.cfg = *cfg
+	w.until = time.Now().Add(cfg.Window)
+	w.armed.Store(cfg.Auto)
+}
+
+// observe counts a request, reporting the unmatched share when it calls
+// for a rollback. That is reported once per reload.
+func (w *noMatchWatch) observe(matched bool) (float64, bool) {
+	requests := w.requests.Add(1)
+	if matched {
+		return 0, false
+	}
+	unmatched := w.unmatched.Add(1)
+	if !w.armed.Load() {
+		return 0, false
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if time.Now().After(w.until) {
+		w.armed.Store(false)
+		return 0, false
+	}
+	share := float64(unmatched) / float64(requests)
+	if requests < int64(w.cfg.MinRequests) || share <= w.cfg.MaxNoMatch || share <= w.baseline {
+		return 0, false
+	}
+	return share, w.armed.CompareAndSwap(true, false)
+}
+
+// observeMatch counts a routed request, and rolls the configuration back
+// when too many stopped matching since the last reload
+func (s *Server) observeMatch(matched bool) {
+	share, rollback := s.watch.observe(matched)
+	if !rollback {
+		return
+	}
+
+	// The rollback takes the server lock, which the request may not hold up
+	go func() {
+		log.Error().
+			Float64("unmatched", share).
+			Msg("requests stopped matching routes after a reload, rolling back")
+		if _, err := s.Rollback("no_match"); err != nil {
+			log.Error().Err(err).Msg("failed to roll back configuration")
+		}
+	}()
+}
+
+// Rollback restores the configuration the last reload replaced. There is
+// nothing to roll back to again until the next reload.
+func (s *Server) Rollback(reason string) ([]config.Change, error) {
+	// No other reload may replace the config between reading it and
+	// restoring the previous one
+	s.reloads.Lock()
+	defer s.reloads.Unlock()
+
+	s.mu.RLock()
+	current, previous := s.config, s.previous
+	s.mu.RUnlock()
+	if previous == nil {
+		return nil, errNoPrevious
+	}
+
+	changes := config.Diff(current, previous)
+	if err := s.reload(previous); err != nil {
+		return nil, fmt.Errorf("failed to roll back: %w", err)
+	}
+	s.mu.Lock()
+	s.previous = nil
+	s.mu.Unlock()
+	s.watch.armed.Store(false)
+
+	configRollbacks.With(reason).Inc()
+	log.Warn().Str("reason", reason).Int("changes", len(changes)).Msg("configuration rolled back")
+	return changes, nil
+}
+
+// rollbackStatus is the admin API view of what a rollback would do
+type rollbackStatus struct {
+	Available bool  `json:"available"` // a previous configuration is kept
+	Watching  bool  `json:"watching"`  // the current one may still be rolled back automatically
+	Requests  int64 `json:"requests"`  // since the last reload
+	Unmatched int64 `json:"unmatched"`
+}
+
+// rollbackResult is the admin API result of a rollback
+type rollbackResult struct {
+	RolledBack bool            `json:"rolled_back"`
+	Changes    []config.Change `json:"changes"`
+}
+
+// handleAdminRollback shows on GET whether the previous configuration can
+// be restored, and restores it on POST
+func (s *Server) handleAdminRollback(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.RLock()
+		available := s.previous != nil
+		s.mu.RUnlock()
+		writeAdminJSON(w, http.StatusOK, rollbackStatus{
+			Available: available,
+			Watching:  s.watch.armed.Load(),
+			Requests:  s.watch.requests.Load(),
+			Unmatched: s.watch.unmatched.Load(),
+		})
+
+	case http.MethodPost:
+		changes, err := s.Rollback("admin")
+		switch {
+		case errors.Is(err, errNoPrevious):
+			writeAdminError(w, http.StatusConflict, err.Error())
+		case err != nil:
+			writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		default:
+			writeAdminJSON(w, http.StatusOK, rollbackResult{RolledBack: true, Changes: changes})
+		}
+
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/router"
+)
+
+// maxRouteDelta caps the size of an imported route delta
+const maxRouteDelta = 1 << 20
+
+// routeEntry is the admin API view of a compiled route
+type routeEntry struct {
+	Position int      `json:"position"` // in match order, from 1; sni routes are numbered on their own
+	Service  string   `json:"service"`
+	Listen   string   `json:"listen"`
+	Node     string   `json:"node"`
+	Rule     string   `json:"rule"`
+	SNI      bool     `json:"sni,omitempty"` // matched by the TLS server name
+	Group    string   `json:"group,omitempty"`
+	Addr     string   `json:"addr,omitempty"`
+	Backends []string `json:"backends,omitempty"`
+	Standby  []string `json:"standby,omitempty"` // backends failed over to
+	HostMap  string   `json:"host_map,omitempty"`
+	Proxy    string   `json:"proxy,omitempty"` // without its password
+	Dialer   string   `json:"dialer,omitempty"`
+}
+
+// routeImport is the admin API result of a route import
+type routeImport struct {
+	Applied bool            `json:"applied"`
+	Changes []config.Change `json:"changes"`
+}
+
+// handleAdminRoutes exports the route table on GET, and applies a route
+// delta adding and removing nodes on POST. With ?dry_run=true the delta
+// is only checked.
+func (s *Server) handleAdminRoutes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.mu.RLock()
+		routes, sniRoutes := s.router.GetRoutes(), s.sniRouter.GetRoutes()
+		services := s.config.Services
+		s.mu.RUnlock()
+
+		listen := make(map[string]string, len(services))
+		for _, svc := range services {
+			listen[svc.Name] = svc.Addr
+		}
+		result := make([]routeEntry, 0, len(routes)+len(sniRoutes))
+		result = appendRouteEntries(result, routes, listen, false)
+		result = appendRouteEntries(result, sniRoutes, listen, true)
+		writeAdminJSON(w, http.StatusOK, result)
+
+	case http.MethodPost:
+		s.importRoutes(w, r)
+
+	default:
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+// appendRouteEntries appends the admin API view of routes to entries
+func appendRouteEntries(entries []routeEntry, routes []router.Route, listen map[string]string, sni bool) []routeEntry {
+	for i, route := range routes {
+		node := route.Node
+		entry := routeEntry{
+			Position: i + 1,
+			Service:  route.Service,
+			Listen:   listen[route.Service],
+			Node:     node.Name,
+			Rule:     router.RuleText(node),
+			SNI:      sni,
+			Group:    node.Group,
+			Addr:     node.Addr,
+			Backends: node.Backends,
+			HostMap:  node.HostMap,
+			Dialer:   node.Dialer,
+		}
+		if node.Standby != nil {
+			entry.Standby = node.Standby.Backends
+		}
+		if proxy := node.ProxyURL(); proxy != "" && node.Dialer == "" {
+			entry.Proxy = redactProxy(proxy)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// importRoutes applies a route delta to the running config. The delta is
+// lost on the next reload of the config source, which it isn't written to.
+func (s *Server) importRoutes(w http.ResponseWriter, r *http.Request) {
+	// A browser can't send these cross-site without asking first
+	switch mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType {
+	case "application/json", "application/yaml", "application/x-yaml":
+	default:
+		writeAdminError(w, http.StatusUnsupportedMediaType, "route delta must be application/json or application/yaml")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxRouteDelta+1))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "failed to read route delta")
+		return
+	}
+	if len(data) > maxRouteDelta {
+		writeAdminError(w, http.StatusRequestEntityTooLarge, "route delta too large")
+		return
+	}
+	delta, err := config.ParseRouteDelta(data)
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+
+	// Each import changes the config the previous reload left
+	s.reloads.Lock()
+	defer s.reloads.Unlock()
+
+	s.mu.RLock()
+	current := s.config
+	s.mu.RUnlock()
+
+	next, err := delta.Apply(current)
+	if err == nil {
+		// Rules and host maps are only checked when routes are built
+		if _, err = router.Build(next.Services); err == nil {
+			_, err = router.BuildSNI(next.Services)
+		}
+	}
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	result := routeImport{Changes: config.Diff(current, next)}
+	if !dryRun {
+		if err := s.reload(next); err != nil {
+			writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		s.imported = true
+		result.Applied = true
+		log.Warn().
+			Int("added", len(delta.Add)).
+			Int("removed", len(delta.Remove)).
+			Msg("routes imported through the admin API")
+	}
+	writeAdminJSON(w, http.StatusOK, result)
+}
@@ -3,39 +3,118 @@ package server
 import (
 	"context"
 	"fmt"
-	"net"
 	"net/http"
+	"reflect"
+	"strings"
 	"sync"
-	"time"
+	"sync/atomic"
 
 	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/accesslog"
+	"github.com/simman/go-forwarder/internal/cluster"
 	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/flags"
 	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/proxyauth"
+	"github.com/simman/go-forwarder/internal/retry"
 	"github.com/simman/go-forwarder/internal/router"
+	"github.com/simman/go-forwarder/internal/tunnel"
 )
 
 // Server represents the main proxy server
 type Server struct {
 	config    *config.Config
+	previous  *config.Config // replaced by the last reload, restored by a rollback
 	router    *router.Router
+	sniRouter *router.Router // nodes of sni services, matched by TLS server name
 	forwarder *forwarder.Forwarder
 	servers   []*http.Server
+	nodes     map[string]*nodeState
+	services  map[string]*serviceState
+	stickyKey []byte
+	accessLog accesslog.Sink
+	debug     *debugPolicy
+	admin     *adminAccess
+	budget    *retry.Budget
+	proxies   *tunnel.ProxyPool
+	dialers   map[string]namedDialer      // dialers nodes select by name
+	fair      map[string]*tunnel.Fairness // tunnel bandwidth schedulers by upstream proxy
+	audit     *auditLog
+	flags     flags.Provider
+	geoWatch  *geoIPWatcher
+	creds     *proxyauth.Refresher
+	sessions  *sessionRegistry
+	conns     *connTable
+	relays    relayGate          // caps the relays open across listeners
+	inherited []*inheritedSocket // sockets passed by systemd, taken while starting
+	binds     []bindStatus       // whether the listen addresses bound
+	cluster   *cluster.Cluster
+	samples   *sampleRing // recent requests for what-if checks, nil without admin listener
+	instance  string
+	handler   http.Handler
+	draining  atomic.Bool // shutting down, clients are asked to reconnect elsewhere
+	reloads   sync.Mutex  // serializes reloads, so imports and rollbacks change the config they read
+	imported  bool        // routes were imported since the config was loaded, guarded by reloads
+	onReload  func(current, next *config.Config) error
+	watch     noMatchWatch
 	mu        sync.RWMutex
 }
 
 // NewServer creates a new server instance
 func NewServer(cfg *config.Config) (*Server, error) {
+	geoDBs, err := loadGeoIP(&cfg.GeoIP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load GeoIP databases: %w", err)
+	}
+	useGeoIP(geoDBs)
+
+	provider := newFlagProvider(cfg.FeatureFlags)
 	s := &Server{
 		config:    cfg,
 		router:    router.NewRouter(),
-		forwarder: forwarder.NewForwarder(),
+		sniRouter: router.NewSNIRouter(),
+		forwarder: forwarder.NewForwarder(cfg.UpstreamTLS),
 		servers:   make([]*http.Server, 0),
+		nodes:     buildNodeStates(cfg.Services, nil, provider),
+		services:  buildServiceStates(cfg.Services),
+		fair:      make(map[string]*tunnel.Fairness),
+		stickyKey: newStickyKey(cfg.StickySecret),
+		accessLog: newAccessLogSink(&cfg.AccessLog),
+		debug:     newDebugPolicy(&cfg.Debug),
+		admin:     newAdminAccess(&cfg.Admin),
+		budget:    retry.NewBudget(cfg.RetryBudget.Ratio, cfg.RetryBudget.MinPerSecond),
+		audit:     newAuditLog(&cfg.Audit),
+		flags:     provider,
+		geoWatch:  newGeoIPWatcher(&cfg.GeoIP),
+		creds:     proxyauth.Start(cfg.ProxyCredentials),
+		sessions:  newSessionRegistry(),
+		conns:     newConnTable(),
+		instance:  newInstanceName(),
+	}
+	s.forwarder.SetTransport(cfg.Transport)
+	applyDNS(cfg)
+	s.forwarder.SetExpectContinueTimeout(cfg.Server.ExpectContinueTimeout)
+	s.forwarder.SetUpstreamIdleTimeout(cfg.Server.UpstreamIdleTimeout)
+	s.forwarder.SetResponseHeaderTimeout(cfg.Server.Timeouts.ResponseHeader)
+	s.relays.setMax(cfg.Server.Tunnel.MaxRelays)
+	if cfg.Admin.Addr != "" {
+		s.samples = newSampleRing(cfg.Admin.ShadowSamples)
 	}
+	s.proxies = newProxyPool(&cfg.Server.Tunnel.ProxyPool, s.forwarder.TLSClientConfig())
+	if s.dialers, err = s.buildDialers(cfg.Dialers, nil); err != nil {
+		return nil, err
+	}
+	s.forwarder.SetDialers(forwarderDialers(s.dialers))
+
+	s.handler = s.middleware(http.HandlerFunc(s.route))
 
 	// Initialize routes
 	if err := s.router.UpdateRoutes(cfg.Services); err != nil {
 		return nil, fmt.Errorf("failed to initialize routes: %w", err)
 	}
+	if err := s.sniRouter.UpdateRoutes(cfg.Services); err != nil {
+		return nil, fmt.Errorf("failed to initialize sni routes: %w", err)
+	}
 
 	return s, nil
 }
@@ -45,8 +124,20 @@ func (s *Server) Start() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	// Share what this instance learns about backends with its peers
+	if err := s.startCluster(); err != nil {
+		return err
+	}
+
+	// Sockets systemd passed by socket activation stand in for binding
+	// their addresses
+	s.inherited = systemdSockets()
+	defer s.closeUnusedSockets()
+	abort := s.config.Server.Listen.OnFailure == config.ListenAbort
+
 	// Create HTTP servers for each unique address
 	addrs := s.getUniqueAddresses()
+	bound := 0
 
 	for _, addr := range addrs {
 		srv := &http.Server{
@@ -55,13 +146,21 @@ func (s *Server) Start() error {
 			ReadTimeout:  s.config.Server.ReadTimeout,
 			WriteTimeout: s.config.Server.WriteTimeout,
 			IdleTimeout:  s.config.Server.IdleTimeout,
+			ConnState:    clientConnState(addr),
+			BaseContext:  listenContext(addr),
+			ConnContext:  connContext,
 		}
 
-		listener, err := net.Listen("tcp", addr)
+		listener, systemd, err := s.listen(addr)
+		s.recordBind(addr, false, systemd, err)
 		if err != nil {
-			return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			if abort {
+				return fmt.Errorf("failed to listen on %s: %w", addr, err)
+			}
+			continue
 		}
 
+		bound++
 		s.servers = append(s.servers, srv)
 
 		go func(srv *http.Server, addr string) {
@@ -72,20 +171,40 @@ func (s *Server) Start() error {
 		}(srv, addr)
 	}
 
+	if bound == 0 {
+		return fmt.Errorf("failed to listen on any of %s", strings.Join(addrs, ", "))
+	}
+
+	if err := s.startAdmin(); err != nil && abort {
+		return fmt.Errorf("failed to start admin server: %w", err)
+	}
+
+	// Everything privileged is done once the addresses are bound
+	if err := dropPrivileges(&s.config.Server.Listen); err != nil {
+		return err
+	}
+
 	return nil
 }
 
 // Stop gracefully stops all servers
 func (s *Server) Stop(ctx context.Context) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+	// Copy the server list so in-flight requests, which read server state
+	// under the lock, can finish while we wait for them
+	s.mu.RLock()
+	servers := append([]*http.Server(nil), s.servers...)
+	period := s.config.Server.ShutdownDrain
+	s.mu.RUnlock()
 
 	log.Info().Msg("stopping servers")
 
+	// Move clients to other instances before the listeners close
+	s.drain(ctx, servers, period)
+
 	var wg sync.WaitGroup
-	errCh := make(chan error, len(s.servers))
+	errCh := make(chan error, len(servers))
 
-	for _, srv := range s.servers {
+	for _, srv := range servers {
 		wg.Add(1)
 		go func(srv *http.Server) {
 			defer wg.Done()
@@ -104,6 +223,32 @@ func (s *Server) Stop(ctx context.Context) error {
 		errs = append(errs, err)
 	}
 
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Stop background node components and close tunnels still open
+	releaseNodeStates(s.nodes, nil, 0)
+
+	// Close connections kept ready for upstream proxies
+	s.proxies.Close()
+	releaseDialers(s.dialers, nil)
+
+	// Stop refreshing feature flags and proxy credentials, and watching
+	// GeoIP databases
+	s.flags.Shutdown()
+	s.creds.Stop()
+	s.geoWatch.close()
+	if s.cluster != nil {
+		s.cluster.Stop()
+	}
+
+	// Flush access logs
+	if s.accessLog != nil {
+		if err := s.accessLog.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
 	// Close forwarder
 	if err := s.forwarder.Close(); err != nil {
 		errs = append(errs, err)
@@ -117,37 +262,233 @@ func (s *Server) Stop(ctx context.Context) error {
 	return nil
 }
 
-// ServeHTTP handles incoming HTTP requests
+// ServeHTTP handles incoming HTTP requests through the middleware chain
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.markDraining(w, r)
+	s.handler.ServeHTTP(w, r)
+}
+
+// middleware wraps h in the middleware chain every request passes through
+func (s *Server) middleware(h http.Handler) http.Handler {
+	return chain(h,
+		s.accessLogMiddleware,
+		s.traceMiddleware,
+		s.recoverMiddleware,
+		s.loopMiddleware,
+		s.clientConnMiddleware,
+		s.normalizeMiddleware,
+		s.debugMiddleware,
+	)
+}
+
+// route dispatches a request to the CONNECT, WebSocket or HTTP handler
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	// Redirect services answer everything on their listener themselves
+	if s.handleRedirect(w, r) {
+		return
+	}
+
 	// Handle CONNECT method for HTTPS proxying
 	if r.Method == http.MethodConnect {
 		s.handleConnect(w, r)
 		return
 	}
 
+	// Answer the service's synthetic routes without forwarding
+	if s.handleSynthetic(w, r) {
+		return
+	}
+
 	// Check for WebSocket upgrade
 	if isWebSocketUpgrade(r) {
 		s.handleWebSocket(w, r)
 		return
 	}
 
+	// Pass other protocol upgrades through as raw tunnels
+	if isUpgrade(r) {
+		s.handleUpgrade(w, r)
+		return
+	}
+
 	// Handle regular HTTP request
 	s.handleHTTP(w, r)
 }
 
+// Config returns the configuration in effect, which rollbacks and route
+// imports change as well as Reload
+func (s *Server) Config() *config.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config
+}
+
+// OnReload sets a function called with the configuration in effect and
+// the one replacing it before every reload, rollbacks and route imports
+// included. An error refuses the new configuration.
+func (s *Server) OnReload(fn func(current, next *config.Config) error) {
+	s.reloads.Lock()
+	defer s.reloads.Unlock()
+	s.onReload = fn
+}
+
 // Reload reloads the configuration
 func (s *Server) Reload(cfg *config.Config) error {
+	s.reloads.Lock()
+	defer s.reloads.Unlock()
+
+	if s.imported {
+		log.Warn().Msg("config reloaded, routes imported through the admin API are dropped")
+		s.imported = false
+	}
+	return s.reload(cfg)
+}
+
+// reload reloads the configuration, with s.reloads held by the caller
+func (s *Server) reload(cfg *config.Config) error {
+	if s.onReload != nil {
+		if err := s.onReload(s.Config(), cfg); err != nil {
+			return err
+		}
+	}
+
+	geoDBs, err := loadGeoIP(&cfg.GeoIP)
+	if err != nil {
+		return fmt.Errorf("failed to load GeoIP databases: %w", err)
+	}
+
+	// Start a changed flag provider before taking the lock, its first
+	// fetch may take a while
+	s.mu.RLock()
+	provider := s.flags
+	flagsChanged := !reflect.DeepEqual(cfg.FeatureFlags, s.config.FeatureFlags)
+	s.mu.RUnlock()
+	if flagsChanged {
+		provider = newFlagProvider(cfg.FeatureFlags)
+	}
+
+	// Likewise fetch changed proxy credentials up front
+	s.mu.RLock()
+	creds := s.creds
+	credsChanged := !reflect.DeepEqual(cfg.ProxyCredentials, s.config.ProxyCredentials)
+	s.mu.RUnlock()
+	if credsChanged {
+		creds = proxyauth.Start(cfg.ProxyCredentials)
+	}
+
+	// Changed dialers connect lazily, creating them only reads their files
+	s.mu.RLock()
+	dialers, err := s.buildDialers(cfg.Dialers, s.dialers)
+	s.mu.RUnlock()
+	if err != nil {
+		if flagsChanged {
+			provider.Shutdown()
+		}
+		if credsChanged {
+			creds.Forget(s.config.ProxyCredentials)
+		}
+		return err
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Update router with new configuration
-	if err := s.router.UpdateRoutes(cfg.Services); err != nil {
-		return fmt.Errorf("failed to update routes: %w", err)
+	// Build both routing tables before using either, so a config whose sni
+	// routes fail doesn't leave the new HTTP routes in place
+	applyRoutes, err := s.router.PrepareRoutes(cfg.Services)
+	if err != nil {
+		err = fmt.Errorf("failed to update routes: %w", err)
+	}
+	var applySNIRoutes func()
+	if err == nil {
+		if applySNIRoutes, err = s.sniRouter.PrepareRoutes(cfg.Services); err != nil {
+			err = fmt.Errorf("failed to update sni routes: %w", err)
+		}
+	}
+	if err != nil {
+		if flagsChanged {
+			provider.Shutdown()
+		}
+		if credsChanged {
+			creds.Forget(s.config.ProxyCredentials)
+		}
+		releaseDialers(dialers, s.dialers)
+		return err
 	}
+	applyRoutes()
+	applySNIRoutes()
 
+	if flagsChanged {
+		s.flags.Shutdown()
+		s.flags = provider
+	}
+	if credsChanged {
+		// Tunnels already open keep the login they were opened with
+		s.creds.Forget(cfg.ProxyCredentials)
+		s.creds = creds
+	}
+	useGeoIP(geoDBs)
+	if cfg.GeoIP != s.config.GeoIP {
+		s.geoWatch.close()
+		s.geoWatch = newGeoIPWatcher(&cfg.GeoIP)
+	}
+	nodes := buildNodeStates(cfg.Services, s.nodes, provider)
+	releaseNodeStates(s.nodes, nodes, cfg.Server.DrainTimeout)
+	s.nodes = nodes
+	s.services = buildServiceStates(cfg.Services)
+	s.debug = newDebugPolicy(&cfg.Debug)
+	s.admin = newAdminAccess(&cfg.Admin)
+	if cfg.RetryBudget != s.config.RetryBudget {
+		s.budget = retry.NewBudget(cfg.RetryBudget.Ratio, cfg.RetryBudget.MinPerSecond)
+	}
+	s.audit.configure(&cfg.Audit)
+	if s.samples != nil {
+		s.samples = s.samples.resize(cfg.Admin.ShadowSamples)
+	}
+	s.forwarder.SetUpstreamTLS(cfg.UpstreamTLS)
+	s.forwarder.SetTransport(cfg.Transport)
+	applyDNS(cfg)
+	s.forwarder.SetExpectContinueTimeout(cfg.Server.ExpectContinueTimeout)
+	s.forwarder.SetUpstreamIdleTimeout(cfg.Server.UpstreamIdleTimeout)
+	s.forwarder.SetResponseHeaderTimeout(cfg.Server.Timeouts.ResponseHeader)
+	s.forwarder.SetDialers(forwarderDialers(dialers))
+	releaseDialers(s.dialers, dialers)
+	s.dialers = dialers
+	if cfg.Server.Tunnel.ProxyPool != s.config.Server.Tunnel.ProxyPool || !reflect.DeepEqual(cfg.UpstreamTLS, s.config.UpstreamTLS) {
+		s.proxies.Close()
+		s.proxies = newProxyPool(&cfg.Server.Tunnel.ProxyPool, s.forwarder.TLSClientConfig())
+	}
+	s.relays.setMax(cfg.Server.Tunnel.MaxRelays)
+	if !reflect.DeepEqual(cfg.Server.Tunnel.Fairness, s.config.Server.Tunnel.Fairness) {
+		// Open tunnels keep the schedulers they started with
+		s.fair = make(map[string]*tunnel.Fairness)
+	}
+	if !reflect.DeepEqual(cfg.AccessLog, s.config.AccessLog) {
+		if s.accessLog != nil {
+			go s.accessLog.Close()
+		}
+		s.accessLog = newAccessLogSink(&cfg.AccessLog)
+	}
+	if cfg.StickySecret != s.config.StickySecret {
+		s.stickyKey = newStickyKey(cfg.StickySecret)
+	}
+	// Log what the reload changed, for auditing
+	changes := config.Diff(s.config, cfg)
+	for _, c := range changes {
+		event := log.Info().Str("kind", c.Kind).Str("name", c.Name).Str("change", c.Op)
+		if len(c.Fields) > 0 {
+			event = event.Strs("fields", c.Fields)
+		}
+		event.Msg("config " + c.Kind + " " + c.Op)
+	}
+	// Keep the replaced config to roll back to, unless nothing changed
+	if len(changes) > 0 {
+		s.previous = s.config
+		s.watch.reset(&cfg.Rollback)
+	}
 	s.config = cfg
 
-	log.Info().Msg("configuration reloaded")
+	log.Info().Int("changes", len(changes)).Msg("configuration reloaded")
 	return nil
 }
 
@@ -172,9 +513,3 @@ func (s *Server) getUniqueAddresses() []string {
 
 	return result
 }
-
-// isWebSocketUpgrade checks if the request is a WebSocket upgrade
-func isWebSocketUpgrade(r *http.Request) bool {
-	return r.Header.Get("Upgrade") == "websocket" &&
-		r.Header.Get("Connection") == "Upgrade"
-}
@@ -0,0 +1,113 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// serviceState holds runtime state shared by all nodes of a service
+type serviceState struct {
+	connect *connectPolicy
+}
+
+// connectPolicy decides who may open CONNECT tunnels through a service
+type connectPolicy struct {
+	disabled bool
+	users    map[string]string
+	allowIPs *acl.ACL
+}
+
+// buildServiceStates creates runtime state for every service in the config
+func buildServiceStates(services []config.Service) map[string]*serviceState {
+	states := make(map[string]*serviceState)
+	for i := range services {
+		svc := &services[i]
+		states[svc.Name] = &serviceState{connect: newConnectPolicy(svc)}
+	}
+	return states
+}
+
+// newConnectPolicy compiles a service's CONNECT settings. Services without
+// a connect block accept tunnels from anyone, as before.
+func newConnectPolicy(svc *config.Service) *connectPolicy {
+	p := &connectPolicy{}
+	if svc.Connect == nil {
+		return p
+	}
+
+	p.disabled = svc.Connect.Enabled != nil && !*svc.Connect.Enabled
+	p.users = svc.Connect.Users
+
+	if len(svc.Connect.AllowIPs) > 0 {
+		allow, err := acl.New(svc.Connect.AllowIPs)
+		if err != nil {
+			log.Error().Err(err).Str("service", svc.Name).Msg("invalid connect allow_ips")
+		}
+		p.allowIPs = allow
+	}
+
+	return p
+}
+
+// authorize checks the request against the policy and returns the HTTP
+// status to reject it with, or 0 if the tunnel may proceed
+func (p *connectPolicy) authorize(r *http.Request) int {
+	if p.disabled {
+		return http.StatusMethodNotAllowed
+	}
+	if p.allowIPs != nil && !p.allowIPs.Contains(acl.ClientIP(r)) {
+		return http.StatusForbidden
+	}
+	if len(p.users) > 0 && !p.authenticated(r) {
+		return http.StatusProxyAuthRequired
+	}
+	return 0
+}
+
+// authenticated verifies Basic credentials in the Proxy-Authorization header
+func (p *connectPolicy) authenticated(r *http.Request) bool {
+	encoded, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return false
+	}
+
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+
+	expected, ok := p.users[user]
+	if !ok {
+		return false
+	}
+
+	if hash, ok := strings.CutPrefix(expected, "sha256:"); ok {
+		sum := sha256.Sum256([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(hash))) == 1
+	}
+	return subtle.ConstantTimeCompare([]byte(password), []byte(expected)) == 1
+}
+
+// serviceState returns the runtime state for the named service
+func (s *Server) serviceState(name string) *serviceState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if st, ok := s.services[name]; ok {
+		return st
+	}
+	return &serviceState{connect: &connectPolicy{}}
+}
@@ -0,0 +1,225 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	wsSessions = metrics.NewGaugeVec(
+		"forwarder_websocket_sessions",
+		"Open WebSocket connections",
+		"node",
+	)
+	wsPinnedReconnects = metrics.NewCounterVec(
+		"forwarder_websocket_pinned_reconnects_total",
+		"WebSocket connections sent to the backend their session was on",
+		"node",
+	)
+)
+
+// wsSession is an open WebSocket connection
+type wsSession struct {
+	ID      string    `json:"id"`
+	Key     string    `json:"key,omitempty"` // identity from the node's session_key
+	Client  string    `json:"client"`
+	Node    string    `json:"node"`
+	Backend string    `json:"backend"`
+	Host    string    `json:"host"`
+	Path    string    `json:"path"`
+	Started time.Time `json:"started"`
+}
+
+// sessionPin is the backend a session identity is sent to
+type sessionPin struct {
+	addr    string
+	proxy   string
+	open    int       // connections of the session still open
+	expires time.Time // when the pin lapses once none are open
+}
+
+type pinKey struct {
+	node, key string
+}
+
+// sessionRegistry tracks open WebSocket connections and, for nodes with
+// sticky reconnection, the backend each session identity was last on
+type sessionRegistry struct {
+	mu        sync.Mutex
+	active    map[string]*wsSession
+	pins      map[pinKey]*sessionPin
+	lastPrune time.Time
+}
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		active: make(map[string]*wsSession),
+		pins:   make(map[pinKey]*sessionPin),
+	}
+}
+
+// sessionKey returns the session identity of r under the node's policy,
+// or "" when it has none
+func sessionKey(r *http.Request, ws *config.WebSocket) string {
+	if ws == nil || ws.SessionKey == "" {
+		return ""
+	}
+	source, name, _ := strings.Cut(ws.SessionKey, ":")
+	switch source {
+	case "header":
+		return r.Header.Get(name)
+	case "query":
+		return r.URL.Query().Get(name)
+	case "cookie":
+		if c, err := r.Cookie(name); err == nil {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// pinned returns the backend and proxy the session key of node is pinned
+// to, if the pin is still in force
+func (sr *sessionRegistry) pinned(node, key string) (string, string, bool) {
+	if key == "" {
+		return "", "", false
+	}
+
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	pin, ok := sr.pins[pinKey{node, key}]
+	if !ok || pin.open == 0 && time.Now().After(pin.expires) {
+		return "", "", false
+	}
+	return pin.addr, pin.proxy, true
+}
+
+// start registers an open connection and pins its session to the backend
+// when sticky is set. The returned func ends the session; the pin then
+// lasts for sticky.
+func (sr *sessionRegistry) start(s *wsSession, proxy string, sticky time.Duration) func() {
+	var id [8]byte
+	rand.Read(id[:])
+	s.ID = hex.EncodeToString(id[:])
+
+	pk := pinKey{s.Node, s.Key}
+	pin := sticky > 0 && s.Key != ""
+
+	sr.mu.Lock()
+	sr.active[s.ID] = s
+	if pin {
+		p, ok := sr.pins[pk]
+		if !ok || p.addr != s.Backend {
+			p = &sessionPin{addr: s.Backend, proxy: proxy, open: p.openCount()}
+			sr.pins[pk] = p
+		}
+		p.open++
+	}
+	sr.pruneLocked()
+	sr.mu.Unlock()
+
+	gauge := wsSessions.With(s.Node)
+	gauge.Inc()
+
+	return func() {
+		gauge.Dec()
+
+		sr.mu.Lock()
+		defer sr.mu.Unlock()
+
+		delete(sr.active, s.ID)
+		if p, ok := sr.pins[pk]; ok && pin && p.open > 0 {
+			p.open--
+			if p.open == 0 {
+				p.expires = time.Now().Add(sticky)
+			}
+		}
+	}
+}
+
+// openCount returns the open connections of a pin, 0 for none
+func (p *sessionPin) openCount() int {
+	if p == nil {
+		return 0
+	}
+	return p.open
+}
+
+// pruneLocked drops lapsed pins, at most once a minute. sr.mu must be held.
+func (sr *sessionRegistry) pruneLocked() {
+	now := time.Now()
+	if now.Sub(sr.lastPrune) < time.Minute {
+		return
+	}
+	sr.lastPrune = now
+	for k, p := range sr.pins {
+		if p.open == 0 && now.After(p.expires) {
+			delete(sr.pins, k)
+		}
+	}
+}
+
+// find returns the open sessions of a client, given as an IP address,
+// host:port or session key, or all of them for "". node, if set, limits
+// the result to one node.
+func (sr *sessionRegistry) find(client, node string) []wsSession {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+
+	sessions := make([]wsSession, 0)
+	for _, s := range sr.active {
+		if node != "" && s.Node != node {
+			continue
+		}
+		if client != "" && !s.belongsTo(client) {
+			continue
+		}
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].Started.Before(sessions[j].Started)
+	})
+	return sessions
+}
+
+// belongsTo reports whether client names the session's client address,
+// its IP alone, or its session key
+func (s *wsSession) belongsTo(client string) bool {
+	return client == s.Key && s.Key != "" || sameClient(s.Client, client)
+}
+
+// validPin reports whether a pinned backend still serves the node, which
+// a reload may have changed
+func validPin(node *config.Node, st *nodeState, addr string) bool {
+	switch {
+	case addr == node.Addr:
+		return true
+	case st.balancer != nil && st.balancer.contains(addr):
+		return true
+	case st.standby != nil && st.standby.contains(addr):
+		return true
+	case st.canary != nil && st.canary.cfg.Addr == addr:
+		return true
+	}
+	return false
+}
+
+// handleAdminSessions lists open WebSocket connections, filtered by
+// ?client= (IP, address or session key) and ?node=
+func (s *Server) handleAdminSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	writeAdminJSON(w, http.StatusOK, s.sessions.find(q.Get("client"), q.Get("node")))
+}
@@ -0,0 +1,266 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/router"
+)
+
+const (
+	// maxShadowConfig caps the size of a candidate config
+	maxShadowConfig = 4 << 20
+
+	// shadowExamples is how many requests are listed per routing change
+	shadowExamples = 3
+)
+
+// requestSample keeps what the router looks at in a request
+type requestSample struct {
+	method     string
+	host       string
+	uri        string
+	proto      string
+	protoMajor int
+	protoMinor int
+	header     http.Header
+	remoteAddr string
+	localAddr  net.Addr
+	tls        bool
+}
+
+// request rebuilds a request the router can match
+func (rs *requestSample) request() *http.Request {
+	u, err := url.ParseRequestURI(rs.uri)
+	if err != nil {
+		u = &url.URL{Path: "/"}
+	}
+	r := &http.Request{
+		Method:     rs.method,
+		Host:       rs.host,
+		URL:        u,
+		RequestURI: rs.uri,
+		Proto:      rs.proto,
+		ProtoMajor: rs.protoMajor,
+		ProtoMinor: rs.protoMinor,
+		Header:     rs.header,
+		RemoteAddr: rs.remoteAddr,
+	}
+	if rs.tls {
+		r.TLS = &tls.ConnectionState{}
+	}
+	ctx := context.Background()
+	if rs.localAddr != nil {
+		ctx = context.WithValue(ctx, http.LocalAddrContextKey, rs.localAddr)
+	}
+	return r.WithContext(ctx)
+}
+
+// sampleRing keeps the most recent requests
+type sampleRing struct {
+	mu      sync.Mutex
+	samples []requestSample
+	next    int
+	full    bool
+}
+
+func newSampleRing(size int) *sampleRing {
+	return &sampleRing{samples: make([]requestSample, size)}
+}
+
+// add records r, replacing the oldest sample once the ring is full
+func (s *sampleRing) add(r *http.Request) {
+	sample := requestSample{
+		method:     r.Method,
+		host:       r.Host,
+		uri:        r.URL.RequestURI(),
+		proto:      r.Proto,
+		protoMajor: r.ProtoMajor,
+		protoMinor: r.ProtoMinor,
+		header:     r.Header.Clone(),
+		remoteAddr: r.RemoteAddr,
+		tls:        r.TLS != nil,
+	}
+	sample.localAddr, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples[s.next] = sample
+	s.next++
+	if s.next == len(s.samples) {
+		s.next = 0
+		s.full = true
+	}
+}
+
+// snapshot returns the samples, oldest first
+func (s *sampleRing) snapshot() []requestSample {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.full {
+		return append([]requestSample(nil), s.samples[:s.next]...)
+	}
+	return append(append([]requestSample(nil), s.samples[s.next:]...), s.samples[:s.next]...)
+}
+
+// resize returns a ring of size holding the most recent samples of s
+func (s *sampleRing) resize(size int) *sampleRing {
+	if size == len(s.samples) {
+		return s
+	}
+	ring := newSampleRing(size)
+	samples := s.snapshot()
+	if len(samples) > size {
+		samples = samples[len(samples)-size:]
+	}
+	for _, sample := range samples {
+		ring.samples[ring.next] = sample
+		ring.next = (ring.next + 1) % size
+		ring.full = ring.full || ring.next == 0
+	}
+	return ring
+}
+
+// recordSample keeps r for what-if checks of candidate configs
+func (s *Server) recordSample(r *http.Request) {
+	s.mu.RLock()
+	samples := s.samples
+	s.mu.RUnlock()
+
+	if samples != nil {
+		samples.add(r)
+	}
+}
+
+// shadowChange is a routing decision that differs under the candidate
+type shadowChange struct {
+	From     string          `json:"from"` // node, empty when unmatched
+	To       string          `json:"to"`
+	Count    int             `json:"count"`
+	Examples []shadowExample `json:"examples"`
+}
+
+type shadowExample struct {
+	Method string `json:"method"`
+	Host   string `json:"host"`
+	URI    string `json:"uri"`
+}
+
+// shadowReport compares routing under the running and a candidate config
+type shadowReport struct {
+	Samples         int            `json:"samples"`
+	Changed         int            `json:"changed"`
+	UnmatchedBefore int            `json:"unmatched_before"`
+	UnmatchedAfter  int            `json:"unmatched_after"`
+	Changes         []shadowChange `json:"changes"`
+}
+
+// handleAdminShadow matches the recent requests against a candidate
+// config posted as YAML and reports which would be routed differently.
+// Nothing is forwarded and the running config is left alone.
+func (s *Server) handleAdminShadow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxShadowConfig+1))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, "failed to read config")
+		return
+	}
+	if len(data) > maxShadowConfig {
+		writeAdminError(w, http.StatusRequestEntityTooLarge, "config too large")
+		return
+	}
+
+	candidate, err := config.Parse(data)
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+	shadow, err := router.Build(candidate.Services)
+	if err != nil {
+		writeAdminError(w, http.StatusUnprocessableEntity, err.Error())
+		return
+	}
+
+	s.mu.RLock()
+	current := s.config.Unmatched
+	samples := s.samples
+	s.mu.RUnlock()
+	if samples == nil {
+		writeAdminError(w, http.StatusNotFound, "request sampling is disabled")
+		return
+	}
+
+	report := shadowReport{Changes: make([]shadowChange, 0)}
+	changes := make(map[[2]string]*shadowChange)
+	for _, sample := range samples.snapshot() {
+		req := sample.request()
+		before := routedNode(s.router, current, req)
+		after := routedNode(shadow, candidate.Unmatched, req)
+
+		report.Samples++
+		if before == "" {
+			report.UnmatchedBefore++
+		}
+		if after == "" {
+			report.UnmatchedAfter++
+		}
+		if before == after {
+			continue
+		}
+
+		report.Changed++
+		key := [2]string{before, after}
+		c, ok := changes[key]
+		if !ok {
+			c = &shadowChange{From: before, To: after}
+			changes[key] = c
+		}
+		c.Count++
+		if len(c.Examples) < shadowExamples {
+			c.Examples = append(c.Examples, shadowExample{Method: sample.method, Host: sample.host, URI: sample.uri})
+		}
+	}
+
+	for _, c := range changes {
+		report.Changes = append(report.Changes, *c)
+	}
+	sort.Slice(report.Changes, func(i, j int) bool {
+		a, b := report.Changes[i], report.Changes[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.From+"\x00"+a.To < b.From+"\x00"+b.To
+	})
+
+	log.Info().
+		Int("samples", report.Samples).
+		Int("changed", report.Changed).
+		Msg("candidate config checked against recent requests")
+	writeAdminJSON(w, http.StatusOK, report)
+}
+
+// routedNode returns the node rt sends req to, taking the unmatched policy
+// into account, or "" when the request would not be forwarded
+func routedNode(rt *router.Router, unmatched config.Unmatched, req *http.Request) string {
+	if route, ok := rt.MatchRoute(req); ok {
+		return route.Node.Name
+	}
+	if unmatched.Action == "forward" {
+		return unmatched.Node
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	requestsInFlight = metrics.NewGaugeVec(
+		"forwarder_requests_in_flight",
+		"HTTP requests currently being handled",
+	)
+	routeRequestsInFlight = metrics.NewGaugeVec(
+		"forwarder_route_requests_in_flight",
+		"HTTP requests currently being handled by route",
+		"route",
+	)
+	requestsShed = metrics.NewCounterVec(
+		"forwarder_requests_shed_total",
+		"Requests refused by load shedding",
+		"route",
+	)
+	classInFlight = metrics.NewGaugeVec(
+		"forwarder_priority_in_flight",
+		"HTTP requests currently being handled by priority class",
+		"class",
+	)
+	classQueued = metrics.NewGaugeVec(
+		"forwarder_priority_queued",
+		"Requests waiting for an in-flight slot by priority class",
+		"class",
+	)
+	classShed = metrics.NewCounterVec(
+		"forwarder_priority_shed_total",
+		"Requests refused by load shedding by priority class",
+		"class",
+	)
+)
+
+// Priority classes, lowest first. Lower classes are shed first and wait
+// behind higher ones.
+const (
+	classLow = iota
+	classNormal
+	classHigh
+	classCritical
+	numClasses
+)
+
+var classNames = [numClasses]string{"low", "normal", "high", "critical"}
+
+// priorityClass returns the class of a node priority
+func priorityClass(priority string) int {
+	switch priority {
+	case "low":
+		return classLow
+	case "high":
+		return classHigh
+	case "critical":
+		return classCritical
+	default:
+		return classNormal
+	}
+}
+
+// shedLimit returns the in-flight count at which requests of class are
+// shed, or 0 when they never are
+func shedLimit(cfg *config.LoadShedding, class int) int64 {
+	if cfg.Threshold <= 0 {
+		return 0
+	}
+	switch class {
+	case classLow:
+		return int64(cfg.LowThreshold)
+	case classNormal:
+		return int64(cfg.Threshold)
+	case classHigh:
+		return int64(cfg.HighThreshold)
+	default:
+		return 0
+	}
+}
+
+// admission counts HTTP requests being handled across all routes and
+// hands out slots to waiting requests, highest class first
+type admission struct {
+	mu       sync.Mutex
+	inFlight int64
+	waiting  [numClasses][]*waiter
+}
+
+// waiter is a request queued for a slot
+type waiter struct {
+	ready    chan struct{}
+	admitted bool
+}
+
+var admitted admission
+
+// acquire takes an in-flight slot for a request of class. Over its limit
+// the request waits up to the queue timeout for one, unless the timeout
+// is zero. It reports false when the request is to be shed.
+func (a *admission) acquire(r *http.Request, cfg *config.LoadShedding, class int) bool {
+	a.mu.Lock()
+	if a.fits(cfg, class) && !a.queuedFrom(class) {
+		a.inFlight++
+		a.mu.Unlock()
+		return true
+	}
+	if cfg.QueueTimeout <= 0 {
+		a.mu.Unlock()
+		return false
+	}
+	w := &waiter{ready: make(chan struct{})}
+	a.waiting[class] = append(a.waiting[class], w)
+	a.mu.Unlock()
+
+	queued := classQueued.With(classNames[class])
+	queued.Inc()
+	defer queued.Dec()
+
+	timer := time.NewTimer(cfg.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if w.admitted {
+		return true
+	}
+	queue := a.waiting[class]
+	for i := range queue {
+		if queue[i] == w {
+			a.waiting[class] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// release frees a slot and hands it to the longest waiting request of the
+// highest class that fits
+func (a *admission) release(cfg *config.LoadShedding) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.inFlight--
+	for class := numClasses - 1; class >= 0; class-- {
+		for len(a.waiting[class]) > 0 {
+			if !a.fits(cfg, class) {
+				// Lower classes have lower limits and don't fit either
+				return
+			}
+			w := a.waiting[class][0]
+			a.waiting[class] = a.waiting[class][1:]
+			w.admitted = true
+			a.inFlight++
+			close(w.ready)
+		}
+	}
+}
+
+// fits reports whether a request of class may start now. a.mu must be held.
+func (a *admission) fits(cfg *config.LoadShedding, class int) bool {
+	limit := shedLimit(cfg, class)
+	return limit == 0 || a.inFlight < limit
+}
+
+// queuedFrom reports whether requests of class or higher are waiting, which
+// a new request must not overtake. a.mu must be held.
+func (a *admission) queuedFrom(class int) bool {
+	for c := class; c < numClasses; c++ {
+		if len(a.waiting[c]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// admit counts the request as in flight, unless load shedding refuses it.
+// Once the in-flight count reaches the limit of the node's priority class,
+// requests wait for a slot if a queue timeout is set and are otherwise
+// answered with 503, in which case admit reports false.
+func (s *Server) admit(w http.ResponseWriter, r *http.Request, node *config.Node) (func(), bool) {
+	s.mu.RLock()
+	cfg := s.config.LoadShedding
+	s.mu.RUnlock()
+
+	class := priorityClass(node.Priority)
+	if !admitted.acquire(r, &cfg, class) {
+		requestsShed.With(node.Name).Inc()
+		classShed.With(classNames[class]).Inc()
+		log.Warn().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("node", node.Name).
+			Str("priority", classNames[class]).
+			Msg("request shed under load")
+		s.handleError(w, r, http.StatusServiceUnavailable, "server overloaded")
+		return nil, false
+	}
+
+	total := requestsInFlight.With()
+	route := routeRequestsInFlight.With(node.Name)
+	perClass := classInFlight.With(classNames[class])
+	total.Inc()
+	route.Inc()
+	perClass.Inc()
+	return func() {
+		s.mu.RLock()
+		cfg := s.config.LoadShedding
+		s.mu.RUnlock()
+
+		admitted.release(&cfg)
+		total.Dec()
+		route.Dec()
+		perClass.Dec()
+	}, true
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var drainingGauge = metrics.NewGaugeVec(
+	"forwarder_draining",
+	"1 while the forwarder is shutting down and asking clients to reconnect elsewhere",
+)
+
+// drain asks clients to move to other instances. From now on every
+// HTTP/1 connection is closed after its current response and HTTP/2
+// connections are sent a GOAWAY. Listeners stay open for period, so a load
+// balancer that still sends traffic here has time to notice, unless ctx
+// ends first.
+func (s *Server) drain(ctx context.Context, servers []*http.Server, period time.Duration) {
+	s.draining.Store(true)
+	drainingGauge.With().Set(1)
+
+	for _, srv := range servers {
+		// Also closes idle HTTP/1 connections
+		srv.SetKeepAlivesEnabled(false)
+	}
+
+	if period <= 0 {
+		return
+	}
+	log.Info().Dur("period", period).Msg("draining client connections")
+
+	timer := time.NewTimer(period)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// markDraining asks the client to close the connection after this
+// response while the forwarder drains. The HTTP/2 server turns the header
+// into a GOAWAY. Tunnels and upgrades are left alone, their handshake
+// responses must not carry it.
+func (s *Server) markDraining(w http.ResponseWriter, r *http.Request) {
+	if !s.draining.Load() || r.Method == http.MethodConnect || isUpgrade(r) {
+		return
+	}
+	w.Header().Set("Connection", "close")
+}
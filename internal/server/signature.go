@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/signature"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+var signatureChecks = metrics.NewCounterVec(
+	"forwarder_signature_checks_total",
+	"Request signature verifications by node and result",
+	"node", "result",
+)
+
+// verifySignature checks the request signature when the node requires
+// one, answering 401 and reporting false when it doesn't verify
+func (s *Server) verifySignature(w http.ResponseWriter, r *http.Request, node *config.Node) bool {
+	v := s.nodeState(node.Name).signature
+	if v == nil {
+		return true
+	}
+
+	keyID, err := v.Verify(r)
+	if err == nil {
+		signatureChecks.With(node.Name, "ok").Inc()
+		trace.Add(r.Context(), "signature", "verified with key %q", keyID)
+		return true
+	}
+
+	result := "invalid"
+	status := http.StatusUnauthorized
+	switch {
+	case errors.Is(err, signature.ErrMissing):
+		result = "missing"
+	case errors.Is(err, signature.ErrExpired):
+		result = "expired"
+	case errors.Is(err, signature.ErrUnknownKey):
+		result = "unknown_key"
+	case errors.Is(err, signature.ErrBodyTooLarge):
+		result = "too_large"
+		status = http.StatusRequestEntityTooLarge
+	case !errors.Is(err, signature.ErrInvalid):
+		// The body couldn't be read
+		result = "error"
+		status = http.StatusBadRequest
+	}
+	signatureChecks.With(node.Name, result).Inc()
+	trace.Add(r.Context(), "signature", "rejected: %v", err)
+
+	log.Warn().
+		Err(err).
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Msg("request signature rejected")
+	s.handleError(w, r, status, err.Error())
+	return false
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+	"github.com/simman/go-forwarder/internal/slo"
+)
+
+// newSLOTracker creates the objective tracker of a node, carrying over the
+// counts of old when the objectives are unchanged
+func newSLOTracker(node *config.Node, old *slo.Tracker) *slo.Tracker {
+	if node.SLO == nil {
+		return nil
+	}
+	obj := slo.Objectives{
+		Availability:  node.SLO.Availability,
+		Latency:       node.SLO.Latency,
+		LatencyTarget: node.SLO.LatencyTarget,
+		Window:        node.SLO.Window,
+	}
+	if old != nil && old.Objectives() == obj {
+		return old
+	}
+	t := slo.NewTracker(node.Name, obj)
+	t.Start()
+	return t
+}
+
+// observeSLO counts the request against the node's objectives once it has
+// been answered. Latency is taken when the response header is sent;
+// requests the client abandoned are left out.
+func (s *Server) observeSLO(w http.ResponseWriter, r *http.Request, node *config.Node) func() {
+	tracker := s.nodeState(node.Name).slo
+	if tracker == nil {
+		return func() {}
+	}
+
+	start := time.Now()
+	if info := getRequestInfo(r); info != nil {
+		start = info.start
+	}
+	rw := rwwrap.Wrap(w)
+	latency := time.Duration(-1)
+	rw.OnWriteHeader(func(int) {
+		latency = time.Since(start)
+	})
+
+	return func() {
+		if info := getRequestInfo(r); info != nil && info.canceled {
+			return
+		}
+		if !rw.WroteHeader() {
+			return
+		}
+		tracker.Record(rw.Status() >= 500, latency)
+	}
+}
+
+// handleAdminSLO reports the objectives of every node that has some, or
+// of the node named in the path
+func (s *Server) handleAdminSLO(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/api/slo"), "/")
+
+	s.mu.RLock()
+	trackers := make(map[string]*slo.Tracker)
+	for node, st := range s.nodes {
+		if st.slo != nil && (name == "" || node == name) {
+			trackers[node] = st.slo
+		}
+	}
+	s.mu.RUnlock()
+
+	if name != "" {
+		t, ok := trackers[name]
+		if !ok {
+			writeAdminError(w, http.StatusNotFound, "node not found or has no slo")
+			return
+		}
+		writeAdminJSON(w, http.StatusOK, t.Report())
+		return
+	}
+
+	reports := make([]slo.Report, 0, len(trackers))
+	for _, t := range trackers {
+		reports = append(reports, t.Report())
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Node < reports[j].Node })
+	writeAdminJSON(w, http.StatusOK, reports)
+}
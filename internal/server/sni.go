@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/mux"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+	"github.com/simman/go-forwarder/internal/tunnel"
+)
+
+var sniConnections = metrics.NewCounterVec(
+	"forwarder_sni_connections_total",
+	"TLS connections relayed by server name without terminating them",
+	"node", "result",
+)
+
+// sniPassthrough is the Passthrough hook of mux listeners. It matches the
+// nodes of sni services against the ClientHello of conn and returns the
+// relay to the matching node, or nil to leave the connection to the
+// listener's own TLS or passthrough target.
+func (s *Server) sniPassthrough(addr string) func(net.Conn, string) func() {
+	return func(conn net.Conn, serverName string) func() {
+		if serverName == "" {
+			return nil
+		}
+
+		req := sniRequest(addr, conn, serverName)
+		route, ok := s.sniRouter.MatchEnabled(req, s.nodeEnabled(req))
+		if !ok {
+			return nil
+		}
+		return func() {
+			s.relaySNI(conn, req, route.Node)
+		}
+	}
+}
+
+// sniRequest describes a TLS connection as the request node rules are
+// matched against: a CONNECT to the server name, so Host, Listener,
+// Proto{tls}, Proto{tunnel}, client address and fingerprint matchers apply
+func sniRequest(addr string, conn net.Conn, serverName string) *http.Request {
+	ctx := context.WithValue(context.Background(), listenAddrKey, addr)
+	ctx = context.WithValue(ctx, http.LocalAddrContextKey, conn.LocalAddr())
+	if fp := mux.Fingerprint(conn); fp != nil {
+		ctx = tlsfp.With(ctx, fp)
+	}
+
+	req := &http.Request{
+		Method:     http.MethodConnect,
+		URL:        &url.URL{Host: serverName},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       serverName,
+		RemoteAddr: conn.RemoteAddr().String(),
+		TLS:        &tls.ConnectionState{ServerName: serverName},
+	}
+	return req.WithContext(ctx)
+}
+
+// sniTarget picks the backend of node for the server name: the one its
+// host map lists, or the next of its backends. Without cookies there is no
+// affinity.
+func (s *Server) sniTarget(node *config.Node, serverName string) *config.Node {
+	st := s.nodeState(node.Name)
+
+	target := node
+	switch b := st.backends(); {
+	case st.hostMap != nil:
+		if backend, ok := st.hostMap.Lookup(serverName); ok {
+			target = withAddr(node, backend)
+		}
+	case b != nil:
+		target = withAddr(node, b.pick())
+	}
+
+	if st.proxySelector != nil && target.Proxy == "" {
+		if target == node {
+			target = withAddr(node, node.Addr)
+		}
+		target.Proxy = st.proxySelector.Current()
+	}
+	return target
+}
+
+// relaySNI connects conn, with its ClientHello still unread, to the backend
+// of node, so client and backend complete the TLS handshake between them
+func (s *Server) relaySNI(conn net.Conn, req *http.Request, node *config.Node) {
+	defer conn.Close()
+	serverName := req.Host
+
+	relayed, ok := s.relays.acquire(connKindSNI)
+	if !ok {
+		sniConnections.With(node.Name, "rejected").Inc()
+		log.Warn().
+			Str("server_name", serverName).
+			Str("node", node.Name).
+			Str("client", req.RemoteAddr).
+			Msg("sni connection rejected, max_relays open")
+		return
+	}
+	defer relayed()
+
+	// Reserve a tunnel slot on the node
+	if lim := s.nodeState(node.Name).tunnels; lim != nil {
+		release, err := lim.Acquire(acl.ClientIP(req).String())
+		if err != nil {
+			sniConnections.With(node.Name, "rejected").Inc()
+			log.Warn().
+				Err(err).
+				Str("server_name", serverName).
+				Str("node", node.Name).
+				Str("client", req.RemoteAddr).
+				Msg("sni connection rejected by limit")
+			return
+		}
+		defer release()
+	}
+
+	// Count the connection as in-flight work so a reload can drain the node
+	ctx, done := s.trackWork(req.Context(), node.Name)
+	defer done()
+
+	target := s.sniTarget(node, serverName)
+
+	var upstream net.Conn
+	var err error
+	d := s.forwarder.Dialer(target)
+	if proxy := target.ProxyURL(); proxy != "" {
+		s.mu.RLock()
+		proxies := s.proxies
+		s.mu.RUnlock()
+		upstream, err = proxies.Dial(ctx, d, proxy, target.Addr)
+	} else {
+		upstream, err = d.DialContext(ctx, "tcp", target.Addr)
+	}
+	if err != nil {
+		sniConnections.With(node.Name, "error").Inc()
+		log.Error().
+			Err(err).
+			Str("server_name", serverName).
+			Str("node", node.Name).
+			Str("backend", target.Addr).
+			Msg("failed to connect to sni backend")
+		return
+	}
+	defer upstream.Close()
+	sniConnections.With(node.Name, "relayed").Inc()
+	s.auditRequest(req, target)
+
+	// Close the connection if the node's drain grace period runs out
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+		upstream.Close()
+	})
+	defer stop()
+
+	log.Debug().
+		Str("server_name", serverName).
+		Str("node", node.Name).
+		Str("backend", target.Addr).
+		Msg("sni connection relayed")
+
+	// List the connection for the admin API
+	entry := &relayedConn{
+		kind:    connKindSNI,
+		client:  req.RemoteAddr,
+		node:    node.Name,
+		route:   describeRoute(node),
+		backend: target.Addr,
+		host:    serverName,
+		close: func() {
+			conn.Close()
+			upstream.Close()
+		},
+	}
+	defer s.conns.add(entry)()
+
+	s.mu.RLock()
+	opts := tunnelOptions(&s.config.Server.Tunnel)
+	s.mu.RUnlock()
+	opts.Fair, opts.Client = s.fairness(target.ProxyURL()), acl.ClientIP(req).String()
+	opts.Progress = &entry.progress
+
+	stats := tunnel.Relay(conn, upstream, opts)
+	if stats.Err != nil {
+		log.Debug().Err(stats.Err).Msg("sni relay copy error")
+	}
+
+	log.Debug().
+		Str("server_name", serverName).
+		Str("node", node.Name).
+		Int64("bytes_up", stats.BytesUp).
+		Int64("bytes_down", stats.BytesDown).
+		Msg("sni connection closed")
+}
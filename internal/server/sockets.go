@@ -0,0 +1,148 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// systemdFirstFD is the first descriptor systemd passes sockets in
+const systemdFirstFD = 3
+
+var listenerUp = metrics.NewGaugeVec(
+	"forwarder_listener_up",
+	"Whether a listen address is bound (1) or failed to bind (0)",
+	"addr",
+)
+
+// inheritedSocket is a listening socket passed by systemd socket activation
+type inheritedSocket struct {
+	name     string // FileDescriptorName= of the socket unit
+	listener net.Listener
+	used     bool
+}
+
+// systemdSockets returns the listening sockets systemd passed to the
+// process, and clears the variables announcing them so child processes
+// don't take them for theirs
+func systemdSockets() []*inheritedSocket {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() || n <= 0 {
+		return nil
+	}
+
+	var sockets []*inheritedSocket
+	for i := 0; i < n; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(systemdFirstFD+i), name)
+		listener, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			log.Warn().Err(err).Int("fd", systemdFirstFD+i).Str("name", name).Msg("ignoring socket passed by systemd")
+			continue
+		}
+		log.Info().Str("addr", listener.Addr().String()).Str("name", name).Msg("socket passed by systemd")
+		sockets = append(sockets, &inheritedSocket{name: name, listener: listener})
+	}
+	return sockets
+}
+
+// bind returns a listener for addr: a socket passed by systemd that is
+// named addr or bound to it, or a newly bound one
+func (s *Server) bind(addr string) (net.Listener, bool, error) {
+	for _, sock := range s.inherited {
+		if !sock.used && (sock.name == addr || boundTo(sock.listener.Addr(), addr)) {
+			sock.used = true
+			return sock.listener, true, nil
+		}
+	}
+	listener, err := net.Listen("tcp", addr)
+	return listener, false, err
+}
+
+// boundTo reports whether a listener's address is addr
+func boundTo(bound net.Addr, addr string) bool {
+	tcp, ok := bound.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if p, err := net.LookupPort("tcp", port); err != nil || p != tcp.Port {
+		return false
+	}
+	if host == "" {
+		return tcp.IP.IsUnspecified()
+	}
+	if strings.EqualFold(host, "localhost") {
+		return tcp.IP.IsLoopback()
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.Equal(tcp.IP) || ip.IsUnspecified() && tcp.IP.IsUnspecified())
+}
+
+// closeUnusedSockets closes the sockets systemd passed that no configured
+// address took
+func (s *Server) closeUnusedSockets() {
+	for _, sock := range s.inherited {
+		if !sock.used {
+			log.Warn().
+				Str("addr", sock.listener.Addr().String()).
+				Str("name", sock.name).
+				Msg("socket passed by systemd matches no listen address, closing it")
+			sock.listener.Close()
+		}
+	}
+	s.inherited = nil
+}
+
+// bindStatus is the admin API view of a listen address
+type bindStatus struct {
+	Addr    string `json:"addr"`
+	Admin   bool   `json:"admin,omitempty"`
+	Bound   bool   `json:"bound"`
+	Systemd bool   `json:"systemd,omitempty"` // passed by socket activation
+	Error   string `json:"error,omitempty"`
+}
+
+// recordBind notes whether addr was bound, logging failures
+func (s *Server) recordBind(addr string, admin, systemd bool, err error) {
+	st := bindStatus{Addr: addr, Admin: admin, Bound: err == nil, Systemd: systemd}
+	if err != nil {
+		st.Error = err.Error()
+		listenerUp.With(addr).Set(0)
+		log.Error().Err(err).Str("addr", addr).Bool("admin", admin).Msg("failed to bind listen address")
+	} else {
+		listenerUp.With(addr).Set(1)
+	}
+	s.binds = append(s.binds, st)
+}
+
+// handleAdminListeners lists the listen addresses and whether they bound
+func (s *Server) handleAdminListeners(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAdminError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	s.mu.RLock()
+	result := append(make([]bindStatus, 0, len(s.binds)), s.binds...)
+	s.mu.RUnlock()
+
+	writeAdminJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+	"github.com/simman/go-forwarder/internal/trace"
+	"github.com/simman/go-forwarder/internal/vars"
+)
+
+var syntheticRequestsTotal = metrics.NewCounterVec(
+	"forwarder_synthetic_requests_total",
+	"Requests answered by a synthetic route",
+	"service", "path",
+)
+
+// whoami is the body of a whoami synthetic route
+type whoami struct {
+	Service  string              `json:"service"`
+	Listener string              `json:"listener"`
+	Method   string              `json:"method"`
+	Host     string              `json:"host"`
+	URI      string              `json:"uri"`
+	Proto    string              `json:"proto"`
+	Client   string              `json:"client"`
+	ClientIP string              `json:"client_ip"`
+	JA3      string              `json:"ja3,omitempty"`
+	JA4      string              `json:"ja4,omitempty"`
+	Headers  map[string][]string `json:"headers"`
+	Route    *whoamiRoute        `json:"route"` // null when no route matches
+}
+
+// whoamiRoute is the route a request would take if it were forwarded
+type whoamiRoute struct {
+	Service string `json:"service"`
+	Node    string `json:"node"`
+	Rule    string `json:"rule"`
+	Addr    string `json:"addr"`
+	Proxy   string `json:"proxy"`
+}
+
+// handleSynthetic answers requests for a synthetic route of a service on
+// the listener they came in on, reporting whether it did
+func (s *Server) handleSynthetic(w http.ResponseWriter, r *http.Request) bool {
+	s.mu.RLock()
+	svc, route := s.syntheticRoute(r)
+	s.mu.RUnlock()
+
+	if route == nil {
+		return false
+	}
+
+	syntheticRequestsTotal.With(svc.Name, route.Path).Inc()
+	trace.Add(r.Context(), "synthetic", "%s route %s of service %s", route.Type, route.Path, svc.Name)
+	if info := getRequestInfo(r); info != nil {
+		info.route = "synthetic " + route.Path
+	}
+
+	switch route.Type {
+	case "whoami":
+		writeAdminJSON(w, route.Status, s.whoami(r, svc))
+	case "redirect":
+		http.Redirect(w, r, vars.Expand(route.Location, r, nil), route.Status)
+	default:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(route.Status)
+		if r.Method != http.MethodHead {
+			w.Write([]byte(route.Body + "\n"))
+		}
+	}
+	return true
+}
+
+// syntheticRoute finds the synthetic route for the request path among the
+// services listening where the request came in, in config order. The
+// caller must hold s.mu.
+func (s *Server) syntheticRoute(r *http.Request) (*config.Service, *config.SyntheticRoute) {
+	addr := s.requestListener(r)
+	for i := range s.config.Services {
+		svc := &s.config.Services[i]
+		if s.serviceListener(svc) != addr {
+			continue
+		}
+		for j := range svc.Synthetic {
+			if svc.Synthetic[j].Path == r.URL.Path {
+				return svc, &svc.Synthetic[j]
+			}
+		}
+	}
+	return nil, nil
+}
+
+// requestListener returns the address of the listener the request came in
+// on. Requests served outside the forwarder's listeners count as arriving
+// on the default address. The caller must hold s.mu.
+func (s *Server) requestListener(r *http.Request) string {
+	if addr, ok := r.Context().Value(listenAddrKey).(string); ok {
+		return addr
+	}
+	return s.config.Server.Addr
+}
+
+// serviceListener returns the address svc listens on. The caller must hold
+// s.mu.
+func (s *Server) serviceListener(svc *config.Service) string {
+	if svc.Addr == "" {
+		return s.config.Server.Addr
+	}
+	return svc.Addr
+}
+
+// whoami describes the request and the route it would be forwarded on
+func (s *Server) whoami(r *http.Request, svc *config.Service) whoami {
+	listener, _ := r.Context().Value(listenAddrKey).(string)
+	resp := whoami{
+		Service:  svc.Name,
+		Listener: listener,
+		Method:   r.Method,
+		Host:     r.Host,
+		URI:      r.URL.RequestURI(),
+		Proto:    r.Proto,
+		Client:   r.RemoteAddr,
+		ClientIP: acl.ClientIP(r).String(),
+		Headers:  r.Header,
+	}
+	if fp := tlsfp.From(r.Context()); fp != nil {
+		resp.JA3, resp.JA4 = fp.JA3, fp.JA4
+	}
+
+	if route, ok := s.router.MatchEnabled(r, s.nodeEnabled(r)); ok {
+		resp.Route = &whoamiRoute{
+			Service: route.Service,
+			Node:    route.Node.Name,
+			Rule:    describeRoute(route.Node),
+			Addr:    route.Node.Addr,
+			Proxy:   redactProxy(route.Node.ProxyURL()),
+		}
+	}
+	return resp
+}
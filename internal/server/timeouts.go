@@ -0,0 +1,61 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// routeContext bounds the upstream work of a request by the node's
+// timeout, or the server default, and never past the server's write
+// timeout, after which the client can't be answered anyway
+func (s *Server) routeContext(r *http.Request, node *config.Node) (context.Context, context.CancelFunc) {
+	s.mu.RLock()
+	timeouts := s.config.Server.Timeouts
+	writeTimeout := s.config.Server.WriteTimeout
+	s.mu.RUnlock()
+
+	timeout, source := node.Timeout, "node timeout"
+	if timeout == 0 {
+		timeout, source = timeouts.Route, "server timeouts.route"
+	}
+	deadline := time.Now().Add(timeout)
+
+	if writeTimeout > 0 {
+		start := time.Now()
+		if info := getRequestInfo(r); info != nil {
+			start = info.start
+		}
+		if limit := start.Add(writeTimeout); limit.Before(deadline) {
+			deadline, source = limit, "server write_timeout"
+		}
+	}
+
+	trace.Add(r.Context(), "timeout", "upstream deadline in %s from %s", time.Until(deadline).Round(time.Millisecond), source)
+	return context.WithDeadline(r.Context(), deadline)
+}
+
+// attemptTimeout returns the limit of one upstream attempt to node, zero
+// when only the route's deadline applies
+func (s *Server) attemptTimeout(node *config.Node) time.Duration {
+	if node.AttemptTimeout > 0 {
+		return node.AttemptTimeout
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.config.Server.Timeouts.Attempt
+}
+
+// forwardAttempt sends the request upstream once, within the attempt
+// timeout of node
+func (s *Server) forwardAttempt(w http.ResponseWriter, r *http.Request, node *config.Node) error {
+	if timeout := s.attemptTimeout(node); timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	return s.forwarder.Forward(w, r, node)
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/rwwrap"
+	"github.com/simman/go-forwarder/internal/tlsfp"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// traceHeader carries the decision trace of a traced request, as a JSON
+// array of steps
+const traceHeader = "X-Forwarder-Trace"
+
+// traceMiddleware records the decisions taken for requests asking for a
+// trace: how headers were normalized, which routes were evaluated, the
+// upstream chosen and the header transforms applied. The steps up to the
+// response are returned in a response header, and the whole trace is
+// logged whatever the log level.
+func (s *Server) traceMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.RLock()
+		policy := s.debug
+		s.mu.RUnlock()
+
+		traced := policy.traced(r)
+
+		// The toggle is meant for the forwarder, not the backend
+		r.Header.Del(policy.trace)
+
+		if !traced {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t := trace.New()
+		r = r.WithContext(trace.With(r.Context(), t))
+		t.Add("request", fmt.Sprintf("%s %s%s %s from %s", r.Method, r.Host, r.URL.RequestURI(), r.Proto, r.RemoteAddr))
+		if fp := tlsfp.From(r.Context()); fp != nil {
+			t.Add("tls", fmt.Sprintf("client fingerprint JA3 %s, JA4 %s", fp.JA3, fp.JA4))
+		}
+
+		rw := rwwrap.Wrap(w)
+		rw.OnWriteHeader(func(status int) {
+			t.Add("response", fmt.Sprintf("status %d", status))
+			if data, err := json.Marshal(t.Steps()); err == nil {
+				rw.Header().Set(traceHeader, string(data))
+			}
+		})
+		defer func() {
+			if rw.Hijacked() {
+				t.Add("done", "connection taken over")
+			} else {
+				t.Add("done", fmt.Sprintf("%d body bytes sent", rw.BytesWritten()))
+			}
+			log.Log().
+				Str("method", r.Method).
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("client", r.RemoteAddr).
+				Interface("trace", t.Steps()).
+				Msg("request trace")
+		}()
+
+		next.ServeHTTP(rw, r)
+	})
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/router"
+	"github.com/simman/go-forwarder/internal/trace"
+)
+
+// matchRoute finds the route for the request. When none matches, the
+// unmatched policy either answers the request, in which case matchRoute
+// reports false, or names the node that takes it instead.
+func (s *Server) matchRoute(w http.ResponseWriter, r *http.Request) (router.Route, bool) {
+	s.recordSample(r)
+
+	if route, ok := s.router.MatchEnabled(r, s.nodeEnabled(r)); ok {
+		s.observeMatch(true)
+		return route, true
+	}
+	s.observeMatch(false)
+
+	s.mu.RLock()
+	policy := s.config.Unmatched
+	s.mu.RUnlock()
+
+	trace.Add(r.Context(), "unmatched", "unmatched_policy action %q, node %q", policy.Action, policy.Node)
+
+	switch policy.Action {
+	case "forward":
+		if route, ok := s.router.Lookup(policy.Node); ok {
+			log.Debug().
+				Str("host", r.Host).
+				Str("path", r.URL.Path).
+				Str("node", policy.Node).
+				Msg("no matching route, forwarding to default node")
+			return route, true
+		}
+		log.Error().Str("node", policy.Node).Msg("default node for unmatched requests not found")
+		s.handleNoMatch(w, r)
+	case "forbidden":
+		log.Warn().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("method", r.Method).
+			Msg("no matching route found, refusing request")
+		s.handleError(w, r, http.StatusForbidden, "forbidden")
+	case "reset":
+		log.Warn().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("method", r.Method).
+			Str("client", r.RemoteAddr).
+			Msg("no matching route found, resetting connection")
+		resetConnection(w)
+	default:
+		s.handleNoMatch(w, r)
+	}
+	return router.Route{}, false
+}
+
+// resetConnection drops the client connection without a response. Over
+// TCP the close sends a reset rather than a graceful FIN.
+func resetConnection(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		// HTTP/2 can't hand over the connection, reset the stream instead
+		panic(http.ErrAbortHandler)
+	}
+
+	// Reach the TCP connection under TLS and listener wrappers
+	raw := conn
+	for {
+		u, ok := raw.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		raw = u.NetConn()
+	}
+	if tcp, ok := raw.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
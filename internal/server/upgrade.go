@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/acl"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/netutil"
+	"github.com/simman/go-forwarder/internal/tunnel"
+)
+
+// headerHasToken reports whether any value of the comma-separated header
+// name contains token, compared case-insensitively
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUpgrade checks if the request asks to switch protocols
+func isUpgrade(r *http.Request) bool {
+	return r.Header.Get("Upgrade") != "" && headerHasToken(r.Header, "Connection", "upgrade")
+}
+
+// isWebSocketUpgrade checks if the request is a WebSocket upgrade
+func isWebSocketUpgrade(r *http.Request) bool {
+	return isUpgrade(r) && headerHasToken(r.Header, "Upgrade", "websocket")
+}
+
+// handleUpgrade passes a protocol upgrade other than WebSocket to the
+// backend. If the backend switches protocols, both connections are joined
+// into a raw tunnel, otherwise its response is relayed as is.
+func (s *Server) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	// Find matching route
+	route, matched := s.matchRoute(w, r)
+	if !matched {
+		return
+	}
+	node := route.Node
+
+	// Serve the maintenance page instead of forwarding
+	if s.handleMaintenance(w, r, node) {
+		return
+	}
+
+	// Reserve a tunnel slot on the node
+	release, ok := s.acquireTunnel(w, r, node)
+	if !ok {
+		return
+	}
+	defer release()
+
+	// Count the connection as in-flight work so a reload can drain the node
+	ctx, done := s.trackWork(r.Context(), node.Name)
+	defer done()
+
+	// Pick the backend that serves this request
+	node = s.resolveTarget(w, r, node)
+
+	protocol := r.Header.Get("Upgrade")
+	log.Debug().
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Str("protocol", protocol).
+		Msg("handling protocol upgrade")
+
+	backendConn, err := s.dialUpgradeBackend(ctx, r, node)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("host", r.Host).
+			Str("node", node.Name).
+			Msg("failed to connect to backend for upgrade")
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	// Send the upgrade request with the node's credentials
+	outReq := r.Clone(ctx)
+	outReq.Host = netutil.HostHeader(node.Addr)
+	forwarder.SetAuthHeaders(outReq.Header, node.Auth)
+	if err := outReq.Write(backendConn); err != nil {
+		log.Error().Err(err).Str("node", node.Name).Msg("failed to send upgrade request")
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
+		return
+	}
+
+	backendBuf := bufio.NewReader(backendConn)
+	resp, err := http.ReadResponse(backendBuf, outReq)
+	if err != nil {
+		log.Error().Err(err).Str("node", node.Name).Msg("failed to read upgrade response")
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	// The backend declined, relay its answer like any other response
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		for name, values := range resp.Header {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(resp.StatusCode)
+		if _, err := io.Copy(w, resp.Body); err != nil {
+			log.Debug().Err(err).Msg("failed to relay upgrade response")
+		}
+		return
+	}
+
+	clientConn, clientBuf, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		log.Error().Err(err).Msg("failed to hijack connection")
+		http.Error(w, "Failed to hijack connection", http.StatusInternalServerError)
+		return
+	}
+	defer clientConn.Close()
+
+	if err := resp.Write(clientConn); err != nil {
+		log.Debug().Err(err).Msg("failed to send switching protocols")
+		return
+	}
+
+	// Either side may have sent data right behind the handshake
+	if err := flushBuffered(clientBuf.Reader, backendConn); err != nil {
+		log.Debug().Err(err).Msg("failed to forward buffered client data")
+		return
+	}
+	if err := flushBuffered(backendBuf, clientConn); err != nil {
+		log.Debug().Err(err).Msg("failed to forward buffered backend data")
+		return
+	}
+
+	// Close the tunnel if the node's drain grace period runs out
+	stop := context.AfterFunc(ctx, func() {
+		clientConn.Close()
+		backendConn.Close()
+	})
+	defer stop()
+
+	log.Info().
+		Str("host", r.Host).
+		Str("path", r.URL.Path).
+		Str("node", node.Name).
+		Str("protocol", protocol).
+		Msg("upgraded connection established")
+
+	// List the connection for the admin API
+	conn := &relayedConn{
+		kind:    connKindUpgrade,
+		client:  r.RemoteAddr,
+		node:    node.Name,
+		route:   describeRoute(node),
+		backend: node.Addr,
+		host:    r.Host,
+		close: func() {
+			clientConn.Close()
+			backendConn.Close()
+		},
+	}
+	defer s.conns.add(conn)()
+
+	s.mu.RLock()
+	opts := tunnelOptions(&s.config.Server.Tunnel)
+	s.mu.RUnlock()
+	opts.Fair, opts.Client = s.fairness(node.ProxyURL()), acl.ClientIP(r).String()
+	opts.Progress = &conn.progress
+
+	stats := tunnel.Relay(clientConn, backendConn, opts)
+	if stats.Err != nil {
+		log.Debug().Err(stats.Err).Msg("upgraded connection copy error")
+	}
+
+	log.Debug().
+		Str("host", r.Host).
+		Str("node", node.Name).
+		Int64("bytes_up", stats.BytesUp).
+		Int64("bytes_down", stats.BytesDown).
+		Msg("upgraded connection closed")
+}
+
+// dialUpgradeBackend connects to the node's backend, through its proxy if
+// one is set, with TLS when the client came in over TLS
+func (s *Server) dialUpgradeBackend(ctx context.Context, r *http.Request, node *config.Node) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+
+	d := s.forwarder.Dialer(node)
+	if proxy := node.ProxyURL(); proxy != "" {
+		s.mu.RLock()
+		proxies := s.proxies
+		s.mu.RUnlock()
+		conn, err = proxies.Dial(ctx, d, proxy, node.Addr)
+	} else {
+		conn, err = d.DialContext(ctx, "tcp", node.Addr)
+	}
+	if err != nil || r.TLS == nil {
+		return conn, err
+	}
+
+	cfg := s.forwarder.NodeTLSConfig(node)
+	cfg.ServerName = netutil.Hostname(node.Addr)
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// flushBuffered writes data already buffered in br to dst
+func flushBuffered(br *bufio.Reader, dst io.Writer) error {
+	n := br.Buffered()
+	if n == 0 {
+		return nil
+	}
+	pending, _ := br.Peek(n)
+	_, err := dst.Write(pending)
+	return err
+}
@@ -1,32 +1,74 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/forwarder"
+	"github.com/simman/go-forwarder/internal/proxyauth"
+	"github.com/simman/go-forwarder/internal/tunnel"
 )
 
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
-		return true // Allow all origins
+		return true // Checked against the node's policy by originAllowed
 	},
 }
 
 // handleWebSocket handles WebSocket upgrade requests
 func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	// Find matching route
-	node, matched := s.router.Match(r)
+	route, matched := s.matchRoute(w, r)
 	if !matched {
+		return
+	}
+	node := route.Node
+
+	// Refuse cross-site handshakes the node doesn't allow
+	if !originAllowed(r, node.WebSocket) {
 		log.Warn().
 			Str("host", r.Host).
-			Str("path", r.URL.Path).
-			Msg("no matching route for WebSocket")
-		http.Error(w, "No matching route found", http.StatusBadGateway)
+			Str("origin", r.Header.Get("Origin")).
+			Str("node", node.Name).
+			Msg("WebSocket origin not allowed")
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Serve the maintenance page instead of forwarding
+	if s.handleMaintenance(w, r, node) {
+		return
+	}
+
+	// Reserve a tunnel slot on the node
+	release, ok := s.acquireTunnel(w, r, node)
+	if !ok {
 		return
 	}
+	defer release()
+
+	// Count the connection as in-flight work so a reload can drain the node
+	ctx, done := s.trackWork(r.Context(), node.Name)
+	defer done()
+
+	// Pick the backend that serves this request, the one its session was
+	// on if it reconnects in time
+	key := sessionKey(r, node.WebSocket)
+	if addr, proxy, ok := s.sessions.pinned(node.Name, key); ok && validPin(node, s.nodeState(node.Name), addr) {
+		node = withAddr(node, addr)
+		node.Proxy = proxy
+		s.recordTarget(r, route.Node, node)
+		wsPinnedReconnects.With(node.Name).Inc()
+	} else {
+		node = s.resolveTarget(w, r, node)
+	}
 
 	log.Debug().
 		Str("host", r.Host).
@@ -34,14 +76,6 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Str("node", node.Name).
 		Msg("handling WebSocket upgrade")
 
-	// Upgrade client connection
-	clientConn, err := upgrader.Upgrade(w, r, nil)
-	if err != nil {
-		log.Error().Err(err).Msg("failed to upgrade client connection")
-		return
-	}
-	defer clientConn.Close()
-
 	// Build backend WebSocket URL
 	scheme := "wss"
 	if r.TLS == nil {
@@ -50,21 +84,32 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 	backendURL := fmt.Sprintf("%s://%s%s", scheme, node.Addr, r.URL.RequestURI())
 
 	// Create dialer with proxy support
-	dialer := websocket.Dialer{
+	wsDialer := websocket.Dialer{
+		NetDialContext:   s.forwarder.Dialer(node).DialContext,
+		TLSClientConfig:  s.forwarder.NodeTLSConfig(node),
 		HandshakeTimeout: upgrader.HandshakeTimeout,
+		Subprotocols:     websocket.Subprotocols(r),
 	}
 
-	if node.Proxy != "" {
-		proxyURL, err := url.Parse(node.Proxy)
+	if proxy := node.ProxyURL(); proxy != "" {
+		proxyURL, err := url.Parse(proxy)
 		if err != nil {
-			log.Error().Err(err).Str("proxy", node.Proxy).Msg("invalid proxy URL")
+			log.Error().Err(err).Str("proxy", proxy).Msg("invalid proxy URL")
+			http.Error(w, "Invalid proxy configuration", http.StatusBadGateway)
 			return
 		}
-		dialer.Proxy = http.ProxyURL(proxyURL)
+		wsDialer.Proxy = func(*http.Request) (*url.URL, error) {
+			return proxyauth.Apply(proxyURL), nil
+		}
 	}
 
-	// Connect to backend
-	backendConn, resp, err := dialer.Dial(backendURL, r.Header)
+	// Present the node's credentials instead of the client's
+	header := backendHandshakeHeader(r.Header)
+	forwarder.SetAuthHeaders(header, node.Auth)
+
+	// Connect to backend before upgrading the client, so a failure can
+	// still be reported with a proper HTTP status
+	backendConn, resp, err := wsDialer.DialContext(ctx, backendURL, header)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -73,10 +118,23 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		if resp != nil {
 			log.Error().Int("status", resp.StatusCode).Msg("backend response status")
 		}
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
 		return
 	}
 	defer backendConn.Close()
 
+	// Upgrade client connection, agreeing on the backend's subprotocol
+	responseHeader := w.Header().Clone()
+	if proto := backendConn.Subprotocol(); proto != "" {
+		responseHeader.Set("Sec-WebSocket-Protocol", proto)
+	}
+	clientConn, err := upgrader.Upgrade(w, r, responseHeader)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to upgrade client connection")
+		return
+	}
+	defer clientConn.Close()
+
 	log.Info().
 		Str("host", r.Host).
 		Str("path", r.URL.Path).
@@ -84,22 +142,73 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Str("backend", backendURL).
 		Msg("WebSocket connection established")
 
+	// List the connection for the admin API and pin its session
+	var sticky time.Duration
+	if ws := route.Node.WebSocket; ws != nil {
+		sticky = ws.StickyReconnect
+	}
+	end := s.sessions.start(&wsSession{
+		Key:     key,
+		Client:  r.RemoteAddr,
+		Node:    node.Name,
+		Backend: node.Addr,
+		Host:    r.Host,
+		Path:    r.URL.Path,
+		Started: time.Now(),
+	}, node.Proxy, sticky)
+	defer end()
+
+	// Close both sides if the node's drain grace period runs out
+	stop := context.AfterFunc(ctx, func() {
+		clientConn.Close()
+		backendConn.Close()
+	})
+	defer stop()
+
+	// List the connection in the connection table too, counting bytes
+	conn := &relayedConn{
+		kind:    connKindWebSocket,
+		client:  r.RemoteAddr,
+		node:    node.Name,
+		route:   describeRoute(route.Node),
+		backend: node.Addr,
+		host:    r.Host,
+		close: func() {
+			clientConn.Close()
+			backendConn.Close()
+		},
+	}
+	defer s.conns.add(conn)()
+
+	// Apply the node's message policy
+	hooks := s.nodeState(node.Name).wsPolicy.apply(clientConn, backendConn)
+
 	// Bidirectional copy
 	errCh := make(chan error, 2)
 
 	// Client to backend
-	go func() {
-		errCh <- s.copyWebSocket(backendConn, clientConn, "client->backend")
-	}()
+	tunnel.Go(func() {
+		errCh <- s.copyWebSocket(backendConn, clientConn, wsClientToBackend, hooks, &conn.progress.Up)
+	})
 
 	// Backend to client
-	go func() {
-		errCh <- s.copyWebSocket(clientConn, backendConn, "backend->client")
-	}()
+	tunnel.Go(func() {
+		errCh <- s.copyWebSocket(clientConn, backendConn, wsBackendToClient, hooks, &conn.progress.Down)
+	})
 
 	// Wait for one direction to finish
 	err = <-errCh
-	if err != nil {
+	var veto *wsVeto
+	if errors.As(err, &veto) {
+		wsMessagesRejected.With(node.Name, veto.reason).Inc()
+		log.Warn().
+			Str("host", r.Host).
+			Str("path", r.URL.Path).
+			Str("node", node.Name).
+			Str("reason", veto.reason).
+			Msg("WebSocket closed by message policy")
+		closeWithVeto(veto, clientConn, backendConn)
+	} else if err != nil {
 		log.Debug().Err(err).Msg("WebSocket copy error")
 	}
 
@@ -110,10 +219,34 @@ func (s *Server) handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		Msg("WebSocket connection closed")
 }
 
-// copyWebSocket copies messages from src to dst
-func (s *Server) copyWebSocket(dst, src *websocket.Conn, direction string) error {
+// handshakeHeaders are generated by the dialer and must not be copied from
+// the client request
+var handshakeHeaders = []string{
+	"Upgrade",
+	"Connection",
+	"Sec-Websocket-Key",
+	"Sec-Websocket-Version",
+	"Sec-Websocket-Extensions",
+	"Sec-Websocket-Protocol",
+}
+
+// backendHandshakeHeader returns the client headers to send to the backend
+func backendHandshakeHeader(h http.Header) http.Header {
+	out := h.Clone()
+	for _, name := range handshakeHeaders {
+		out.Del(name)
+	}
+	return out
+}
+
+// copyWebSocket copies messages from src to dst, passing each through
+// hooks, and adds the size of those written to count
+func (s *Server) copyWebSocket(dst, src *websocket.Conn, direction string, hooks []wsHook, count *atomic.Int64) error {
 	for {
 		messageType, message, err := src.ReadMessage()
+		if errors.Is(err, websocket.ErrReadLimit) {
+			return &wsVeto{code: websocket.CloseMessageTooBig, reason: "size"}
+		}
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Debug().Err(err).Str("direction", direction).Msg("unexpected WebSocket close")
@@ -121,10 +254,17 @@ func (s *Server) copyWebSocket(dst, src *websocket.Conn, direction string) error
 			return err
 		}
 
+		for _, hook := range hooks {
+			if veto := hook(direction, messageType, message); veto != nil {
+				return veto
+			}
+		}
+
 		err = dst.WriteMessage(messageType, message)
 		if err != nil {
 			log.Debug().Err(err).Str("direction", direction).Msg("failed to write WebSocket message")
 			return err
 		}
+		count.Add(int64(len(message)))
 	}
 }
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"math"
+	"regexp"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// Relay directions of WebSocket messages
+const (
+	wsClientToBackend = "client->backend"
+	wsBackendToClient = "backend->client"
+)
+
+var wsMessagesRejected = metrics.NewCounterVec(
+	"forwarder_websocket_messages_rejected_total",
+	"WebSocket messages that closed their connection by policy",
+	"node", "reason",
+)
+
+// wsVeto stops a WebSocket relay, both sides are closed with code
+type wsVeto struct {
+	code   int
+	reason string // size, rate or pattern
+}
+
+func (v *wsVeto) Error() string {
+	return "websocket message refused: " + v.reason
+}
+
+// wsHook inspects one relayed message and may veto it. Hooks are created
+// per connection and may keep state for it.
+type wsHook func(direction string, messageType int, data []byte) *wsVeto
+
+// wsPolicy is a node's compiled WebSocket message policy
+type wsPolicy struct {
+	maxSize int64
+	rate    float64
+	deny    []*regexp.Regexp
+}
+
+// newWSPolicy compiles the message policy of cfg, nil if there is none
+func newWSPolicy(cfg *config.WebSocket) *wsPolicy {
+	if cfg == nil || cfg.MaxMessageSize == 0 && cfg.RateLimit == 0 && len(cfg.DenyPatterns) == 0 {
+		return nil
+	}
+
+	p := &wsPolicy{maxSize: int64(cfg.MaxMessageSize), rate: cfg.RateLimit}
+	for _, pattern := range cfg.DenyPatterns {
+		// Patterns were checked by the config validator
+		if re, err := regexp.Compile(pattern); err == nil {
+			p.deny = append(p.deny, re)
+		}
+	}
+	return p
+}
+
+// apply limits message sizes on both connections and returns the hooks
+// for one relayed connection
+func (p *wsPolicy) apply(client, backend *websocket.Conn) []wsHook {
+	if p == nil {
+		return nil
+	}
+
+	// The size limit is enforced while reading, so large messages are
+	// never buffered
+	if p.maxSize > 0 {
+		client.SetReadLimit(p.maxSize)
+		backend.SetReadLimit(p.maxSize)
+	}
+
+	var hooks []wsHook
+	if p.rate > 0 {
+		hooks = append(hooks, rateHook(p.rate))
+	}
+	if len(p.deny) > 0 {
+		hooks = append(hooks, denyHook(p.deny))
+	}
+	return hooks
+}
+
+// rateHook limits client messages to rate per second, allowing bursts of
+// one second's worth. Its state is only touched by the client reader.
+func rateHook(rate float64) wsHook {
+	burst := math.Max(1, math.Ceil(rate))
+	tokens := burst
+	last := time.Now()
+
+	return func(direction string, _ int, _ []byte) *wsVeto {
+		if direction != wsClientToBackend {
+			return nil
+		}
+
+		now := time.Now()
+		tokens = math.Min(burst, tokens+now.Sub(last).Seconds()*rate)
+		last = now
+		if tokens < 1 {
+			return &wsVeto{code: websocket.ClosePolicyViolation, reason: "rate"}
+		}
+		tokens--
+		return nil
+	}
+}
+
+// denyHook refuses text messages in either direction matching a pattern
+func denyHook(patterns []*regexp.Regexp) wsHook {
+	return func(_ string, messageType int, data []byte) *wsVeto {
+		if messageType != websocket.TextMessage {
+			return nil
+		}
+		for _, re := range patterns {
+			if re.Match(data) {
+				return &wsVeto{code: websocket.ClosePolicyViolation, reason: "pattern"}
+			}
+		}
+		return nil
+	}
+}
+
+// closeWithVeto sends the veto's close frame to both sides
+func closeWithVeto(veto *wsVeto, conns ...*websocket.Conn) {
+	msg := websocket.FormatCloseMessage(veto.code, "message refused by policy")
+	deadline := time.Now().Add(time.Second)
+	for _, conn := range conns {
+		conn.WriteControl(websocket.CloseMessage, msg, deadline)
+	}
+}
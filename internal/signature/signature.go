@@ -0,0 +1,186 @@
+package signature
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+var (
+	// ErrMissing reports a request without a signature
+	ErrMissing = errors.New("missing signature")
+	// ErrInvalid reports a signature no key produced
+	ErrInvalid = errors.New("invalid signature")
+	// ErrExpired reports a timestamp outside the allowed clock skew
+	ErrExpired = errors.New("signature timestamp outside allowed skew")
+	// ErrUnknownKey reports a key id matching no unexpired key
+	ErrUnknownKey = errors.New("unknown signature key")
+	// ErrBodyTooLarge reports a body larger than the verified maximum
+	ErrBodyTooLarge = errors.New("request body too large to verify")
+)
+
+// Verifier checks HMAC signatures of incoming requests
+type Verifier struct {
+	cfg  config.Signature
+	hash func() hash.Hash
+	now  func() time.Time
+}
+
+// New creates a verifier from node configuration
+func New(cfg *config.Signature) *Verifier {
+	v := &Verifier{cfg: *cfg, now: time.Now}
+	switch cfg.Algorithm {
+	case "sha1":
+		v.hash = sha1.New
+	case "sha512":
+		v.hash = sha512.New
+	default:
+		v.hash = sha256.New
+	}
+	return v
+}
+
+// Verify checks the signature of r and returns the id of the key that
+// verified it. The body is read to compute the signature and replaced so
+// it can still be forwarded.
+func (v *Verifier) Verify(r *http.Request) (string, error) {
+	value := strings.TrimSpace(r.Header.Get(v.cfg.Header))
+	if value == "" {
+		return "", ErrMissing
+	}
+	value, ok := strings.CutPrefix(value, v.cfg.Prefix)
+	if !ok {
+		return "", ErrInvalid
+	}
+	signature, err := v.decode(value)
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	var timestamp string
+	if v.cfg.TimestampHeader != "" {
+		timestamp = strings.TrimSpace(r.Header.Get(v.cfg.TimestampHeader))
+		if timestamp == "" {
+			return "", ErrMissing
+		}
+		secs, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return "", ErrInvalid
+		}
+		if skew := v.now().Sub(time.Unix(secs, 0)); skew > v.cfg.MaxSkew || -skew > v.cfg.MaxSkew {
+			return "", ErrExpired
+		}
+	}
+
+	body, err := v.readBody(r)
+	if err != nil {
+		return "", err
+	}
+	payload := v.payload(r, timestamp, body)
+
+	keyID := ""
+	if v.cfg.KeyIDHeader != "" {
+		keyID = r.Header.Get(v.cfg.KeyIDHeader)
+	}
+	now := v.now()
+	tried := false
+	for _, key := range v.cfg.Keys {
+		if v.cfg.KeyIDHeader != "" && key.ID != keyID {
+			continue
+		}
+		if !key.Expires.IsZero() && !now.Before(key.Expires) {
+			continue
+		}
+		tried = true
+
+		mac := hmac.New(v.hash, []byte(key.Secret))
+		mac.Write(payload)
+		if hmac.Equal(mac.Sum(nil), signature) {
+			return key.ID, nil
+		}
+	}
+	if !tried && v.cfg.KeyIDHeader != "" {
+		return "", ErrUnknownKey
+	}
+	return "", ErrInvalid
+}
+
+// decode turns the signature header value into bytes
+func (v *Verifier) decode(value string) ([]byte, error) {
+	if v.cfg.Encoding == "base64" {
+		if b, err := base64.StdEncoding.DecodeString(value); err == nil {
+			return b, nil
+		}
+		return base64.URLEncoding.DecodeString(value)
+	}
+	return hex.DecodeString(value)
+}
+
+// readBody reads the request body up to the limit and puts it back
+func (v *Verifier) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	limit := int64(v.cfg.MaxBodySize)
+	if r.ContentLength > limit {
+		return nil, ErrBodyTooLarge
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, ErrBodyTooLarge
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	return body, nil
+}
+
+// payload builds the signed payload from the template
+func (v *Verifier) payload(r *http.Request, timestamp string, body []byte) []byte {
+	var b bytes.Buffer
+	tmpl := v.cfg.Payload
+	for tmpl != "" {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			b.WriteString(tmpl)
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			b.WriteString(tmpl)
+			break
+		}
+		b.WriteString(tmpl[:start])
+		switch name := tmpl[start+1 : start+end]; name {
+		case "timestamp":
+			b.WriteString(timestamp)
+		case "method":
+			b.WriteString(r.Method)
+		case "path":
+			b.WriteString(r.URL.RequestURI())
+		case "body":
+			b.Write(body)
+		default:
+			b.WriteString(tmpl[start : start+end+1])
+		}
+		tmpl = tmpl[start+end+1:]
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,210 @@
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	algorithm  = "AWS4-HMAC-SHA256"
+	timeFormat = "20060102T150405Z"
+	dateFormat = "20060102"
+
+	// UnsignedPayload may be used as the payload hash when the body can't be hashed up front
+	UnsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// Credentials are AWS access credentials
+type Credentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+}
+
+// CredentialsFromEnv fills empty fields from the standard AWS environment variables
+func CredentialsFromEnv(c Credentials) Credentials {
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+	}
+	if c.SecretAccessKey == "" {
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	if c.SessionToken == "" {
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	return c
+}
+
+// Signer signs HTTP requests with AWS Signature Version 4
+type Signer struct {
+	Credentials Credentials
+	Region      string
+	Service     string
+}
+
+// HashPayload returns the hex SHA-256 of a payload
+func HashPayload(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// Sign adds the Authorization, X-Amz-Date and X-Amz-Content-Sha256 headers
+// to req. payloadHash is the hex SHA-256 of the body or UnsignedPayload.
+func (s *Signer) Sign(req *http.Request, payloadHash string, now time.Time) error {
+	if s.Credentials.AccessKeyID == "" || s.Credentials.SecretAccessKey == "" {
+		return fmt.Errorf("missing AWS credentials")
+	}
+
+	now = now.UTC()
+	amzDate := now.Format(timeFormat)
+	date := now.Format(dateFormat)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	signedHeaders, canonicalHeaders := canonicalHeaders(req.Header, host)
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalPath(req.URL),
+		canonicalQuery(req.URL),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.Region, s.Service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{
+		algorithm,
+		amzDate,
+		scope,
+		HashPayload([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, s.Service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		algorithm, s.Credentials.AccessKeyID, scope, signedHeaders, signature))
+
+	return nil
+}
+
+// unsignedHeaders are left out of the signature because clients or
+// intermediaries may add or rewrite them in transit
+var unsignedHeaders = map[string]bool{
+	"authorization":     true,
+	"user-agent":        true,
+	"content-length":    true,
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"te":                true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+	"expect":            true,
+}
+
+// canonicalHeaders returns the signed header list and canonical header block
+func canonicalHeaders(h http.Header, host string) (string, string) {
+	values := map[string]string{"host": strings.TrimSpace(host)}
+	for k, vv := range h {
+		name := strings.ToLower(k)
+		if unsignedHeaders[name] {
+			continue
+		}
+		trimmed := make([]string, len(vv))
+		for i, v := range vv {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		values[name] = strings.Join(trimmed, ",")
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(values[name])
+		b.WriteByte('\n')
+	}
+
+	return strings.Join(names, ";"), b.String()
+}
+
+// canonicalPath returns the URI-encoded request path. Every service except
+// S3 expects the already encoded path to be encoded a second time.
+func (s *Signer) canonicalPath(u *url.URL) string {
+	path := u.EscapedPath()
+	if path == "" {
+		return "/"
+	}
+	if s.Service == "s3" {
+		return path
+	}
+	return EscapePath(path)
+}
+
+// canonicalQuery returns the sorted, encoded query string
+func canonicalQuery(u *url.URL) string {
+	query := u.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vv := append([]string(nil), query[k]...)
+		sort.Strings(vv)
+		for _, v := range vv {
+			parts = append(parts, escape(k)+"="+escape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// EscapePath percent-encodes each segment of a path the way SigV4 expects
+func EscapePath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		segments[i] = escape(seg)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape percent-encodes everything except unreserved characters
+func escape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,289 @@
+// Package slo tracks the requests of a route against availability and
+// latency objectives, and how fast they spend the error budget the
+// objectives leave
+package slo
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// Objective names used in metrics and reports
+const (
+	Availability = "availability"
+	Latency      = "latency"
+)
+
+// refreshInterval is how often the burn rate gauges are recomputed
+const refreshInterval = 15 * time.Second
+
+// burnWindows are the spans burn rates are reported over, besides the
+// whole compliance window: the short ones catch fast burns, the long ones
+// slow leaks
+var burnWindows = []time.Duration{5 * time.Minute, time.Hour, 6 * time.Hour}
+
+var (
+	events = metrics.NewCounterVec(
+		"forwarder_slo_events_total",
+		"Requests counted against a route objective, good or bad",
+		"node", "objective", "result",
+	)
+	burnRate = metrics.NewGaugeVec(
+		"forwarder_slo_burn_rate",
+		"Rate the error budget is spent at over a window, 1 spends it exactly by the end of the compliance window",
+		"node", "objective", "window",
+	)
+	budgetRemaining = metrics.NewGaugeVec(
+		"forwarder_slo_error_budget_remaining",
+		"Share of the error budget left in the compliance window, negative once the objective is missed",
+		"node", "objective",
+	)
+)
+
+// Objectives are the targets of a route. A zero target skips its objective.
+type Objectives struct {
+	Availability  float64       // share of requests answered without a 5xx
+	Latency       time.Duration // threshold of the latency objective
+	LatencyTarget float64       // share of requests answered within Latency
+	Window        time.Duration // compliance window, kept in one minute buckets
+}
+
+// Report is the state of a route's objectives
+type Report struct {
+	Node         string     `json:"node"`
+	Window       string     `json:"window"`
+	Requests     int64      `json:"requests"`
+	Availability *Objective `json:"availability,omitempty"`
+	Latency      *Objective `json:"latency,omitempty"`
+}
+
+// Objective is the state of one objective over the compliance window
+type Objective struct {
+	Target          float64            `json:"target"`
+	Threshold       string             `json:"threshold,omitempty"` // of the latency objective
+	Good            int64              `json:"good"`
+	Bad             int64              `json:"bad"`
+	SLI             float64            `json:"sli"`              // share of good requests, 1 without traffic
+	BudgetRemaining float64            `json:"budget_remaining"` // 1 untouched, negative when missed
+	BurnRates       map[string]float64 `json:"burn_rates"`       // by window
+	Met             bool               `json:"met"`
+}
+
+// bucket counts the requests of one minute
+type bucket struct {
+	minute int64
+	total  int64
+	errors int64 // answered with a 5xx
+	timed  int64 // with a known latency
+	slow   int64 // of those, over the threshold
+}
+
+// Tracker counts a route's requests in the buckets of its window
+type Tracker struct {
+	node string
+	obj  Objectives
+
+	mu      sync.Mutex
+	buckets []bucket
+
+	stopCh  chan struct{}
+	stopped sync.Once
+}
+
+// NewTracker creates the tracker of node
+func NewTracker(node string, obj Objectives) *Tracker {
+	minutes := int(obj.Window / time.Minute)
+	if minutes < 1 {
+		minutes = 1
+	}
+	return &Tracker{
+		node:    node,
+		obj:     obj,
+		buckets: make([]bucket, minutes),
+		stopCh:  make(chan struct{}),
+	}
+}
+
+// Objectives returns the targets the tracker was created with
+func (t *Tracker) Objectives() Objectives {
+	return t.obj
+}
+
+// Start keeps the gauges of the tracker current
+func (t *Tracker) Start() {
+	go t.run()
+}
+
+// Stop ends the gauge updates and removes the tracker's series
+func (t *Tracker) Stop() {
+	t.stopped.Do(func() {
+		close(t.stopCh)
+		for _, objective := range []string{Availability, Latency} {
+			budgetRemaining.Delete(t.node, objective)
+			for _, w := range t.windows() {
+				burnRate.Delete(t.node, objective, w.label)
+			}
+		}
+	})
+}
+
+func (t *Tracker) run() {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		t.Report()
+		select {
+		case <-ticker.C:
+		case <-t.stopCh:
+			return
+		}
+	}
+}
+
+// Record counts a finished request. failed marks a 5xx answer, latency is
+// the time to the response header, negative when none was sent.
+func (t *Tracker) Record(failed bool, latency time.Duration) {
+	t.mu.Lock()
+	b := t.current(time.Now())
+	b.total++
+	if failed {
+		b.errors++
+	}
+	slow := latency > t.obj.Latency
+	if latency >= 0 {
+		b.timed++
+		if slow {
+			b.slow++
+		}
+	}
+	t.mu.Unlock()
+
+	if t.obj.Availability > 0 {
+		events.With(t.node, Availability, result(!failed)).Inc()
+	}
+	if t.obj.LatencyTarget > 0 && latency >= 0 {
+		events.With(t.node, Latency, result(!slow)).Inc()
+	}
+}
+
+func result(good bool) string {
+	if good {
+		return "good"
+	}
+	return "bad"
+}
+
+// current returns the bucket of now, resetting it if it is stale. The
+// caller must hold t.mu.
+func (t *Tracker) current(now time.Time) *bucket {
+	minute := now.Unix() / 60
+	b := &t.buckets[minute%int64(len(t.buckets))]
+	if b.minute != minute {
+		*b = bucket{minute: minute}
+	}
+	return b
+}
+
+// sum adds up the buckets of the last span
+func (t *Tracker) sum(now time.Time, span time.Duration) bucket {
+	oldest := now.Unix()/60 - int64(span/time.Minute) + 1
+	var total bucket
+	for _, b := range t.buckets {
+		if b.minute >= oldest {
+			total.total += b.total
+			total.errors += b.errors
+			total.timed += b.timed
+			total.slow += b.slow
+		}
+	}
+	return total
+}
+
+// window is a span burn rates are reported over
+type window struct {
+	label string
+	span  time.Duration
+}
+
+// windows returns the burn rate windows shorter than the compliance
+// window, and the compliance window itself
+func (t *Tracker) windows() []window {
+	var ws []window
+	for _, span := range burnWindows {
+		if span < t.obj.Window {
+			ws = append(ws, window{label: formatSpan(span), span: span})
+		}
+	}
+	return append(ws, window{label: formatSpan(t.obj.Window), span: t.obj.Window})
+}
+
+// Report summarizes the window and updates the gauges
+func (t *Tracker) Report() Report {
+	now := time.Now()
+	t.mu.Lock()
+	totals := make(map[time.Duration]bucket)
+	for _, w := range t.windows() {
+		totals[w.span] = t.sum(now, w.span)
+	}
+	t.mu.Unlock()
+
+	all := totals[t.obj.Window]
+	report := Report{Node: t.node, Window: formatSpan(t.obj.Window), Requests: all.total}
+	if t.obj.Availability > 0 {
+		report.Availability = t.objective(Availability, t.obj.Availability, totals, func(b bucket) (int64, int64) {
+			return b.total, b.errors
+		})
+	}
+	if t.obj.LatencyTarget > 0 {
+		report.Latency = t.objective(Latency, t.obj.LatencyTarget, totals, func(b bucket) (int64, int64) {
+			return b.timed, b.slow
+		})
+		report.Latency.Threshold = t.obj.Latency.String()
+	}
+	return report
+}
+
+// objective computes one objective from the window totals, counted by
+// events, and sets its gauges
+func (t *Tracker) objective(name string, target float64, totals map[time.Duration]bucket, count func(bucket) (total, bad int64)) *Objective {
+	budget := 1 - target
+	o := &Objective{Target: target, SLI: 1, BurnRates: make(map[string]float64)}
+
+	for _, w := range t.windows() {
+		total, bad := count(totals[w.span])
+		rate := 0.0
+		if total > 0 {
+			rate = round(float64(bad) / float64(total) / budget)
+		}
+		o.BurnRates[w.label] = rate
+		burnRate.With(t.node, name, w.label).Set(rate)
+	}
+
+	total, bad := count(totals[t.obj.Window])
+	o.Good, o.Bad = total-bad, bad
+	if total > 0 {
+		o.SLI = round(float64(o.Good) / float64(total))
+	}
+	o.BudgetRemaining = 1 - o.BurnRates[formatSpan(t.obj.Window)]
+	o.Met = o.SLI >= target
+	budgetRemaining.With(t.node, name).Set(o.BudgetRemaining)
+	return o
+}
+
+// round drops the float noise of dividing by budgets such as 1-0.999
+func round(f float64) float64 {
+	return math.Round(f*1e6) / 1e6
+}
+
+// formatSpan writes whole hours and minutes compactly, 6h or 90m
+func formatSpan(d time.Duration) string {
+	if d%time.Hour == 0 {
+		return fmt.Sprintf("%dh", d/time.Hour)
+	}
+	return fmt.Sprintf("%dm", d/time.Minute)
+}
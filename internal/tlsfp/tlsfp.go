@@ -0,0 +1,343 @@
+// Package tlsfp computes JA3 and JA4 fingerprints of TLS ClientHellos,
+// which tell client stacks apart by the ciphers and extensions they offer
+package tlsfp
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Extension types read from the ClientHello
+const (
+	extServerName          = 0x0000
+	extSupportedGroups     = 0x000a
+	extPointFormats        = 0x000b
+	extSignatureAlgorithms = 0x000d
+	extALPN                = 0x0010
+	extSupportedVersions   = 0x002b
+)
+
+// ErrNotClientHello is returned for data that doesn't hold a ClientHello
+var ErrNotClientHello = errors.New("not a TLS ClientHello")
+
+// Fingerprint identifies the TLS stack of a client
+type Fingerprint struct {
+	JA3     string // MD5 of JA3Full, as usually published
+	JA3Full string // version,ciphers,extensions,groups,point formats
+	JA4     string
+
+	ServerName string // requested by SNI, not part of the fingerprints
+}
+
+type contextKey struct{}
+
+// With returns ctx carrying fp
+func With(ctx context.Context, fp *Fingerprint) context.Context {
+	return context.WithValue(ctx, contextKey{}, fp)
+}
+
+// From returns the fingerprint of the client connection ctx belongs to,
+// or nil when it wasn't computed
+func From(ctx context.Context) *Fingerprint {
+	fp, _ := ctx.Value(contextKey{}).(*Fingerprint)
+	return fp
+}
+
+// clientHello holds the ClientHello fields fingerprints are built from
+type clientHello struct {
+	version    uint16
+	ciphers    []uint16
+	extensions []uint16 // in the order sent
+	groups     []uint16
+	points     []uint8
+	sigAlgs    []uint16
+	versions   []uint16 // supported_versions
+	alpn       []string
+	serverName string
+	sni        bool
+}
+
+// Parse fingerprints the ClientHello in record, a TLS handshake record as
+// read from the start of a connection
+func Parse(record []byte) (*Fingerprint, error) {
+	hello, err := parseRecord(record)
+	if err != nil {
+		return nil, err
+	}
+	full := hello.ja3()
+	sum := md5.Sum([]byte(full))
+	return &Fingerprint{
+		JA3:     hex.EncodeToString(sum[:]),
+		JA3Full: full,
+		JA4:     hello.ja4(),
+
+		ServerName: hello.serverName,
+	}, nil
+}
+
+// reader consumes big-endian fields, failing once data runs out
+type reader struct {
+	data []byte
+	err  bool
+}
+
+func (r *reader) bytes(n int) []byte {
+	if r.err || n > len(r.data) {
+		r.err = true
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *reader) u8() int {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])
+}
+
+func (r *reader) u16() int {
+	b := r.bytes(2)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<8 | int(b[1])
+}
+
+func (r *reader) u24() int {
+	b := r.bytes(3)
+	if b == nil {
+		return 0
+	}
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+// sub returns a reader over the next n bytes
+func (r *reader) sub(n int) *reader {
+	b := r.bytes(n)
+	return &reader{data: b, err: b == nil && n > 0}
+}
+
+func (r *reader) u16s() []uint16 {
+	var list []uint16
+	for len(r.data) >= 2 {
+		list = append(list, uint16(r.u16()))
+	}
+	return list
+}
+
+func parseRecord(record []byte) (*clientHello, error) {
+	rec := &reader{data: record}
+	if rec.u8() != 0x16 {
+		return nil, ErrNotClientHello
+	}
+	rec.u16() // record version
+	body := rec.sub(rec.u16())
+	if body.u8() != 0x01 {
+		return nil, ErrNotClientHello
+	}
+	msg := body.sub(body.u24())
+	if msg.err {
+		return nil, fmt.Errorf("%w: truncated", ErrNotClientHello)
+	}
+
+	hello := &clientHello{version: uint16(msg.u16())}
+	msg.bytes(32)       // random
+	msg.bytes(msg.u8()) // session id
+	hello.ciphers = msg.sub(msg.u16()).u16s()
+	msg.bytes(msg.u8()) // compression methods
+	if msg.err {
+		return nil, fmt.Errorf("%w: truncated", ErrNotClientHello)
+	}
+	if len(msg.data) == 0 {
+		return hello, nil // no extensions
+	}
+
+	exts := msg.sub(msg.u16())
+	for len(exts.data) >= 4 {
+		typ := uint16(exts.u16())
+		data := exts.sub(exts.u16())
+		hello.extensions = append(hello.extensions, typ)
+
+		switch typ {
+		case extServerName:
+			hello.sni = true
+			hello.serverName = parseServerName(data)
+		case extSupportedGroups:
+			hello.groups = data.sub(data.u16()).u16s()
+		case extPointFormats:
+			hello.points = data.bytes(data.u8())
+		case extSignatureAlgorithms:
+			hello.sigAlgs = data.sub(data.u16()).u16s()
+		case extSupportedVersions:
+			hello.versions = data.sub(data.u8()).u16s()
+		case extALPN:
+			list := data.sub(data.u16())
+			for len(list.data) > 0 && !list.err {
+				hello.alpn = append(hello.alpn, string(list.bytes(list.u8())))
+			}
+		}
+	}
+	if exts.err {
+		return nil, fmt.Errorf("%w: truncated extensions", ErrNotClientHello)
+	}
+	return hello, nil
+}
+
+// parseServerName returns the host name of a server_name extension
+func parseServerName(data *reader) string {
+	list := data.sub(data.u16())
+	for len(list.data) > 0 && !list.err {
+		typ := list.u8()
+		name := list.bytes(list.u16())
+		if typ == 0 && !list.err {
+			return strings.ToLower(string(name))
+		}
+	}
+	return ""
+}
+
+// grease reports whether v is a GREASE value (RFC 8701), which clients
+// send at random and fingerprints leave out
+func grease(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+func withoutGrease(list []uint16) []uint16 {
+	out := make([]uint16, 0, len(list))
+	for _, v := range list {
+		if !grease(v) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func joinDecimal(list []uint16) string {
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = strconv.Itoa(int(v))
+	}
+	return strings.Join(parts, "-")
+}
+
+func joinHex(list []uint16) string {
+	parts := make([]string, len(list))
+	for i, v := range list {
+		parts[i] = fmt.Sprintf("%04x", v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// ja3 builds the JA3 string: version, ciphers, extensions, groups and point
+// formats, in the order sent
+func (h *clientHello) ja3() string {
+	points := make([]string, len(h.points))
+	for i, p := range h.points {
+		points[i] = strconv.Itoa(int(p))
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(h.version)),
+		joinDecimal(withoutGrease(h.ciphers)),
+		joinDecimal(withoutGrease(h.extensions)),
+		joinDecimal(withoutGrease(h.groups)),
+		strings.Join(points, "-"),
+	}, ",")
+}
+
+// ja4 builds the JA4 fingerprint: a readable summary of the version, SNI,
+// counts and ALPN, then truncated hashes of the sorted ciphers and of the
+// sorted extensions with the signature algorithms
+func (h *clientHello) ja4() string {
+	ciphers := withoutGrease(h.ciphers)
+	extensions := withoutGrease(h.extensions)
+
+	// TLS 1.3 clients name their versions in an extension
+	version := h.version
+	if versions := withoutGrease(h.versions); len(versions) > 0 {
+		version = slices.Max(versions)
+	}
+	sni := "i"
+	if h.sni {
+		sni = "d"
+	}
+	a := fmt.Sprintf("t%s%s%02d%02d%s", tlsVersion(version), sni, min(len(ciphers), 99), min(len(extensions), 99), alpnCode(h.alpn))
+
+	sortedCiphers := append([]uint16(nil), ciphers...)
+	slices.Sort(sortedCiphers)
+	b := truncatedHash(joinHex(sortedCiphers))
+
+	var sortedExts []uint16
+	for _, e := range extensions {
+		if e != extServerName && e != extALPN {
+			sortedExts = append(sortedExts, e)
+		}
+	}
+	slices.Sort(sortedExts)
+	c := joinHex(sortedExts)
+	if sigAlgs := withoutGrease(h.sigAlgs); len(sigAlgs) > 0 {
+		c += "_" + joinHex(sigAlgs)
+	}
+	if len(sortedExts) == 0 {
+		c = ""
+	}
+
+	return a + "_" + b + "_" + truncatedHash(c)
+}
+
+// truncatedHash is the first 12 hex digits of the SHA-256 of s, or zeros
+// for an empty list
+func truncatedHash(s string) string {
+	if s == "" {
+		return "000000000000"
+	}
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:12]
+}
+
+func tlsVersion(v uint16) string {
+	switch v {
+	case 0x0304:
+		return "13"
+	case 0x0303:
+		return "12"
+	case 0x0302:
+		return "11"
+	case 0x0301:
+		return "10"
+	case 0x0300:
+		return "s3"
+	case 0x0002:
+		return "s2"
+	}
+	return "00"
+}
+
+// alpnCode is the first and last character of the first ALPN protocol,
+// of its hex form when either isn't alphanumeric
+func alpnCode(alpn []string) string {
+	if len(alpn) == 0 || alpn[0] == "" {
+		return "00"
+	}
+	p := alpn[0]
+	first, last := p[0], p[len(p)-1]
+	if !alnum(first) || !alnum(last) {
+		h := hex.EncodeToString([]byte(p))
+		return h[:1] + h[len(h)-1:]
+	}
+	return string([]byte{first, last})
+}
+
+func alnum(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
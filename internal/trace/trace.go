@@ -0,0 +1,71 @@
+package trace
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type contextKey struct{}
+
+// Step is one decision taken for a traced request
+type Step struct {
+	At     string `json:"at"` // time since the request arrived
+	Stage  string `json:"stage"`
+	Detail string `json:"detail"`
+}
+
+// Trace records the decisions taken for one request, in order
+type Trace struct {
+	start time.Time
+	mu    sync.Mutex
+	steps []Step
+}
+
+// New starts a trace for a request arriving now
+func New() *Trace {
+	return &Trace{start: time.Now()}
+}
+
+// With returns ctx carrying t
+func With(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, contextKey{}, t)
+}
+
+// From returns the trace ctx carries, or nil when the request isn't traced
+func From(ctx context.Context) *Trace {
+	t, _ := ctx.Value(contextKey{}).(*Trace)
+	return t
+}
+
+// Enabled reports whether the request of ctx is traced, to skip building
+// details nobody reads
+func Enabled(ctx context.Context) bool {
+	return From(ctx) != nil
+}
+
+// Add records a step for the request of ctx, if it is traced
+func Add(ctx context.Context, stage, format string, args ...any) {
+	if t := From(ctx); t != nil {
+		t.Add(stage, fmt.Sprintf(format, args...))
+	}
+}
+
+// Add records a step
+func (t *Trace) Add(stage, detail string) {
+	at := time.Since(t.start).Round(time.Microsecond).String()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.steps = append(t.steps, Step{At: at, Stage: stage, Detail: detail})
+}
+
+// Steps returns the steps recorded so far
+func (t *Trace) Steps() []Step {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]Step(nil), t.steps...)
+}
@@ -0,0 +1,182 @@
+package transform
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/vars"
+)
+
+// DefaultMaxBodySize caps bodies read for transformation when no limit is configured
+const DefaultMaxBodySize = 1 << 20
+
+var (
+	// ErrBodyTooLarge is returned when the request body exceeds the size cap
+	ErrBodyTooLarge = errors.New("request body too large to transform")
+
+	// ErrInvalidBody is returned when the body can't be parsed for its content type
+	ErrInvalidBody = errors.New("request body could not be parsed")
+)
+
+// BodyTransformer rewrites JSON and form request bodies before forwarding
+type BodyTransformer struct {
+	maxSize    int64
+	jsonSet    map[string]any
+	formSet    map[string]string
+	formRename map[string]string
+}
+
+// NewBodyTransformer creates a transformer from node configuration
+func NewBodyTransformer(cfg *config.BodyTransform) *BodyTransformer {
+	maxSize := int64(cfg.MaxSize)
+	if maxSize == 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	return &BodyTransformer{
+		maxSize:    maxSize,
+		jsonSet:    cfg.JSONSet,
+		formSet:    cfg.FormSet,
+		formRename: cfg.FormRename,
+	}
+}
+
+// Apply rewrites the request body in place according to its content type.
+// Bodies of other content types are left untouched.
+func (t *BodyTransformer) Apply(r *http.Request) error {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	var rewrite func([]byte, *http.Request) ([]byte, error)
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		if len(t.jsonSet) == 0 {
+			return nil
+		}
+		rewrite = t.rewriteJSON
+	case mediaType == "application/x-www-form-urlencoded":
+		if len(t.formSet) == 0 && len(t.formRename) == 0 {
+			return nil
+		}
+		rewrite = t.rewriteForm
+	default:
+		return nil
+	}
+
+	body, err := t.readBody(r)
+	if err != nil {
+		return err
+	}
+
+	body, err = rewrite(body, r)
+	if err != nil {
+		return err
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+	return nil
+}
+
+// readBody reads the whole request body, enforcing the size cap
+func (t *BodyTransformer) readBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+	if r.ContentLength > t.maxSize {
+		return nil, ErrBodyTooLarge
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, t.maxSize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	if int64(len(body)) > t.maxSize {
+		return nil, ErrBodyTooLarge
+	}
+	return body, nil
+}
+
+// rewriteJSON injects the configured fields into a JSON object body.
+// Keys may use dots to address nested objects, e.g. "client.id". Numbers
+// are kept as written, so large IDs don't lose precision as float64.
+func (t *BodyTransformer) rewriteJSON(body []byte, r *http.Request) ([]byte, error) {
+	doc := make(map[string]any)
+	if len(bytes.TrimSpace(body)) > 0 {
+		dec := json.NewDecoder(bytes.NewReader(body))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+		}
+		if _, err := dec.Token(); err != io.EOF {
+			return nil, fmt.Errorf("%w: data after the JSON object", ErrInvalidBody)
+		}
+	}
+	if doc == nil {
+		// A null body, treated like an empty one
+		doc = make(map[string]any)
+	}
+
+	for path, value := range t.jsonSet {
+		if s, ok := value.(string); ok {
+			value = vars.Expand(s, r, nil)
+		}
+		if err := setPath(doc, strings.Split(path, "."), value); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+		}
+	}
+
+	return json.Marshal(doc)
+}
+
+// setPath sets value at the nested key path, creating objects as needed
+func setPath(doc map[string]any, keys []string, value any) error {
+	for i, key := range keys[:len(keys)-1] {
+		next, ok := doc[key]
+		if !ok {
+			child := make(map[string]any)
+			doc[key] = child
+			doc = child
+			continue
+		}
+		child, ok := next.(map[string]any)
+		if !ok {
+			return fmt.Errorf("field %s is not an object", strings.Join(keys[:i+1], "."))
+		}
+		doc = child
+	}
+	doc[keys[len(keys)-1]] = value
+	return nil
+}
+
+// rewriteForm renames and sets fields in a URL-encoded form body
+func (t *BodyTransformer) rewriteForm(body []byte, r *http.Request) ([]byte, error) {
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+
+	for from, to := range t.formRename {
+		if values, ok := form[from]; ok {
+			delete(form, from)
+			form[to] = values
+		}
+	}
+
+	for key, value := range t.formSet {
+		form.Set(key, vars.Expand(value, r, nil))
+	}
+
+	return []byte(form.Encode()), nil
+}
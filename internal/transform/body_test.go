@@ -0,0 +1,47 @@
+package transform
+
+import (
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+func TestRewriteJSONKeepsNumbers(t *testing.T) {
+	bt := NewBodyTransformer(&config.BodyTransform{
+		JSONSet: map[string]any{"client.id": "fwd"},
+	})
+
+	tests := []struct {
+		body string
+		want string
+		err  error
+	}{
+		{`{"id":9007199254740993,"price":0.1000000000000000055511}`, `{"client":{"id":"fwd"},"id":9007199254740993,"price":0.1000000000000000055511}`, nil},
+		{`{"n":1e400}`, `{"client":{"id":"fwd"},"n":1e400}`, nil},
+		{``, `{"client":{"id":"fwd"}}`, nil},
+		{`null`, `{"client":{"id":"fwd"}}`, nil},
+		{`{"a":1} {"b":2}`, ``, ErrInvalidBody},
+		{`[1,2]`, ``, ErrInvalidBody},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+
+		err := bt.Apply(req)
+		if !errors.Is(err, tt.err) {
+			t.Errorf("body %q: error %v, want %v", tt.body, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		got, _ := io.ReadAll(req.Body)
+		if string(got) != tt.want {
+			t.Errorf("body %q: rewritten to %s, want %s", tt.body, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package transform
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/simman/go-forwarder/internal/config"
+)
+
+// RequestEncoder decompresses gzip request bodies for backends that can't
+// read them, or compresses large bodies for backends that accept gzip
+type RequestEncoder struct {
+	decompress bool
+	maxSize    int64
+	compress   bool
+	minSize    int64
+	level      int
+}
+
+// NewRequestEncoder creates an encoder from node configuration
+func NewRequestEncoder(cfg *config.RequestEncoding) *RequestEncoder {
+	return &RequestEncoder{
+		decompress: cfg.Decompress,
+		maxSize:    int64(cfg.MaxSize),
+		compress:   cfg.Compress,
+		minSize:    int64(cfg.MinSize),
+		level:      cfg.Level,
+	}
+}
+
+// Decode replaces a gzip request body with its content, read whole so the
+// backend gets a Content-Length. It reports whether the body was
+// decompressed. Bodies with other encodings are left untouched.
+func (e *RequestEncoder) Decode(r *http.Request) (bool, error) {
+	if !e.decompress || !isGzip(r.Header.Get("Content-Encoding")) {
+		return false, nil
+	}
+	if r.Body == nil || r.Body == http.NoBody {
+		r.Header.Del("Content-Encoding")
+		return false, nil
+	}
+	defer r.Body.Close()
+
+	zr, err := gzip.NewReader(r.Body)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	body, err := io.ReadAll(io.LimitReader(zr, e.maxSize+1))
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrInvalidBody, err)
+	}
+	if int64(len(body)) > e.maxSize {
+		return false, ErrBodyTooLarge
+	}
+
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	r.Header.Del("Content-Encoding")
+	r.Header.Del("Transfer-Encoding")
+	r.TransferEncoding = nil
+	return true, nil
+}
+
+// Encode compresses a request body without Content-Encoding while it is
+// forwarded. Bodies of unknown length count as large. The compressed
+// length isn't known up front, so the body is sent chunked. It reports
+// whether the body is compressed.
+func (e *RequestEncoder) Encode(r *http.Request) bool {
+	if !e.compress || r.Body == nil || r.Body == http.NoBody || r.Header.Get("Content-Encoding") != "" {
+		return false
+	}
+	if r.ContentLength >= 0 && r.ContentLength < e.minSize {
+		return false
+	}
+
+	body := r.Body
+	pr, pw := io.Pipe()
+	go func() {
+		defer body.Close()
+		zw, _ := gzip.NewWriterLevel(pw, e.level)
+		_, err := io.Copy(zw, body)
+		if err == nil {
+			err = zw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	r.Body = pr
+	r.ContentLength = -1
+	r.Header.Del("Content-Length")
+	r.Header.Set("Content-Encoding", "gzip")
+	return true
+}
+
+// isGzip reports whether a Content-Encoding value is gzip alone
+func isGzip(encoding string) bool {
+	encoding = strings.ToLower(strings.TrimSpace(encoding))
+	return encoding == "gzip" || encoding == "x-gzip"
+}
@@ -0,0 +1,172 @@
+package tunnel
+
+import (
+	"sync"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+const (
+	// fairQuantum is the most bytes a client sends per turn
+	fairQuantum = 16 * 1024
+
+	// fairBurst is how far a scheduler may fall behind its bandwidth, so
+	// a quiet period doesn't turn into a burst
+	fairBurst = 50 * time.Millisecond
+)
+
+var (
+	fairBytesTotal = metrics.NewCounterVec(
+		"forwarder_tunnel_fair_bytes_total",
+		"Bytes relayed through fair-queued tunnels, per client",
+		"proxy", "client", "direction",
+	)
+	fairClients = metrics.NewGaugeVec(
+		"forwarder_tunnel_fair_clients",
+		"Clients waiting for their share of an upstream's bandwidth",
+		"proxy", "direction",
+	)
+)
+
+// Fairness shares the bandwidth of one upstream between the clients of
+// the tunnels through it, in each direction
+type Fairness struct {
+	Up   *Scheduler // client -> upstream
+	Down *Scheduler // upstream -> client
+}
+
+// NewFairness creates schedulers for an upstream named name that carries
+// rate bytes per second in each direction
+func NewFairness(name string, rate int64) *Fairness {
+	return &Fairness{
+		Up:   NewScheduler(name, "up", rate),
+		Down: NewScheduler(name, "down", rate),
+	}
+}
+
+// Scheduler shares a fixed bandwidth between clients by deficit round
+// robin: clients with data to send take turns, and each turn lets a
+// client send up to fairQuantum bytes. A client with many or busy
+// tunnels gets the same share as any other client waiting to send.
+type Scheduler struct {
+	name      string
+	direction string
+	rate      float64 // bytes per second
+
+	mu      sync.Mutex
+	flows   map[string]*flow
+	active  []*flow   // clients waiting to send, in turn order
+	running bool      // a goroutine is handing out turns
+	free    time.Time // when the bandwidth is next free
+}
+
+// flow is one client waiting to send
+type flow struct {
+	client  string
+	deficit int
+	waiting []*grant
+	queued  bool // in active, or being served
+}
+
+// grant is a write waiting for its turn
+type grant struct {
+	n        int
+	ready    chan struct{}
+	canceled bool
+}
+
+// NewScheduler creates a scheduler for rate bytes per second
+func NewScheduler(name, direction string, rate int64) *Scheduler {
+	return &Scheduler{
+		name:      name,
+		direction: direction,
+		rate:      float64(rate),
+		flows:     make(map[string]*flow),
+	}
+}
+
+// Wait blocks until client may send n bytes, at most fairQuantum, and
+// reports whether it may. It gives up when done is closed.
+func (s *Scheduler) Wait(client string, n int, done <-chan struct{}) bool {
+	g := &grant{n: n, ready: make(chan struct{})}
+
+	s.mu.Lock()
+	f, ok := s.flows[client]
+	if !ok {
+		f = &flow{client: client}
+		s.flows[client] = f
+	}
+	f.waiting = append(f.waiting, g)
+	if !f.queued {
+		f.queued = true
+		s.active = append(s.active, f)
+		fairClients.With(s.name, s.direction).Inc()
+	}
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-g.ready:
+		fairBytesTotal.With(s.name, client, s.direction).Add(float64(n))
+		return true
+	case <-done:
+		s.mu.Lock()
+		g.canceled = true
+		s.mu.Unlock()
+		return false
+	}
+}
+
+// run hands out turns until no client is waiting
+func (s *Scheduler) run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for len(s.active) > 0 {
+		f := s.active[0]
+		s.active = s.active[1:]
+		f.deficit += fairQuantum
+
+		for len(f.waiting) > 0 {
+			g := f.waiting[0]
+			if g.canceled {
+				f.waiting = f.waiting[1:]
+				continue
+			}
+			if g.n > f.deficit {
+				break
+			}
+			f.deficit -= g.n
+			f.waiting = f.waiting[1:]
+
+			// Pace writes to the bandwidth, other clients queue up
+			// behind this one meanwhile
+			now := time.Now()
+			if s.free.Before(now.Add(-fairBurst)) {
+				s.free = now.Add(-fairBurst)
+			}
+			wait := s.free.Sub(now)
+			s.free = s.free.Add(time.Duration(float64(g.n) / s.rate * float64(time.Second)))
+			if wait > 0 {
+				s.mu.Unlock()
+				time.Sleep(wait)
+				s.mu.Lock()
+			}
+			close(g.ready)
+		}
+
+		if len(f.waiting) > 0 {
+			s.active = append(s.active, f)
+			continue
+		}
+		f.queued = false
+		f.deficit = 0
+		delete(s.flows, f.client)
+		fairClients.With(s.name, s.direction).Dec()
+	}
+	s.running = false
+}
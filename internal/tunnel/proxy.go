@@ -0,0 +1,384 @@
+package tunnel
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/dialer"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/netutil"
+	"github.com/simman/go-forwarder/internal/proxyauth"
+)
+
+// maxDrainBody is the largest error body read to keep a proxy connection
+const maxDrainBody = 4 * 1024
+
+var (
+	proxyConnects = metrics.NewCounterVec(
+		"forwarder_proxy_connects_total",
+		"CONNECT requests sent to upstream proxies by whether the connection came from the pool",
+		"proxy", "pooled",
+	)
+	proxyIdleConns = metrics.NewGaugeVec(
+		"forwarder_proxy_idle_conns",
+		"Connections to upstream proxies kept ready for the next CONNECT",
+		"proxy",
+	)
+)
+
+// ProxyOptions controls how connections to upstream proxies are pooled
+type ProxyOptions struct {
+	Idle        int           // connections kept open and ready per proxy, 0 disables warming
+	IdleTimeout time.Duration // how long a ready connection may wait before it is closed
+	TLS         *tls.Config   // client config for https:// proxies
+}
+
+// ProxyPool opens CONNECT tunnels through upstream proxies. Every tunnel
+// consumes its connection, so the pool keeps a few connections per proxy
+// already dialed and, for https proxies, past the TLS handshake. A tunnel
+// then only waits for the CONNECT round trip. Connections whose CONNECT
+// was refused are reused when the proxy keeps them open.
+type ProxyPool struct {
+	opts ProxyOptions
+
+	mu      sync.Mutex
+	proxies map[string]*proxyConns
+	closed  bool
+	done    chan struct{}
+}
+
+// NewProxyPool creates a pool with the given options
+func NewProxyPool(opts ProxyOptions) *ProxyPool {
+	p := &ProxyPool{
+		opts:    opts,
+		proxies: make(map[string]*proxyConns),
+		done:    make(chan struct{}),
+	}
+	if opts.Idle > 0 && opts.IdleTimeout > 0 {
+		go p.reap()
+	}
+	return p
+}
+
+// Dial opens a tunnel to target through the proxy at proxyURL. Connections
+// to the proxy are opened with d.
+func (p *ProxyPool) Dial(ctx context.Context, d dialer.ContextDialer, proxyURL, target string) (net.Conn, error) {
+	proxy, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+
+	pc, err := p.get(proxy, d)
+	if err != nil {
+		return nil, err
+	}
+	return pc.connect(ctx, target)
+}
+
+// Close closes all ready connections and stops warming new ones
+func (p *ProxyPool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return
+	}
+	p.closed = true
+	close(p.done)
+	for _, pc := range p.proxies {
+		pc.close()
+	}
+}
+
+// get returns the connection set for a proxy and dial policy
+func (p *ProxyPool) get(proxy *url.URL, d dialer.ContextDialer) (*proxyConns, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, errors.New("proxy pool closed")
+	}
+
+	key := proxy.String() + "|" + dialer.KeyOf(d)
+	pc, ok := p.proxies[key]
+	if !ok {
+		pc = &proxyConns{
+			pool:   p,
+			proxy:  proxy,
+			addr:   netutil.URLAddr(proxy),
+			dialer: d,
+			label:  proxy.Host,
+		}
+		p.proxies[key] = pc
+	}
+	return pc, nil
+}
+
+// reap periodically closes ready connections that waited too long
+func (p *ProxyPool) reap() {
+	ticker := time.NewTicker(p.opts.IdleTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		sets := make([]*proxyConns, 0, len(p.proxies))
+		for _, pc := range p.proxies {
+			sets = append(sets, pc)
+		}
+		p.mu.Unlock()
+
+		for _, pc := range sets {
+			pc.expire()
+		}
+	}
+}
+
+// idleConn is a connection to a proxy waiting for its CONNECT
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// proxyConns holds the ready connections to one proxy
+type proxyConns struct {
+	pool   *ProxyPool
+	proxy  *url.URL
+	addr   string
+	dialer dialer.ContextDialer
+	label  string
+
+	mu      sync.Mutex
+	idle    []idleConn
+	warming int
+	closed  bool
+}
+
+// connect sends CONNECT for target, on a ready connection if there is one.
+// A ready connection the proxy has meanwhile closed is replaced by a fresh
+// one, since the failure says nothing about the target.
+func (pc *proxyConns) connect(ctx context.Context, target string) (net.Conn, error) {
+	conn := pc.take()
+	defer pc.warm()
+
+	if conn != nil {
+		proxyConnects.With(pc.label, "true").Inc()
+		tunnel, stale, err := pc.handshake(ctx, conn, target)
+		if err == nil || !stale {
+			return tunnel, err
+		}
+		log.Debug().Err(err).Str("proxy", pc.label).Msg("pooled proxy connection failed, dialing a new one")
+	}
+
+	conn, err := pc.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proxyConnects.With(pc.label, "false").Inc()
+	tunnel, _, err := pc.handshake(ctx, conn, target)
+	return tunnel, err
+}
+
+// dial opens a connection to the proxy, completing TLS for https proxies
+func (pc *proxyConns) dial(ctx context.Context) (net.Conn, error) {
+	conn, err := pc.dialer.DialContext(ctx, "tcp", pc.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+	if pc.proxy.Scheme != "https" {
+		return conn, nil
+	}
+
+	cfg := pc.pool.opts.TLS
+	if cfg == nil {
+		cfg = &tls.Config{}
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = pc.proxy.Hostname()
+
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed TLS handshake with proxy: %w", err)
+	}
+	return tlsConn, nil
+}
+
+// handshake sends CONNECT over conn and waits for the proxy's answer.
+// stale reports whether a failure happened before the proxy answered,
+// which on a pooled connection means the proxy dropped it meanwhile.
+func (pc *proxyConns) handshake(ctx context.Context, conn net.Conn, target string) (net.Conn, bool, error) {
+	// Bound the handshake by the context, then leave deadlines to the relay
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Unix(1, 0))
+	})
+	defer func() {
+		if stop() {
+			conn.SetDeadline(time.Time{})
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user := proxyauth.Userinfo(pc.proxy); user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, true, fmt.Errorf("failed to send CONNECT to proxy: %w", err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, true, fmt.Errorf("failed to read proxy response: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("proxy returned non-200 response: %s", resp.Status)
+		if stop() && pc.drain(resp) {
+			conn.SetDeadline(time.Time{})
+			pc.put(conn)
+		} else {
+			conn.Close()
+		}
+		return nil, false, err
+	}
+
+	// Bytes the target sent right after the proxy's answer are already buffered
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, false, nil
+	}
+	return conn, false, nil
+}
+
+// drain reads a small error body so the connection can carry another CONNECT
+func (pc *proxyConns) drain(resp *http.Response) bool {
+	defer resp.Body.Close()
+
+	if resp.Close || resp.ContentLength < 0 || resp.ContentLength > maxDrainBody {
+		return false
+	}
+	_, err := io.Copy(io.Discard, resp.Body)
+	return err == nil
+}
+
+// take returns the newest ready connection, or nil
+func (pc *proxyConns) take() net.Conn {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if len(pc.idle) == 0 {
+		return nil
+	}
+	last := pc.idle[len(pc.idle)-1]
+	pc.idle = pc.idle[:len(pc.idle)-1]
+	proxyIdleConns.With(pc.label).Set(float64(len(pc.idle)))
+	return last.conn
+}
+
+// put keeps conn ready for a later CONNECT, or closes it if the pool is full
+func (pc *proxyConns) put(conn net.Conn) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	if pc.closed || len(pc.idle) >= pc.pool.opts.Idle {
+		conn.Close()
+		return
+	}
+	pc.idle = append(pc.idle, idleConn{conn: conn, since: time.Now()})
+	proxyIdleConns.With(pc.label).Set(float64(len(pc.idle)))
+}
+
+// warm dials connections in the background until Idle are ready
+func (pc *proxyConns) warm() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	for !pc.closed && len(pc.idle)+pc.warming < pc.pool.opts.Idle {
+		pc.warming++
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), dialer.DefaultTimeout)
+			defer cancel()
+
+			conn, err := pc.dial(ctx)
+
+			pc.mu.Lock()
+			pc.warming--
+			pc.mu.Unlock()
+
+			if err != nil {
+				log.Debug().Err(err).Str("proxy", pc.label).Msg("failed to warm proxy connection")
+				return
+			}
+			pc.put(conn)
+		}()
+	}
+}
+
+// expire closes ready connections older than the idle timeout
+func (pc *proxyConns) expire() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	cutoff := time.Now().Add(-pc.pool.opts.IdleTimeout)
+	kept := pc.idle[:0]
+	for _, ic := range pc.idle {
+		if ic.since.Before(cutoff) {
+			ic.conn.Close()
+			continue
+		}
+		kept = append(kept, ic)
+	}
+	pc.idle = kept
+	proxyIdleConns.With(pc.label).Set(float64(len(pc.idle)))
+}
+
+// close closes all ready connections and stops warming
+func (pc *proxyConns) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.closed = true
+	for _, ic := range pc.idle {
+		ic.conn.Close()
+	}
+	pc.idle = nil
+	proxyIdleConns.With(pc.label).Set(0)
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
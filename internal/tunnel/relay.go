@@ -0,0 +1,168 @@
+package tunnel
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+// bufferSize is the copy buffer size used by each relay direction
+const bufferSize = 32 * 1024
+
+var relayGoroutines = metrics.NewGaugeVec(
+	"forwarder_relay_goroutines",
+	"Goroutines copying the data of open relays",
+)
+
+// Go runs fn in a goroutine counted as a relay goroutine
+func Go(fn func()) {
+	relayGoroutines.With().Inc()
+	go func() {
+		defer relayGoroutines.With().Dec()
+		fn()
+	}()
+}
+
+// Options controls deadlines applied to each direction of a relay. A zero
+// timeout disables the corresponding deadline.
+type Options struct {
+	ClientReadTimeout    time.Duration // idle time allowed between reads from the client
+	ClientWriteTimeout   time.Duration // time allowed for a single write to the client
+	UpstreamReadTimeout  time.Duration // idle time allowed between reads from the upstream
+	UpstreamWriteTimeout time.Duration // time allowed for a single write to the upstream
+
+	Fair   *Fairness // shares the upstream's bandwidth between clients, nil disables
+	Client string    // client the relay's bytes count against in Fair
+
+	Progress *Progress // counts bytes while the relay runs, may be nil
+}
+
+// Progress counts the bytes a relay has copied so far
+type Progress struct {
+	Up   atomic.Int64 // client -> upstream
+	Down atomic.Int64 // upstream -> client
+}
+
+// Stats reports how a relay ended
+type Stats struct {
+	BytesUp   int64 // client -> upstream
+	BytesDown int64 // upstream -> client
+	Err       error // first error that ended the relay, nil on clean close
+}
+
+// Relay copies data between client and upstream in both directions until
+// either side closes, errors, or hits a deadline. Both connections are
+// closed before Relay returns.
+func Relay(client, upstream net.Conn, opts Options) Stats {
+	type result struct {
+		n   int64
+		err error
+	}
+
+	// Hijacked connections may still carry the HTTP server's deadlines
+	client.SetDeadline(time.Time{})
+	upstream.SetDeadline(time.Time{})
+
+	upCh := make(chan result, 1)
+	downCh := make(chan result, 1)
+
+	// Writes waiting for their fair share give up once the relay ends
+	done := make(chan struct{})
+	var upWait, downWait func(int) bool
+	if opts.Fair != nil {
+		upWait = func(n int) bool { return opts.Fair.Up.Wait(opts.Client, n, done) }
+		downWait = func(n int) bool { return opts.Fair.Down.Wait(opts.Client, n, done) }
+	}
+	var upCount, downCount *atomic.Int64
+	if opts.Progress != nil {
+		upCount, downCount = &opts.Progress.Up, &opts.Progress.Down
+	}
+
+	Go(func() {
+		n, err := copyWithDeadlines(upstream, client, opts.ClientReadTimeout, opts.UpstreamWriteTimeout, upWait, upCount)
+		upCh <- result{n, err}
+	})
+	Go(func() {
+		n, err := copyWithDeadlines(client, upstream, opts.UpstreamReadTimeout, opts.ClientWriteTimeout, downWait, downCount)
+		downCh <- result{n, err}
+	})
+
+	// Wait for the first direction to finish, then close both sides so the
+	// other direction unblocks
+	var stats Stats
+	select {
+	case r := <-upCh:
+		stats.BytesUp, stats.Err = r.n, r.err
+		close(done)
+		client.Close()
+		upstream.Close()
+		stats.BytesDown = (<-downCh).n
+	case r := <-downCh:
+		stats.BytesDown, stats.Err = r.n, r.err
+		close(done)
+		client.Close()
+		upstream.Close()
+		stats.BytesUp = (<-upCh).n
+	}
+
+	return stats
+}
+
+// copyWithDeadlines copies from src to dst, refreshing the read deadline
+// before every read and the write deadline before every write. With a
+// wait func, data is written in turns of at most fairQuantum bytes, each
+// once wait allows it. Written bytes are added to count, if set, as they
+// go.
+func copyWithDeadlines(dst, src net.Conn, readTimeout, writeTimeout time.Duration, wait func(int) bool, count *atomic.Int64) (int64, error) {
+	buf := make([]byte, bufferSize)
+	var written int64
+
+	for {
+		if readTimeout > 0 {
+			src.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+		nr, rerr := src.Read(buf)
+
+		for chunk := buf[:nr]; len(chunk) > 0; {
+			n := len(chunk)
+			if wait != nil {
+				n = min(n, fairQuantum)
+				if !wait(n) {
+					return written, net.ErrClosed
+				}
+			}
+			if writeTimeout > 0 {
+				dst.SetWriteDeadline(time.Now().Add(writeTimeout))
+			}
+			nw, werr := dst.Write(chunk[:n])
+			written += int64(nw)
+			if count != nil {
+				count.Add(int64(nw))
+			}
+			if werr != nil {
+				return written, werr
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+			chunk = chunk[n:]
+		}
+
+		if rerr != nil {
+			if rerr == io.EOF {
+				return written, nil
+			}
+			return written, rerr
+		}
+	}
+}
+
+// IsTimeout reports whether err was caused by a relay deadline
+func IsTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
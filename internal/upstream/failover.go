@@ -0,0 +1,239 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+)
+
+var (
+	backendHealthy = metrics.NewGaugeVec(
+		"forwarder_backend_healthy",
+		"Whether a primary or standby backend of a failover node is healthy (1) or not (0)",
+		"node", "backend",
+	)
+	failoverActive = metrics.NewGaugeVec(
+		"forwarder_failover_active",
+		"Whether a node sends its traffic to its standby backends (1) or its primaries (0)",
+		"node",
+	)
+	failovers = metrics.NewCounterVec(
+		"forwarder_failovers_total",
+		"Number of times a node switched between its primary and standby backends",
+		"node", "to",
+	)
+)
+
+// FailoverOptions configures health probing and failing back
+type FailoverOptions struct {
+	Interval  time.Duration // time between probe rounds
+	Timeout   time.Duration // dial timeout of a single probe
+	FailAfter int           // consecutive failed probes marking a backend unhealthy
+	FailBack  time.Duration // how long a primary must stay healthy before traffic returns
+
+	// Dial opens probe connections, defaults to a plain net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// backendHealth tracks probe results for one backend
+type backendHealth struct {
+	addr     string
+	healthy  bool
+	failures int       // consecutive failed probes
+	since    time.Time // start of the current run of successful probes, zero after a failure
+}
+
+// Failover probes the primary and standby backends of a node and decides
+// which set serves it. Standbys take over once every primary is unhealthy,
+// as long as one of them is healthy, and primaries take back over once one
+// of them has passed every probe for the fail-back window.
+type Failover struct {
+	node      string
+	opts      FailoverOptions
+	mu        sync.RWMutex
+	primaries []*backendHealth
+	standbys  []*backendHealth
+	standby   bool
+	stopCh    chan struct{}
+	stopped   sync.Once
+}
+
+// NewFailover creates a failover for the given backends. Every backend
+// counts as healthy until probes say otherwise, so the primaries are used
+// first.
+func NewFailover(node string, primaries, standbys []string, opts FailoverOptions) *Failover {
+	f := &Failover{
+		node:   node,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+	}
+
+	now := time.Now()
+	for _, addr := range primaries {
+		f.primaries = append(f.primaries, &backendHealth{addr: addr, healthy: true, since: now})
+	}
+	for _, addr := range standbys {
+		f.standbys = append(f.standbys, &backendHealth{addr: addr, healthy: true, since: now})
+	}
+	failoverActive.With(node).Set(0)
+
+	return f
+}
+
+// Start begins probing in the background
+func (f *Failover) Start() {
+	go f.run()
+}
+
+// Stop stops probing
+func (f *Failover) Stop() {
+	f.stopped.Do(func() {
+		close(f.stopCh)
+		for _, b := range f.backends() {
+			backendHealthy.Delete(f.node, b.addr)
+		}
+		failoverActive.Delete(f.node)
+	})
+}
+
+// OnStandby reports whether the standby backends serve the node
+func (f *Failover) OnStandby() bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.standby
+}
+
+// backends returns the primaries followed by the standbys
+func (f *Failover) backends() []*backendHealth {
+	return append(append([]*backendHealth(nil), f.primaries...), f.standbys...)
+}
+
+// run probes all backends on every tick until stopped
+func (f *Failover) run() {
+	f.probeAll()
+
+	ticker := time.NewTicker(f.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			f.probeAll()
+		case <-f.stopCh:
+			return
+		}
+	}
+}
+
+// probeAll probes every backend concurrently and re-evaluates which set
+// serves the node
+func (f *Failover) probeAll() {
+	dial := f.opts.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	backends := f.backends()
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, b := range backends {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), f.opts.Timeout)
+			defer cancel()
+			conn, err := dial(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			errs[i] = err
+		}(i, b.addr)
+	}
+	wg.Wait()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	for i, b := range backends {
+		if err := errs[i]; err != nil {
+			b.failures++
+			b.since = time.Time{}
+			if b.healthy && b.failures >= f.opts.FailAfter {
+				log.Warn().Err(err).Str("node", f.node).Str("backend", b.addr).Msg("backend unhealthy")
+				b.healthy = false
+			}
+		} else {
+			if !b.healthy {
+				log.Info().Str("node", f.node).Str("backend", b.addr).Msg("backend healthy again")
+			}
+			b.failures = 0
+			b.healthy = true
+			if b.since.IsZero() {
+				b.since = now
+			}
+		}
+		if b.healthy {
+			backendHealthy.With(f.node, b.addr).Set(1)
+		} else {
+			backendHealthy.With(f.node, b.addr).Set(0)
+		}
+	}
+
+	f.choose(now)
+}
+
+// choose fails over when every primary is unhealthy and a standby isn't,
+// and fails back once a primary has been stable for the fail-back window
+func (f *Failover) choose(now time.Time) {
+	if !f.standby {
+		if anyHealthy(f.primaries) || !anyHealthy(f.standbys) {
+			return
+		}
+		log.Warn().Str("node", f.node).Msg("all primary backends unhealthy, failing over to standby")
+		f.switchTo(true)
+		return
+	}
+
+	if anyStable(f.primaries, now, f.opts.FailBack) {
+		log.Info().Str("node", f.node).Dur("stable", f.opts.FailBack).Msg("primary backends stable, failing back")
+		f.switchTo(false)
+	}
+}
+
+// switchTo makes the standby or primary backends serve the node
+func (f *Failover) switchTo(standby bool) {
+	f.standby = standby
+	if standby {
+		failoverActive.With(f.node).Set(1)
+		failovers.With(f.node, "standby").Inc()
+	} else {
+		failoverActive.With(f.node).Set(0)
+		failovers.With(f.node, "primary").Inc()
+	}
+}
+
+// anyHealthy reports whether one of backends is healthy
+func anyHealthy(backends []*backendHealth) bool {
+	for _, b := range backends {
+		if b.healthy {
+			return true
+		}
+	}
+	return false
+}
+
+// anyStable reports whether one of backends has passed every probe for at
+// least window
+func anyStable(backends []*backendHealth, now time.Time, window time.Duration) bool {
+	for _, b := range backends {
+		if b.healthy && !b.since.IsZero() && now.Sub(b.since) >= window {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,218 @@
+package upstream
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/simman/go-forwarder/internal/metrics"
+	"github.com/simman/go-forwarder/internal/netutil"
+)
+
+var (
+	proxyLatency = metrics.NewGaugeVec(
+		"forwarder_proxy_latency_seconds",
+		"Smoothed connect latency of each upstream proxy",
+		"node", "proxy",
+	)
+	proxyHealthy = metrics.NewGaugeVec(
+		"forwarder_proxy_healthy",
+		"Whether the last probe of an upstream proxy succeeded (1) or failed (0)",
+		"node", "proxy",
+	)
+	proxySwitches = metrics.NewCounterVec(
+		"forwarder_proxy_switches_total",
+		"Number of times a node switched its preferred upstream proxy",
+		"node",
+	)
+)
+
+// smoothing is the weight of a new probe in the latency moving average
+const smoothing = 0.3
+
+// SelectorOptions configures probing and switching behavior
+type SelectorOptions struct {
+	Interval   time.Duration // time between probe rounds
+	Timeout    time.Duration // dial timeout of a single probe
+	Hysteresis time.Duration // margin a proxy must beat the current one by
+
+	// Dial opens probe connections, defaults to a plain net.Dialer
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// proxyStats tracks probe results for one proxy
+type proxyStats struct {
+	url     string
+	label   string // url without the password, for logs and metrics
+	addr    string
+	latency time.Duration
+	healthy bool
+	probed  bool
+}
+
+// Selector periodically probes a set of upstream proxies and prefers the
+// healthy one with the lowest connect latency
+type Selector struct {
+	node    string
+	opts    SelectorOptions
+	mu      sync.RWMutex
+	proxies []*proxyStats
+	current int
+	stopCh  chan struct{}
+	stopped sync.Once
+}
+
+// NewSelector creates a selector for the given proxy URLs. The first proxy is
+// used until probes say otherwise.
+func NewSelector(node string, proxies []string, opts SelectorOptions) *Selector {
+	s := &Selector{
+		node:   node,
+		opts:   opts,
+		stopCh: make(chan struct{}),
+	}
+
+	for _, p := range proxies {
+		stats := &proxyStats{url: p, label: p, healthy: true}
+		if u, err := url.Parse(p); err == nil {
+			stats.addr = netutil.URLAddr(u)
+			stats.label = u.Redacted()
+		}
+		s.proxies = append(s.proxies, stats)
+	}
+
+	return s
+}
+
+// Start begins probing in the background
+func (s *Selector) Start() {
+	go s.run()
+}
+
+// Stop stops probing
+func (s *Selector) Stop() {
+	s.stopped.Do(func() {
+		close(s.stopCh)
+		for _, p := range s.proxies {
+			proxyLatency.Delete(s.node, p.label)
+			proxyHealthy.Delete(s.node, p.label)
+		}
+	})
+}
+
+// Current returns the currently preferred proxy URL
+func (s *Selector) Current() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.proxies[s.current].url
+}
+
+// run probes all proxies on every tick until stopped
+func (s *Selector) run() {
+	s.probeAll()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.probeAll()
+		case <-s.stopCh:
+			return
+		}
+	}
+}
+
+// probeAll probes every proxy concurrently and re-evaluates the choice
+func (s *Selector) probeAll() {
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+
+	dial := s.opts.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+
+	results := make([]result, len(s.proxies))
+	var wg sync.WaitGroup
+	for i, p := range s.proxies {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), s.opts.Timeout)
+			defer cancel()
+			start := time.Now()
+			conn, err := dial(ctx, "tcp", addr)
+			if err == nil {
+				conn.Close()
+			}
+			results[i] = result{latency: time.Since(start), err: err}
+		}(i, p.addr)
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, p := range s.proxies {
+		r := results[i]
+		if r.err != nil {
+			if p.healthy {
+				log.Warn().Err(r.err).Str("node", s.node).Str("proxy", p.label).Msg("upstream proxy probe failed")
+			}
+			p.healthy = false
+			proxyHealthy.With(s.node, p.label).Set(0)
+			continue
+		}
+
+		if !p.probed {
+			p.latency = r.latency
+		} else {
+			p.latency = time.Duration(smoothing*float64(r.latency) + (1-smoothing)*float64(p.latency))
+		}
+		p.probed = true
+		p.healthy = true
+		proxyHealthy.With(s.node, p.label).Set(1)
+		proxyLatency.With(s.node, p.label).Set(p.latency.Seconds())
+	}
+
+	s.choose()
+}
+
+// choose switches to the best proxy when the current one is unhealthy or a
+// healthy proxy beats it by more than the hysteresis margin
+func (s *Selector) choose() {
+	best := -1
+	for i, p := range s.proxies {
+		if !p.healthy || !p.probed {
+			continue
+		}
+		if best < 0 || p.latency < s.proxies[best].latency {
+			best = i
+		}
+	}
+
+	if best < 0 || best == s.current {
+		return
+	}
+
+	cur := s.proxies[s.current]
+	if cur.healthy && cur.probed && s.proxies[best].latency+s.opts.Hysteresis >= cur.latency {
+		return
+	}
+
+	log.Info().
+		Str("node", s.node).
+		Str("from", cur.label).
+		Str("to", s.proxies[best].label).
+		Dur("latency", s.proxies[best].latency).
+		Msg("switching upstream proxy")
+
+	s.current = best
+	proxySwitches.With(s.node).Inc()
+}
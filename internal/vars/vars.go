@@ -0,0 +1,167 @@
+// Package vars expands {placeholders} in config strings with values from
+// the request being handled: target URLs, header values, redirects, body
+// transforms and error pages share one set of variables.
+package vars
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+type contextKey struct{}
+
+// With returns ctx carrying the regex captures of the route the request
+// matched, read by {re.name} and {re.N}
+func With(ctx context.Context, captures map[string]string) context.Context {
+	if len(captures) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, contextKey{}, captures)
+}
+
+// Captures returns the regex captures ctx carries
+func Captures(ctx context.Context) map[string]string {
+	captures, _ := ctx.Value(contextKey{}).(map[string]string)
+	return captures
+}
+
+// Expand replaces {placeholders} in tmpl with values from the request and
+// from local, which holds variables of the caller such as {node} or
+// {status}. Supported request variables:
+//
+//	{host} {hostname} {path} {query} {request_uri} {method} {scheme}
+//	{remote_addr} {client_ip} {header.Name} {query.name} {cookie.name}
+//	{re.name} {re.N}
+//
+// Unknown placeholders are left untouched, so JSON and other text with
+// braces passes through.
+func Expand(tmpl string, r *http.Request, local map[string]string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+
+	var b strings.Builder
+	for {
+		// The innermost braces name a variable, so text like JSON around
+		// a placeholder is kept
+		end := strings.IndexByte(tmpl, '}')
+		if end < 0 {
+			break
+		}
+		start := strings.LastIndexByte(tmpl[:end], '{')
+		if start < 0 {
+			b.WriteString(tmpl[:end+1])
+			tmpl = tmpl[end+1:]
+			continue
+		}
+
+		b.WriteString(tmpl[:start])
+		name := tmpl[start+1 : end]
+		if v, ok := local[name]; ok {
+			b.WriteString(v)
+		} else if v, ok := lookup(name, r); ok {
+			b.WriteString(v)
+		} else {
+			b.WriteString(tmpl[start : end+1])
+		}
+		tmpl = tmpl[end+1:]
+	}
+	b.WriteString(tmpl)
+
+	return b.String()
+}
+
+// Check reports placeholders in tmpl that Expand can't resolve. local
+// names the caller's variables.
+func Check(tmpl string, local ...string) error {
+	rest := tmpl
+	for {
+		end := strings.IndexByte(rest, '}')
+		if end < 0 {
+			break
+		}
+		if start := strings.LastIndexByte(rest[:end], '{'); start >= 0 {
+			if name := rest[start+1 : end]; !known(name, local) {
+				return fmt.Errorf("unknown variable {%s} in %q", name, tmpl)
+			}
+		}
+		rest = rest[end+1:]
+	}
+	if strings.Contains(rest, "{") {
+		return fmt.Errorf("unclosed { in %q", tmpl)
+	}
+	return nil
+}
+
+// known reports whether name is a request variable or one of local
+func known(name string, local []string) bool {
+	for _, l := range local {
+		if name == l {
+			return true
+		}
+	}
+	switch name {
+	case "host", "hostname", "path", "query", "request_uri", "method", "scheme", "remote_addr", "client_ip":
+		return true
+	}
+	for _, prefix := range []string{"header.", "query.", "cookie.", "re."} {
+		if key, ok := strings.CutPrefix(name, prefix); ok && key != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup resolves a single request variable
+func lookup(name string, r *http.Request) (string, bool) {
+	switch name {
+	case "host":
+		return r.Host, true
+	case "hostname":
+		if host, _, err := net.SplitHostPort(r.Host); err == nil {
+			return host, true
+		}
+		return r.Host, true
+	case "path":
+		return r.URL.Path, true
+	case "query":
+		return r.URL.RawQuery, true
+	case "request_uri":
+		return r.URL.RequestURI(), true
+	case "method":
+		return r.Method, true
+	case "scheme":
+		if r.TLS != nil {
+			return "https", true
+		}
+		return "http", true
+	case "remote_addr":
+		return r.RemoteAddr, true
+	case "client_ip":
+		if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			return host, true
+		}
+		return r.RemoteAddr, true
+	}
+
+	if key, ok := strings.CutPrefix(name, "header."); ok {
+		return r.Header.Get(key), true
+	}
+	if key, ok := strings.CutPrefix(name, "query."); ok {
+		return r.URL.Query().Get(key), true
+	}
+	if key, ok := strings.CutPrefix(name, "cookie."); ok {
+		if c, err := r.Cookie(key); err == nil {
+			return c.Value, true
+		}
+		return "", true
+	}
+	if key, ok := strings.CutPrefix(name, "re."); ok {
+		return Captures(r.Context())[key], true
+	}
+
+	return "", false
+}
@@ -0,0 +1,146 @@
+package testutil
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Response is one scripted backend answer
+type Response struct {
+	Status int           // default 200
+	Header http.Header   // added to the response
+	Body   string        // response body
+	Delay  time.Duration // wait before answering, cut short if the client goes away
+	Drop   bool          // close the connection without answering
+}
+
+// Request is a request a backend received
+type Request struct {
+	Method string
+	Host   string
+	URI    string
+	Header http.Header
+	Body   string
+}
+
+// Backend is a local HTTP server answering with scripted responses. It
+// plays the responses in order, then keeps answering with the last one,
+// or with an empty 200 when none were given. Every request is recorded.
+type Backend struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	script    []Response
+	requests  []Request
+	inFlight  int
+	maxFlight int
+}
+
+// NewBackend starts a backend that is closed when the test ends
+func NewBackend(tb testing.TB, responses ...Response) *Backend {
+	tb.Helper()
+
+	b := &Backend{script: responses}
+	b.Server = httptest.NewServer(http.HandlerFunc(b.serve))
+	tb.Cleanup(b.Close)
+	return b
+}
+
+// Addr returns the host:port of the backend, for a node's addr
+func (b *Backend) Addr() string {
+	return b.Listener.Addr().String()
+}
+
+// Script replaces the responses still to be played
+func (b *Backend) Script(responses ...Response) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.script = responses
+}
+
+// Requests returns the requests received so far, oldest first
+func (b *Backend) Requests() []Request {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]Request(nil), b.requests...)
+}
+
+// MaxInFlight returns the most requests the backend handled at once
+func (b *Backend) MaxInFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.maxFlight
+}
+
+func (b *Backend) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	b.mu.Lock()
+	b.requests = append(b.requests, Request{
+		Method: r.Method,
+		Host:   r.Host,
+		URI:    r.RequestURI,
+		Header: r.Header.Clone(),
+		Body:   string(body),
+	})
+	resp := Response{}
+	if len(b.script) > 0 {
+		resp = b.script[0]
+		if len(b.script) > 1 {
+			b.script = b.script[1:]
+		}
+	}
+	b.inFlight++
+	b.maxFlight = max(b.maxFlight, b.inFlight)
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.inFlight--
+		b.mu.Unlock()
+	}()
+
+	if resp.Delay > 0 {
+		timer := time.NewTimer(resp.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	if resp.Drop {
+		if hj, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hj.Hijack(); err == nil {
+				// Reset rather than close cleanly, like a crashed backend
+				if tcp, ok := conn.(*net.TCPConn); ok {
+					tcp.SetLinger(0)
+				}
+				conn.Close()
+				return
+			}
+		}
+		panic(http.ErrAbortHandler)
+	}
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	status := resp.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, resp.Body)
+}
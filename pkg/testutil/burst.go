@@ -0,0 +1,38 @@
+package testutil
+
+import "sync"
+
+// Burst calls do n times at once, released together once every call is
+// ready to go, and returns the results in call order. It exercises
+// concurrency limits, load shedding and queueing of a route.
+func Burst(n int, do func(i int) Result) []Result {
+	results := make([]Result, n)
+	start := make(chan struct{})
+
+	var ready, done sync.WaitGroup
+	ready.Add(n)
+	done.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer done.Done()
+			ready.Done()
+			<-start
+			results[i] = do(i)
+		}(i)
+	}
+	ready.Wait()
+	close(start)
+	done.Wait()
+
+	return results
+}
+
+// CountStatus returns how many results have each status, with failed
+// requests under 0
+func CountStatus(results []Result) map[int]int {
+	counts := make(map[int]int)
+	for _, r := range results {
+		counts[r.Status]++
+	}
+	return counts
+}
@@ -0,0 +1,141 @@
+package testutil
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/simman/go-forwarder/internal/config"
+	"github.com/simman/go-forwarder/internal/server"
+	"gopkg.in/yaml.v3"
+)
+
+// Config parses a YAML config. ${name} placeholders are replaced by vars
+// first, e.g. with backend addresses, and unknown ones are left as they
+// are. server.addr may be left out, the forwarder is served on a local
+// port picked by the test server.
+func Config(tb testing.TB, doc string, vars map[string]string) *config.Config {
+	tb.Helper()
+
+	doc = os.Expand(doc, func(name string) string {
+		if v, ok := vars[name]; ok {
+			return v
+		}
+		return "${" + name + "}"
+	})
+	data, err := withServerAddr([]byte(doc))
+	if err != nil {
+		tb.Fatalf("invalid test config: %v", err)
+	}
+
+	cfg, err := config.Parse(data)
+	if err != nil {
+		tb.Fatalf("invalid test config: %v", err)
+	}
+	return cfg
+}
+
+// withServerAddr sets server.addr to a local address unless the config
+// has one, which the forwarder requires even though it is not listened on
+func withServerAddr(data []byte) ([]byte, error) {
+	var doc map[string]any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		doc = make(map[string]any)
+	}
+	srv, _ := doc["server"].(map[string]any)
+	if srv == nil {
+		srv = make(map[string]any)
+		doc["server"] = srv
+	}
+	if _, ok := srv["addr"]; ok {
+		return data, nil
+	}
+	srv["addr"] = "127.0.0.1:0"
+	return yaml.Marshal(doc)
+}
+
+// Forwarder is a forwarder serving a config on a local port. Requests go
+// through the same middleware, routing and forwarding as in production,
+// but the listeners, admin API and config watcher are not started.
+type Forwarder struct {
+	*httptest.Server
+	srv *server.Server
+}
+
+// NewForwarder starts a forwarder for cfg that is stopped when the test
+// ends
+func NewForwarder(tb testing.TB, cfg *config.Config) *Forwarder {
+	tb.Helper()
+
+	srv, err := server.NewServer(cfg)
+	if err != nil {
+		tb.Fatalf("failed to create forwarder: %v", err)
+	}
+	f := &Forwarder{Server: httptest.NewServer(srv), srv: srv}
+	tb.Cleanup(func() {
+		f.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Stop(ctx)
+	})
+	return f
+}
+
+// Reload applies cfg as a config reload would
+func (f *Forwarder) Reload(tb testing.TB, cfg *config.Config) {
+	tb.Helper()
+
+	if err := f.srv.Reload(cfg); err != nil {
+		tb.Fatalf("failed to reload forwarder: %v", err)
+	}
+}
+
+// Result is a response read in full, or the error that prevented it
+type Result struct {
+	Status   int
+	Header   http.Header
+	Body     string
+	Duration time.Duration
+	Err      error
+}
+
+// NewRequest returns a request for the forwarder with the given Host
+func (f *Forwarder) NewRequest(method, host, path string, body io.Reader) *http.Request {
+	req, err := http.NewRequest(method, f.URL+path, body)
+	if err != nil {
+		panic(err)
+	}
+	req.Host = host
+	return req
+}
+
+// Do sends req and reads the whole response
+func (f *Forwarder) Do(req *http.Request) Result {
+	start := time.Now()
+	resp, err := f.Client().Do(req)
+	if err != nil {
+		return Result{Duration: time.Since(start), Err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return Result{
+		Status:   resp.StatusCode,
+		Header:   resp.Header,
+		Body:     string(body),
+		Duration: time.Since(start),
+		Err:      err,
+	}
+}
+
+// Get sends a GET for path with the given Host
+func (f *Forwarder) Get(host, path string) Result {
+	return f.Do(f.NewRequest(http.MethodGet, host, path, nil))
+}
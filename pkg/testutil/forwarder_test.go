@@ -0,0 +1,156 @@
+package testutil_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simman/go-forwarder/pkg/testutil"
+)
+
+func TestForwarderRoutesAndReloads(t *testing.T) {
+	blue := testutil.NewBackend(t, testutil.Response{Body: "blue"})
+	green := testutil.NewBackend(t, testutil.Response{Body: "green"})
+
+	doc := `
+services:
+  - name: main
+    forwarder:
+      nodes:
+        - name: app
+          addr: ${backend}
+          filter: {host: app.test}
+`
+	fwd := testutil.NewForwarder(t, testutil.Config(t, doc, map[string]string{"backend": blue.Addr()}))
+
+	res := fwd.Get("app.test", "/hello?x=1")
+	if res.Err != nil || res.Status != http.StatusOK || res.Body != "blue" {
+		t.Fatalf("before reload: status %d, body %q, error %v", res.Status, res.Body, res.Err)
+	}
+	reqs := blue.Requests()
+	if len(reqs) != 1 || reqs[0].URI != "/hello?x=1" {
+		t.Fatalf("blue backend received %+v, want one request for /hello?x=1", reqs)
+	}
+
+	// No route matches another host
+	if res := fwd.Get("other.test", "/"); res.Status != http.StatusBadGateway {
+		t.Fatalf("unmatched host: status %d, want %d", res.Status, http.StatusBadGateway)
+	}
+
+	fwd.Reload(t, testutil.Config(t, doc, map[string]string{"backend": green.Addr()}))
+	if res := fwd.Get("app.test", "/"); res.Body != "green" {
+		t.Fatalf("after reload: status %d, body %q, error %v", res.Status, res.Body, res.Err)
+	}
+	if n := len(blue.Requests()); n != 1 {
+		t.Fatalf("blue backend received %d requests after the reload, want none", n-1)
+	}
+}
+
+func TestForwarderShedding(t *testing.T) {
+	backend := testutil.NewBackend(t, testutil.Response{Body: "ok", Delay: 100 * time.Millisecond})
+
+	cfg := testutil.Config(t, `
+load_shedding: {threshold: 2}
+services:
+  - name: main
+    forwarder:
+      nodes:
+        - name: api
+          addr: ${backend}
+          filter: {host: api.test}
+`, map[string]string{"backend": backend.Addr()})
+	fwd := testutil.NewForwarder(t, cfg)
+
+	results := testutil.Burst(5, func(int) testutil.Result {
+		return fwd.Get("api.test", "/")
+	})
+	counts := testutil.CountStatus(results)
+	if counts[http.StatusServiceUnavailable] != 3 || counts[http.StatusOK] != 2 {
+		t.Fatalf("statuses %v, want 2 answered and 3 shed", counts)
+	}
+	if n := backend.MaxInFlight(); n > 2 {
+		t.Fatalf("backend handled %d requests at once, want at most 2", n)
+	}
+}
+
+func TestForwarderUpstreamProxy(t *testing.T) {
+	backend := testutil.NewBackend(t, testutil.Response{Body: "via proxy"})
+	proxy := testutil.NewProxy(t, "user", "secret")
+
+	cfg := testutil.Config(t, `
+services:
+  - name: main
+    forwarder:
+      nodes:
+        - name: egress
+          addr: ${backend}
+          proxy: ${proxy}
+          filter: {host: egress.test}
+`, map[string]string{"backend": backend.Addr(), "proxy": proxy.ProxyURL()})
+	fwd := testutil.NewForwarder(t, cfg)
+
+	res := fwd.Get("egress.test", "/out")
+	if res.Err != nil || res.Status != http.StatusOK || res.Body != "via proxy" {
+		t.Fatalf("status %d, body %q, error %v, targets %v", res.Status, res.Body, res.Err, proxy.Targets())
+	}
+	targets := proxy.Targets()
+	if len(targets) != 1 || !strings.Contains(targets[0], backend.Addr()) {
+		t.Fatalf("proxy targets %v, want one for %s", targets, backend.Addr())
+	}
+}
+
+func TestForwarderDroppedConnection(t *testing.T) {
+	backend := testutil.NewBackend(t, testutil.Response{Drop: true})
+
+	cfg := testutil.Config(t, `
+services:
+  - name: main
+    forwarder:
+      nodes:
+        - name: flaky
+          addr: ${backend}
+          filter: {host: flaky.test}
+`, map[string]string{"backend": backend.Addr()})
+	fwd := testutil.NewForwarder(t, cfg)
+
+	if res := fwd.Get("flaky.test", "/"); res.Status != http.StatusBadGateway {
+		t.Fatalf("status %d, error %v, want %d", res.Status, res.Err, http.StatusBadGateway)
+	}
+}
+
+func TestForwarderMaintenanceBypass(t *testing.T) {
+	backend := testutil.NewBackend(t, testutil.Response{Body: "ok"})
+
+	doc := `
+services:
+  - name: main
+    forwarder:
+      nodes:
+        - name: app
+          addr: ${backend}
+          filter: {host: app.test}
+          maintenance:
+            enabled: ${enabled}
+            allow_header: "X-Bypass=letmein"
+`
+	for _, enabled := range []string{"true", "false"} {
+		fwd := testutil.NewForwarder(t, testutil.Config(t, doc, map[string]string{"backend": backend.Addr(), "enabled": enabled}))
+
+		req := fwd.NewRequest(http.MethodGet, "app.test", "/", nil)
+		req.Header.Set("X-Bypass", "letmein")
+		if res := fwd.Do(req); res.Status != http.StatusOK {
+			t.Fatalf("maintenance %s: status %d, error %v", enabled, res.Status, res.Err)
+		}
+	}
+
+	// The backend never sees the bypass secret
+	for _, req := range backend.Requests() {
+		if v := req.Header.Get("X-Bypass"); v != "" {
+			t.Fatalf("backend received X-Bypass %q", v)
+		}
+	}
+	if n := len(backend.Requests()); n != 2 {
+		t.Fatalf("backend received %d requests, want 2", n)
+	}
+}
@@ -0,0 +1,136 @@
+package testutil
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Proxy is a local upstream HTTP proxy. It opens CONNECT tunnels and
+// relays requests in absolute form, and records the targets it was asked
+// for. With credentials set, requests without matching Basic
+// Proxy-Authorization are answered with 407.
+type Proxy struct {
+	*httptest.Server
+
+	username, password string
+
+	mu      sync.Mutex
+	targets []string
+}
+
+// NewProxy starts a proxy that is closed when the test ends. An empty
+// username accepts every request.
+func NewProxy(tb testing.TB, username, password string) *Proxy {
+	tb.Helper()
+
+	p := &Proxy{username: username, password: password}
+	p.Server = httptest.NewServer(http.HandlerFunc(p.serve))
+	tb.Cleanup(p.Close)
+	return p
+}
+
+// ProxyURL returns the proxy URL for a node's proxy setting, with the
+// credentials when set
+func (p *Proxy) ProxyURL() string {
+	u, _ := url.Parse(p.URL)
+	if p.username != "" {
+		u.User = url.UserPassword(p.username, p.password)
+	}
+	return u.String()
+}
+
+// Targets returns the host:port of every tunnel and the URL of every
+// relayed request, oldest first
+func (p *Proxy) Targets() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.targets...)
+}
+
+func (p *Proxy) serve(w http.ResponseWriter, r *http.Request) {
+	if p.username != "" && !p.authorized(r) {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="testutil"`)
+		http.Error(w, "proxy authentication required", http.StatusProxyAuthRequired)
+		return
+	}
+
+	target := r.URL.String()
+	if r.Method == http.MethodConnect {
+		target = r.Host
+	}
+	p.mu.Lock()
+	p.targets = append(p.targets, target)
+	p.mu.Unlock()
+
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "expected a request in absolute form", http.StatusBadRequest)
+		return
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Authorization")
+	out.Header.Del("Proxy-Connection")
+	resp, err := http.DefaultTransport.RoundTrip(out)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	for name, values := range resp.Header {
+		w.Header()[name] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (p *Proxy) authorized(r *http.Request) bool {
+	want := "Basic " + base64.StdEncoding.EncodeToString([]byte(p.username+":"+p.password))
+	return r.Header.Get("Proxy-Authorization") == want
+}
+
+// tunnel connects the client to the CONNECT target and copies both ways
+func (p *Proxy) tunnel(w http.ResponseWriter, r *http.Request) {
+	upstream, err := net.DialTimeout("tcp", r.Host, 5*time.Second)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buf, err := hj.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	io.WriteString(client, "HTTP/1.1 200 Connection Established\r\n\r\n")
+
+	go func() {
+		// Bytes the client sent right after the CONNECT are buffered
+		io.Copy(upstream, buf)
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+	upstream.Close()
+}